@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"io"
 	"log"
 	"net/http"
@@ -8,11 +12,23 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/devwelkin/hermes-lite/internal/accesslog"
+	"github.com/devwelkin/hermes-lite/internal/acl"
+	"github.com/devwelkin/hermes-lite/internal/auth"
+	"github.com/devwelkin/hermes-lite/internal/clientip"
+	"github.com/devwelkin/hermes-lite/internal/cors"
 	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/jwt"
+	"github.com/devwelkin/hermes-lite/internal/mtls"
+	"github.com/devwelkin/hermes-lite/internal/negotiate"
+	"github.com/devwelkin/hermes-lite/internal/ratelimit"
 	"github.com/devwelkin/hermes-lite/internal/request"
 	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/secure"
 	"github.com/devwelkin/hermes-lite/internal/server"
+	"github.com/devwelkin/hermes-lite/internal/tracing"
 )
 
 const port = 42069
@@ -47,40 +63,57 @@ const (
   </body></html>`
 )
 
+// tracer is set when -otlp-endpoint is given.
+var tracer *tracing.Tracer
+
+// cspReports collects what browsers report against the CSP.
+var cspReports = secure.ReportHandler(nil)
+
 func proxyHandler(w *response.Writer, req *request.Request) {
-	path := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
+	path := strings.TrimPrefix(req.RequestLine.URL.RequestURI(), "/httpbin")
 	targetURL := "https://httpbin.org" + path
 	log.Printf("proxying to %s", targetURL)
 
-	// Make the request to the target server
-	resp, err := http.Get(targetURL)
+	// Make the request to the target server, as a child span of the request
+	ctx := req.Context()
+	if tracer != nil {
+		var span *tracing.Span
+		ctx, span = tracer.Start(ctx, "GET", tracing.KindClient, tracing.SpanContext{})
+		span.SetAttributes(tracing.String("http.request.method", "GET"), tracing.String("url.full", targetURL))
+		defer span.End()
+	}
+	upstream, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		log.Printf("error building httpbin request: %v", err)
+		_ = w.WriteStatusLine(response.StatusBadRequest)
+		return
+	}
+	tracing.Inject(ctx, upstream.Header.Set)
+	mtls.Forward(req, upstream.Header.Set)
+	resp, err := http.DefaultClient.Do(upstream)
 	if err != nil {
 		log.Printf("error making request to httpbin: %v", err)
 		// Send an error response back to the client
-		body := []byte(htmlInternalError)
-		h := response.GetDefaultHeaders(len(body))
-		h.Set("Content-Type", "text/html")
+		w.Header().Set("Content-Type", "text/html")
 		_ = w.WriteStatusLine(response.StatusInternalServerError)
-		_ = w.WriteHeaders(h)
-		_, _ = w.WriteBody(body)
+		_, _ = w.Write([]byte(htmlInternalError))
 		return
 	}
 	defer resp.Body.Close()
 
-	// Prepare headers for the chunked response
 	h := headers.NewHeaders()
-	// Copy headers from httpbin response, but skip Content-Length and Transfer-Encoding
+	// Copy headers from httpbin response, but skip Content-Length and Transfer-Encoding,
+	// the writer frames the body itself
 	for key, values := range resp.Header {
 		lowerKey := strings.ToLower(key)
 		if lowerKey != "content-length" && lowerKey != "transfer-encoding" {
 			h.Set(key, strings.Join(values, ", "))
 		}
 	}
-	h.Set("Transfer-Encoding", "chunked")
-	h.Set("Connection", "close") // good practice for simple servers
 
-	// Write status line and headers
-	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+	// keep upstream's reason phrase, e.g. "404 NOT FOUND" from httpbin
+	_, reason, _ := strings.Cut(resp.Status, " ")
+	if err := w.WriteStatusLineReason(response.StatusCode(resp.StatusCode), reason); err != nil {
 		log.Printf("error writing proxy status line: %v", err)
 		return
 	}
@@ -89,73 +122,259 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 		return
 	}
 
-	// Stream the body chunk by chunk
-	buf := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			log.Printf("read %d bytes from httpbin, writing as chunk", n)
-			if _, writeErr := w.WriteChunkedBody(buf[:n]); writeErr != nil {
-				log.Printf("error writing chunked body: %v", writeErr)
-				break // Stop streaming if we can't write to the client
-			}
-		}
-		if err == io.EOF {
-			break // End of body
-		}
-		if err != nil {
-			log.Printf("error reading from httpbin body: %v", err)
-			break
-		}
-	}
-
-	// Signal end of chunked response
-	if _, err := w.WriteChunkedBodyDone(); err != nil {
-		log.Printf("error writing chunked body done: %v", err)
+	// Stream the body; anything past the buffer goes out chunked
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("error streaming httpbin body: %v", err)
 	}
 }
 
 func myHandler(w *response.Writer, req *request.Request) {
 	// Route to proxy if the path matches
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
+	if strings.HasPrefix(req.RequestLine.URL.Path, "/httpbin/") {
 		proxyHandler(w, req)
 		return
 	}
 
-	var body string
+	switch req.RequestLine.Method {
+	case "GET", "HEAD":
+	case "OPTIONS":
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		_ = w.WriteStatusLine(response.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		_ = w.WriteStatusLine(response.StatusMethodNotAllowed)
+		return
+	}
+
+	var body, message string
 	var statusCode response.StatusCode
 
-	switch req.RequestLine.RequestTarget {
+	switch req.RequestLine.URL.Path {
 	case "/yourproblem":
 		statusCode = response.StatusBadRequest
 		body = htmlBadRequest
+		message = "Your request honestly kinda sucked."
 	case "/myproblem":
 		statusCode = response.StatusInternalServerError
 		body = htmlInternalError
+		message = "Okay, you know what? This one is on me."
 	default:
 		statusCode = response.StatusOK
 		body = htmlOK
+		message = "Your request was an absolute banger."
 	}
 
-	bodyBytes := []byte(body)
-	h := response.GetDefaultHeaders(len(bodyBytes))
-	h.Set("Content-Type", "text/html")
+	// same page for browsers, API clients and curl
+	contentType, ok := negotiate.Negotiate(w, req, "text/html", "application/json", "text/plain")
+	if !ok {
+		return
+	}
+	switch contentType {
+	case "application/json":
+		b, _ := json.Marshal(map[string]any{"status": statusCode, "message": message})
+		body = string(b)
+	case "text/plain":
+		body = message + "\n"
+	}
 
+	w.Header().Set("Content-Type", contentType)
 	if err := w.WriteStatusLine(statusCode); err != nil {
 		log.Printf("error writing status line: %v", err)
 		return
 	}
-	if err := w.WriteHeaders(h); err != nil {
-		log.Printf("error writing headers: %v", err)
-		return
-	}
-	if _, err := w.WriteBody(bodyBytes); err != nil {
+	if _, err := w.Write([]byte(body)); err != nil {
 		log.Printf("error writing body: %v", err)
 	}
 }
 
 func main() {
-	server, err := server.Serve(port, myHandler)
+	certFile := flag.String("tls-cert", "", "TLS certificate file, serves HTTPS (and h2) when set with -tls-key")
+	keyFile := flag.String("tls-key", "", "TLS private key file")
+	clientCA := flag.String("client-ca", "", "verify TLS client certificates against the CAs in this PEM file")
+	requireClientCert := flag.Bool("require-client-cert", false, "refuse TLS clients without a certificate, needs -client-ca")
+	crlFile := flag.String("crl", "", "refuse client certificates revoked in this CRL file, reread when it changes")
+	h2c := flag.Bool("h2c", false, "accept cleartext HTTP/2")
+	proxyProtocol := flag.String("proxy-protocol", "", "expect a PROXY protocol header from these CIDRs, \"*\" for any peer")
+	trustedProxies := flag.String("trusted-proxies", "", "CIDRs whose X-Forwarded-For and Forwarded headers are trusted")
+	cspReportOnly := flag.Bool("csp-report-only", false, "only report Content-Security-Policy violations to /csp-report, don't block")
+	hstsMaxAge := flag.Duration("hsts-max-age", 0, "send Strict-Transport-Security over TLS with this max-age, 0 disables")
+	aclFile := flag.String("acl", "", "IP allow/deny rules by route and host in this file, reread when it changes")
+	corsOrigins := flag.String("cors-origins", "", "origins allowed to call the server from browsers, comma separated; https://*.example.com and * work")
+	htpasswd := flag.String("htpasswd", "", "require Basic auth with the users in this htpasswd file (bcrypt, SHA-crypt or {SHA} hashes)")
+	jwks := flag.String("jwks", "", "require Bearer JWTs signed by the keys in this JWKS file or http(s) URL")
+	jwtIssuer := flag.String("jwt-issuer", "", "iss JWTs must carry")
+	jwtAudience := flag.String("jwt-audience", "", "aud JWTs must include")
+	rateLimit := flag.Int("rate-limit", 0, "requests per minute allowed per client IP, 0 disables")
+	rateBurst := flag.Int("rate-burst", 0, "requests a client may burst above the rate, defaults to the rate")
+	maxConns := flag.Int("max-conns", 0, "open connections allowed at once, 0 for no limit")
+	rejectConns := flag.Bool("reject-conns", false, "answer connections over -max-conns with 503 instead of not accepting them")
+	maxHandlers := flag.Int("max-handlers", 0, "handlers allowed to run at once, 0 for no limit")
+	handlerQueue := flag.Int("handler-queue", 100, "requests that may wait for a handler slot")
+	handlerWait := flag.Duration("handler-wait", time.Second, "longest a request waits for a handler slot")
+	shedTarget := flag.Duration("shed-target", 0, "queue wait that counts as overload for adaptive shedding, 0 disables")
+	adminPort := flag.Int("admin-port", 0, "serve Prometheus metrics at /metrics on this port, off when 0")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "export traces to this OTLP/HTTP URL, e.g. http://localhost:4318/v1/traces")
+	accessLog := flag.String("access-log", "", "access log file, stdout when empty")
+	accessLogFormat := flag.String("access-log-format", "combined", "access log format: common, combined or json")
+	accessLogSample := flag.Float64("access-log-sample", 1, "fraction of requests to log, 5xx are always logged")
+	accessLogMaxSize := flag.Int64("access-log-max-size", 100<<20, "rotate the access log past this many bytes, 0 disables")
+	accessLogRotate := flag.Duration("access-log-rotate", 0, "rotate the access log this often, 0 disables")
+	accessLogBackups := flag.Int("access-log-backups", 7, "rotated access logs to keep, 0 keeps all")
+	flag.Parse()
+
+	var opts []server.Option
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Error loading TLS key pair: %v", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if *clientCA != "" {
+			pool, err := mtls.LoadCertPool(*clientCA)
+			if err != nil {
+				log.Fatalf("Error loading client CAs: %v", err)
+			}
+			clientAuth := mtls.ClientAuth{CAs: pool, Require: *requireClientCert}
+			if *crlFile != "" {
+				if clientAuth.CRL, err = mtls.LoadCRL(*crlFile); err != nil {
+					log.Fatalf("Error loading CRL: %v", err)
+				}
+			}
+			clientAuth.Apply(tlsConfig)
+		}
+		opts = append(opts, server.WithTLS(tlsConfig))
+	}
+	if *h2c {
+		opts = append(opts, server.WithH2C())
+	}
+	if *proxyProtocol == "*" {
+		opts = append(opts, server.WithProxyProtocol())
+	} else if *proxyProtocol != "" {
+		lbs, err := clientip.ParsePrefixes(*proxyProtocol)
+		if err != nil {
+			log.Fatalf("Error parsing -proxy-protocol: %v", err)
+		}
+		opts = append(opts, server.WithProxyProtocol(lbs...))
+	}
+	if *trustedProxies != "" {
+		proxies, err := clientip.ParsePrefixes(*trustedProxies)
+		if err != nil {
+			log.Fatalf("Error parsing -trusted-proxies: %v", err)
+		}
+		opts = append(opts, server.WithTrustedProxies(proxies...))
+	}
+	if *maxConns > 0 {
+		overflow := server.Backoff
+		if *rejectConns {
+			overflow = server.Reject
+		}
+		opts = append(opts, server.WithMaxConns(*maxConns, overflow))
+	}
+	if *maxHandlers > 0 {
+		opts = append(opts, server.WithMaxHandlers(*maxHandlers, *handlerQueue, *handlerWait))
+		if *shedTarget > 0 {
+			opts = append(opts, server.WithAdaptiveShedding(*shedTarget, 100*time.Millisecond))
+		}
+	}
+	if *adminPort != 0 {
+		opts = append(opts, server.WithAdminListener(*adminPort))
+	}
+	var access *acl.ACL
+	if *aclFile != "" {
+		var err error
+		if access, err = acl.Load(*aclFile); err != nil {
+			log.Fatalf("Error loading ACL: %v", err)
+		}
+		opts = append(opts, server.WithConnFilter(access.AllowConn))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go access.Watch(ctx, 5*time.Second)
+	}
+
+	format, err := accesslog.ParseFormat(*accessLogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logCfg := accesslog.Config{Format: format, SampleRate: *accessLogSample}
+	if *accessLog != "" {
+		f, err := accesslog.OpenRotatingFile(*accessLog, *accessLogMaxSize, *accessLogRotate, *accessLogBackups)
+		if err != nil {
+			log.Fatalf("Error opening access log: %v", err)
+		}
+		defer f.Close()
+		logCfg.Out = f
+	}
+	mws := []server.Middleware{accesslog.New(logCfg).Middleware()}
+	if *otlpEndpoint != "" {
+		tracer = tracing.NewTracer(tracing.Config{
+			Exporter: &tracing.OTLPExporter{Endpoint: *otlpEndpoint, ServiceName: "hermes-lite"},
+		})
+		defer tracer.Shutdown(context.Background())
+		mws = append(mws, tracer.Middleware())
+	}
+	policy := secure.DefaultPolicy()
+	policy.HSTS.MaxAge = *hstsMaxAge
+	policy.CSP.ReportOnly = *cspReportOnly
+	policy.CSP.ReportURI = "/csp-report"
+	mws = append(mws, secure.New(policy).Middleware())
+	if *corsOrigins != "" {
+		var origins []string
+		for o := range strings.SplitSeq(*corsOrigins, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				origins = append(origins, o)
+			}
+		}
+		c, err := cors.New(cors.Config{AllowedOrigins: origins, MaxAge: 10 * time.Minute})
+		if err != nil {
+			log.Fatalf("Error configuring CORS: %v", err)
+		}
+		mws = append(mws, c.Middleware())
+	}
+	// guards keep out the clients that aren't allowed in, CSP reports
+	// included. those only skip auth, browsers send them without
+	// credentials
+	var guards []server.Middleware
+	if access != nil {
+		guards = append(guards, access.Middleware())
+	}
+	if *rateLimit > 0 {
+		// ahead of auth, so failed logins count against the client too
+		limiter := ratelimit.New(ratelimit.Config{Limit: ratelimit.PerMinute(*rateLimit).WithBurst(*rateBurst)})
+		guards = append(guards, limiter.Middleware())
+	}
+	var schemes []auth.Scheme
+	if *jwks != "" {
+		jcfg := jwt.JWKSConfig{File: *jwks}
+		if strings.HasPrefix(*jwks, "http://") || strings.HasPrefix(*jwks, "https://") {
+			jcfg = jwt.JWKSConfig{URL: *jwks}
+		}
+		verifier := jwt.New(jwt.Config{
+			Keys:         jwt.NewJWKS(jcfg),
+			Expectations: jwt.Expectations{Issuer: *jwtIssuer, Audience: *jwtAudience, Leeway: time.Minute},
+		})
+		schemes = append(schemes, &auth.Bearer{Realm: "hermes-lite", Verifier: verifier})
+	}
+	if *htpasswd != "" {
+		users, err := auth.LoadHtpasswd(*htpasswd)
+		if err != nil {
+			log.Fatalf("Error loading htpasswd: %v", err)
+		}
+		schemes = append(schemes, &auth.Basic{Realm: "hermes-lite", Users: users})
+	}
+	var site server.Handler = myHandler
+	if len(schemes) > 0 {
+		site = server.Chain(site, auth.New(auth.Config{Schemes: schemes}).Middleware())
+	}
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.URL.Path == "/csp-report" {
+			cspReports(w, req)
+			return
+		}
+		site(w, req)
+	}, append(mws, guards...)...)
+
+	server, err := server.Serve(port, handler, opts...)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -2,7 +2,10 @@ module github.com/devwelkin/hermes-lite
 
 go 1.25.3
 
-require github.com/stretchr/testify v1.11.1
+require (
+	github.com/stretchr/testify v1.11.1
+	golang.org/x/crypto v0.54.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
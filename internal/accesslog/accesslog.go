@@ -0,0 +1,238 @@
+// Package accesslog records one line per request in Common Log Format,
+// Combined Log Format or JSON.
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// Format selects the line layout.
+type Format int
+
+const (
+	// Common is the NCSA Common Log Format.
+	Common Format = iota
+	// Combined is Common plus referer and user agent.
+	Combined
+	// JSON writes one slog JSON object per request.
+	JSON
+)
+
+// ParseFormat maps "common", "combined" or "json" to a Format.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "common", "clf":
+		return Common, nil
+	case "combined":
+		return Combined, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, fmt.Errorf("unknown access log format %q", s)
+}
+
+// clfTime is the timestamp layout of Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// Record is what gets logged about one request.
+type Record struct {
+	Time       time.Time
+	RemoteAddr string
+	ClientIP   string // resolved through trusted proxies, "" if unknown
+	Method     string
+	Target     string
+	Proto      string
+	Status     response.StatusCode
+	Bytes      int64
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+}
+
+// Config configures the access log middleware.
+type Config struct {
+	// Out receives the log lines, os.Stdout if nil. use a RotatingFile for
+	// rotation.
+	Out    io.Writer
+	Format Format
+	// SampleRate is the fraction of requests logged, in (0, 1]. 0 logs
+	// everything. server errors (5xx) are always logged.
+	SampleRate float64
+}
+
+// Logger writes access log records.
+type Logger struct {
+	cfg  Config
+	mu   sync.Mutex // keeps text lines whole
+	json *slog.Logger
+	now  func() time.Time
+}
+
+// New creates a Logger from cfg.
+func New(cfg Config) *Logger {
+	if cfg.Out == nil {
+		cfg.Out = os.Stdout
+	}
+	l := &Logger{cfg: cfg, now: time.Now}
+	if cfg.Format == JSON {
+		l.json = slog.New(slog.NewJSONHandler(cfg.Out, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// the request time is logged as its own field
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}))
+	}
+	return l
+}
+
+// Middleware logs every request that goes through it.
+func (l *Logger) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := l.now()
+			next(w, req)
+
+			status := w.Status()
+			if status == 0 {
+				// the server closes an untouched response as 200
+				status = response.StatusOK
+			}
+			l.Log(Record{
+				Time:       start,
+				RemoteAddr: req.RemoteAddr,
+				ClientIP:   clientIP(req),
+				Method:     req.RequestLine.Method,
+				Target:     req.RequestLine.RequestTarget,
+				Proto:      "HTTP/" + req.RequestLine.HTTPVersion,
+				Status:     status,
+				Bytes:      w.BytesWritten(),
+				Duration:   l.now().Sub(start),
+				Referer:    req.Headers["referer"],
+				UserAgent:  req.Headers["user-agent"],
+			})
+		}
+	}
+}
+
+// Log writes rec, subject to sampling.
+func (l *Logger) Log(rec Record) {
+	if !l.sampled(rec) {
+		return
+	}
+
+	if l.cfg.Format == JSON {
+		l.json.LogAttrs(context.Background(), slog.LevelInfo, "access",
+			slog.Time("time", rec.Time),
+			slog.String("remote_addr", rec.RemoteAddr),
+			slog.String("client_ip", rec.ClientIP),
+			slog.String("method", rec.Method),
+			slog.String("target", rec.Target),
+			slog.String("proto", rec.Proto),
+			slog.Int("status", int(rec.Status)),
+			slog.Int64("bytes", rec.Bytes),
+			slog.Float64("duration_ms", float64(rec.Duration.Microseconds())/1000),
+			slog.String("referer", rec.Referer),
+			slog.String("user_agent", rec.UserAgent),
+		)
+		return
+	}
+
+	line := FormatLine(l.cfg.Format, rec)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = io.WriteString(l.cfg.Out, line)
+}
+
+func (l *Logger) sampled(rec Record) bool {
+	if l.cfg.SampleRate <= 0 || l.cfg.SampleRate >= 1 || rec.Status.IsServerError() {
+		return true
+	}
+	return rand.Float64() < l.cfg.SampleRate
+}
+
+// FormatLine renders rec as a Common or Combined line, newline included.
+func FormatLine(format Format, rec Record) string {
+	var b strings.Builder
+	host := rec.ClientIP
+	if host == "" {
+		host = hostOnly(rec.RemoteAddr)
+	}
+	b.WriteString(orDash(host))
+	b.WriteString(" - - [")
+	b.WriteString(rec.Time.Format(clfTime))
+	b.WriteString("] \"")
+	b.WriteString(escape(rec.Method + " " + rec.Target + " " + rec.Proto))
+	b.WriteString("\" ")
+	b.WriteString(strconv.Itoa(int(rec.Status)))
+	b.WriteByte(' ')
+	if rec.Bytes > 0 {
+		b.WriteString(strconv.FormatInt(rec.Bytes, 10))
+	} else {
+		b.WriteByte('-')
+	}
+	if format == Combined {
+		b.WriteString(" \"")
+		b.WriteString(escape(orDash(rec.Referer)))
+		b.WriteString("\" \"")
+		b.WriteString(escape(orDash(rec.UserAgent)))
+		b.WriteByte('"')
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func clientIP(req *request.Request) string {
+	if !req.ClientIP.IsValid() {
+		return ""
+	}
+	return req.ClientIP.String()
+}
+
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escape keeps client controlled values from breaking the line format.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+
+func testRequest() *request.Request {
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/apache_pb.gif", HTTPVersion: "1.0"},
+		Headers:     headers.NewHeaders(),
+		RemoteAddr:  "127.0.0.1:54321",
+	}
+	req.Headers.Set("referer", "http://www.example.com/start.html")
+	req.Headers.Set("user-agent", `Mozilla/4.08 "quoted"`)
+	return req
+}
+
+// serve runs a request through l with a handler answering status and body.
+func serve(l *Logger, status response.StatusCode, body string) {
+	l.now = func() time.Time { return start }
+	h := l.Middleware()(func(w *response.Writer, req *request.Request) {
+		if status != 0 {
+			_ = w.WriteStatusLine(status)
+		}
+		_, _ = w.Write([]byte(body))
+	})
+	w := response.NewWriter(&bytes.Buffer{})
+	h(w, testRequest())
+	_ = w.Close()
+}
+
+func TestCommonAndCombined(t *testing.T) {
+	var out bytes.Buffer
+	serve(New(Config{Out: &out, Format: Common}), 0, "0123456789")
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 10`+"\n", out.String())
+
+	out.Reset()
+	serve(New(Config{Out: &out, Format: Combined}), response.StatusNoContent, "")
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 204 - `+
+		`"http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""`+"\n", out.String())
+}
+
+func TestJSON(t *testing.T) {
+	var out bytes.Buffer
+	serve(New(Config{Out: &out, Format: JSON}), response.StatusNotFound, "nope")
+
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &rec))
+	assert.Equal(t, "access", rec["msg"])
+	assert.Equal(t, "127.0.0.1:54321", rec["remote_addr"])
+	assert.Equal(t, "GET", rec["method"])
+	assert.Equal(t, "/apache_pb.gif", rec["target"])
+	assert.Equal(t, "HTTP/1.0", rec["proto"])
+	assert.Equal(t, float64(404), rec["status"])
+	assert.Equal(t, float64(4), rec["bytes"])
+	assert.Equal(t, `Mozilla/4.08 "quoted"`, rec["user_agent"])
+	assert.NotContains(t, rec, "level")
+}
+
+func TestSampling(t *testing.T) {
+	var out bytes.Buffer
+	l := New(Config{Out: &out, Format: Common, SampleRate: 1e-9})
+	for range 50 {
+		l.Log(Record{Status: response.StatusOK})
+	}
+	assert.Empty(t, out.String())
+
+	l.Log(Record{Status: response.StatusBadGateway})
+	assert.Contains(t, out.String(), " 502 ")
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	rf, err := OpenRotatingFile(path, 10, time.Hour, 2)
+	require.NoError(t, err)
+	rf.now = func() time.Time { return now }
+	defer rf.Close()
+	// files that only look like backups
+	for _, name := range []string{"access.log.bak", "access.log.1.gz", "access.log.20230101T000000Z.gz"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+
+	// size: a write that doesn't fit starts a new file, lines stay whole
+	_, err = rf.Write([]byte("12345678\n"))
+	require.NoError(t, err)
+	_, err = rf.Write([]byte("abc\n"))
+	require.NoError(t, err)
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "abc\n", string(current))
+
+	// time: the interval rotates even a small file
+	now = now.Add(time.Hour)
+	rf.opened = now.Add(-time.Hour)
+	_, err = rf.Write([]byte("x\n"))
+	require.NoError(t, err)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, rf.Rotate())
+
+	backups, err := rf.backups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 2, "older backups are pruned")
+	last, err := os.ReadFile(backups[1].name)
+	require.NoError(t, err)
+	assert.Equal(t, "x\n", string(last))
+	for _, name := range []string{"access.log.bak", "access.log.1.gz", "access.log.20230101T000000Z.gz"} {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+
+	// Test: Same-second backups sort by their counter, .10 after .9
+	names := []string{"access.log.20240101T030000Z", "access.log.20240101T030000Z.9", "access.log.20240101T030000Z.10"}
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+	backups, err = rf.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 5)
+	for i, name := range names {
+		assert.Equal(t, filepath.Join(dir, name), backups[2+i].name)
+	}
+}
@@ -0,0 +1,200 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an io.Writer that appends to a file and rotates it once it
+// grows past MaxSize bytes or every Interval, whichever comes first. the old
+// file is renamed to path.<timestamp> and only the newest MaxBackups are kept.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64         // 0 disables size based rotation
+	Interval   time.Duration // 0 disables time based rotation
+	MaxBackups int           // 0 keeps every backup
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+}
+
+// OpenRotatingFile opens (or creates) path for appending.
+func OpenRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		Interval:   interval,
+		MaxBackups: maxBackups,
+		now:        time.Now,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	rf.opened = rf.now()
+	return nil
+}
+
+// Write appends p, rotating first if p would push the file past MaxSize or
+// the interval is up. a single line is never split across files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.due(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) due(next int64) bool {
+	if rf.MaxSize > 0 && rf.size > 0 && rf.size+next > rf.MaxSize {
+		return true
+	}
+	return rf.Interval > 0 && rf.now().Sub(rf.opened) >= rf.Interval
+}
+
+// Rotate closes the current file, moves it aside and opens a fresh one.
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rotate()
+}
+
+func (rf *RotatingFile) rotate() error {
+	if rf.f != nil {
+		if err := rf.f.Close(); err != nil {
+			return err
+		}
+		rf.f = nil
+	}
+	backup := rf.backupName()
+	if err := os.Rename(rf.Path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	return rf.prune()
+}
+
+// backupStamp is the timestamp layout of backup names.
+const backupStamp = "20060102T150405Z"
+
+// backupName picks path.<timestamp>, adding a counter if two rotations land
+// in the same second.
+func (rf *RotatingFile) backupName() string {
+	base := rf.Path + "." + rf.now().UTC().Format(backupStamp)
+	name := base
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+}
+
+// backup is a file backupName made.
+type backup struct {
+	name  string
+	stamp string
+	n     int // the same-second counter, 0 for none
+}
+
+// backups lists the backups of the file, oldest first. other files next to
+// it, access.log.bak or the .gz files of an external rotation, aren't ours
+// and are left out.
+func (rf *RotatingFile) backups() ([]backup, error) {
+	dir, prefix := filepath.Dir(rf.Path), filepath.Base(rf.Path)+"."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []backup
+	for _, e := range entries {
+		rest, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		stamp, counter, hasCounter := strings.Cut(rest, ".")
+		if _, err := time.Parse(backupStamp, stamp); err != nil {
+			continue
+		}
+		b := backup{name: filepath.Join(dir, e.Name()), stamp: stamp}
+		if hasCounter {
+			if b.n, err = strconv.Atoi(counter); err != nil || b.n < 1 {
+				continue
+			}
+		}
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].stamp != out[j].stamp {
+			return out[i].stamp < out[j].stamp
+		}
+		return out[i].n < out[j].n
+	})
+	return out, nil
+}
+
+// prune removes the oldest backups beyond MaxBackups.
+func (rf *RotatingFile) prune() error {
+	if rf.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := rf.backups()
+	if err != nil {
+		return err
+	}
+	if len(backups) <= rf.MaxBackups {
+		return nil
+	}
+	for _, b := range backups[:len(backups)-rf.MaxBackups] {
+		if err := os.Remove(b.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
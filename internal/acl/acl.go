@@ -0,0 +1,321 @@
+// Package acl allows and denies clients by IP address: a global list that
+// applies everywhere, and lists per route (path prefix) and per host. the
+// lists come from a file that is picked up again when it changes, and the
+// global one can drop connections right at accept, see AllowConn.
+//
+// the file has one rule per line, in sections:
+//
+//	# anything before the first section is global
+//	deny 198.51.100.0/24
+//
+//	[route /admin]
+//	allow 192.0.2.0/24, 2001:db8:1::/48
+//
+//	[host internal.example.com]
+//	allow 10.0.0.0/8
+//	deny 10.9.0.0/16
+//
+// within a list the longest matching prefix decides. an address no rule
+// covers is denied by lists that have allow rules and allowed by the
+// others, "default allow" or "default deny" in a section says otherwise.
+package acl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/clientip"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// List is one section of rules.
+type List struct {
+	trie Trie
+	// Default applies to addresses no rule covers.
+	Default Action
+}
+
+// Add adds a rule.
+func (l *List) Add(p netip.Prefix, action Action) {
+	l.trie.Insert(p, action)
+}
+
+// Allows reports whether the list lets addr through.
+func (l *List) Allows(addr netip.Addr) bool {
+	if a, _ := l.trie.Lookup(addr); a != NoMatch {
+		return a == Allow
+	}
+	return l.Default != Deny
+}
+
+// Rules is a parsed ACL file.
+type Rules struct {
+	Global *List
+	Hosts  map[string]*List
+	// Routes are path prefixes, checked longest first.
+	Routes map[string]*List
+	routes []string // keys of Routes, longest first
+}
+
+// route returns the list of the longest route prefix of path, on a
+// segment boundary: /admin covers /admin and /admin/users, not /administer.
+func (r *Rules) route(path string) *List {
+	for _, prefix := range r.routes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return r.Routes[prefix]
+		}
+	}
+	return nil
+}
+
+// Parse reads rules in the file format of the package doc.
+func Parse(rd io.Reader) (*Rules, error) {
+	r := &Rules{Global: &List{}, Hosts: map[string]*List{}, Routes: map[string]*List{}}
+	lists := []*List{r.Global}
+	explicit := map[*List]bool{}
+	hasAllow := map[*List]bool{}
+	cur := r.Global
+
+	sc := bufio.NewScanner(rd)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			kind, arg, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"), " ")
+			arg = strings.TrimSpace(arg)
+			if !strings.HasSuffix(line, "]") {
+				ok = false
+			}
+			var m map[string]*List
+			switch {
+			case kind == "global" && !ok:
+				cur = r.Global
+				continue
+			case kind == "route" && ok && strings.HasPrefix(arg, "/"):
+				m = r.Routes
+			case kind == "host" && ok && arg != "":
+				m, arg = r.Hosts, strings.ToLower(arg)
+			default:
+				return nil, fmt.Errorf("line %d: bad section %q", n, line)
+			}
+			if m[arg] == nil {
+				m[arg] = &List{}
+				lists = append(lists, m[arg])
+			}
+			cur = m[arg]
+			continue
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		var action Action
+		switch verb {
+		case "allow":
+			action = Allow
+			hasAllow[cur] = true
+		case "deny":
+			action = Deny
+		case "default":
+			switch arg {
+			case "allow":
+				cur.Default = Allow
+			case "deny":
+				cur.Default = Deny
+			default:
+				return nil, fmt.Errorf("line %d: default must be allow or deny", n)
+			}
+			explicit[cur] = true
+			continue
+		default:
+			return nil, fmt.Errorf("line %d: expected allow, deny or default, got %q", n, verb)
+		}
+		prefixes, err := clientip.ParsePrefixes(arg)
+		if err != nil || len(prefixes) == 0 {
+			return nil, fmt.Errorf("line %d: bad address list %q", n, arg)
+		}
+		for _, p := range prefixes {
+			cur.Add(p, action)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range lists {
+		if !explicit[l] && hasAllow[l] {
+			l.Default = Deny
+		}
+	}
+	for prefix := range r.Routes {
+		r.routes = append(r.routes, prefix)
+	}
+	sort.Slice(r.routes, func(i, j int) bool { return len(r.routes[i]) > len(r.routes[j]) })
+	return r, nil
+}
+
+// ACL holds the current rules, swapped atomically on reload so requests
+// never see half a file.
+type ACL struct {
+	rules atomic.Pointer[Rules]
+
+	path    string
+	mu      sync.Mutex // serializes reloads
+	modTime time.Time
+}
+
+// New creates an ACL with fixed rules.
+func New(rules *Rules) *ACL {
+	a := &ACL{}
+	a.rules.Store(rules)
+	return a
+}
+
+// Load reads an ACL file.
+func Load(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload rereads the file. the old rules stay if it fails.
+func (a *ACL) Reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reload()
+}
+
+func (a *ACL) reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rules, err := Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.rules.Store(rules)
+	a.modTime = fi.ModTime()
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, checking
+// every interval until ctx is done. a file that doesn't parse is logged and
+// the old rules are kept.
+func (a *ACL) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		fi, err := os.Stat(a.path)
+		if err != nil {
+			continue
+		}
+		a.mu.Lock()
+		if !fi.ModTime().Equal(a.modTime) {
+			if err := a.reload(); err != nil {
+				log.Printf("acl: keeping the old rules: %v", err)
+				a.modTime = fi.ModTime()
+			} else {
+				log.Printf("acl: reloaded %s", a.path)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Rules returns the current rules.
+func (a *ACL) Rules() *Rules {
+	return a.rules.Load()
+}
+
+// AllowConn checks addr against the global list, for
+// server.WithConnFilter. connections it refuses never get to send a byte.
+// the server lets trusted proxies through, Middleware checks the clients
+// behind them.
+func (a *ACL) AllowConn(addr netip.Addr) bool {
+	return a.Rules().Global.Allows(addr)
+}
+
+// Allowed checks the request's client address against the global list and
+// the lists of its host and route.
+func (a *ACL) Allowed(req *request.Request) bool {
+	addr := clientAddr(req)
+	r := a.Rules()
+	if !r.Global.Allows(addr) {
+		return false
+	}
+	if l := r.Hosts[host(req)]; l != nil && !l.Allows(addr) {
+		return false
+	}
+	if l := r.route(req.RequestLine.URL.Path); l != nil && !l.Allows(addr) {
+		return false
+	}
+	return true
+}
+
+// Middleware answers 403 Forbidden to clients the lists deny.
+func (a *ACL) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if !a.Allowed(req) {
+				w.Header().Set("Content-Type", "text/plain")
+				_ = w.WriteStatusLine(response.StatusForbidden)
+				_, _ = w.Write([]byte(response.StatusText(response.StatusForbidden) + "\n"))
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+// clientAddr is the effective client address, the peer's if the server
+// didn't work one out.
+func clientAddr(req *request.Request) netip.Addr {
+	if req.ClientIP.IsValid() {
+		return req.ClientIP
+	}
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr()
+}
+
+// host is the request's host, lowercase and without a port.
+func host(req *request.Request) string {
+	h := req.RequestLine.URL.Host
+	if h == "" {
+		h = req.Headers["host"]
+	}
+	if hostname, _, err := net.SplitHostPort(h); err == nil {
+		h = hostname
+	}
+	return strings.ToLower(strings.Trim(h, "[]"))
+}
@@ -0,0 +1,178 @@
+package acl
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrie(t *testing.T) {
+	var tr Trie
+	tr.Insert(netip.MustParsePrefix("10.0.0.0/8"), Allow)
+	tr.Insert(netip.MustParsePrefix("10.9.0.0/16"), Deny)
+	tr.Insert(netip.MustParsePrefix("10.9.8.7/32"), Allow)
+	tr.Insert(netip.MustParsePrefix("2001:db8::/32"), Deny)
+	tr.Insert(netip.MustParsePrefix("::ffff:192.0.2.0/120"), Deny)
+
+	for _, tc := range []struct {
+		addr   string
+		action Action
+		bits   int
+	}{
+		{"10.1.2.3", Allow, 8},
+		{"10.9.1.1", Deny, 16},
+		{"10.9.8.7", Allow, 32},
+		{"::ffff:10.9.8.7", Allow, 32},
+		{"11.0.0.1", NoMatch, 0},
+		{"192.0.2.55", Deny, 24},
+		{"2001:db8:1::1", Deny, 32},
+		{"2001:db9::1", NoMatch, 0},
+	} {
+		action, bits := tr.Lookup(netip.MustParseAddr(tc.addr))
+		assert.Equal(t, tc.action, action, tc.addr)
+		assert.Equal(t, tc.bits, bits, tc.addr)
+	}
+
+	// Test: The empty trie and the zero address match nothing, /0 everything
+	var empty Trie
+	action, _ := empty.Lookup(netip.MustParseAddr("10.0.0.1"))
+	assert.Equal(t, NoMatch, action)
+	action, _ = tr.Lookup(netip.Addr{})
+	assert.Equal(t, NoMatch, action)
+	tr.Insert(netip.MustParsePrefix("0.0.0.0/0"), Deny)
+	action, bits := tr.Lookup(netip.MustParseAddr("11.0.0.1"))
+	assert.Equal(t, Deny, action)
+	assert.Equal(t, 0, bits)
+}
+
+const rules = `
+# blocked everywhere
+deny 198.51.100.0/24
+
+[route /admin]   # office and VPN
+allow 192.0.2.0/24, 2001:db8:1::/48
+allow 203.0.113.7
+
+[route /admin/public]
+default allow
+
+[host Internal.example.com]
+allow 10.0.0.0/8
+deny 10.9.0.0/16
+`
+
+func TestParse(t *testing.T) {
+	r, err := Parse(strings.NewReader(rules))
+	require.NoError(t, err)
+
+	assert.True(t, r.Global.Allows(netip.MustParseAddr("192.0.2.1")))
+	assert.False(t, r.Global.Allows(netip.MustParseAddr("198.51.100.1")))
+
+	admin := r.route("/admin/users")
+	require.NotNil(t, admin)
+	assert.Equal(t, Deny, admin.Default, "lists with allow rules are allowlists")
+	assert.True(t, admin.Allows(netip.MustParseAddr("2001:db8:1::5")))
+	assert.True(t, admin.Allows(netip.MustParseAddr("203.0.113.7")))
+	assert.False(t, admin.Allows(netip.MustParseAddr("203.0.113.8")))
+	assert.Same(t, admin, r.route("/admin"))
+	assert.Nil(t, r.route("/administer"))
+	assert.Same(t, r.Routes["/admin/public"], r.route("/admin/public/x"))
+	assert.Contains(t, r.Hosts, "internal.example.com")
+
+	// Test: Mistakes are reported with their line
+	for _, bad := range []string{
+		"allow",
+		"allow 10.0.0.0/33",
+		"permit 10.0.0.0/8",
+		"default maybe",
+		"[route admin]",
+		"[host]",
+		"[route /admin",
+		"[server x]",
+	} {
+		_, err := Parse(strings.NewReader("\n" + bad))
+		assert.ErrorContains(t, err, "line 2", bad)
+	}
+}
+
+// serve runs a request from addr for host and path through the middleware
+// and returns the status.
+func serve(t *testing.T, a *ACL, addr, host, path string) int {
+	t.Helper()
+	u, err := request.ParseTarget("GET", path)
+	require.NoError(t, err)
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: path, URL: u},
+		Headers:     headers.Headers{"host": host},
+		RemoteAddr:  addr,
+	}
+	resp := servertest.Do(t, a.Middleware()(func(w *response.Writer, req *request.Request) {}), req)
+	return resp.StatusCode
+}
+
+func TestMiddleware(t *testing.T) {
+	r, err := Parse(strings.NewReader(rules))
+	require.NoError(t, err)
+	a := New(r)
+
+	for _, tc := range []struct {
+		addr, host, path string
+		code             int
+	}{
+		{"203.0.113.9:1234", "example.com", "/", 200},
+		{"198.51.100.4:1234", "example.com", "/", 403},
+		{"192.0.2.10:1234", "example.com", "/admin/", 200},
+		{"203.0.113.9:1234", "example.com", "/admin/", 403},
+		{"203.0.113.9:1234", "example.com", "/admin/public/logo.png", 200},
+		{"[2001:db8:1::9]:443", "example.com", "/admin", 200},
+		{"10.1.1.1:1234", "internal.example.com:8080", "/", 200},
+		{"10.9.1.1:1234", "INTERNAL.example.com", "/", 403},
+		{"192.0.2.10:1234", "internal.example.com", "/admin", 403},
+	} {
+		assert.Equal(t, tc.code, serve(t, a, tc.addr, tc.host, tc.path), tc)
+	}
+
+	// Test: Globally blocked networks are dropped at accept
+	assert.False(t, a.AllowConn(netip.MustParseAddr("198.51.100.4")))
+	assert.True(t, a.AllowConn(netip.MustParseAddr("203.0.113.9")))
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	require.NoError(t, os.WriteFile(path, []byte("deny 192.0.2.0/24\n"), 0o600))
+	a, err := Load(path)
+	require.NoError(t, err)
+	addr := netip.MustParseAddr("192.0.2.1")
+	assert.False(t, a.AllowConn(addr))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Watch(ctx, 5*time.Millisecond)
+
+	// Test: A changed file is picked up
+	require.NoError(t, os.WriteFile(path, []byte("deny 198.51.100.0/24\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	assert.Eventually(t, func() bool { return a.AllowConn(addr) }, time.Second, 5*time.Millisecond)
+
+	// Test: A broken file keeps the old rules
+	require.NoError(t, os.WriteFile(path, []byte("deny everyone\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	assert.Error(t, a.Reload())
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, a.AllowConn(addr))
+	assert.False(t, a.AllowConn(netip.MustParseAddr("198.51.100.1")))
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
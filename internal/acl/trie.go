@@ -0,0 +1,91 @@
+package acl
+
+import "net/netip"
+
+// Action is what a rule does with a matching address.
+type Action int
+
+const (
+	// NoMatch means no rule covered the address.
+	NoMatch Action = iota
+	Allow
+	Deny
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	}
+	return "no match"
+}
+
+// Trie maps prefixes to actions and finds the longest prefix holding an
+// address, one bit per level, so a lookup costs at most 32 steps for IPv4
+// and 128 for IPv6 however many prefixes there are. IPv4-mapped IPv6
+// addresses are looked up as IPv4. the zero value is empty and ready.
+type Trie struct {
+	v4, v6 *node
+}
+
+type node struct {
+	child  [2]*node
+	action Action // NoMatch on nodes that only lead somewhere
+}
+
+// Insert sets the action for p, replacing what was set for exactly p.
+func (t *Trie) Insert(p netip.Prefix, action Action) {
+	p = p.Masked()
+	addr := p.Addr()
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		p = netip.PrefixFrom(addr, max(p.Bits()-96, 0))
+	}
+	root := &t.v6
+	if addr.Is4() {
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &node{}
+	}
+	n := *root
+	b := addr.AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &node{}
+		}
+		n = n.child[bit]
+	}
+	n.action = action
+}
+
+// Lookup returns the action of the longest prefix containing addr, and the
+// prefix length, NoMatch if there is none.
+func (t *Trie) Lookup(addr netip.Addr) (Action, int) {
+	addr = addr.Unmap()
+	n := t.v6
+	if addr.Is4() {
+		n = t.v4
+	}
+	best, bits := NoMatch, 0
+	if n == nil || !addr.IsValid() {
+		return best, bits
+	}
+	b := addr.AsSlice()
+	for i := 0; ; i++ {
+		if n.action != NoMatch {
+			best, bits = n.action, i
+		}
+		if i == len(b)*8 {
+			break
+		}
+		n = n.child[b[i/8]>>(7-i%8)&1]
+		if n == nil {
+			break
+		}
+	}
+	return best, bits
+}
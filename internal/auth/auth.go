@@ -0,0 +1,146 @@
+// Package auth authenticates requests from the Authorization header: Basic
+// against an htpasswd file, Bearer tokens through a pluggable verifier, and
+// Digest (RFC 7616). a request that fails gets 401 Unauthorized with a
+// WWW-Authenticate challenge for every scheme the server accepts.
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+var (
+	// ErrNoCredentials means the request had no Authorization header for
+	// the scheme.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrMalformed means the credentials couldn't be parsed.
+	ErrMalformed = errors.New("malformed credentials")
+	// ErrInvalidCredentials means the credentials were parsed but are wrong.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is who a request was authenticated as.
+type Principal struct {
+	Name string
+	// Scheme is the scheme that authenticated it, e.g. "Basic".
+	Scheme string
+	// Claims are extra details from the scheme, a token's claims for
+	// Bearer. nil for Basic and Digest.
+	Claims map[string]any
+}
+
+// Scheme is one HTTP authentication scheme.
+type Scheme interface {
+	// Name is the scheme's name as it appears in Authorization, e.g. "Basic".
+	Name() string
+	// Authenticate checks the credentials that followed the scheme name.
+	Authenticate(req *request.Request, credentials string) (*Principal, error)
+	// Challenge returns the WWW-Authenticate value inviting the client to
+	// try again. err is why authentication failed, ErrNoCredentials if the
+	// client didn't try this scheme.
+	Challenge(req *request.Request, err error) string
+}
+
+// Config configures the middleware.
+type Config struct {
+	// Schemes are tried by the name in Authorization. their challenges go
+	// out in this order, so put the strongest first.
+	Schemes []Scheme
+	// Optional lets requests without an Authorization header through
+	// anonymously, Get returns nil for them. wrong credentials are still
+	// turned away.
+	Optional bool
+}
+
+// Authenticator is the middleware state.
+type Authenticator struct {
+	cfg Config
+}
+
+// New creates an Authenticator.
+func New(cfg Config) *Authenticator {
+	return &Authenticator{cfg: cfg}
+}
+
+type ctxKey struct{}
+
+// Get returns the principal the request was authenticated as, nil outside
+// the middleware or for anonymous requests.
+func Get(req *request.Request) *Principal {
+	p, _ := req.Context().Value(ctxKey{}).(*Principal)
+	return p
+}
+
+// SetPrincipal attaches p to the request for Get, for middleware that
+// authenticates requests its own way.
+func SetPrincipal(req *request.Request, p *Principal) {
+	req.SetContext(context.WithValue(req.Context(), ctxKey{}, p))
+}
+
+// Authenticate checks the request's Authorization header against the
+// configured schemes. the scheme is returned with its error so the caller
+// can challenge accordingly, nil if no scheme matched.
+func (a *Authenticator) Authenticate(req *request.Request) (*Principal, Scheme, error) {
+	name, credentials, _ := strings.Cut(strings.TrimSpace(req.Headers["authorization"]), " ")
+	if name == "" {
+		return nil, nil, ErrNoCredentials
+	}
+	for _, s := range a.cfg.Schemes {
+		if strings.EqualFold(s.Name(), name) {
+			p, err := s.Authenticate(req, strings.TrimSpace(credentials))
+			return p, s, err
+		}
+	}
+	return nil, nil, ErrNoCredentials
+}
+
+// Middleware authenticates every request and answers 401 with the
+// challenges of all schemes when it fails.
+func (a *Authenticator) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			p, failed, err := a.Authenticate(req)
+			switch {
+			case err == nil:
+				SetPrincipal(req, p)
+			case a.cfg.Optional && failed == nil && req.Headers["authorization"] == "":
+			default:
+				a.Unauthorized(w, req, failed, err)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+// Unauthorized sends 401 with a WWW-Authenticate challenge per scheme.
+// failed is the scheme that rejected err, the others are told the client
+// didn't try them. a token with too little scope gets 403 instead, asking
+// again won't help.
+func (a *Authenticator) Unauthorized(w *response.Writer, req *request.Request, failed Scheme, err error) {
+	status := response.StatusUnauthorized
+	if errors.Is(err, ErrInsufficientScope) {
+		status = response.StatusForbidden
+	}
+	h := w.Header()
+	for _, s := range a.cfg.Schemes {
+		if s == failed {
+			h.Add("WWW-Authenticate", s.Challenge(req, err))
+		} else {
+			h.Add("WWW-Authenticate", s.Challenge(req, ErrNoCredentials))
+		}
+	}
+	h.Set("Content-Type", "text/plain")
+	_ = w.WriteStatusLine(status)
+	_, _ = w.Write([]byte(response.StatusText(status) + "\n"))
+}
+
+// quote makes s a quoted-string for a challenge parameter.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
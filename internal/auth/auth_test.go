@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+// do runs a GET for target through the middleware and returns the response
+// and the principal the handler saw, nil if it wasn't reached.
+func do(t *testing.T, a *Authenticator, target, authorization string) (*http.Response, *Principal) {
+	t.Helper()
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: target},
+		Headers:     headers.Headers{},
+	}
+	if authorization != "" {
+		req.Headers["authorization"] = authorization
+	}
+	var seen *Principal
+	resp := servertest.Do(t, a.Middleware()(func(w *response.Writer, req *request.Request) {
+		seen = Get(req)
+		if seen == nil {
+			seen = &Principal{}
+		}
+		_, _ = w.Write([]byte("ok"))
+	}), req)
+	return resp, seen
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestBasic(t *testing.T) {
+	users, err := ParseHtpasswd(strings.NewReader("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	require.NoError(t, err)
+	a := New(Config{Schemes: []Scheme{&Basic{Realm: "hermes", Users: users}}})
+
+	resp, p := do(t, a, "/", basicAuth("bob", "password"))
+	assert.Equal(t, 200, resp.StatusCode)
+	require.NotNil(t, p)
+	assert.Equal(t, "bob", p.Name)
+	assert.Equal(t, "Basic", p.Scheme)
+
+	// Test: Wrong password, unknown user, garbage and nothing at all
+	for _, authz := range []string{basicAuth("bob", "nope"), basicAuth("eve", "password"), "Basic !!!", "Basic " + base64.StdEncoding.EncodeToString([]byte("bob")), ""} {
+		resp, p := do(t, a, "/", authz)
+		assert.Equal(t, 401, resp.StatusCode, authz)
+		assert.Nil(t, p, authz)
+		assert.Equal(t, `Basic realm="hermes", charset="UTF-8"`, resp.Header.Get("WWW-Authenticate"))
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestBearer(t *testing.T) {
+	verifier := TokenVerifierFunc(func(_ *request.Request, token string) (*Principal, error) {
+		switch token {
+		case "good":
+			return &Principal{Name: "svc", Claims: map[string]any{"scope": "read"}}, nil
+		case "readonly":
+			return nil, ErrInsufficientScope
+		}
+		return nil, errors.New(`token "expired"`)
+	})
+	a := New(Config{Schemes: []Scheme{&Bearer{Realm: "api", Scope: "read write", Verifier: verifier}}})
+
+	resp, p := do(t, a, "/", "bearer good")
+	assert.Equal(t, 200, resp.StatusCode)
+	require.NotNil(t, p)
+	assert.Equal(t, "svc", p.Name)
+	assert.Equal(t, "Bearer", p.Scheme)
+	assert.Equal(t, "read", p.Claims["scope"])
+
+	for _, tc := range []struct {
+		authorization string
+		status        int
+		challenge     string
+	}{
+		{"", 401, `Bearer realm="api", scope="read write"`},
+		{"Bearer bad", 401, `Bearer realm="api", scope="read write", error="invalid_token", error_description="token expired"`},
+		{"Bearer not a token", 401, `Bearer realm="api", scope="read write", error="invalid_request"`},
+		{"Bearer readonly", 403, `Bearer realm="api", scope="read write", error="insufficient_scope"`},
+	} {
+		resp, p := do(t, a, "/", tc.authorization)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.authorization)
+		assert.Nil(t, p)
+		assert.Equal(t, tc.challenge, resp.Header.Get("WWW-Authenticate"), tc.authorization)
+	}
+
+	assert.True(t, validToken68("eyJhbGciOi.J9-_~+/=="))
+	assert.False(t, validToken68("=="))
+	assert.False(t, validToken68("ab=c"))
+}
+
+// digestResponse answers a Digest challenge like a client would.
+func digestResponse(t *testing.T, challenge, user, password, uri, nc string) string {
+	t.Helper()
+	c, ok := strings.CutPrefix(challenge, "Digest ")
+	require.True(t, ok, challenge)
+	p, err := parseParams(c)
+	require.NoError(t, err)
+	alg := p["algorithm"]
+	ha1 := HA1(alg, user, p["realm"], password)
+	ha2 := digestHash(alg, "GET:"+uri)
+	resp := digestHash(alg, ha1+":"+p["nonce"]+":"+nc+":0a4f113b:auth:"+ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="0a4f113b", response="%s", opaque="%s"`,
+		user, p["realm"], p["nonce"], uri, alg, nc, resp, p["opaque"])
+}
+
+func TestDigest(t *testing.T) {
+	clk := &clock{time.Unix(1700000000, 0)}
+	d := NewDigest(DigestConfig{
+		Realm: "http-auth@example.org",
+		Lookup: func(user, alg string) (string, bool) {
+			if user != "Mufasa" {
+				return "", false
+			}
+			return HA1(alg, user, "http-auth@example.org", "Circle of Life"), true
+		},
+		NonceTTL: time.Minute,
+	})
+	d.now = clk.now
+	a := New(Config{Schemes: []Scheme{d}})
+
+	resp, p := do(t, a, "/dir/index.html", "")
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Nil(t, p)
+	challenge := resp.Header.Get("WWW-Authenticate")
+	assert.Regexp(t, `^Digest realm="http-auth@example.org", qop="auth", algorithm=SHA-256, nonce="[\w-]+", opaque="[\w-]+"$`, challenge)
+
+	authz := digestResponse(t, challenge, "Mufasa", "Circle of Life", "/dir/index.html", "00000001")
+	resp, p = do(t, a, "/dir/index.html", authz)
+	assert.Equal(t, 200, resp.StatusCode)
+	require.NotNil(t, p)
+	assert.Equal(t, "Mufasa", p.Name)
+	assert.Equal(t, "Digest", p.Scheme)
+
+	// Test: The same nonce count again is a replay
+	resp, _ = do(t, a, "/dir/index.html", authz)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "stale=true")
+
+	// Test: The next count on the same nonce works
+	resp, _ = do(t, a, "/dir/index.html", digestResponse(t, challenge, "Mufasa", "Circle of Life", "/dir/index.html", "00000002"))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: Wrong password, other user, other uri
+	for _, authz := range []string{
+		digestResponse(t, challenge, "Mufasa", "Circle of Death", "/dir/index.html", "00000003"),
+		digestResponse(t, challenge, "Scar", "Circle of Life", "/dir/index.html", "00000003"),
+		digestResponse(t, challenge, "Mufasa", "Circle of Life", "/other", "00000003"),
+		`Digest username="Mufasa", realm="x`,
+	} {
+		resp, _ = do(t, a, "/dir/index.html", authz)
+		assert.Equal(t, 401, resp.StatusCode)
+		assert.NotContains(t, resp.Header.Get("WWW-Authenticate"), "stale=true")
+	}
+
+	// Test: An expired nonce is stale
+	clk.t = clk.t.Add(time.Minute)
+	resp, _ = do(t, a, "/dir/index.html", digestResponse(t, challenge, "Mufasa", "Circle of Life", "/dir/index.html", "00000004"))
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "stale=true")
+}
+
+func TestDigestNonceLimit(t *testing.T) {
+	clk := &clock{time.Unix(1700000000, 0)}
+	d := NewDigest(DigestConfig{MaxNonces: 3})
+	d.now = clk.now
+
+	// Test: Challenges keep no state
+	var nonces []string
+	for range 5 {
+		clk.t = clk.t.Add(time.Second)
+		nonces = append(nonces, d.newNonce())
+	}
+	assert.Empty(t, d.nonces)
+
+	// Test: Nonces are tracked once used, the first used are dropped past the limit
+	for _, n := range nonces {
+		issued, ok := d.checkNonce(n)
+		require.True(t, ok)
+		assert.True(t, d.useNonce(n, issued, 1))
+	}
+	assert.Len(t, d.nonces, 3)
+	assert.NotContains(t, d.nonces, nonces[1])
+	assert.Contains(t, d.nonces, nonces[4])
+
+	// Test: A dropped nonce can't start over
+	issued, _ := d.checkNonce(nonces[1])
+	assert.False(t, d.useNonce(nonces[1], issued, 1))
+
+	// Test: Newer nonces still work
+	clk.t = clk.t.Add(time.Second)
+	n := d.newNonce()
+	issued, ok := d.checkNonce(n)
+	require.True(t, ok)
+	assert.True(t, d.useNonce(n, issued, 1))
+
+	// Test: Forged and tampered nonces don't check out
+	_, ok = d.checkNonce(randomString())
+	assert.False(t, ok)
+	b, err := base64.RawURLEncoding.DecodeString(n)
+	require.NoError(t, err)
+	b[7]++
+	_, ok = d.checkNonce(base64.RawURLEncoding.EncodeToString(b))
+	assert.False(t, ok)
+}
+
+func TestSchemes(t *testing.T) {
+	users, err := ParseHtpasswd(strings.NewReader("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	require.NoError(t, err)
+	d := NewDigest(DigestConfig{Realm: "r", Algorithms: []string{SHA256, MD5}, Lookup: func(string, string) (string, bool) { return "", false }})
+	a := New(Config{Schemes: []Scheme{d, &Basic{Realm: "r", Users: users}}, Optional: true})
+
+	// Test: Anonymous requests get through when optional, bad ones don't
+	resp, p := do(t, a, "/", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, &Principal{}, p)
+
+	resp, _ = do(t, a, "/", "Negotiate abc")
+	assert.Equal(t, 401, resp.StatusCode)
+	challenges := resp.Header.Values("WWW-Authenticate")
+	require.Len(t, challenges, 2)
+	assert.Regexp(t, `^Digest .*algorithm=SHA-256.*, Digest .*algorithm=MD5`, challenges[0])
+	assert.Equal(t, `Basic realm="r", charset="UTF-8"`, challenges[1])
+
+	resp, p = do(t, a, "/", basicAuth("bob", "password"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "bob", p.Name)
+}
+
+func TestParseParams(t *testing.T) {
+	p, err := parseParams(`username="Mufasa", realm="a \"quoted\", realm" ,nc=00000001,qop=auth, empty=""`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"username": "Mufasa",
+		"realm":    `a "quoted", realm`,
+		"nc":       "00000001",
+		"qop":      "auth",
+		"empty":    "",
+	}, p)
+
+	for _, s := range []string{`a="open`, `=x`, `a=1, a=2`, `a="x"y`, `novalue`} {
+		_, err := parseParams(s)
+		assert.ErrorIs(t, err, ErrMalformed, s)
+	}
+}
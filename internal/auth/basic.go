@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+)
+
+// Verifier checks a user's password. *Htpasswd is one.
+type Verifier interface {
+	Verify(user, password string) bool
+}
+
+// Basic is the Basic scheme (RFC 7617). the password crosses the wire in
+// the clear, only use it over TLS.
+type Basic struct {
+	Realm string
+	Users Verifier
+}
+
+// Name implements Scheme.
+func (b *Basic) Name() string { return "Basic" }
+
+// Authenticate implements Scheme.
+func (b *Basic) Authenticate(_ *request.Request, credentials string) (*Principal, error) {
+	raw, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	user, password, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrMalformed
+	}
+	if !b.Users.Verify(user, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: user, Scheme: "Basic"}, nil
+}
+
+// Challenge implements Scheme.
+func (b *Basic) Challenge(_ *request.Request, _ error) string {
+	return "Basic realm=" + quote(b.Realm) + `, charset="UTF-8"`
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptMaxCost is the highest cost accepted. each step doubles the work,
+// a hash at the format's limit of 31 would tie up a CPU for days on every
+// login attempt.
+const bcryptMaxCost = 14
+
+// checkBcrypt makes sure hash is a $2a$, $2b$ or $2y$ hash at a cost we
+// are willing to pay.
+func checkBcrypt(hash string) error {
+	if len(hash) < 4 || hash[0] != '$' || hash[1] != '2' || hash[3] != '$' {
+		return ErrInvalidHash
+	}
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return ErrInvalidHash
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil || cost > bcryptMaxCost {
+		return ErrInvalidHash
+	}
+	return nil
+}
+
+// compareBcrypt checks password against a bcrypt hash.
+func compareBcrypt(hash, password string) (bool, error) {
+	if err := checkBcrypt(hash); err != nil {
+		return false, err
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return false, nil
+	}
+	return false, ErrInvalidHash
+}
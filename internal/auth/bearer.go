@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+)
+
+// TokenVerifier checks a bearer token and returns who it belongs to.
+// errors other than ErrInsufficientScope are reported to the client as
+// invalid_token.
+type TokenVerifier interface {
+	VerifyToken(req *request.Request, token string) (*Principal, error)
+}
+
+// TokenVerifierFunc adapts a function to TokenVerifier.
+type TokenVerifierFunc func(req *request.Request, token string) (*Principal, error)
+
+// VerifyToken implements TokenVerifier.
+func (f TokenVerifierFunc) VerifyToken(req *request.Request, token string) (*Principal, error) {
+	return f(req, token)
+}
+
+// ErrInsufficientScope is returned by a TokenVerifier for a valid token
+// that doesn't grant enough.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+// Bearer is the Bearer scheme (RFC 6750).
+type Bearer struct {
+	Realm string
+	// Scope is advertised in the challenge, optional.
+	Scope    string
+	Verifier TokenVerifier
+}
+
+// Name implements Scheme.
+func (b *Bearer) Name() string { return "Bearer" }
+
+// Authenticate implements Scheme.
+func (b *Bearer) Authenticate(req *request.Request, credentials string) (*Principal, error) {
+	if !validToken68(credentials) {
+		return nil, ErrMalformed
+	}
+	p, err := b.Verifier.VerifyToken(req, credentials)
+	if err != nil {
+		return nil, err
+	}
+	if p.Scheme == "" {
+		p.Scheme = "Bearer"
+	}
+	return p, nil
+}
+
+// Challenge implements Scheme. a failed token gets the error code of
+// RFC 6750 section 3.1, no credentials get none.
+func (b *Bearer) Challenge(_ *request.Request, err error) string {
+	c := "Bearer realm=" + quote(b.Realm)
+	if b.Scope != "" {
+		c += ", scope=" + quote(b.Scope)
+	}
+	switch {
+	case errors.Is(err, ErrNoCredentials):
+	case errors.Is(err, ErrMalformed):
+		c += `, error="invalid_request"`
+	case errors.Is(err, ErrInsufficientScope):
+		c += `, error="insufficient_scope"`
+	default:
+		c += `, error="invalid_token"`
+		if err != nil {
+			c += ", error_description=" + quote(description(err.Error()))
+		}
+	}
+	return c
+}
+
+// validToken68 reports whether s is a token68: letters, digits and
+// -._~+/ followed by optional = padding.
+func validToken68(s string) bool {
+	if s == "" {
+		return false
+	}
+	i := 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' ||
+			c == '.' || c == '_' || c == '~' || c == '+' || c == '/') {
+			break
+		}
+	}
+	if i == 0 {
+		return false
+	}
+	for ; i < len(s); i++ {
+		if s[i] != '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// description drops the characters RFC 6750 doesn't allow in
+// error_description: controls, non-ASCII, " and \.
+func description(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+)
+
+// Digest algorithms. MD5 is only there for clients that know nothing
+// better.
+const (
+	SHA256 = "SHA-256"
+	MD5    = "MD5"
+)
+
+// ErrStaleNonce means the response was right but the nonce expired or was
+// replayed. the client is told stale=true and retries without asking the
+// user again.
+var ErrStaleNonce = errors.New("stale nonce")
+
+// Defaults for DigestConfig.
+const (
+	DefaultNonceTTL  = 5 * time.Minute
+	DefaultMaxNonces = 10000
+)
+
+// HA1 is H(user:realm:password), what a Digest server stores instead of
+// the password.
+func HA1(algorithm, user, realm, password string) string {
+	return digestHash(algorithm, user+":"+realm+":"+password)
+}
+
+// DigestConfig configures NewDigest.
+type DigestConfig struct {
+	Realm string
+	// Algorithms are offered in order, [SHA256] if empty.
+	Algorithms []string
+	// Lookup returns the HA1 of user for algorithm, see HA1.
+	Lookup func(user, algorithm string) (ha1 string, ok bool)
+	// NonceTTL is how long a nonce is good for, DefaultNonceTTL if 0.
+	NonceTTL time.Duration
+	// MaxNonces bounds the nonces tracked at once, DefaultMaxNonces if 0.
+	// the ones first used longest ago go first when it's reached, their
+	// clients are sent a new nonce.
+	MaxNonces int
+}
+
+// Digest is the Digest scheme (RFC 7616) with qop=auth. nonces are signed
+// timestamps, so handing them out keeps no state. once a request
+// authenticates with a nonce it is tracked with the last nonce count seen
+// for it, so a captured request can't be replayed.
+type Digest struct {
+	cfg    DigestConfig
+	key    []byte // signs nonces
+	opaque string
+	now    func() time.Time
+
+	mu     sync.Mutex
+	nonces map[string]*list.Element
+	order  *list.List // of *nonceState, front was first used longest ago
+	// floor is the latest issue time of a nonce dropped before it expired.
+	// untracked nonces issued up to it may have been dropped, they are
+	// refused.
+	floor time.Time
+}
+
+type nonceState struct {
+	nonce  string
+	issued time.Time
+	nc     uint64
+}
+
+// nonces are the issue time, 8 random bytes and a truncated MAC of both.
+const (
+	nonceData = 16
+	nonceMAC  = 16
+)
+
+// NewDigest creates a Digest scheme.
+func NewDigest(cfg DigestConfig) *Digest {
+	if len(cfg.Algorithms) == 0 {
+		cfg.Algorithms = []string{SHA256}
+	}
+	if cfg.NonceTTL <= 0 {
+		cfg.NonceTTL = DefaultNonceTTL
+	}
+	if cfg.MaxNonces <= 0 {
+		cfg.MaxNonces = DefaultMaxNonces
+	}
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return &Digest{
+		cfg:    cfg,
+		key:    key,
+		opaque: randomString(),
+		now:    time.Now,
+		nonces: make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// Name implements Scheme.
+func (d *Digest) Name() string { return "Digest" }
+
+// Authenticate implements Scheme.
+func (d *Digest) Authenticate(req *request.Request, credentials string) (*Principal, error) {
+	p, err := parseParams(credentials)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range []string{"username", "realm", "nonce", "uri", "response", "qop", "nc", "cnonce"} {
+		if p[k] == "" {
+			return nil, ErrMalformed
+		}
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 32)
+	if err != nil || len(p["nc"]) != 8 {
+		return nil, ErrMalformed
+	}
+	algorithm := p["algorithm"]
+	if algorithm == "" {
+		algorithm = MD5
+	}
+	if !d.offers(algorithm) || p["qop"] != "auth" || p["realm"] != d.cfg.Realm ||
+		p["opaque"] != d.opaque || p["uri"] != req.RequestLine.RequestTarget {
+		return nil, ErrInvalidCredentials
+	}
+
+	// unknown users are checked against a made up HA1 to take as long
+	ha1, ok := d.cfg.Lookup(p["username"], algorithm)
+	if !ok {
+		ha1 = HA1(algorithm, p["username"], d.cfg.Realm, d.opaque)
+	}
+	ha2 := digestHash(algorithm, req.RequestLine.Method+":"+p["uri"])
+	want := digestHash(algorithm, ha1+":"+p["nonce"]+":"+p["nc"]+":"+p["cnonce"]+":auth:"+ha2)
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(p["response"]))) != 1 || !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	// only now is the nonce looked at: a right answer to an old nonce is
+	// stale, not wrong
+	issued, ok := d.checkNonce(p["nonce"])
+	if !ok || !d.useNonce(p["nonce"], issued, nc) {
+		return nil, ErrStaleNonce
+	}
+	return &Principal{Name: p["username"], Scheme: "Digest"}, nil
+}
+
+// Challenge implements Scheme. there is one challenge per algorithm, all
+// with the same fresh nonce.
+func (d *Digest) Challenge(_ *request.Request, err error) string {
+	nonce := d.newNonce()
+	challenges := make([]string, len(d.cfg.Algorithms))
+	for i, alg := range d.cfg.Algorithms {
+		c := "Digest realm=" + quote(d.cfg.Realm) + `, qop="auth", algorithm=` + alg +
+			", nonce=" + quote(nonce) + ", opaque=" + quote(d.opaque)
+		if errors.Is(err, ErrStaleNonce) {
+			c += ", stale=true"
+		}
+		challenges[i] = c
+	}
+	return strings.Join(challenges, ", ")
+}
+
+func (d *Digest) offers(algorithm string) bool {
+	for _, a := range d.cfg.Algorithms {
+		if strings.EqualFold(a, algorithm) {
+			return true
+		}
+	}
+	return false
+}
+
+// newNonce issues a nonce.
+func (d *Digest) newNonce() string {
+	b := make([]byte, nonceData, nonceData+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(d.now().UnixNano()))
+	_, _ = rand.Read(b[8:])
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b)[:nonceData+nonceMAC])
+}
+
+// checkNonce verifies a nonce was issued here and hasn't expired, and
+// returns when it was issued.
+func (d *Digest) checkNonce(nonce string) (time.Time, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != nonceData+nonceMAC {
+		return time.Time{}, false
+	}
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(b[:nonceData])
+	if !hmac.Equal(mac.Sum(nil)[:nonceMAC], b[nonceData:]) {
+		return time.Time{}, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	age := d.now().Sub(issued)
+	return issued, age >= 0 && age < d.cfg.NonceTTL
+}
+
+// useNonce records nc for a valid nonce. it fails for a count that isn't
+// above the last one, and for a nonce that may have been dropped.
+func (d *Digest) useNonce(nonce string, issued time.Time, nc uint64) bool {
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		if now.Sub(e.Value.(*nonceState).issued) < d.cfg.NonceTTL {
+			break
+		}
+		d.drop(e)
+	}
+
+	if e, ok := d.nonces[nonce]; ok {
+		st := e.Value.(*nonceState)
+		if nc <= st.nc {
+			return false
+		}
+		st.nc = nc
+		return true
+	}
+	if !issued.After(d.floor) {
+		return false
+	}
+	if d.order.Len() >= d.cfg.MaxNonces {
+		e := d.order.Front()
+		if st := e.Value.(*nonceState); st.issued.After(d.floor) {
+			d.floor = st.issued
+		}
+		d.drop(e)
+	}
+	d.nonces[nonce] = d.order.PushBack(&nonceState{nonce: nonce, issued: issued, nc: nc})
+	return true
+}
+
+func (d *Digest) drop(e *list.Element) {
+	delete(d.nonces, d.order.Remove(e).(*nonceState).nonce)
+}
+
+func digestHash(algorithm, s string) string {
+	var h hash.Hash
+	if strings.EqualFold(algorithm, MD5) {
+		h = md5.New()
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func randomString() string {
+	b := make([]byte, 18)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseParams parses the comma separated name=value pairs of an auth
+// header, values being tokens or quoted strings. names are lowercased.
+func parseParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, ErrMalformed
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, ErrMalformed
+			}
+			value, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		if _, dup := params[name]; dup {
+			return nil, ErrMalformed
+		}
+		params[name] = value
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ',' {
+			return nil, ErrMalformed
+		}
+	}
+}
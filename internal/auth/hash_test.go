@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const longPassword = "a fairly long password that goes past sixty four bytes for sure yes"
+
+func TestCompareHash(t *testing.T) {
+	for _, tc := range []struct{ hash, password string }{
+		// OpenWall's bcrypt test vector
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		{dummyHash, "secret"},
+		// the SHA-crypt spec's vector
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"$5$saltstring$yfyeZZ0j/oU2MKdIYKggaDb1R.RJqGsQr1.Xzx6xcU6", longPassword},
+		{"$6$saltstring$iVMPLnUDxPnp1PCwmmAbHGvn3iyTP.zQ3GEzkiXiNqTWWV0dMtWUvMQ92TLUS7o6YJATQzKJiMoimtnVogPOj1", longPassword},
+		{"$5$rounds=1000$short$u2xBcw3lCyXYlwMd2F6y2Y9D37sNMiBjXpqH4nI7Mc0", longPassword},
+		{"$6$rounds=1234$abcdefghijklmnop$LSrnhkIn.KXL7mxS6jPET5M.bqS/N7PEmqAzRLF3fyDIcpKtGbwXdnpl86856coJaHgStgf96yJfxIQtMtMw./", longPassword},
+		// htpasswd -s
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password"},
+	} {
+		ok, err := CompareHash(tc.hash, tc.password)
+		require.NoError(t, err, tc.hash)
+		assert.True(t, ok, tc.hash)
+
+		ok, err = CompareHash(tc.hash, tc.password+"x")
+		require.NoError(t, err, tc.hash)
+		assert.False(t, ok, tc.hash)
+	}
+
+	// Test: Unknown and broken hashes, and ones that take too long
+	for _, hash := range []string{
+		"plain", "$1$md5$xyz", "$2x$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "$2a$05$short", "$5$",
+		"$2b$31$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$6$rounds=999999999$abcdefghijklmnop$LSrnhkIn.KXL7mxS6jPET5M.bqS/N7PEmqAzRLF3fyDIcpKtGbwXdnpl86856coJaHgStgf96yJfxIQtMtMw./",
+	} {
+		_, err := CompareHash(hash, "x")
+		assert.ErrorIs(t, err, ErrInvalidHash, hash)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader(`# users
+alice:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5
+
+bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`))
+	require.NoError(t, err)
+	assert.True(t, h.Verify("alice", "Hello world!"))
+	assert.True(t, h.Verify("bob", "password"))
+	assert.False(t, h.Verify("bob", "Hello world!"))
+	assert.False(t, h.Verify("mallory", "password"))
+
+	_, err = ParseHtpasswd(strings.NewReader("carol:plaintext\n"))
+	assert.ErrorIs(t, err, ErrInvalidHash)
+	_, err = ParseHtpasswd(strings.NewReader("dave:$2b$20$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n"))
+	assert.ErrorIs(t, err, ErrInvalidHash)
+	_, err = ParseHtpasswd(strings.NewReader("no colon\n"))
+	assert.Error(t, err)
+}
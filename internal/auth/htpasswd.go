@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/devwelkin/hermes-lite/internal/shacrypt"
+)
+
+// ErrInvalidHash is returned for a password hash in an unknown format, or
+// one that asks for more work than we do per login.
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Htpasswd holds users from an Apache style htpasswd file: user:hash lines,
+// # comments. hashes may be bcrypt ($2a$, $2b$, $2y$), SHA-crypt ($5$,
+// $6$) or {SHA}.
+type Htpasswd struct {
+	mu    sync.RWMutex
+	users map[string]string
+	path  string
+}
+
+// LoadHtpasswd reads an htpasswd file.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ParseHtpasswd reads htpasswd lines from r.
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	users, err := parseHtpasswd(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Htpasswd{users: users}, nil
+}
+
+// Reload rereads the file, e.g. on SIGHUP. the old users stay if it fails.
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users, err := parseHtpasswd(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.path, err)
+	}
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	return nil
+}
+
+func parseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if checkHash(hash) != nil {
+			return nil, fmt.Errorf("line %d: %w for %q", n, ErrInvalidHash, user)
+		}
+		users[user] = hash
+	}
+	return users, sc.Err()
+}
+
+// dummyHash is checked for unknown users, so they take as long to turn
+// away as a wrong password does.
+const dummyHash = "$2b$10$012345678901234567890uquiKkX48UVykoH7PVkTNeJrHlAbpqAG"
+
+// Verify reports whether password is user's.
+func (h *Htpasswd) Verify(user, password string) bool {
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		_, _ = CompareHash(dummyHash, password)
+		return false
+	}
+	match, err := CompareHash(hash, password)
+	return err == nil && match
+}
+
+// checkHash makes sure hash is in a format CompareHash knows, without
+// running it.
+func checkHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return checkBcrypt(hash)
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		if _, err := shacrypt.Rounds(hash); err != nil {
+			return ErrInvalidHash
+		}
+		return nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		return nil
+	}
+	return ErrInvalidHash
+}
+
+// CompareHash checks password against a hash in one of the htpasswd
+// formats, in constant time for a given hash.
+func CompareHash(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return compareBcrypt(hash, password)
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		ok, err := shacrypt.Compare(hash, password)
+		if err != nil {
+			return false, ErrInvalidHash
+		}
+		return ok, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		got := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(got), []byte(hash[len("{SHA}"):])) == 1, nil
+	}
+	return false, ErrInvalidHash
+}
@@ -0,0 +1,119 @@
+// Package clientip works out the address of the client behind trusted
+// reverse proxies from X-Forwarded-For or Forwarded (RFC 7239).
+package clientip
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+)
+
+// Resolver trusts forwarding headers only as far as they were written by
+// proxies inside Trusted.
+type Resolver struct {
+	Trusted []netip.Prefix
+}
+
+// ParsePrefixes parses a comma separated list of CIDRs and bare addresses,
+// a bare address is a single host prefix.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// IsTrusted reports whether addr is inside one of the trusted prefixes.
+func (r *Resolver) IsTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range r.Trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client address for a request that came from peer.
+// when peer is a trusted proxy the forwarding chain is walked from the
+// nearest hop back, and the first address outside the trusted set is the
+// client. Forwarded is used when present, X-Forwarded-For otherwise. a hop
+// that doesn't parse ends the walk at the last good address, since nothing
+// before it can be trusted.
+func (r *Resolver) Resolve(peer netip.Addr, h headers.Headers) netip.Addr {
+	peer = peer.Unmap()
+	if !r.IsTrusted(peer) {
+		return peer
+	}
+
+	var hops []string
+	if fwd, ok := h["forwarded"]; ok {
+		hops = forwardedFor(fwd)
+	} else if xff, ok := h["x-forwarded-for"]; ok {
+		for _, hop := range strings.Split(xff, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			return client
+		}
+		client = addr
+		if !r.IsTrusted(addr) {
+			return addr
+		}
+	}
+	return client
+}
+
+// parseHop reads an address with an optional port, IPv6 in brackets when it
+// has one.
+func parseHop(s string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedFor returns the for= value of every Forwarded element, in order.
+// elements without one get "", which stops the walk like any bad hop.
+func forwardedFor(v string) []string {
+	var out []string
+	for _, elem := range headers.SplitQuoted(v, ',') {
+		var hop string
+		for _, pair := range headers.SplitQuoted(elem, ';') {
+			key, val, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(key, "for") {
+				hop = headers.Unquote(val)
+			}
+		}
+		out = append(out, hop)
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package clientip
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	ps, err := ParsePrefixes("10.0.0.0/8, 192.0.2.7,2001:db8::/32,10.1.2.3/8")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.7/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}, ps)
+
+	_, err = ParsePrefixes("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestResolve(t *testing.T) {
+	trusted, err := ParsePrefixes("10.0.0.0/8, 2001:db8::/32")
+	require.NoError(t, err)
+	r := &Resolver{Trusted: trusted}
+	proxy := netip.MustParseAddr("10.0.0.1")
+
+	tests := []struct {
+		name string
+		peer netip.Addr
+		h    headers.Headers
+		want string
+	}{
+		{"untrusted peer ignores headers", netip.MustParseAddr("203.0.113.9"),
+			headers.Headers{"x-forwarded-for": "1.2.3.4"}, "203.0.113.9"},
+		{"no header", proxy, headers.Headers{}, "10.0.0.1"},
+		{"first untrusted from the right", proxy,
+			headers.Headers{"x-forwarded-for": "6.6.6.6, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"ports and brackets", proxy,
+			headers.Headers{"x-forwarded-for": "[2001:db9::1]:443, 10.0.0.2:80"}, "2001:db9::1"},
+		{"all trusted gives the leftmost", proxy,
+			headers.Headers{"x-forwarded-for": "10.9.9.9, 10.0.0.2"}, "10.9.9.9"},
+		{"garbage stops at the last good hop", proxy,
+			headers.Headers{"x-forwarded-for": "1.2.3.4, nonsense, 10.0.0.2"}, "10.0.0.2"},
+		{"mapped v4 peer", netip.MustParseAddr("::ffff:10.0.0.1"),
+			headers.Headers{"x-forwarded-for": "1.2.3.4"}, "1.2.3.4"},
+		{"forwarded wins over xff", proxy, headers.Headers{
+			"forwarded":       `for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711"`,
+			"x-forwarded-for": "1.1.1.1",
+		}, "192.0.2.60"},
+		{"forwarded quoted separators", proxy, headers.Headers{
+			"forwarded": `for=198.51.100.1;ext="a,b;c", for=10.0.0.3`,
+		}, "198.51.100.1"},
+		{"forwarded obfuscated", proxy, headers.Headers{"forwarded": "for=_hidden, for=10.0.0.3"}, "10.0.0.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, r.Resolve(tt.peer, tt.h).String())
+		})
+	}
+}
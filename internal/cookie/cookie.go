@@ -0,0 +1,240 @@
+// Package cookie parses Cookie request headers and builds Set-Cookie
+// values (RFC 6265, plus SameSite and Partitioned).
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Custom errors
+var (
+	ErrInvalidName   = errors.New("invalid cookie name")
+	ErrInvalidValue  = errors.New("invalid cookie value")
+	ErrInvalidPath   = errors.New("invalid cookie path")
+	ErrInvalidDomain = errors.New("invalid cookie domain")
+	// ErrNotSecure means an attribute or name prefix that browsers only
+	// accept together with Secure.
+	ErrNotSecure = errors.New("cookie must be secure")
+)
+
+// SameSite is the SameSite attribute.
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out, browsers treat that as Lax.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+func (s SameSite) String() string {
+	switch s {
+	case SameSiteLax:
+		return "Lax"
+	case SameSiteStrict:
+		return "Strict"
+	case SameSiteNone:
+		return "None"
+	}
+	return ""
+}
+
+// TimeFormat is the date format of the Expires attribute.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Cookie is a cookie as sent in Cookie, or to be sent in Set-Cookie. only
+// Name, Value and Quoted are filled in by Parse, the rest are Set-Cookie
+// attributes.
+type Cookie struct {
+	Name  string
+	Value string
+	// Quoted is set when the value came in double quotes. values with a
+	// space or comma are always quoted on the way out.
+	Quoted bool
+
+	Path    string
+	Domain  string
+	Expires time.Time // zero leaves it out
+	// MaxAge in seconds. 0 leaves it out, negative deletes the cookie
+	// (sent as Max-Age=0).
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// Parse splits a Cookie header into its cookies, in order. pairs that don't
+// parse are skipped, the way browsers skip them.
+func Parse(header string) []Cookie {
+	var cookies []Cookie
+	for _, pair := range strings.Split(header, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !validName(name) {
+			continue
+		}
+		value, quoted := unquote(value)
+		if !validValue(value, quoted) {
+			continue
+		}
+		cookies = append(cookies, Cookie{Name: name, Value: value, Quoted: quoted})
+	}
+	return cookies
+}
+
+// Get returns the first cookie called name in a Cookie header.
+func Get(header, name string) (Cookie, bool) {
+	for _, c := range Parse(header) {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Cookie{}, false
+}
+
+// Validate checks the cookie can be sent in a Set-Cookie header.
+func (c *Cookie) Validate() error {
+	if !validName(c.Name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, c.Name)
+	}
+	if !validValue(c.Value, true) {
+		return fmt.Errorf("%w: %q", ErrInvalidValue, c.Value)
+	}
+	for i := 0; i < len(c.Path); i++ {
+		if b := c.Path[i]; b < 0x20 || b == 0x7f || b == ';' {
+			return fmt.Errorf("%w: %q", ErrInvalidPath, c.Path)
+		}
+	}
+	if c.Domain != "" && !validDomain(c.Domain) {
+		return fmt.Errorf("%w: %q", ErrInvalidDomain, c.Domain)
+	}
+	if !c.Secure {
+		switch {
+		case c.SameSite == SameSiteNone:
+			return fmt.Errorf("%w: SameSite=None", ErrNotSecure)
+		case c.Partitioned:
+			return fmt.Errorf("%w: Partitioned", ErrNotSecure)
+		case strings.HasPrefix(c.Name, "__Secure-"), strings.HasPrefix(c.Name, "__Host-"):
+			return fmt.Errorf("%w: %s prefix", ErrNotSecure, c.Name)
+		}
+	}
+	if strings.HasPrefix(c.Name, "__Host-") && (c.Domain != "" || c.Path != "/") {
+		return fmt.Errorf("%w: __Host- cookies need Path=/ and no Domain", ErrInvalidName)
+	}
+	return nil
+}
+
+// Format validates the cookie and returns it as a Set-Cookie value.
+func (c *Cookie) Format() (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	if c.Quoted || strings.ContainsAny(c.Value, " ,") {
+		b.WriteString(`"` + c.Value + `"`)
+	} else {
+		b.WriteString(c.Value)
+	}
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		// a leading dot is ignored by browsers (RFC 6265 5.2.3)
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(TimeFormat))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=" + c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String(), nil
+}
+
+// validName checks name is a token.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		isLetter := (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+		isDigit := b >= '0' && b <= '9'
+		if !isLetter && !isDigit && !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(b)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validValue checks value only holds cookie-octets. quoted values may also
+// hold spaces and commas, which is what real clients send.
+func validValue(value string, quoted bool) bool {
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		switch {
+		case b == ' ' || b == ',':
+			if !quoted {
+				return false
+			}
+		case b <= 0x20, b >= 0x7f, b == '"', b == ';', b == '\\':
+			return false
+		}
+	}
+	return true
+}
+
+// unquote strips the double quotes from a quoted value.
+func unquote(value string) (string, bool) {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1], true
+	}
+	return value, false
+}
+
+// validDomain checks d looks like a host name or an IP address.
+func validDomain(d string) bool {
+	d = strings.TrimPrefix(d, ".")
+	if d == "" || len(d) > 253 {
+		return false
+	}
+	if strings.Contains(d, ":") {
+		// an IPv6 address, which browsers won't match anyway
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			b := label[i]
+			if !(b >= 'a' && b <= 'z') && !(b >= 'A' && b <= 'Z') && !(b >= '0' && b <= '9') && b != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Pairs in order, quotes stripped, junk skipped
+	cookies := Parse(`a=1; b="two words";bad name=x; c=; noequals; d=x\y; e=3`)
+	assert.Equal(t, []Cookie{
+		{Name: "a", Value: "1"},
+		{Name: "b", Value: "two words", Quoted: true},
+		{Name: "c", Value: ""},
+		{Name: "e", Value: "3"},
+	}, cookies)
+
+	// Test: Get finds the first of duplicate names
+	c, ok := Get("id=1; id=2", "id")
+	require.True(t, ok)
+	assert.Equal(t, "1", c.Value)
+	_, ok = Get("id=1", "other")
+	assert.False(t, ok)
+
+	assert.Empty(t, Parse(""))
+}
+
+func TestFormat(t *testing.T) {
+	// Test: All the attributes
+	c := &Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     time.Date(2026, 10, 18, 10, 0, 0, 0, time.FixedZone("x", 3600)),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	v, err := c.Format()
+	require.NoError(t, err)
+	assert.Equal(t, "session=abc123; Path=/; Domain=example.com; Expires=Sun, 18 Oct 2026 09:00:00 GMT; "+
+		"Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned", v)
+
+	// Test: Deleting, and quoting a value with spaces
+	v, err = (&Cookie{Name: "msg", Value: "hi there", MaxAge: -1, SameSite: SameSiteLax}).Format()
+	require.NoError(t, err)
+	assert.Equal(t, `msg="hi there"; Max-Age=0; SameSite=Lax`, v)
+
+	// Test: Invalid cookies are refused
+	for _, tc := range []struct {
+		cookie Cookie
+		err    error
+	}{
+		{Cookie{Name: ""}, ErrInvalidName},
+		{Cookie{Name: "a b"}, ErrInvalidName},
+		{Cookie{Name: "a", Value: `x"y`}, ErrInvalidValue},
+		{Cookie{Name: "a", Value: "x;y"}, ErrInvalidValue},
+		{Cookie{Name: "a", Value: "x\ny"}, ErrInvalidValue},
+		{Cookie{Name: "a", Path: "/;x"}, ErrInvalidPath},
+		{Cookie{Name: "a", Domain: "exa mple.com"}, ErrInvalidDomain},
+		{Cookie{Name: "a", Domain: "-bad.com"}, ErrInvalidDomain},
+		{Cookie{Name: "a", SameSite: SameSiteNone}, ErrNotSecure},
+		{Cookie{Name: "a", Partitioned: true}, ErrNotSecure},
+		{Cookie{Name: "__Secure-a"}, ErrNotSecure},
+		{Cookie{Name: "__Host-a", Secure: true, Path: "/", Domain: "example.com"}, ErrInvalidName},
+	} {
+		_, err := tc.cookie.Format()
+		assert.ErrorIs(t, err, tc.err, "%+v", tc.cookie)
+	}
+
+	_, err = (&Cookie{Name: "__Host-a", Secure: true, Path: "/"}).Format()
+	assert.NoError(t, err)
+}
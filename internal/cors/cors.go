@@ -0,0 +1,224 @@
+// Package cors implements Cross-Origin Resource Sharing: it answers
+// preflight requests and adds the Access-Control-* headers browsers need
+// before they let a page read a response from another origin.
+package cors
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// ErrWildcardCredentials is returned by New for a config that allows any
+// origin to send credentials: every site on the web could then read the
+// user's responses.
+var ErrWildcardCredentials = errors.New(`cors: AllowedOrigins "*" with AllowCredentials`)
+
+// DefaultMethods are allowed when Config.AllowedMethods is empty.
+var DefaultMethods = []string{"GET", "HEAD", "POST"}
+
+// Config configures the middleware.
+type Config struct {
+	// AllowedOrigins are origins like "https://app.example.com", or
+	// patterns with one wildcard for subdomains, "https://*.example.com".
+	// "*" allows any origin.
+	AllowedOrigins []string
+	// AllowOrigin decides for origins AllowedOrigins didn't match.
+	AllowOrigin func(origin string, req *request.Request) bool
+
+	// AllowedMethods defaults to DefaultMethods.
+	AllowedMethods []string
+	// AllowedHeaders are the request headers a page may send, "*" for any.
+	// CORS-safelisted headers like Accept are always allowed.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers a page may read besides the
+	// safelisted ones.
+	ExposedHeaders []string
+	// AllowCredentials lets cookies and HTTP auth go along. the origin is
+	// then echoed, and AllowedOrigins can't hold "*".
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight answer. 0 leaves it
+	// to the browser (5 seconds), negative turns caching off.
+	MaxAge time.Duration
+}
+
+// CORS is the middleware state.
+type CORS struct {
+	cfg       Config
+	allowAll  bool
+	exact     map[string]bool
+	wildcards []wildcard
+	methods   map[string]bool
+	headers   map[string]bool
+	anyHeader bool
+}
+
+// wildcard is an origin pattern split at its *.
+type wildcard struct {
+	prefix, suffix string
+}
+
+// New creates the middleware state from cfg.
+func New(cfg Config) (*CORS, error) {
+	c := &CORS{
+		exact:   make(map[string]bool),
+		methods: make(map[string]bool),
+		headers: make(map[string]bool),
+	}
+	for _, o := range cfg.AllowedOrigins {
+		o = strings.ToLower(o)
+		switch {
+		case o == "*":
+			if cfg.AllowCredentials {
+				return nil, ErrWildcardCredentials
+			}
+			c.allowAll = true
+		case strings.Contains(o, "*"):
+			prefix, suffix, _ := strings.Cut(o, "*")
+			c.wildcards = append(c.wildcards, wildcard{prefix, suffix})
+		default:
+			c.exact[o] = true
+		}
+	}
+	if len(cfg.AllowedMethods) == 0 {
+		cfg.AllowedMethods = DefaultMethods
+	}
+	for _, m := range cfg.AllowedMethods {
+		c.methods[m] = true
+	}
+	for _, h := range cfg.AllowedHeaders {
+		if h == "*" {
+			c.anyHeader = true
+		}
+		c.headers[strings.ToLower(h)] = true
+	}
+	c.cfg = cfg
+	return c, nil
+}
+
+// allowed reports whether origin may read responses.
+func (c *CORS) allowed(origin string, req *request.Request) bool {
+	o := strings.ToLower(origin)
+	if c.exact[o] {
+		return true
+	}
+	// "null" (sandboxed frames, file: pages) only when listed by name
+	if c.allowAll && o != "null" {
+		return true
+	}
+	for _, w := range c.wildcards {
+		if w.matches(o) {
+			return true
+		}
+	}
+	return c.cfg.AllowOrigin != nil && c.cfg.AllowOrigin(origin, req)
+}
+
+// matches checks the part in place of the * is one or more DNS labels, so
+// "https://*.example.com" takes "https://a.b.example.com" but neither
+// "https://example.com" nor "https://evil.com/.example.com".
+func (w wildcard) matches(origin string) bool {
+	if len(origin) <= len(w.prefix)+len(w.suffix) ||
+		!strings.HasPrefix(origin, w.prefix) || !strings.HasSuffix(origin, w.suffix) {
+		return false
+	}
+	middle := origin[len(w.prefix) : len(origin)-len(w.suffix)]
+	for _, label := range strings.Split(middle, ".") {
+		if label == "" {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			b := label[i]
+			if !(b >= 'a' && b <= 'z') && !(b >= '0' && b <= '9') && b != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Middleware answers preflights itself and decorates every other request
+// from an allowed origin.
+func (c *CORS) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			origin := req.Headers["origin"]
+			isPreflight := req.RequestLine.Method == "OPTIONS" && origin != "" &&
+				req.Headers["access-control-request-method"] != ""
+			if isPreflight {
+				c.preflight(w, req, origin)
+				return
+			}
+
+			h := w.Header()
+			if !c.allowAll {
+				// the answer depends on who asks, caches must keep them apart
+				h.AddToken("Vary", "Origin")
+			}
+			if origin != "" && c.allowed(origin, req) {
+				c.setOrigin(w, origin)
+				if len(c.cfg.ExposedHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(c.cfg.ExposedHeaders, ", "))
+				}
+			}
+			next(w, req)
+		}
+	}
+}
+
+// preflight answers an OPTIONS preflight with 204. a refused preflight gets
+// no Access-Control-* headers, which is what fails it in the browser.
+func (c *CORS) preflight(w *response.Writer, req *request.Request, origin string) {
+	h := w.Header()
+	h.AddToken("Vary", "Origin")
+	h.AddToken("Vary", "Access-Control-Request-Method")
+	h.AddToken("Vary", "Access-Control-Request-Headers")
+	defer func() { _ = w.WriteStatusLine(response.StatusNoContent) }()
+
+	method := req.Headers["access-control-request-method"]
+	if !c.allowed(origin, req) || !c.methods[method] {
+		return
+	}
+	var reqHeaders []string
+	for _, name := range strings.Split(req.Headers["access-control-request-headers"], ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		// browsers only list headers that need permission, safelisted
+		// ones with unsafe values (a JSON Content-Type) included
+		if !c.anyHeader && !c.headers[name] {
+			return
+		}
+		reqHeaders = append(reqHeaders, name)
+	}
+
+	c.setOrigin(w, origin)
+	h.Set("Access-Control-Allow-Methods", method)
+	if len(reqHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(reqHeaders, ", "))
+	}
+	switch {
+	case c.cfg.MaxAge > 0:
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.cfg.MaxAge/time.Second)))
+	case c.cfg.MaxAge < 0:
+		h.Set("Access-Control-Max-Age", "0")
+	}
+}
+
+func (c *CORS) setOrigin(w *response.Writer, origin string) {
+	h := w.Header()
+	if c.allowAll {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,121 @@
+package cors
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// do runs a request through the middleware and reports whether the handler
+// was reached.
+func do(t *testing.T, c *CORS, method string, h headers.Headers) (*http.Response, bool) {
+	t.Helper()
+	req := &request.Request{RequestLine: request.RequestLine{Method: method}, Headers: h}
+	reached := false
+	resp := servertest.Do(t, c.Middleware()(func(w *response.Writer, req *request.Request) {
+		reached = true
+		_, _ = w.Write([]byte("ok"))
+	}), req)
+	return resp, reached
+}
+
+func TestOrigins(t *testing.T) {
+	c, err := New(Config{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"},
+		AllowOrigin: func(origin string, _ *request.Request) bool {
+			return origin == "http://localhost:3000"
+		},
+	})
+	require.NoError(t, err)
+	for origin, want := range map[string]bool{
+		"https://app.example.com":          true,
+		"HTTPS://APP.EXAMPLE.COM":          true,
+		"https://a.example.org":            true,
+		"https://a.b.example.org":          true,
+		"http://localhost:3000":            true,
+		"https://example.org":              false,
+		"https://evilexample.org":          false,
+		"https://evil.com/.example.org":    false,
+		"https://a.example.org:8443":       false,
+		"https://app.example.com.evil.com": false,
+		"null":                             false,
+	} {
+		resp, reached := do(t, c, "GET", headers.Headers{"origin": origin})
+		assert.True(t, reached)
+		assert.Equal(t, "Origin", resp.Header.Get("Vary"))
+		if want {
+			assert.Equal(t, origin, resp.Header.Get("Access-Control-Allow-Origin"), origin)
+		} else {
+			assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), origin)
+		}
+	}
+
+	// Test: Any origin, but never with credentials
+	c, err = New(Config{AllowedOrigins: []string{"*"}})
+	require.NoError(t, err)
+	resp, _ := do(t, c, "GET", headers.Headers{"origin": "https://x.io"})
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, resp.Header.Get("Vary"))
+	_, err = New(Config{AllowedOrigins: []string{"https://a.io", "*"}, AllowCredentials: true})
+	assert.ErrorIs(t, err, ErrWildcardCredentials)
+
+	// Test: Credentialed origins are echoed
+	c, err = New(Config{AllowedOrigins: []string{"https://*.io"}, AllowCredentials: true, ExposedHeaders: []string{"X-Total"}})
+	require.NoError(t, err)
+	resp, _ = do(t, c, "GET", headers.Headers{"origin": "https://x.io"})
+	assert.Equal(t, "https://x.io", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "X-Total", resp.Header.Get("Access-Control-Expose-Headers"))
+	assert.Equal(t, "Origin", resp.Header.Get("Vary"))
+	resp, _ = do(t, c, "GET", headers.Headers{"origin": "null"})
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestPreflight(t *testing.T) {
+	c, err := New(Config{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type", "X-Request-Id"},
+		MaxAge:         10 * time.Minute,
+	})
+	require.NoError(t, err)
+	preflight := func(origin, method, reqHeaders string) *http.Response {
+		h := headers.Headers{"origin": origin, "access-control-request-method": method}
+		if reqHeaders != "" {
+			h["access-control-request-headers"] = reqHeaders
+		}
+		resp, reached := do(t, c, "OPTIONS", h)
+		assert.False(t, reached, "preflight reached the handler")
+		assert.Equal(t, 204, resp.StatusCode)
+		return resp
+	}
+
+	resp := preflight("https://app.example.com", "PUT", "content-type, X-Request-ID")
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "PUT", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "content-type, x-request-id", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+	assert.Equal(t, "Origin, Access-Control-Request-Method, Access-Control-Request-Headers", resp.Header.Get("Vary"))
+
+	// Test: Refused preflights carry no CORS headers
+	for _, tc := range [][3]string{
+		{"https://other.com", "PUT", ""},
+		{"https://app.example.com", "DELETE", ""},
+		{"https://app.example.com", "PUT", "authorization"},
+	} {
+		resp := preflight(tc[0], tc[1], tc[2])
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), tc)
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Methods"), tc)
+	}
+
+	// Test: A plain OPTIONS request is the handler's
+	_, reached := do(t, c, "OPTIONS", headers.Headers{"origin": "https://app.example.com"})
+	assert.True(t, reached)
+}
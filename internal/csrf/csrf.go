@@ -0,0 +1,290 @@
+// Package csrf protects form handling from cross-site request forgery.
+// unsafe requests must come from the site's own origin, going by
+// Sec-Fetch-Site and Origin, and carry a token matching a secret the
+// client can't be made to send from elsewhere: kept in the session
+// (synchronizer token) or, without sessions, in a cookie (double submit).
+package csrf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/cookie"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+	"github.com/devwelkin/hermes-lite/internal/session"
+)
+
+// reasons a request is refused, passed to Config.ErrorHandler.
+var (
+	ErrCrossOrigin = errors.New("cross-origin request")
+	ErrNoToken     = errors.New("CSRF token missing")
+	ErrBadToken    = errors.New("CSRF token invalid")
+)
+
+// Defaults for the zero Config fields.
+const (
+	DefaultCookieName = "csrf"
+	DefaultHeaderName = "X-CSRF-Token"
+	DefaultFieldName  = "csrf_token"
+)
+
+// sessionKey is where the secret lives in a session.
+const sessionKey = "_csrf"
+
+const secretLen = 32
+
+// Config configures the middleware.
+type Config struct {
+	// CookieName holds the secret when there is no session, defaults to
+	// DefaultCookieName, or "__Host-" + DefaultCookieName with Secure so
+	// that a sibling subdomain can't plant one.
+	CookieName string
+	Secure     bool
+	// HeaderName and FieldName are where the token is looked for, the
+	// header first, for scripts, then the form field.
+	HeaderName string
+	FieldName  string
+	// TrustedOrigins may send unsafe requests besides the site itself,
+	// e.g. "https://admin.example.com".
+	TrustedOrigins []string
+	// Route names the route of a request for ExemptRoutes, routes listed
+	// there aren't checked, webhooks say.
+	Route        server.RouteFunc
+	ExemptRoutes []string
+	// ErrorHandler answers refused requests, 403 with the reason if nil.
+	ErrorHandler func(w *response.Writer, req *request.Request, err error)
+}
+
+// CSRF is the middleware state.
+type CSRF struct {
+	cfg Config
+}
+
+// New creates the middleware state from cfg.
+func New(cfg Config) *CSRF {
+	if cfg.CookieName == "" {
+		cfg.CookieName = DefaultCookieName
+		if cfg.Secure {
+			cfg.CookieName = "__Host-" + DefaultCookieName
+		}
+	}
+	if cfg.HeaderName == "" {
+		cfg.HeaderName = DefaultHeaderName
+	}
+	if cfg.FieldName == "" {
+		cfg.FieldName = DefaultFieldName
+	}
+	if cfg.ErrorHandler == nil {
+		cfg.ErrorHandler = forbidden
+	}
+	return &CSRF{cfg: cfg}
+}
+
+func forbidden(w *response.Writer, _ *request.Request, err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	_ = w.WriteStatusLine(response.StatusForbidden)
+	_, _ = w.Write([]byte(response.StatusText(response.StatusForbidden) + ": " + err.Error() + "\n"))
+}
+
+// state is what the middleware leaves on the request for the helpers.
+type state struct {
+	c      *CSRF
+	w      *response.Writer
+	req    *request.Request
+	secret []byte // nil until a token is asked for
+}
+
+// get returns the client's secret, making one the first time if it has
+// none, so clients that never see a form aren't given one.
+func (st *state) get() []byte {
+	if st.secret == nil {
+		st.secret = st.c.secret(st.w, st.req)
+	}
+	return st.secret
+}
+
+type ctxKey struct{}
+
+// Token returns a token for the request's secret, to put in forms or hand
+// to scripts. it is different every call, masked with a fresh pad, so a
+// compressed page doesn't leak the secret (BREACH). "" outside the
+// middleware. a client without a secret is given one here, so call it
+// before the response headers go out.
+func Token(req *request.Request) string {
+	st, ok := req.Context().Value(ctxKey{}).(*state)
+	if !ok {
+		return ""
+	}
+	return mask(st.get())
+}
+
+// TemplateField returns a hidden input with the token, ready to go in a
+// <form>.
+func TemplateField(req *request.Request) string {
+	st, ok := req.Context().Value(ctxKey{}).(*state)
+	if !ok {
+		return ""
+	}
+	return `<input type="hidden" name="` + html.EscapeString(st.c.cfg.FieldName) + `" value="` + mask(st.get()) + `">`
+}
+
+// safe methods don't change anything, so need no protection.
+func safe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// Middleware checks unsafe requests and lets handlers hand out tokens. it
+// goes after the session middleware, when there is one.
+func (c *CSRF) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			st := &state{c: c, w: w, req: req}
+			req.SetContext(context.WithValue(req.Context(), ctxKey{}, st))
+
+			if !safe(req.RequestLine.Method) && !c.exempt(req) {
+				st.secret = c.stored(req)
+				if err := c.check(req, st.secret); err != nil {
+					c.cfg.ErrorHandler(w, req, err)
+					return
+				}
+			}
+			next(w, req)
+		}
+	}
+}
+
+func (c *CSRF) exempt(req *request.Request) bool {
+	return c.cfg.Route != nil && slices.Contains(c.cfg.ExemptRoutes, c.cfg.Route(req))
+}
+
+// stored returns the client's secret from the session or the cookie, nil
+// if it has none.
+func (c *CSRF) stored(req *request.Request) []byte {
+	var v string
+	if s := session.Get(req); s != nil {
+		v, _ = s.Value(sessionKey)
+	} else if ck, ok := req.Cookie(c.cfg.CookieName); ok {
+		v = ck.Value
+	}
+	if secret, err := base64.RawURLEncoding.DecodeString(v); err == nil && len(secret) == secretLen {
+		return secret
+	}
+	return nil
+}
+
+// secret returns the client's secret, making one if there is none yet.
+func (c *CSRF) secret(w *response.Writer, req *request.Request) []byte {
+	if secret := c.stored(req); secret != nil {
+		return secret
+	}
+	secret := randomBytes(secretLen)
+	if s := session.Get(req); s != nil {
+		s.Set(sessionKey, base64.RawURLEncoding.EncodeToString(secret))
+		return secret
+	}
+	_ = w.SetCookie(&cookie.Cookie{
+		Name:     c.cfg.CookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(secret),
+		Path:     "/",
+		Secure:   c.cfg.Secure,
+		HttpOnly: true,
+		SameSite: cookie.SameSiteLax,
+	})
+	return secret
+}
+
+// check refuses cross-origin requests and requests without a token for
+// secret. a nil secret, the client has none yet, matches no token.
+func (c *CSRF) check(req *request.Request, secret []byte) error {
+	if err := c.checkOrigin(req); err != nil {
+		return err
+	}
+	token := req.Headers[strings.ToLower(c.cfg.HeaderName)]
+	if token == "" {
+		token = req.FormValue(c.cfg.FieldName)
+	}
+	if token == "" {
+		return ErrNoToken
+	}
+	got, ok := unmask(token)
+	if !ok || subtle.ConstantTimeCompare(got, secret) != 1 {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// checkOrigin trusts Sec-Fetch-Site where browsers send it and falls back
+// to Origin. requests with neither, from old browsers or non-browser
+// clients, are left to the token.
+func (c *CSRF) checkOrigin(req *request.Request) error {
+	origin := req.Headers["origin"]
+	if origin != "" && slices.Contains(c.cfg.TrustedOrigins, origin) {
+		return nil
+	}
+	switch req.Headers["sec-fetch-site"] {
+	case "same-origin", "none":
+		// none is the user typing the address or using a bookmark
+		return nil
+	case "":
+	default:
+		return ErrCrossOrigin
+	}
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		// including "null", from sandboxed frames and some redirects
+		return ErrCrossOrigin
+	}
+	host := req.Headers["host"]
+	if host == "" {
+		host = req.RequestLine.URL.Host
+	}
+	if !strings.EqualFold(u.Host, host) {
+		return ErrCrossOrigin
+	}
+	return nil
+}
+
+// mask returns pad || pad^secret, base64url.
+func mask(secret []byte) string {
+	pad := randomBytes(len(secret))
+	out := make([]byte, 2*len(secret))
+	copy(out, pad)
+	for i, b := range secret {
+		out[len(secret)+i] = pad[i] ^ b
+	}
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+func unmask(token string) ([]byte, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != 2*secretLen {
+		return nil, false
+	}
+	secret := make([]byte, secretLen)
+	for i := range secret {
+		secret[i] = raw[i] ^ raw[secretLen+i]
+	}
+	return secret, true
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
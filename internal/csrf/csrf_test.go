@@ -0,0 +1,206 @@
+package csrf
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+	"github.com/devwelkin/hermes-lite/internal/servertest"
+	"github.com/devwelkin/hermes-lite/internal/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// client is a browser with a cookie jar.
+type client struct {
+	t       *testing.T
+	handler server.Handler
+	jar     map[string]string
+	// token is the last token the handler handed out
+	token string
+}
+
+func newClient(t *testing.T, mws ...server.Middleware) *client {
+	c := &client{t: t, jar: map[string]string{}}
+	c.handler = server.Chain(func(w *response.Writer, req *request.Request) {
+		c.token = Token(req)
+		_, _ = w.Write([]byte(TemplateField(req)))
+	}, mws...)
+	return c
+}
+
+func (c *client) do(method, path string, h headers.Headers, body string) *http.Response {
+	c.t.Helper()
+	if h == nil {
+		h = headers.Headers{}
+	}
+	h["host"] = "example.com"
+	var pairs []string
+	for k, v := range c.jar {
+		pairs = append(pairs, k+"="+v)
+	}
+	if len(pairs) > 0 {
+		h["cookie"] = strings.Join(pairs, "; ")
+	}
+	if body != "" {
+		h["content-length"] = strconv.Itoa(len(body))
+	}
+	u, err := request.ParseTarget(method, path)
+	require.NoError(c.t, err)
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: path, URL: u},
+		Headers:     h,
+		Body:        []byte(body),
+	}
+
+	resp := servertest.Do(c.t, c.handler, req)
+	for _, ck := range resp.Cookies() {
+		c.jar[ck.Name] = ck.Value
+	}
+	return resp
+}
+
+func TestDoubleSubmit(t *testing.T) {
+	c := newClient(t, New(Config{}).Middleware())
+
+	resp := c.do("GET", "/form", nil, "")
+	assert.Equal(t, 200, resp.StatusCode)
+	require.Contains(t, c.jar, DefaultCookieName)
+	require.NotEmpty(t, c.token)
+	page := c.token
+
+	// Test: The token works in the header and in the form, masked anew
+	// every time
+	resp = c.do("POST", "/submit", headers.Headers{"x-csrf-token": page}, "")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NotEqual(t, page, c.token)
+	form := url.Values{"name": {"x"}, DefaultFieldName: {c.token}}.Encode()
+	resp = c.do("POST", "/submit", headers.Headers{"content-type": "application/x-www-form-urlencoded"}, form)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: Missing, forged and foreign tokens
+	resp = c.do("POST", "/submit", nil, "")
+	assert.Equal(t, 403, resp.StatusCode)
+	body := new(strings.Builder)
+	_, _ = bufio.NewReader(resp.Body).WriteTo(body)
+	assert.Equal(t, "Forbidden: CSRF token missing\n", body.String())
+	resp = c.do("POST", "/submit", headers.Headers{"x-csrf-token": "AAAA"}, "")
+	assert.Equal(t, 403, resp.StatusCode)
+
+	other := newClient(t, New(Config{}).Middleware())
+	other.do("GET", "/form", nil, "")
+	resp = c.do("DELETE", "/thing", headers.Headers{"x-csrf-token": other.token}, "")
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: Without the cookie no token is any good
+	delete(c.jar, DefaultCookieName)
+	resp = c.do("POST", "/submit", headers.Headers{"x-csrf-token": page}, "")
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestSynchronizer(t *testing.T) {
+	sessions := session.New(session.Config{Store: session.NewMemoryStore()})
+	c := newClient(t, sessions.Middleware(), New(Config{}).Middleware())
+
+	c.do("GET", "/form", nil, "")
+	assert.NotContains(t, c.jar, DefaultCookieName, "the secret lives in the session")
+	require.Contains(t, c.jar, session.DefaultCookieName)
+	resp := c.do("PUT", "/thing", headers.Headers{"x-csrf-token": c.token}, "")
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: A new session means a new secret
+	token := c.token
+	delete(c.jar, session.DefaultCookieName)
+	resp = c.do("PUT", "/thing", headers.Headers{"x-csrf-token": token}, "")
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestLazySecret(t *testing.T) {
+	sessions := session.New(session.Config{Store: session.NewMemoryStore()})
+	plain := func(w *response.Writer, req *request.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}
+
+	// Test: Pages that hand out no token store nothing, with or without
+	// sessions
+	for _, h := range []server.Handler{
+		server.Chain(plain, sessions.Middleware(), New(Config{}).Middleware()),
+		server.Chain(plain, New(Config{}).Middleware()),
+	} {
+		resp := servertest.Do(t, h, &request.Request{RequestLine: request.RequestLine{Method: "GET"}})
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Empty(t, resp.Cookies())
+
+		// nor does a refused unsafe request
+		resp = servertest.Do(t, h, &request.Request{RequestLine: request.RequestLine{Method: "POST"}, Headers: headers.Headers{}})
+		assert.Equal(t, 403, resp.StatusCode)
+		assert.Empty(t, resp.Cookies())
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	var reason error
+	c := newClient(t, New(Config{
+		Secure:         true,
+		TrustedOrigins: []string{"https://admin.example.com"},
+		Route:          func(req *request.Request) string { return req.RequestLine.URL.Path },
+		ExemptRoutes:   []string{"/webhook"},
+		ErrorHandler: func(w *response.Writer, _ *request.Request, err error) {
+			reason = err
+			_ = w.WriteStatusLine(response.StatusBadRequest)
+		},
+	}).Middleware())
+	c.do("GET", "/", nil, "")
+	require.Contains(t, c.jar, "__Host-csrf")
+
+	for _, tc := range []struct {
+		h   headers.Headers
+		err error
+	}{
+		{headers.Headers{"sec-fetch-site": "same-origin", "origin": "https://example.com"}, nil},
+		{headers.Headers{"sec-fetch-site": "none"}, nil},
+		{headers.Headers{"origin": "https://EXAMPLE.com"}, nil},
+		{headers.Headers{"origin": "https://admin.example.com", "sec-fetch-site": "same-site"}, nil},
+		{headers.Headers{"sec-fetch-site": "cross-site", "origin": "https://example.com"}, ErrCrossOrigin},
+		{headers.Headers{"sec-fetch-site": "same-site"}, ErrCrossOrigin},
+		{headers.Headers{"origin": "https://evil.example"}, ErrCrossOrigin},
+		{headers.Headers{"origin": "null"}, ErrCrossOrigin},
+	} {
+		reason = nil
+		tc.h["x-csrf-token"] = c.token
+		resp := c.do("POST", "/submit", tc.h, "")
+		if tc.err == nil {
+			assert.Equal(t, 200, resp.StatusCode, tc.h)
+		} else {
+			assert.Equal(t, 400, resp.StatusCode, tc.h)
+			assert.ErrorIs(t, reason, tc.err, tc.h)
+		}
+	}
+
+	// Test: Exempt routes and safe methods aren't checked
+	resp := c.do("POST", "/webhook", headers.Headers{"sec-fetch-site": "cross-site"}, "")
+	assert.Equal(t, 200, resp.StatusCode)
+	resp = c.do("GET", "/submit", headers.Headers{"sec-fetch-site": "cross-site"}, "")
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestTemplateField(t *testing.T) {
+	c := newClient(t, New(Config{FieldName: `a"b`}).Middleware())
+	resp := c.do("GET", "/", nil, "")
+	body := new(strings.Builder)
+	_, _ = bufio.NewReader(resp.Body).WriteTo(body)
+	assert.Regexp(t, regexp.MustCompile(`^<input type="hidden" name="a&#34;b" value="[\w-]{86}">$`), body.String())
+
+	// outside the middleware there is nothing to hand out
+	req := &request.Request{}
+	assert.Empty(t, Token(req))
+	assert.Empty(t, TemplateField(req))
+}
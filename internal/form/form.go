@@ -0,0 +1,246 @@
+// Package form parses request bodies sent by HTML forms:
+// application/x-www-form-urlencoded and multipart/form-data.
+package form
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+)
+
+// Custom errors
+var (
+	ErrNotForm       = errors.New("not a form content type")
+	ErrMalformed     = errors.New("malformed form body")
+	ErrTooManyParts  = errors.New("too many form fields")
+	ErrFieldTooLarge = errors.New("form field too large")
+	ErrBodyTooLarge  = errors.New("form body too large")
+)
+
+// Limits bounds what a form may cost to parse. zero fields take the value
+// from DefaultLimits.
+type Limits struct {
+	// MaxParts is the most fields (and files) a form may have.
+	MaxParts int
+	// MaxFieldSize is the longest a non-file value may be.
+	MaxFieldSize int64
+	// MaxTotalSize is the most bytes of field and file content in total.
+	MaxTotalSize int64
+	// MaxMemory is how many bytes of file content are kept in memory,
+	// files past it spill to temporary files.
+	MaxMemory int64
+}
+
+// DefaultLimits are used when no limits are given.
+var DefaultLimits = Limits{
+	MaxParts:     1000,
+	MaxFieldSize: 1 << 20,
+	MaxTotalSize: 32 << 20,
+	MaxMemory:    10 << 20,
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxParts <= 0 {
+		l.MaxParts = DefaultLimits.MaxParts
+	}
+	if l.MaxFieldSize <= 0 {
+		l.MaxFieldSize = DefaultLimits.MaxFieldSize
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = DefaultLimits.MaxTotalSize
+	}
+	if l.MaxMemory <= 0 {
+		l.MaxMemory = DefaultLimits.MaxMemory
+	}
+	return l
+}
+
+// Values maps field names to their values, in the order they were sent.
+type Values map[string][]string
+
+// Get returns the first value for key, "" if there is none.
+func (v Values) Get(key string) string {
+	if vs := v[key]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// Add appends value to key.
+func (v Values) Add(key, value string) {
+	v[key] = append(v[key], value)
+}
+
+// Form is a parsed form body.
+type Form struct {
+	Value Values
+	File  map[string][]*FileHeader
+}
+
+// RemoveAll deletes the temporary files of spilled file parts.
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, fhs := range f.File {
+		for _, fh := range fhs {
+			if fh.tmpfile != "" {
+				if err := os.Remove(fh.tmpfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileHeader describes an uploaded file.
+type FileHeader struct {
+	// Filename is the client's file name reduced to a safe base name, see
+	// SanitizeFilename. never use it as a path without further checks.
+	Filename string
+	Header   headers.Headers
+	Size     int64
+
+	content []byte // held in memory
+	tmpfile string // or spilled here
+}
+
+// File is an uploaded file opened for reading.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// Open opens the uploaded file.
+func (fh *FileHeader) Open() (File, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return nopCloser{bytes.NewReader(fh.content)}, nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Parse parses body according to contentType, either kind of form.
+func Parse(contentType string, body io.Reader, lim Limits) (*Form, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrNotForm, contentType)
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		lim = lim.withDefaults()
+		b, err := io.ReadAll(io.LimitReader(body, lim.MaxTotalSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(b)) > lim.MaxTotalSize {
+			return nil, ErrBodyTooLarge
+		}
+		values, err := ParseURLEncoded(string(b), lim)
+		if err != nil {
+			return nil, err
+		}
+		return &Form{Value: values, File: map[string][]*FileHeader{}}, nil
+	case "multipart/form-data":
+		boundary := params["boundary"]
+		if boundary == "" {
+			return nil, fmt.Errorf("%w: no boundary", ErrMalformed)
+		}
+		return NewReader(body, boundary).ReadForm(lim)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrNotForm, mediaType)
+}
+
+// MultipartBoundary returns the boundary of a multipart/form-data content
+// type.
+func MultipartBoundary(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" {
+		return "", fmt.Errorf("%w: %q", ErrNotForm, contentType)
+	}
+	if params["boundary"] == "" {
+		return "", fmt.Errorf("%w: no boundary", ErrMalformed)
+	}
+	return params["boundary"], nil
+}
+
+// ParseURLEncoded parses an application/x-www-form-urlencoded string.
+func ParseURLEncoded(s string, lim Limits) (Values, error) {
+	lim = lim.withDefaults()
+	values := Values{}
+	parts := 0
+	for pair := range strings.SplitSeq(s, "&") {
+		if pair == "" {
+			continue
+		}
+		if parts++; parts > lim.MaxParts {
+			return nil, ErrTooManyParts
+		}
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := Unescape(rawKey)
+		if err != nil {
+			return nil, err
+		}
+		value, err := Unescape(rawValue)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(value)) > lim.MaxFieldSize {
+			return nil, fmt.Errorf("%w: %q", ErrFieldTooLarge, key)
+		}
+		values.Add(key, value)
+	}
+	return values, nil
+}
+
+// Unescape decodes a urlencoded component: %XX escapes and + for space.
+func Unescape(s string) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '+':
+			b.WriteByte(' ')
+		case '%':
+			if i+2 >= len(s) || !IsHex(s[i+1]) || !IsHex(s[i+2]) {
+				return "", fmt.Errorf("%w: bad escape in %q", ErrMalformed, s)
+			}
+			b.WriteByte(Unhex(s[i+1])<<4 | Unhex(s[i+2]))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// IsHex reports whether c is a hex digit, as in a %XX escape.
+func IsHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// Unhex returns the value of the hex digit c.
+func Unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
@@ -0,0 +1,158 @@
+package form
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURLEncoded(t *testing.T) {
+	// Test: Escapes, plus signs, repeats and empty values
+	v, err := ParseURLEncoded("name=J%C3%BCrgen+M&tag=a&tag=b&empty=&flag&&x%26y=1", Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, "Jürgen M", v.Get("name"))
+	assert.Equal(t, []string{"a", "b"}, v["tag"])
+	assert.Equal(t, []string{""}, v["empty"])
+	assert.Equal(t, []string{""}, v["flag"])
+	assert.Equal(t, "1", v.Get("x&y"))
+	assert.Equal(t, "", v.Get("missing"))
+
+	// Test: Bad escapes and limits
+	_, err = ParseURLEncoded("a=%zz", Limits{})
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, err = ParseURLEncoded("a=%4", Limits{})
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, err = ParseURLEncoded("a=1&b=2&c=3", Limits{MaxParts: 2})
+	assert.ErrorIs(t, err, ErrTooManyParts)
+	_, err = ParseURLEncoded("a=12345", Limits{MaxFieldSize: 4})
+	assert.ErrorIs(t, err, ErrFieldTooLarge)
+
+	_, err = Parse("application/x-www-form-urlencoded", strings.NewReader("a=12345"), Limits{MaxTotalSize: 4})
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	_, err = Parse("application/json", strings.NewReader("{}"), Limits{})
+	assert.ErrorIs(t, err, ErrNotForm)
+}
+
+const boundary = "xYzZY"
+
+// multipartBody builds a body from alternating header blocks and contents.
+func multipartBody(parts ...string) string {
+	var b strings.Builder
+	b.WriteString("preamble to ignore\r\n")
+	for i := 0; i < len(parts); i += 2 {
+		b.WriteString("--" + boundary + "\r\n" + parts[i] + "\r\n\r\n" + parts[i+1] + "\r\n")
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+	return b.String()
+}
+
+func TestReadForm(t *testing.T) {
+	big := strings.Repeat("0123456789", 2000)
+	body := multipartBody(
+		`Content-Disposition: form-data; name="title"`, "hello\r\nworld",
+		`Content-Disposition: form-data; name="doc"; filename="C:/Users/me/notes.txt"`+"\r\nContent-Type: text/plain", "small file",
+		`Content-Disposition: form-data; name="doc"; filename="../../big.bin"`, big,
+	)
+	// one byte reads make sure the delimiter is found across buffer refills
+	r := NewReader(iotest.OneByteReader(strings.NewReader(body)), boundary)
+	f, err := r.ReadForm(Limits{MaxMemory: 1000})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = f.RemoveAll() })
+
+	assert.Equal(t, "hello\r\nworld", f.Value.Get("title"))
+	require.Len(t, f.File["doc"], 2)
+
+	small := f.File["doc"][0]
+	assert.Equal(t, "notes.txt", small.Filename)
+	assert.Equal(t, "text/plain", small.Header["content-type"])
+	assert.Empty(t, small.tmpfile)
+	file, err := small.Open()
+	require.NoError(t, err)
+	got, _ := io.ReadAll(file)
+	assert.Equal(t, "small file", string(got))
+
+	// Test: A file over the memory budget spills to disk
+	spilled := f.File["doc"][1]
+	assert.Equal(t, "big.bin", spilled.Filename)
+	assert.Equal(t, int64(len(big)), spilled.Size)
+	require.NotEmpty(t, spilled.tmpfile)
+	file, err = spilled.Open()
+	require.NoError(t, err)
+	got, _ = io.ReadAll(file)
+	_ = file.Close()
+	assert.Equal(t, big, string(got))
+
+	require.NoError(t, f.RemoveAll())
+	_, err = os.Stat(spilled.tmpfile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReadFormLimits(t *testing.T) {
+	field := func(name, value string) []string {
+		return []string{`Content-Disposition: form-data; name="` + name + `"`, value}
+	}
+	read := func(lim Limits, parts ...string) error {
+		_, err := NewReader(strings.NewReader(multipartBody(parts...)), boundary).ReadForm(lim)
+		return err
+	}
+
+	parts := append(field("a", "1"), field("b", "2")...)
+	assert.ErrorIs(t, read(Limits{MaxParts: 1}, parts...), ErrTooManyParts)
+	assert.ErrorIs(t, read(Limits{MaxFieldSize: 3}, field("a", "1234")...), ErrFieldTooLarge)
+	assert.ErrorIs(t, read(Limits{MaxTotalSize: 5}, append(field("a", "123"), field("b", "456")...)...), ErrBodyTooLarge)
+	file := []string{`Content-Disposition: form-data; name="f"; filename="x"`, strings.Repeat("x", 100)}
+	assert.ErrorIs(t, read(Limits{MaxTotalSize: 50}, file...), ErrBodyTooLarge)
+	assert.ErrorIs(t, read(Limits{MaxTotalSize: 50, MaxMemory: 10}, file...), ErrBodyTooLarge)
+
+	// Test: Broken bodies
+	assert.ErrorIs(t, read(Limits{}, "Content-Disposition: attachment", "x"), ErrMalformed)
+	_, err := NewReader(strings.NewReader("--"+boundary+"\r\nContent-Disposition: form-data; name=a\r\n\r\nno end"),
+		boundary).ReadForm(Limits{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestNextPartStreaming(t *testing.T) {
+	body := multipartBody(
+		`Content-Disposition: form-data; name="skipped"`, "never read",
+		`Content-Disposition: form-data; name="file"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`, "pdf bytes",
+	)
+	// no CRLF after the closing boundary
+	r := NewReader(strings.NewReader(strings.TrimSuffix(body, "\r\n")), boundary)
+
+	p, err := r.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "skipped", p.Name)
+	assert.False(t, p.IsFile())
+
+	p, err = r.NextPart()
+	require.NoError(t, err)
+	assert.True(t, p.IsFile())
+	assert.Equal(t, "résumé.pdf", p.Filename)
+	got, err := io.ReadAll(p)
+	require.NoError(t, err)
+	assert.Equal(t, "pdf bytes", string(got))
+
+	_, err = r.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for in, want := range map[string]string{
+		"report.pdf":             "report.pdf",
+		`C:\Users\me\a.txt`:      "a.txt",
+		"../../etc/passwd":       "passwd",
+		"..":                     "unnamed",
+		"":                       "unnamed",
+		"dir/":                   "unnamed",
+		"evil\x00name\r\n.txt":   "evilname.txt",
+		"  spaced.txt ":          "spaced.txt",
+		strings.Repeat("é", 200): strings.Repeat("é", 127),
+	} {
+		assert.Equal(t, want, SanitizeFilename(in), "%q", in)
+	}
+}
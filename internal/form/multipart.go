@@ -0,0 +1,307 @@
+package form
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+)
+
+const (
+	// readerSize is the buffer the body is scanned through. it has to hold
+	// a whole delimiter and a part header line.
+	readerSize = 8 << 10
+	// maxHeaderBytes bounds the header block of a single part.
+	maxHeaderBytes = 16 << 10
+	// maxFilenameLen is the longest sanitized file name, in bytes.
+	maxFilenameLen = 255
+)
+
+// Reader reads a multipart/form-data body one part at a time, so a handler
+// can stream large uploads instead of holding them.
+type Reader struct {
+	br            *bufio.Reader
+	dashBoundary  string // "--boundary"
+	delim         []byte // "\r\n--boundary", ends a part's content
+	part          *Part
+	started, done bool
+}
+
+// NewReader creates a Reader for a body with the given boundary.
+func NewReader(r io.Reader, boundary string) *Reader {
+	return &Reader{
+		br:           bufio.NewReaderSize(r, readerSize),
+		dashBoundary: "--" + boundary,
+		delim:        []byte("\r\n--" + boundary),
+	}
+}
+
+// Part is one part of a multipart body. Read returns its content.
+type Part struct {
+	Header headers.Headers
+	// Name is the form field name.
+	Name string
+	// Filename is the sanitized file name, "" for a plain field.
+	Filename string
+	isFile   bool
+
+	r   *Reader
+	eof bool
+}
+
+// IsFile reports whether the part is a file upload.
+func (p *Part) IsFile() bool {
+	return p.isFile
+}
+
+// NextPart returns the next part, io.EOF after the last one. the rest of
+// the previous part is skipped.
+func (r *Reader) NextPart() (*Part, error) {
+	if r.part != nil {
+		if _, err := io.Copy(io.Discard, r.part); err != nil {
+			return nil, err
+		}
+		r.part = nil
+		// the part stopped just before its delimiter's CRLF
+		if _, err := r.br.Discard(2); err != nil {
+			return nil, unexpected(err)
+		}
+	}
+	if r.done {
+		return nil, io.EOF
+	}
+
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		line = strings.TrimRight(line, " \t") // transport padding
+		switch {
+		case line == r.dashBoundary:
+		case line == r.dashBoundary+"--":
+			r.done = true
+			return nil, io.EOF
+		case !r.started:
+			// preamble, ignored
+			continue
+		default:
+			return nil, fmt.Errorf("%w: expected boundary", ErrMalformed)
+		}
+		break
+	}
+	r.started = true
+
+	p, err := r.readPartHeader()
+	if err != nil {
+		return nil, err
+	}
+	r.part = p
+	return p, nil
+}
+
+// readLine reads a line without its line ending. lines too long for the
+// buffer come back in pieces, they can't be a boundary anyway.
+func (r *Reader) readLine() (string, error) {
+	line, err := r.br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || (err == io.EOF && len(line) > 0) {
+		// the closing boundary may be missing its CRLF
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+func (r *Reader) readPartHeader() (*Part, error) {
+	h := headers.NewHeaders()
+	size := 0
+	for {
+		line, err := r.br.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return nil, fmt.Errorf("%w: part header line too long", ErrMalformed)
+			}
+			return nil, unexpected(err)
+		}
+		if size += len(line); size > maxHeaderBytes {
+			return nil, fmt.Errorf("%w: part header too large", ErrMalformed)
+		}
+		// headers.Parse wants CRLF, tolerate a bare LF like most parsers
+		if !bytes.HasSuffix(line, []byte("\r\n")) {
+			line = append(bytes.TrimSuffix(line, []byte("\n")), '\r', '\n')
+		}
+		_, done, err := h.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+		if done {
+			break
+		}
+	}
+
+	p := &Part{Header: h, r: r}
+	disposition, params, err := mime.ParseMediaType(h["content-disposition"])
+	if err != nil || disposition != "form-data" || params["name"] == "" {
+		return nil, fmt.Errorf("%w: bad content-disposition %q", ErrMalformed, h["content-disposition"])
+	}
+	p.Name = params["name"]
+	if filename, ok := params["filename"]; ok {
+		// mime decodes filename* (RFC 5987) into filename as well
+		p.isFile = true
+		p.Filename = SanitizeFilename(filename)
+	}
+	return p, nil
+}
+
+// Read reads the part's content.
+func (p *Part) Read(b []byte) (int, error) {
+	if p.eof {
+		return 0, io.EOF
+	}
+	br, delim := p.r.br, p.r.delim
+	peek, err := br.Peek(readerSize)
+	if i := bytes.Index(peek, delim); i >= 0 {
+		if i == 0 {
+			p.eof = true
+			return 0, io.EOF
+		}
+		n := copy(b, peek[:i])
+		_, _ = br.Discard(n)
+		return n, nil
+	}
+	if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+		// the body ended inside a part
+		return 0, unexpected(err)
+	}
+	// hold back anything that could be the start of the delimiter
+	n := copy(b, peek[:len(peek)-len(delim)+1])
+	_, _ = br.Discard(n)
+	return n, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return fmt.Errorf("%w: %w", ErrMalformed, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// ReadForm reads the whole body into a Form within lim. files over the
+// memory budget are written to temporary files, call Form.RemoveAll when
+// done with them.
+func (r *Reader) ReadForm(lim Limits) (_ *Form, err error) {
+	lim = lim.withDefaults()
+	f := &Form{Value: Values{}, File: map[string][]*FileHeader{}}
+	defer func() {
+		if err != nil {
+			_ = f.RemoveAll()
+		}
+	}()
+
+	var parts int
+	total, memory := lim.MaxTotalSize, lim.MaxMemory
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			return f, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if parts++; parts > lim.MaxParts {
+			return nil, ErrTooManyParts
+		}
+
+		if !p.IsFile() {
+			max := min(lim.MaxFieldSize, total)
+			b, err := io.ReadAll(io.LimitReader(p, max+1))
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(b)) > max {
+				if max == total {
+					return nil, ErrBodyTooLarge
+				}
+				return nil, fmt.Errorf("%w: %q", ErrFieldTooLarge, p.Name)
+			}
+			total -= int64(len(b))
+			f.Value.Add(p.Name, string(b))
+			continue
+		}
+
+		fh := &FileHeader{Filename: p.Filename, Header: p.Header}
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, p, min(memory, total)+1)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n > memory && n <= total {
+			// over the memory budget, the rest goes to disk
+			if err := fh.spill(&buf, p, total); err != nil {
+				return nil, err
+			}
+		} else {
+			fh.content = buf.Bytes()
+			fh.Size = n
+			memory -= n
+		}
+		if fh.Size > total {
+			return nil, ErrBodyTooLarge
+		}
+		total -= fh.Size
+		f.File[p.Name] = append(f.File[p.Name], fh)
+	}
+}
+
+// spill writes what was read so far and the rest of p to a temporary file.
+// it stops reading one byte past limit.
+func (fh *FileHeader) spill(head *bytes.Buffer, p *Part, limit int64) error {
+	file, err := os.CreateTemp("", "hermes-upload-*")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fh.tmpfile = file.Name()
+
+	n, err := io.Copy(file, io.MultiReader(head, io.LimitReader(p, limit+1-int64(head.Len()))))
+	if err != nil {
+		return err
+	}
+	fh.Size = n
+	return nil
+}
+
+// SanitizeFilename reduces a client supplied file name to something safe
+// to show or to use as the last element of a path: the base name, without
+// control characters, at most 255 bytes. names that end up empty, or are
+// "." or "..", become "unnamed".
+func SanitizeFilename(name string) string {
+	// browsers on Windows send full paths
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	for len(name) > maxFilenameLen {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "unnamed"
+	}
+	return name
+}
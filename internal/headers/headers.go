@@ -3,8 +3,13 @@ package headers
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"strings"
 )
 
+// ErrInvalidHeader is returned for a field line that doesn't parse.
+var ErrInvalidHeader = errors.New("invalid header")
+
 type Headers map[string]string
 
 func NewHeaders() Headers {
@@ -27,11 +32,11 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 
 	colonIdx := bytes.IndexByte(line, ':')
 	if colonIdx == -1 {
-		return 0, false, errors.New("invalid header: no colon found")
+		return 0, false, fmt.Errorf("%w: no colon found", ErrInvalidHeader)
 	}
 
 	if colonIdx == 0 || line[colonIdx-1] == ' ' {
-		return 0, false, errors.New("invalid header")
+		return 0, false, ErrInvalidHeader
 	}
 
 	key := bytes.TrimSpace(line[:colonIdx])
@@ -42,7 +47,7 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		isSpecial := bytes.IndexByte([]byte("!#$%&'*+-.^_`|~"), b) != -1
 
 		if !isLetter && !isDigit && !isSpecial {
-			return 0, false, errors.New("invalid header key: invalid character")
+			return 0, false, fmt.Errorf("%w: invalid character in key", ErrInvalidHeader)
 		}
 	}
 
@@ -50,9 +55,14 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	key = bytes.ToLower(key)
 	value := bytes.TrimSpace(line[colonIdx+1:])
 
-	_, ok := h[string(key)]
-	if ok {
-		h[string(key)] += ", " + string(value)
+	if prev, ok := h[string(key)]; ok {
+		// repeats are comma-joined, except cookie which has its own
+		// separator (RFC 6265 5.4)
+		sep := ", "
+		if string(key) == "cookie" {
+			sep = "; "
+		}
+		h[string(key)] = prev + sep + string(value)
 		return idx + 2, false, nil
 	}
 
@@ -75,3 +85,71 @@ func (h Headers) Get(key string) (string, error) {
 func (h Headers) Set(key, value string) {
 	h[key] = value
 }
+
+// Add adds another value for key, for fields that can't be comma-joined
+// like Set-Cookie. the values are kept newline separated, a field value
+// can't hold a newline, and go out as separate field lines.
+func (h Headers) Add(key, value string) {
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			h[k] = v + "\n" + value
+			return
+		}
+	}
+	h[key] = value
+}
+
+// Values returns the values added for key, matching case-insensitively.
+func (h Headers) Values(key string) []string {
+	v, ok := h.Lookup(key)
+	if !ok {
+		return nil
+	}
+	return strings.Split(v, "\n")
+}
+
+// AddToken adds token to a comma separated list field like Vary, unless it
+// is already there (ignoring case).
+func (h Headers) AddToken(key, token string) {
+	for k, v := range h {
+		if !strings.EqualFold(k, key) {
+			continue
+		}
+		if v == "" {
+			h[k] = token
+			return
+		}
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); strings.EqualFold(t, token) || t == "*" {
+				return
+			}
+		}
+		h[k] = v + ", " + token
+		return
+	}
+	h[key] = token
+}
+
+// Lookup returns the value for key, matching the key case-insensitively.
+// parsed headers are always lowercase but response headers keep whatever
+// case they were Set with.
+func (h Headers) Lookup(key string) (string, bool) {
+	if v, ok := h[key]; ok {
+		return v, true
+	}
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Del removes key, matching case-insensitively.
+func (h Headers) Del(key string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
+}
@@ -75,3 +75,47 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 }
+
+func TestHeadersRepeats(t *testing.T) {
+	// Test: Repeated fields are comma-joined, cookies with a semicolon
+	h := NewHeaders()
+	data := []byte("Accept: a\r\nAccept: b\r\nCookie: x=1\r\nCookie: y=2\r\n\r\n")
+	for {
+		n, done, err := h.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, "a, b", h["accept"])
+	assert.Equal(t, "x=1; y=2", h["cookie"])
+
+	// Test: Add keeps every value
+	h = NewHeaders()
+	h.Add("Set-Cookie", "a=1")
+	h.Add("set-cookie", "b=2")
+	assert.Equal(t, []string{"a=1", "b=2"}, h.Values("SET-COOKIE"))
+	assert.Nil(t, h.Values("missing"))
+}
+
+func TestAddToken(t *testing.T) {
+	h := NewHeaders()
+	h.AddToken("Vary", "Accept")
+	h.AddToken("vary", "origin")
+	h.AddToken("Vary", "ACCEPT")
+	assert.Equal(t, "Accept, origin", h["Vary"])
+
+	// Test: A wildcard already covers everything
+	h = Headers{"Vary": "*"}
+	h.AddToken("Vary", "Accept")
+	assert.Equal(t, "*", h["Vary"])
+}
+
+func TestQuoted(t *testing.T) {
+	assert.Equal(t, []string{`a="x,y"`, " b=2", ""}, SplitQuoted(`a="x,y", b=2,`, ','))
+	assert.Equal(t, []string{`a="q\",;"`, "b"}, SplitQuoted(`a="q\",;";b`, ';'))
+	assert.Equal(t, `say "hi"`, Unquote(`"say \"hi\""`))
+	assert.Equal(t, "token", Unquote("token"))
+	assert.Equal(t, `"`, Unquote(`"`))
+}
@@ -0,0 +1,251 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frameType is the type octet of a frame header (RFC 9113 6).
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+// frame flags, their meaning depends on the type.
+const (
+	flagEndStream  uint8 = 0x1
+	flagAck        uint8 = 0x1
+	flagEndHeaders uint8 = 0x4
+	flagPadded     uint8 = 0x8
+	flagPriority   uint8 = 0x20
+)
+
+// settingID identifies a SETTINGS parameter (RFC 9113 6.5.2).
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+type setting struct {
+	id  settingID
+	val uint32
+}
+
+const (
+	frameHeaderLen = 9
+	// the connection preface every client opens with
+	clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	defaultMaxFrameSize   = 16384
+	maxAllowedFrameSize   = 1<<24 - 1
+	defaultWindowSize     = 65535
+	maxWindowSize         = 1<<31 - 1
+	defaultHeaderTableLen = 4096
+)
+
+// frameHeader is the fixed 9 octets in front of every frame.
+type frameHeader struct {
+	length   uint32
+	typ      frameType
+	flags    uint8
+	streamID uint32
+}
+
+func (h frameHeader) has(flag uint8) bool {
+	return h.flags&flag != 0
+}
+
+// frame is a frame with its payload still raw, padding removed.
+type frame struct {
+	frameHeader
+	payload []byte
+}
+
+// readFrame reads one frame. frames bigger than maxSize are a FRAME_SIZE_ERROR.
+func readFrame(r io.Reader, buf []byte, maxSize uint32) (frame, []byte, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, buf, err
+	}
+	fh := frameHeader{
+		length:   uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2]),
+		typ:      frameType(hdr[3]),
+		flags:    hdr[4],
+		streamID: binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1),
+	}
+	if fh.length > maxSize {
+		return frame{}, buf, connError(errCodeFrameSize, "frame of %d bytes over the %d limit", fh.length, maxSize)
+	}
+	if cap(buf) < int(fh.length) {
+		buf = make([]byte, fh.length)
+	}
+	payload := buf[:fh.length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, buf, err
+	}
+	f := frame{frameHeader: fh, payload: payload}
+	if err := f.unpad(); err != nil {
+		return frame{}, buf, err
+	}
+	return f, buf, nil
+}
+
+// unpad strips the padding of PADDED DATA and HEADERS frames.
+func (f *frame) unpad() error {
+	if (f.typ != frameData && f.typ != frameHeaders) || !f.has(flagPadded) {
+		return nil
+	}
+	if len(f.payload) < 1 {
+		return connError(errCodeFrameSize, "padded frame without pad length")
+	}
+	pad := int(f.payload[0])
+	if pad >= len(f.payload) {
+		return connError(errCodeProtocol, "padding longer than the frame")
+	}
+	f.payload = f.payload[1 : len(f.payload)-pad]
+	return nil
+}
+
+// appendFrame appends a frame header and payload to dst.
+func appendFrame(dst []byte, typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID&(1<<31-1))
+	return append(dst, payload...)
+}
+
+func parseSettings(f frame) ([]setting, error) {
+	if f.streamID != 0 {
+		return nil, connError(errCodeProtocol, "SETTINGS on stream %d", f.streamID)
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return nil, connError(errCodeFrameSize, "SETTINGS ack with a payload")
+		}
+		return nil, nil
+	}
+	if len(f.payload)%6 != 0 {
+		return nil, connError(errCodeFrameSize, "SETTINGS length %d", len(f.payload))
+	}
+	var out []setting
+	for p := f.payload; len(p) > 0; p = p[6:] {
+		s := setting{
+			id:  settingID(binary.BigEndian.Uint16(p)),
+			val: binary.BigEndian.Uint32(p[2:]),
+		}
+		switch s.id {
+		case settingEnablePush:
+			if s.val > 1 {
+				return nil, connError(errCodeProtocol, "ENABLE_PUSH %d", s.val)
+			}
+		case settingInitialWindowSize:
+			if s.val > maxWindowSize {
+				return nil, connError(errCodeFlowControl, "INITIAL_WINDOW_SIZE %d", s.val)
+			}
+		case settingMaxFrameSize:
+			if s.val < defaultMaxFrameSize || s.val > maxAllowedFrameSize {
+				return nil, connError(errCodeProtocol, "MAX_FRAME_SIZE %d", s.val)
+			}
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func appendSettings(dst []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.id))
+		dst = binary.BigEndian.AppendUint32(dst, s.val)
+	}
+	return dst
+}
+
+// errCode is an RFC 9113 7 error code, carried by RST_STREAM and GOAWAY.
+type errCode uint32
+
+const (
+	errCodeNo                 errCode = 0x0
+	errCodeProtocol           errCode = 0x1
+	errCodeInternal           errCode = 0x2
+	errCodeFlowControl        errCode = 0x3
+	errCodeSettingsTimeout    errCode = 0x4
+	errCodeStreamClosed       errCode = 0x5
+	errCodeFrameSize          errCode = 0x6
+	errCodeRefusedStream      errCode = 0x7
+	errCodeCancel             errCode = 0x8
+	errCodeCompression        errCode = 0x9
+	errCodeConnect            errCode = 0xa
+	errCodeEnhanceYourCalm    errCode = 0xb
+	errCodeInadequateSecurity errCode = 0xc
+	errCodeHTTP11Required     errCode = 0xd
+)
+
+var errCodeNames = map[errCode]string{
+	errCodeNo:                 "NO_ERROR",
+	errCodeProtocol:           "PROTOCOL_ERROR",
+	errCodeInternal:           "INTERNAL_ERROR",
+	errCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	errCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	errCodeStreamClosed:       "STREAM_CLOSED",
+	errCodeFrameSize:          "FRAME_SIZE_ERROR",
+	errCodeRefusedStream:      "REFUSED_STREAM",
+	errCodeCancel:             "CANCEL",
+	errCodeCompression:        "COMPRESSION_ERROR",
+	errCodeConnect:            "CONNECT_ERROR",
+	errCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	errCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	errCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c errCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(c))
+}
+
+// connErr is a connection error: the connection is torn down with GOAWAY.
+type connErr struct {
+	code   errCode
+	reason string
+}
+
+func (e connErr) Error() string {
+	return fmt.Sprintf("http2: connection error %v: %s", e.code, e.reason)
+}
+
+func connError(code errCode, format string, args ...any) error {
+	return connErr{code: code, reason: fmt.Sprintf(format, args...)}
+}
+
+// streamErr is a stream error: only that stream is reset.
+type streamErr struct {
+	streamID uint32
+	code     errCode
+	reason   string
+}
+
+func (e streamErr) Error() string {
+	return fmt.Sprintf("http2: stream %d error %v: %s", e.streamID, e.code, e.reason)
+}
+
+func streamError(id uint32, code errCode, format string, args ...any) error {
+	return streamErr{streamID: id, code: code, reason: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,407 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors from the header block decoder, all of them are connection errors
+// of type COMPRESSION_ERROR.
+var (
+	errHpackIndex     = errors.New("hpack: invalid index")
+	errHpackTruncated = errors.New("hpack: truncated header block")
+	errHpackInteger   = errors.New("hpack: integer overflow")
+	errHpackTableSize = errors.New("hpack: invalid dynamic table size update")
+	errHpackTooLarge  = errors.New("hpack: header list too large")
+)
+
+// headerField is one decoded or to be encoded header.
+type headerField struct {
+	name, value string
+	sensitive   bool // never indexed
+}
+
+// size is the RFC 7541 4.1 entry size.
+func (f headerField) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+// staticTable is RFC 7541 Appendix A, index 1 is staticTable[0].
+var staticTable = []headerField{
+	{name: ":authority"},
+	{name: ":method", value: "GET"},
+	{name: ":method", value: "POST"},
+	{name: ":path", value: "/"},
+	{name: ":path", value: "/index.html"},
+	{name: ":scheme", value: "http"},
+	{name: ":scheme", value: "https"},
+	{name: ":status", value: "200"},
+	{name: ":status", value: "204"},
+	{name: ":status", value: "206"},
+	{name: ":status", value: "304"},
+	{name: ":status", value: "400"},
+	{name: ":status", value: "404"},
+	{name: ":status", value: "500"},
+	{name: "accept-charset"},
+	{name: "accept-encoding", value: "gzip, deflate"},
+	{name: "accept-language"},
+	{name: "accept-ranges"},
+	{name: "accept"},
+	{name: "access-control-allow-origin"},
+	{name: "age"},
+	{name: "allow"},
+	{name: "authorization"},
+	{name: "cache-control"},
+	{name: "content-disposition"},
+	{name: "content-encoding"},
+	{name: "content-language"},
+	{name: "content-length"},
+	{name: "content-location"},
+	{name: "content-range"},
+	{name: "content-type"},
+	{name: "cookie"},
+	{name: "date"},
+	{name: "etag"},
+	{name: "expect"},
+	{name: "expires"},
+	{name: "from"},
+	{name: "host"},
+	{name: "if-match"},
+	{name: "if-modified-since"},
+	{name: "if-none-match"},
+	{name: "if-range"},
+	{name: "if-unmodified-since"},
+	{name: "last-modified"},
+	{name: "link"},
+	{name: "location"},
+	{name: "max-forwards"},
+	{name: "proxy-authenticate"},
+	{name: "proxy-authorization"},
+	{name: "range"},
+	{name: "referer"},
+	{name: "refresh"},
+	{name: "retry-after"},
+	{name: "server"},
+	{name: "set-cookie"},
+	{name: "strict-transport-security"},
+	{name: "transfer-encoding"},
+	{name: "user-agent"},
+	{name: "vary"},
+	{name: "via"},
+	{name: "www-authenticate"},
+}
+
+// dynamicTable is the FIFO of RFC 7541 2.3.2. newest entries sit at the end
+// of the slice, index 62 is the newest one.
+type dynamicTable struct {
+	entries []headerField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f headerField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits. an entry bigger than
+// the whole table empties it.
+func (t *dynamicTable) evict() {
+	i := 0
+	for t.size > t.maxSize && i < len(t.entries) {
+		t.size -= t.entries[i].size()
+		i++
+	}
+	if i > 0 {
+		t.entries = append(t.entries[:0], t.entries[i:]...)
+	}
+}
+
+// get returns the field at a 1-based HPACK index, static then dynamic.
+func (t *dynamicTable) get(idx uint64) (headerField, bool) {
+	if idx == 0 {
+		return headerField{}, false
+	}
+	if idx <= uint64(len(staticTable)) {
+		return staticTable[idx-1], true
+	}
+	d := idx - uint64(len(staticTable))
+	if d > uint64(len(t.entries)) {
+		return headerField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-d], true
+}
+
+// search finds the best index for f: a full match if there is one, else a
+// name match. 0 means nothing matched.
+func (t *dynamicTable) search(f headerField) (idx uint64, full bool) {
+	for i, e := range staticTable {
+		if e.name != f.name {
+			continue
+		}
+		if e.value == f.value {
+			return uint64(i + 1), true
+		}
+		if idx == 0 {
+			idx = uint64(i + 1)
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.name != f.name {
+			continue
+		}
+		di := uint64(len(staticTable) + len(t.entries) - i)
+		if e.value == f.value {
+			return di, true
+		}
+		if idx == 0 {
+			idx = di
+		}
+	}
+	return idx, false
+}
+
+// hpackDecoder decodes header blocks. it lives on the connection's read side.
+type hpackDecoder struct {
+	table dynamicTable
+	// maxTableSize is the SETTINGS_HEADER_TABLE_SIZE we advertised, size
+	// updates from the peer may not go above it.
+	maxTableSize int
+	// maxListSize caps the decoded header list, 0 is no cap.
+	maxListSize int
+}
+
+func newHpackDecoder(maxTableSize, maxListSize int) *hpackDecoder {
+	d := &hpackDecoder{maxTableSize: maxTableSize, maxListSize: maxListSize}
+	d.table.maxSize = maxTableSize
+	return d
+}
+
+// decode decodes a complete header block.
+func (d *hpackDecoder) decode(block []byte) ([]headerField, error) {
+	var fields []headerField
+	listSize := 0
+	first := true
+	for len(block) > 0 {
+		b := block[0]
+		var (
+			f   headerField
+			err error
+		)
+		switch {
+		case b&0x80 != 0: // 6.1 indexed
+			var idx uint64
+			idx, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if f, ok = d.table.get(idx); !ok {
+				return nil, fmt.Errorf("%w: %d", errHpackIndex, idx)
+			}
+		case b&0xc0 == 0x40: // 6.2.1 incremental indexing
+			f, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xe0 == 0x20: // 6.3 dynamic table size update
+			if !first {
+				return nil, errHpackTableSize
+			}
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("%w: %d", errHpackTableSize, size)
+			}
+			d.table.setMaxSize(int(size))
+			continue
+		default: // 6.2.2 without indexing, 6.2.3 never indexed
+			never := b&0x10 != 0
+			f, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.sensitive = never
+		}
+		first = false
+
+		listSize += f.size()
+		if d.maxListSize > 0 && listSize > d.maxListSize {
+			return nil, errHpackTooLarge
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// readLiteral reads a literal field whose name index has an n-bit prefix.
+func (d *hpackDecoder) readLiteral(p []byte, n uint8) (headerField, []byte, error) {
+	var f headerField
+	idx, p, err := readInt(p, n)
+	if err != nil {
+		return f, nil, err
+	}
+	if idx == 0 {
+		if f.name, p, err = readString(p); err != nil {
+			return f, nil, err
+		}
+	} else {
+		named, ok := d.table.get(idx)
+		if !ok {
+			return f, nil, fmt.Errorf("%w: %d", errHpackIndex, idx)
+		}
+		f.name = named.name
+	}
+	f.value, p, err = readString(p)
+	return f, p, err
+}
+
+// readInt reads an RFC 7541 5.1 integer with an n-bit prefix.
+func readInt(p []byte, n uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, errHpackTruncated
+	}
+	mask := uint64(1)<<n - 1
+	v := uint64(p[0]) & mask
+	p = p[1:]
+	if v < mask {
+		return v, p, nil
+	}
+	var shift uint
+	for {
+		if len(p) == 0 {
+			return 0, nil, errHpackTruncated
+		}
+		b := p[0]
+		p = p[1:]
+		if shift >= 56 {
+			return 0, nil, errHpackInteger
+		}
+		v += uint64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+	}
+}
+
+// readString reads an RFC 7541 5.2 string literal.
+func readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, errHpackTruncated
+	}
+	huffman := p[0]&0x80 != 0
+	length, p, err := readInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(p)) < length {
+		return "", nil, errHpackTruncated
+	}
+	raw := p[:length]
+	p = p[length:]
+	if !huffman {
+		return string(raw), p, nil
+	}
+	decoded, err := huffmanDecode(nil, raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(decoded), p, nil
+}
+
+// hpackEncoder encodes header blocks. it lives on the connection's write
+// side and must only be used under the write lock.
+type hpackEncoder struct {
+	table dynamicTable
+	// pendingSize is a table size change we still have to announce, -1 when
+	// there is none. minSize is the smallest size since the last block, so a
+	// shrink followed by a grow is announced as both (RFC 7541 4.2).
+	pendingSize int
+	minSize     int
+}
+
+func newHpackEncoder() *hpackEncoder {
+	e := &hpackEncoder{pendingSize: -1, minSize: -1}
+	e.table.maxSize = 4096
+	return e
+}
+
+// setMaxTableSize follows a SETTINGS_HEADER_TABLE_SIZE change from the peer.
+func (e *hpackEncoder) setMaxTableSize(n int) {
+	if e.minSize < 0 || n < e.minSize {
+		e.minSize = n
+	}
+	e.pendingSize = n
+	e.table.setMaxSize(n)
+}
+
+// encode appends the header block for fields to dst.
+func (e *hpackEncoder) encode(dst []byte, fields []headerField) []byte {
+	if e.pendingSize >= 0 {
+		if e.minSize < e.pendingSize {
+			dst = appendInt(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.pendingSize))
+		e.pendingSize, e.minSize = -1, -1
+	}
+
+	for _, f := range fields {
+		idx, full := e.table.search(f)
+		switch {
+		case full && !f.sensitive:
+			dst = appendInt(dst, 0x80, 7, idx)
+		case f.sensitive:
+			dst = appendInt(dst, 0x10, 4, idx)
+			if idx == 0 {
+				dst = appendString(dst, f.name)
+			}
+			dst = appendString(dst, f.value)
+		default:
+			dst = appendInt(dst, 0x40, 6, idx)
+			if idx == 0 {
+				dst = appendString(dst, f.name)
+			}
+			dst = appendString(dst, f.value)
+			e.table.add(f)
+		}
+	}
+	return dst
+}
+
+// appendInt appends v with an n-bit prefix; flags fill the bits above it.
+func appendInt(dst []byte, flags byte, n uint8, v uint64) []byte {
+	mask := uint64(1)<<n - 1
+	if v < mask {
+		return append(dst, flags|byte(v))
+	}
+	dst = append(dst, flags|byte(mask))
+	v -= mask
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// appendString appends s as a string literal, huffman coded when that's
+// shorter.
+func appendString(dst []byte, s string) []byte {
+	if hl := huffmanEncodedLen(s); hl < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(hl))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
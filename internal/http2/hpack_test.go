@@ -0,0 +1,138 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+// RFC 7541 C.4, three requests on one connection with huffman coding.
+var rfcRequests = []struct {
+	fields []headerField
+	wire   string
+}{
+	{
+		fields: []headerField{
+			{name: ":method", value: "GET"},
+			{name: ":scheme", value: "http"},
+			{name: ":path", value: "/"},
+			{name: ":authority", value: "www.example.com"},
+		},
+		wire: "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+	},
+	{
+		fields: []headerField{
+			{name: ":method", value: "GET"},
+			{name: ":scheme", value: "http"},
+			{name: ":path", value: "/"},
+			{name: ":authority", value: "www.example.com"},
+			{name: "cache-control", value: "no-cache"},
+		},
+		wire: "8286 84be 5886 a8eb 1064 9cbf",
+	},
+	{
+		fields: []headerField{
+			{name: ":method", value: "GET"},
+			{name: ":scheme", value: "https"},
+			{name: ":path", value: "/index.html"},
+			{name: ":authority", value: "www.example.com"},
+			{name: "custom-key", value: "custom-value"},
+		},
+		wire: "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+	},
+}
+
+func TestHpackEncode(t *testing.T) {
+	enc := newHpackEncoder()
+	for i, r := range rfcRequests {
+		got := enc.encode(nil, r.fields)
+		assert.Equal(t, hex.EncodeToString(unhex(t, r.wire)), hex.EncodeToString(got), "request %d", i+1)
+	}
+	assert.Equal(t, 164, enc.table.size)
+}
+
+func TestHpackDecode(t *testing.T) {
+	// Test: RFC 7541 C.4 decodes to the same fields
+	dec := newHpackDecoder(4096, 0)
+	for i, r := range rfcRequests {
+		got, err := dec.decode(unhex(t, r.wire))
+		require.NoError(t, err, "request %d", i+1)
+		assert.Equal(t, r.fields, got, "request %d", i+1)
+	}
+	require.Len(t, dec.table.entries, 3)
+	assert.Equal(t, "custom-key", dec.table.entries[2].name)
+
+	// Test: RFC 7541 C.2.3 never indexed literal
+	dec = newHpackDecoder(4096, 0)
+	got, err := dec.decode(unhex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74"))
+	require.NoError(t, err)
+	assert.Equal(t, []headerField{{name: "password", value: "secret", sensitive: true}}, got)
+	assert.Empty(t, dec.table.entries)
+
+	// Test: Index past the tables
+	_, err = newHpackDecoder(4096, 0).decode([]byte{0xbe})
+	require.ErrorIs(t, err, errHpackIndex)
+
+	// Test: Size update above our setting
+	_, err = newHpackDecoder(4096, 0).decode(appendInt(nil, 0x20, 5, 8192))
+	require.ErrorIs(t, err, errHpackTableSize)
+
+	// Test: Size update after the first field
+	_, err = newHpackDecoder(4096, 0).decode([]byte{0x82, 0x20})
+	require.ErrorIs(t, err, errHpackTableSize)
+
+	// Test: Truncated string
+	_, err = newHpackDecoder(4096, 0).decode([]byte{0x40, 0x05, 'a'})
+	require.ErrorIs(t, err, errHpackTruncated)
+}
+
+func TestHpackTableSize(t *testing.T) {
+	// Test: Shrinking the table evicts and is announced to the decoder
+	enc := newHpackEncoder()
+	dec := newHpackDecoder(4096, 0)
+	block := enc.encode(nil, rfcRequests[2].fields)
+	_, err := dec.decode(block)
+	require.NoError(t, err)
+
+	enc.setMaxTableSize(0)
+	enc.setMaxTableSize(100)
+	block = enc.encode(nil, []headerField{{name: "x-a", value: "1"}})
+	assert.Equal(t, byte(0x20), block[0], "size update to 0 first")
+	got, err := dec.decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, []headerField{{name: "x-a", value: "1"}}, got)
+	assert.Equal(t, enc.table.entries, dec.table.entries)
+	assert.Equal(t, 100, dec.table.maxSize)
+}
+
+func TestHuffman(t *testing.T) {
+	for _, s := range []string{"", "www.example.com", "no-cache", "\x00\xff binary \x7f", strings.Repeat("z", 300)} {
+		encoded := huffmanEncode(nil, s)
+		assert.Equal(t, huffmanEncodedLen(s), len(encoded))
+		decoded, err := huffmanDecode(nil, encoded)
+		require.NoError(t, err)
+		assert.Equal(t, s, string(decoded))
+	}
+
+	// Test: Padding that isn't all ones
+	_, err := huffmanDecode(nil, []byte{0x00})
+	require.ErrorIs(t, err, errInvalidHuffman)
+
+	// Test: More than 7 bits of padding
+	_, err = huffmanDecode(nil, []byte{0xff})
+	require.ErrorIs(t, err, errInvalidHuffman)
+
+	// Test: EOS in the string
+	_, err = huffmanDecode(nil, []byte{0xff, 0xff, 0xff, 0xff})
+	require.ErrorIs(t, err, errInvalidHuffman)
+}
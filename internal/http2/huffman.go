@@ -0,0 +1,89 @@
+package http2
+
+import "errors"
+
+var errInvalidHuffman = errors.New("hpack: invalid huffman data")
+
+// huffmanNode is a node of the decoding tree. leaves have sym >= 0.
+type huffmanNode struct {
+	next [2]int32
+	sym  int32
+}
+
+var huffmanTree = buildHuffmanTree()
+
+func buildHuffmanTree() []huffmanNode {
+	tree := []huffmanNode{{sym: -1}}
+	for sym, c := range huffmanTable {
+		n := 0
+		for i := int(c.bits) - 1; i >= 0; i-- {
+			bit := (c.code >> uint(i)) & 1
+			if tree[n].next[bit] == 0 {
+				tree = append(tree, huffmanNode{sym: -1})
+				tree[n].next[bit] = int32(len(tree) - 1)
+			}
+			n = int(tree[n].next[bit])
+		}
+		tree[n].sym = int32(sym)
+	}
+	return tree
+}
+
+// huffmanDecode decodes src, failing on EOS, on padding longer than 7 bits
+// or on padding that isn't the most significant bits of EOS (all ones).
+func huffmanDecode(dst []byte, src []byte) ([]byte, error) {
+	n := 0
+	depth := 0 // bits read since the last symbol
+	ones := true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			next := huffmanTree[n].next[bit]
+			if next == 0 {
+				// only EOS (30 ones) runs off the tree
+				return nil, errInvalidHuffman
+			}
+			n = int(next)
+			depth++
+			ones = ones && bit == 1
+			if sym := huffmanTree[n].sym; sym >= 0 {
+				dst = append(dst, byte(sym))
+				n, depth, ones = 0, 0, true
+			}
+		}
+	}
+	if depth > 7 || !ones {
+		return nil, errInvalidHuffman
+	}
+	return dst, nil
+}
+
+// huffmanEncodedLen returns the length of s once huffman encoded.
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanTable[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// huffmanEncode appends the huffman encoding of s to dst, padded with the
+// most significant bits of EOS.
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	n := 0 // bits in acc
+	for i := 0; i < len(s); i++ {
+		c := huffmanTable[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		n += int(c.bits)
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>uint(n)))
+		}
+	}
+	if n > 0 {
+		pad := 8 - n
+		dst = append(dst, byte(acc<<uint(pad))|byte(1<<uint(pad)-1))
+	}
+	return dst
+}
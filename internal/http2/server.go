@@ -0,0 +1,1028 @@
+// Package http2 is the HTTP/2 (RFC 9113) side of the server: framing, HPACK,
+// stream multiplexing and flow control. requests are handed back to the
+// server as request.Request values and answered through a response.Wire, so
+// the same handlers run on both protocols.
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+)
+
+// NextProto is the ALPN protocol id for HTTP/2 over TLS.
+const NextProto = "h2"
+
+const (
+	// DefaultMaxConcurrentStreams is advertised unless configured otherwise.
+	DefaultMaxConcurrentStreams = 100
+	// DefaultMaxHeaderListSize caps a decoded header block.
+	DefaultMaxHeaderListSize = 1 << 20
+	// DefaultMaxBodySize caps a request body, which is held in memory.
+	DefaultMaxBodySize = 10 << 20
+)
+
+var errStreamClosed = errors.New("http2: stream closed")
+
+// Handler serves the request on one stream. it runs in its own goroutine
+// and must have finished the response through wire when it returns.
+type Handler func(wire response.Wire, req *request.Request)
+
+// Server holds the settings shared by HTTP/2 connections.
+type Server struct {
+	Handler              Handler
+	MaxConcurrentStreams uint32 // 0 means DefaultMaxConcurrentStreams
+	MaxHeaderListSize    uint32 // 0 means DefaultMaxHeaderListSize
+	// MaxBodySize caps request bodies, 0 means DefaultMaxBodySize. larger
+	// ones are answered with 413 and the stream is reset.
+	MaxBodySize int64
+}
+
+// ServeConn speaks HTTP/2 on conn until it is closed. buffered holds bytes
+// already read off conn (e.g. the start of the preface), they are consumed
+// first. request contexts derive from ctx and are also cancelled when the
+// client resets the stream or the connection ends.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn, buffered []byte) error {
+	sc := s.newConn(ctx, conn, buffered)
+	return sc.serve(nil)
+}
+
+// ServeUpgrade speaks HTTP/2 on a connection that just switched over with
+// Upgrade: h2c. the caller has already sent 101 Switching Protocols. req is
+// the upgrade request, its response goes out on stream 1. settings is the
+// HTTP2-Settings header value.
+func (s *Server) ServeUpgrade(ctx context.Context, conn net.Conn, buffered []byte, req *request.Request, settings string) error {
+	payload, err := DecodeSettings(settings)
+	if err != nil {
+		return err
+	}
+	sc := s.newConn(ctx, conn, buffered)
+	parsed, err := parseSettings(frame{frameHeader: frameHeader{typ: frameSettings}, payload: payload})
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(parsed); err != nil {
+		return err
+	}
+	return sc.serve(req)
+}
+
+// DecodeSettings decodes and checks an HTTP2-Settings header value
+// (base64url of a SETTINGS payload).
+func DecodeSettings(v string) ([]byte, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, fmt.Errorf("http2: bad HTTP2-Settings: %w", err)
+	}
+	if _, err := parseSettings(frame{frameHeader: frameHeader{typ: frameSettings}, payload: payload}); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+type streamState int
+
+const (
+	stateOpen             streamState = iota // receiving the request
+	stateHalfClosedRemote                    // request done, handler answering
+	stateClosed
+)
+
+type stream struct {
+	id    uint32
+	state streamState
+
+	// read side, only touched by the read loop
+	req         *request.Request
+	body        bytes.Buffer
+	declaredLen int64 // content-length, -1 if absent
+	recvWindow  int64
+
+	// write side, guarded by serverConn.mu
+	sendWindow int64
+	reset      bool // RST_STREAM either way, writes fail
+
+	cancel context.CancelFunc // cancels the request context
+}
+
+// serverConn is one HTTP/2 connection. the read loop owns the hpack decoder
+// and the read-side stream fields; writes from handlers share writeMu.
+type serverConn struct {
+	srv    *Server
+	conn   net.Conn
+	br     *bufio.Reader
+	ctx    context.Context
+	cancel context.CancelFunc
+	tls    *tls.ConnectionState
+
+	maxStreams    uint32
+	maxHeaderList uint32
+	maxBody       int64
+
+	writeMu sync.Mutex
+	enc     *hpackEncoder
+	dec     *hpackDecoder
+
+	mu               sync.Mutex
+	cond             *sync.Cond
+	streams          map[uint32]*stream
+	active           int // streams not yet closed
+	sendWindow       int64
+	peerInitWindow   int64
+	peerMaxFrameSize uint32
+	closed           bool
+	handlers         sync.WaitGroup
+
+	// read loop only
+	lastStreamID uint32
+	seq          uint64 // requests started
+	recvWindow   int64
+	goingAway    bool
+	contStream   uint32 // stream a header block is being continued on
+	contBlock    []byte
+	contEnd      bool
+	contSelfDep  bool // the HEADERS made its stream depend on itself
+}
+
+func (s *Server) newConn(ctx context.Context, conn net.Conn, buffered []byte) *serverConn {
+	var r io.Reader = conn
+	if len(buffered) > 0 {
+		r = io.MultiReader(bytes.NewReader(buffered), conn)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	sc := &serverConn{
+		srv:              s,
+		conn:             conn,
+		br:               bufio.NewReader(r),
+		ctx:              ctx,
+		cancel:           cancel,
+		maxStreams:       s.MaxConcurrentStreams,
+		maxHeaderList:    s.MaxHeaderListSize,
+		maxBody:          s.MaxBodySize,
+		enc:              newHpackEncoder(),
+		streams:          map[uint32]*stream{},
+		sendWindow:       defaultWindowSize,
+		peerInitWindow:   defaultWindowSize,
+		peerMaxFrameSize: defaultMaxFrameSize,
+		recvWindow:       defaultWindowSize,
+	}
+	if sc.maxStreams == 0 {
+		sc.maxStreams = DefaultMaxConcurrentStreams
+	}
+	if sc.maxHeaderList == 0 {
+		sc.maxHeaderList = DefaultMaxHeaderListSize
+	}
+	if sc.maxBody <= 0 {
+		sc.maxBody = DefaultMaxBodySize
+	}
+	sc.dec = newHpackDecoder(defaultHeaderTableLen, int(sc.maxHeaderList))
+	sc.cond = sync.NewCond(&sc.mu)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		sc.tls = &state
+	}
+	return sc
+}
+
+// serve runs the connection. upgrade is the h2c upgrade request, if any.
+func (sc *serverConn) serve(upgrade *request.Request) error {
+	defer sc.close()
+
+	// the server preface is our SETTINGS, it goes out before anything else
+	err := sc.writeFrame(frameSettings, 0, 0, appendSettings(nil,
+		setting{settingMaxConcurrentStreams, sc.maxStreams},
+		setting{settingMaxHeaderListSize, sc.maxHeaderList},
+	))
+	if err != nil {
+		return err
+	}
+
+	if upgrade != nil {
+		sc.lastStreamID = 1
+		st := sc.newStream(1)
+		st.req = upgrade
+		st.req.RequestLine.HTTPVersion = "2.0"
+		sc.startRequest(st, upgrade.Context())
+		sc.dispatch(st)
+	}
+
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != clientPreface {
+		return sc.goAway(connError(errCodeProtocol, "bad connection preface"))
+	}
+
+	var buf []byte
+	first := true
+	for {
+		var f frame
+		f, buf, err = readFrame(sc.br, buf, defaultMaxFrameSize)
+		if err != nil {
+			var ce connErr
+			if errors.As(err, &ce) {
+				return sc.goAway(err)
+			}
+			return err
+		}
+		if first && (f.typ != frameSettings || f.has(flagAck)) {
+			return sc.goAway(connError(errCodeProtocol, "first frame is not SETTINGS"))
+		}
+		first = false
+
+		if err := sc.processFrame(f); err != nil {
+			var se streamErr
+			if errors.As(err, &se) {
+				sc.resetStream(se.streamID, se.code)
+				continue
+			}
+			var ce connErr
+			if errors.As(err, &ce) {
+				return sc.goAway(err)
+			}
+			return err
+		}
+	}
+}
+
+// close tears the connection down and wakes up every blocked writer.
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.reset = true
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.cancel()
+	_ = sc.conn.Close()
+	sc.handlers.Wait()
+}
+
+// goAway sends GOAWAY for a connection error and returns it.
+func (sc *serverConn) goAway(err error) error {
+	var ce connErr
+	code, debug := errCodeInternal, ""
+	if errors.As(err, &ce) {
+		code, debug = ce.code, ce.reason
+	}
+	payload := binary.BigEndian.AppendUint32(nil, sc.lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, debug...)
+	_ = sc.writeFrame(frameGoAway, 0, 0, payload)
+	return err
+}
+
+func (sc *serverConn) resetStream(id uint32, code errCode) {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(code))
+	_ = sc.writeFrame(frameRSTStream, 0, id, payload)
+
+	sc.mu.Lock()
+	if st, ok := sc.streams[id]; ok {
+		st.reset = true
+		sc.removeStreamLocked(st)
+		st.cancelRequest()
+	}
+	sc.mu.Unlock()
+}
+
+func (sc *serverConn) processFrame(f frame) error {
+	if sc.contStream != 0 && (f.typ != frameContinuation || f.streamID != sc.contStream) {
+		return connError(errCodeProtocol, "expected CONTINUATION on stream %d", sc.contStream)
+	}
+
+	switch f.typ {
+	case frameData:
+		return sc.processData(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return connError(errCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.payload) != 5 {
+			return streamError(f.streamID, errCodeFrameSize, "PRIORITY length %d", len(f.payload))
+		}
+		// priorities are advisory and we don't use them
+		return nil
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePushPromise:
+		return connError(errCodeProtocol, "clients can't push")
+	case framePing:
+		if f.streamID != 0 {
+			return connError(errCodeProtocol, "PING on stream %d", f.streamID)
+		}
+		if len(f.payload) != 8 {
+			return connError(errCodeFrameSize, "PING length %d", len(f.payload))
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return connError(errCodeProtocol, "GOAWAY on stream %d", f.streamID)
+		}
+		// the client is done opening streams, the ones in flight finish
+		sc.goingAway = true
+		return nil
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case frameContinuation:
+		return sc.processContinuation(f)
+	default:
+		// unknown frame types are ignored
+		return nil
+	}
+}
+
+func (sc *serverConn) processSettings(f frame) error {
+	settings, err := parseSettings(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagAck) {
+		return nil
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+// applySettings takes the peer's settings into account on our write side.
+func (sc *serverConn) applySettings(settings []setting) error {
+	for _, s := range settings {
+		switch s.id {
+		case settingHeaderTableSize:
+			sc.writeMu.Lock()
+			sc.enc.setMaxTableSize(int(min(s.val, defaultHeaderTableLen)))
+			sc.writeMu.Unlock()
+		case settingInitialWindowSize:
+			sc.mu.Lock()
+			delta := int64(s.val) - sc.peerInitWindow
+			sc.peerInitWindow = int64(s.val)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					sc.mu.Unlock()
+					return connError(errCodeFlowControl, "INITIAL_WINDOW_SIZE overflows stream %d", st.id)
+				}
+			}
+			sc.cond.Broadcast()
+			sc.mu.Unlock()
+		case settingMaxFrameSize:
+			sc.mu.Lock()
+			sc.peerMaxFrameSize = s.val
+			sc.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f frame) error {
+	if len(f.payload) != 4 {
+		return connError(errCodeFrameSize, "WINDOW_UPDATE length %d", len(f.payload))
+	}
+	inc := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if f.streamID == 0 {
+		if inc == 0 {
+			return connError(errCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		sc.sendWindow += inc
+		if sc.sendWindow > maxWindowSize {
+			return connError(errCodeFlowControl, "connection window overflow")
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	if f.streamID > sc.lastStreamID {
+		return connError(errCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.streamID)
+	}
+	if inc == 0 {
+		return streamError(f.streamID, errCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	st, ok := sc.streams[f.streamID]
+	if !ok {
+		// closed streams can still see window updates in flight
+		return nil
+	}
+	st.sendWindow += inc
+	if st.sendWindow > maxWindowSize {
+		return streamError(f.streamID, errCodeFlowControl, "stream window overflow")
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f frame) error {
+	if f.streamID == 0 {
+		return connError(errCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.payload) != 4 {
+		return connError(errCodeFrameSize, "RST_STREAM length %d", len(f.payload))
+	}
+	if f.streamID > sc.lastStreamID {
+		return connError(errCodeProtocol, "RST_STREAM on idle stream %d", f.streamID)
+	}
+	sc.mu.Lock()
+	if st, ok := sc.streams[f.streamID]; ok {
+		st.reset = true
+		sc.removeStreamLocked(st)
+		st.cancelRequest()
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f frame) error {
+	if f.streamID == 0 {
+		return connError(errCodeProtocol, "HEADERS on stream 0")
+	}
+	block := f.payload
+	if f.has(flagPriority) {
+		if len(block) < 5 {
+			return connError(errCodeFrameSize, "HEADERS too short for priority")
+		}
+		// the error waits for the end of the block, it has to be
+		// decoded all the same (RFC 9113 4.3)
+		sc.contSelfDep = binary.BigEndian.Uint32(block)&(1<<31-1) == f.streamID
+		block = block[5:]
+	} else {
+		sc.contSelfDep = false
+	}
+
+	sc.contBlock = append(sc.contBlock[:0], block...)
+	sc.contEnd = f.has(flagEndStream)
+	if !f.has(flagEndHeaders) {
+		sc.contStream = f.streamID
+		return nil
+	}
+	return sc.endHeaders(f.streamID)
+}
+
+func (sc *serverConn) processContinuation(f frame) error {
+	if sc.contStream == 0 {
+		return connError(errCodeProtocol, "CONTINUATION without HEADERS")
+	}
+	if uint32(len(sc.contBlock)+len(f.payload)) > sc.maxHeaderList {
+		return connError(errCodeEnhanceYourCalm, "header block too large")
+	}
+	sc.contBlock = append(sc.contBlock, f.payload...)
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+	sc.contStream = 0
+	return sc.endHeaders(f.streamID)
+}
+
+// endHeaders handles a complete header block: a new request or trailers.
+func (sc *serverConn) endHeaders(id uint32) error {
+	// the block is decoded no matter what, the hpack state depends on it
+	fields, err := sc.dec.decode(sc.contBlock)
+	if err != nil {
+		return connError(errCodeCompression, "%v", err)
+	}
+	endStream := sc.contEnd
+
+	sc.mu.Lock()
+	st, existing := sc.streams[id]
+	open := existing && st.state == stateOpen
+	sc.mu.Unlock()
+
+	if sc.contSelfDep {
+		if !existing && id > sc.lastStreamID && id%2 == 1 {
+			sc.lastStreamID = id
+		}
+		return streamError(id, errCodeProtocol, "stream depends on itself")
+	}
+
+	if existing {
+		if !open {
+			return streamError(id, errCodeStreamClosed, "HEADERS on half closed stream")
+		}
+		if !endStream {
+			return streamError(id, errCodeProtocol, "trailers without END_STREAM")
+		}
+		trailers, err := trailerFields(id, fields)
+		if err != nil {
+			return err
+		}
+		st.req.Trailers = trailers
+		return sc.endRequest(st)
+	}
+
+	if id%2 == 0 || id <= sc.lastStreamID {
+		return connError(errCodeProtocol, "HEADERS opening stream %d", id)
+	}
+	sc.lastStreamID = id
+	if sc.goingAway {
+		return streamError(id, errCodeRefusedStream, "connection is going away")
+	}
+
+	sc.mu.Lock()
+	full := sc.active >= int(sc.maxStreams)
+	sc.mu.Unlock()
+	if full {
+		return streamError(id, errCodeRefusedStream, "too many concurrent streams")
+	}
+
+	req, declaredLen, err := requestFromFields(id, fields)
+	if err != nil {
+		return err
+	}
+	st = sc.newStream(id)
+	st.req = req
+	st.declaredLen = declaredLen
+	sc.startRequest(st, sc.ctx)
+	if declaredLen > sc.maxBody {
+		return sc.tooLarge(st)
+	}
+	if endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processData(f frame) error {
+	if f.streamID == 0 {
+		return connError(errCodeProtocol, "DATA on stream 0")
+	}
+
+	// flow control counts the whole frame, padding included
+	n := int64(f.length)
+	if n > sc.recvWindow {
+		return connError(errCodeFlowControl, "connection window exceeded")
+	}
+	sc.recvWindow -= n
+
+	sc.mu.Lock()
+	st, ok := sc.streams[f.streamID]
+	open := ok && st.state == stateOpen
+	sc.mu.Unlock()
+	if !open {
+		if f.streamID > sc.lastStreamID {
+			return connError(errCodeProtocol, "DATA on idle stream %d", f.streamID)
+		}
+		// dropped, so the connection window comes back
+		if err := sc.refillConn(n); err != nil {
+			return err
+		}
+		return streamError(f.streamID, errCodeStreamClosed, "DATA on closed stream")
+	}
+	if n > st.recvWindow {
+		if err := sc.refillConn(n); err != nil {
+			return err
+		}
+		return streamError(f.streamID, errCodeFlowControl, "stream window exceeded")
+	}
+	st.recvWindow -= n
+
+	// the data is now held by the stream, which caps it at maxBody, so the
+	// connection window can go back without growing what's buffered past
+	// maxBody per stream
+	if err := sc.refillConn(n); err != nil {
+		return err
+	}
+	size := int64(st.body.Len() + len(f.payload))
+	if st.declaredLen >= 0 && size > st.declaredLen {
+		return streamError(f.streamID, errCodeProtocol, "body longer than content-length")
+	}
+	if size > sc.maxBody {
+		return sc.tooLarge(st)
+	}
+	st.body.Write(f.payload)
+
+	if f.has(flagEndStream) {
+		return sc.endRequest(st)
+	}
+	// the stream window only opens as far as the body may still grow, plus
+	// a byte, so a client with too much to send finds out instead of
+	// stalling on a closed window
+	grant := min(n, sc.maxBody+1-size-st.recvWindow)
+	if grant > 0 {
+		st.recvWindow += grant
+		return sc.writeWindowUpdate(f.streamID, uint32(grant))
+	}
+	return nil
+}
+
+// refillConn hands n bytes of connection window back to the client.
+func (sc *serverConn) refillConn(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	sc.recvWindow += n
+	return sc.writeWindowUpdate(0, uint32(n))
+}
+
+// tooLarge answers a request whose body is over maxBody with 413 and asks
+// the client to stop sending it (RFC 9113 8.1).
+func (sc *serverConn) tooLarge(st *stream) error {
+	fields := []headerField{{name: ":status", value: strconv.Itoa(int(response.StatusContentTooLarge))}}
+	if err := sc.writeHeaders(st, fields, true); err != nil {
+		return err
+	}
+	sc.resetStream(st.id, errCodeNo)
+	return nil
+}
+
+// endRequest is called once the client half closes: the request is complete
+// and goes to the handler.
+func (sc *serverConn) endRequest(st *stream) error {
+	if st.declaredLen >= 0 && int64(st.body.Len()) != st.declaredLen {
+		return streamError(st.id, errCodeProtocol, "body shorter than content-length")
+	}
+	if st.body.Len() > 0 {
+		st.req.Body = st.body.Bytes()
+	}
+	sc.dispatch(st)
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st := &stream{
+		id:          id,
+		state:       stateOpen,
+		declaredLen: -1,
+		recvWindow:  defaultWindowSize,
+		sendWindow:  sc.peerInitWindow,
+	}
+	sc.streams[id] = st
+	sc.active++
+	return st
+}
+
+// startRequest fills in the connection details of st's request and gives it
+// a context of its own, derived from parent.
+func (sc *serverConn) startRequest(st *stream, parent context.Context) {
+	sc.seq++
+	req := st.req
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	req.LocalAddr = sc.conn.LocalAddr().String()
+	req.Seq = sc.seq
+	req.TLS = sc.tls
+	req.ReceivedAt = time.Now()
+
+	ctx, cancel := context.WithCancel(parent)
+	if parent != sc.ctx {
+		// the upgrade request also ends with the HTTP/2 connection
+		stop := context.AfterFunc(sc.ctx, cancel)
+		cancelReq := cancel
+		cancel = func() { stop(); cancelReq() }
+	}
+	req.SetContext(ctx)
+	st.cancel = cancel
+}
+
+// cancelRequest cancels the request context, if the request got that far.
+func (st *stream) cancelRequest() {
+	if st.cancel != nil {
+		st.cancel()
+	}
+}
+
+func (sc *serverConn) dispatch(st *stream) {
+	sc.mu.Lock()
+	st.state = stateHalfClosedRemote
+	sc.mu.Unlock()
+
+	wire := &streamWire{sc: sc, st: st}
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer st.cancelRequest()
+		sc.srv.Handler(wire, st.req)
+		// a handler that didn't finish still ends the stream
+		if err := wire.Finish(); err != nil && !errors.Is(err, errStreamClosed) {
+			log.Printf("http2: error finishing stream %d: %v", st.id, err)
+		}
+	}()
+}
+
+func (sc *serverConn) removeStreamLocked(st *stream) {
+	if st.state == stateClosed {
+		return
+	}
+	st.state = stateClosed
+	delete(sc.streams, st.id)
+	sc.active--
+}
+
+// writeFrame writes a single frame.
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, id uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	_, err := sc.conn.Write(appendFrame(nil, typ, flags, id, payload))
+	return err
+}
+
+func (sc *serverConn) writeWindowUpdate(id uint32, n uint32) error {
+	return sc.writeFrame(frameWindowUpdate, 0, id, binary.BigEndian.AppendUint32(nil, n))
+}
+
+// writeHeaders encodes fields and writes them as HEADERS plus as many
+// CONTINUATION frames as the peer's frame size needs, back to back.
+func (sc *serverConn) writeHeaders(st *stream, fields []headerField, endStream bool) error {
+	sc.mu.Lock()
+	maxFrame := int(sc.peerMaxFrameSize)
+	reset := st.reset
+	sc.mu.Unlock()
+	if reset {
+		return errStreamClosed
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	block := sc.enc.encode(nil, fields)
+	var out []byte
+	typ := frameHeaders
+	for {
+		chunk := block
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		block = block[len(chunk):]
+
+		var flags uint8
+		if typ == frameHeaders && endStream {
+			flags |= flagEndStream
+		}
+		if len(block) == 0 {
+			flags |= flagEndHeaders
+		}
+		out = appendFrame(out, typ, flags, st.id, chunk)
+		if len(block) == 0 {
+			break
+		}
+		typ = frameContinuation
+	}
+	_, err := sc.conn.Write(out)
+	return err
+}
+
+// writeData sends p on st as DATA frames, waiting for flow control windows.
+func (sc *serverConn) writeData(st *stream, p []byte, endStream bool) (int, error) {
+	written := 0
+	for len(p) > 0 || endStream {
+		sc.mu.Lock()
+		for len(p) > 0 && !st.reset && !sc.closed && (sc.sendWindow <= 0 || st.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if st.reset || sc.closed {
+			sc.mu.Unlock()
+			return written, errStreamClosed
+		}
+		n := min(int64(len(p)), sc.sendWindow, st.sendWindow, int64(sc.peerMaxFrameSize))
+		sc.sendWindow -= n
+		st.sendWindow -= n
+		sc.mu.Unlock()
+
+		var flags uint8
+		last := int(n) == len(p)
+		if last && endStream {
+			flags = flagEndStream
+		}
+		if err := sc.writeFrame(frameData, flags, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+		if last {
+			break
+		}
+	}
+	return written, nil
+}
+
+// streamDone is called when our side of st is complete.
+func (sc *serverConn) streamDone(st *stream) {
+	sc.mu.Lock()
+	sc.removeStreamLocked(st)
+	sc.mu.Unlock()
+}
+
+// requestFromFields builds a request out of a decoded header block,
+// enforcing RFC 9113 8.2 and 8.3.
+func requestFromFields(id uint32, fields []headerField) (*request.Request, int64, error) {
+	var method, scheme, path, authority string
+	h := headers.NewHeaders()
+	regular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			if regular {
+				return nil, 0, streamError(id, errCodeProtocol, "pseudo header %s after regular headers", f.name)
+			}
+			var dst *string
+			switch f.name {
+			case ":method":
+				dst = &method
+			case ":scheme":
+				dst = &scheme
+			case ":path":
+				dst = &path
+			case ":authority":
+				dst = &authority
+			default:
+				return nil, 0, streamError(id, errCodeProtocol, "unknown pseudo header %s", f.name)
+			}
+			if *dst != "" {
+				return nil, 0, streamError(id, errCodeProtocol, "duplicate %s", f.name)
+			}
+			*dst = f.value
+			continue
+		}
+		regular = true
+		if err := checkField(id, f); err != nil {
+			return nil, 0, err
+		}
+		addField(h, f)
+	}
+
+	if method == "" || (method != "CONNECT" && (scheme == "" || path == "")) {
+		return nil, 0, streamError(id, errCodeProtocol, "missing pseudo headers")
+	}
+	if _, ok := h["host"]; !ok && authority != "" {
+		h["host"] = authority
+	}
+
+	declaredLen := int64(-1)
+	if v, ok := h["content-length"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, 0, streamError(id, errCodeProtocol, "bad content-length %q", v)
+		}
+		declaredLen = n
+	}
+
+	target := path
+	if method == "CONNECT" {
+		target = authority
+	}
+	u, err := request.ParseTarget(method, target)
+	if err != nil {
+		return nil, 0, streamError(id, errCodeProtocol, "%v", err)
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target,
+			URL:           u,
+			HTTPVersion:   "2.0",
+		},
+		Headers: h,
+	}
+	return req, declaredLen, nil
+}
+
+func trailerFields(id uint32, fields []headerField) (headers.Headers, error) {
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			return nil, streamError(id, errCodeProtocol, "pseudo header in trailers")
+		}
+		if err := checkField(id, f); err != nil {
+			return nil, err
+		}
+		addField(h, f)
+	}
+	return h, nil
+}
+
+// connectionHeaders are HTTP/1 hop-by-hop headers, they have no meaning in
+// HTTP/2 and make a request malformed.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+func checkField(id uint32, f headerField) error {
+	if f.name == "" || strings.ToLower(f.name) != f.name {
+		return streamError(id, errCodeProtocol, "header name %q is not lowercase", f.name)
+	}
+	if connectionHeaders[f.name] {
+		return streamError(id, errCodeProtocol, "connection specific header %s", f.name)
+	}
+	if f.name == "te" && f.value != "trailers" {
+		return streamError(id, errCodeProtocol, "te: %s", f.value)
+	}
+	if strings.ContainsAny(f.value, "\r\n\x00") {
+		return streamError(id, errCodeProtocol, "invalid value for %s", f.name)
+	}
+	return nil
+}
+
+// addField adds f the way headers.Parse joins repeats. cookie crumbs are
+// joined back into one cookie-string (RFC 9113 8.2.3).
+func addField(h headers.Headers, f headerField) {
+	prev, ok := h[f.name]
+	switch {
+	case !ok:
+		h[f.name] = f.value
+	case f.name == "cookie":
+		h[f.name] = prev + "; " + f.value
+	default:
+		h[f.name] = prev + ", " + f.value
+	}
+}
+
+// streamWire writes a response on a stream. it implements response.Wire.
+type streamWire struct {
+	sc    *serverConn
+	st    *stream
+	ended bool // END_STREAM sent
+	done  bool // Finish ran
+}
+
+func (sw *streamWire) WriteHead(code response.StatusCode, _ string, h headers.Headers) error {
+	fields := []headerField{{name: ":status", value: strconv.Itoa(int(code))}}
+	fields = appendResponseFields(fields, h)
+	return sw.sc.writeHeaders(sw.st, fields, false)
+}
+
+func (sw *streamWire) WriteBody(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return sw.sc.writeData(sw.st, p, false)
+}
+
+func (sw *streamWire) WriteChunk(p []byte) (int, error) {
+	// DATA frames already delimit the body
+	return sw.WriteBody(p)
+}
+
+func (sw *streamWire) WriteLastChunk() (int, error) {
+	return 0, nil
+}
+
+func (sw *streamWire) WriteTrailers(h headers.Headers) error {
+	if len(h) == 0 {
+		return nil
+	}
+	sw.ended = true
+	return sw.sc.writeHeaders(sw.st, appendResponseFields(nil, h), true)
+}
+
+func (sw *streamWire) Finish() error {
+	if sw.done {
+		return nil
+	}
+	sw.done = true
+	defer sw.sc.streamDone(sw.st)
+	if sw.ended {
+		return nil
+	}
+	sw.ended = true
+	_, err := sw.sc.writeData(sw.st, nil, true)
+	return err
+}
+
+// appendResponseFields lowercases h into fields, leaving out the HTTP/1
+// connection headers. values added with Headers.Add become one field each.
+func appendResponseFields(fields []headerField, h headers.Headers) []headerField {
+	for key, val := range h {
+		name := strings.ToLower(key)
+		if connectionHeaders[name] {
+			continue
+		}
+		for _, v := range strings.Split(val, "\n") {
+			fields = append(fields, headerField{name: name, value: v})
+		}
+	}
+	return fields
+}
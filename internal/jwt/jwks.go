@@ -0,0 +1,280 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Key is a verification key from a key set.
+type Key struct {
+	ID string
+	// Algorithm restricts the key to one algorithm when set.
+	Algorithm string
+	// Key is []byte, *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+	Key any
+}
+
+// KeyStore finds the keys that may have signed a token.
+type KeyStore interface {
+	// Lookup returns the keys for kid and alg. kid may be empty, when the
+	// token didn't name its key.
+	Lookup(ctx context.Context, kid, alg string) ([]Key, error)
+}
+
+// KeySet is a fixed set of keys, a KeyStore on its own.
+type KeySet []Key
+
+// Lookup implements KeyStore.
+func (ks KeySet) Lookup(_ context.Context, kid, alg string) ([]Key, error) {
+	var out []Key
+	for _, k := range ks {
+		if (kid == "" || k.ID == kid) && (k.Algorithm == "" || k.Algorithm == alg) {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+// jwk is one key of a JWKS document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// ParseJWKS parses a JWKS document. keys that aren't for signatures or of
+// a kind this package can't use are skipped, broken ones are an error.
+func ParseJWKS(data []byte) (KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	var ks KeySet
+	for i, j := range doc.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.key()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %d (%q): %w", i, j.Kid, err)
+		}
+		if key != nil {
+			ks = append(ks, Key{ID: j.Kid, Algorithm: j.Alg, Key: key})
+		}
+	}
+	return ks, nil
+}
+
+func (j jwk) key() (any, error) {
+	b64 := base64.RawURLEncoding
+	switch {
+	case j.Kty == "RSA":
+		n, err := b64.DecodeString(j.N)
+		if err != nil || len(n) < 256 {
+			return nil, fmt.Errorf("bad or short modulus")
+		}
+		e, err := b64.DecodeString(j.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("bad exponent")
+		}
+		exp := new(big.Int).SetBytes(e)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case j.Kty == "EC" && j.Crv == "P-256":
+		x, errX := b64.DecodeString(j.X)
+		y, errY := b64.DecodeString(j.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("bad point")
+		}
+		// parsing the uncompressed point checks it is on the curve
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	case j.Kty == "OKP" && j.Crv == "Ed25519":
+		x, err := b64.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad public key")
+		}
+		return ed25519.PublicKey(x), nil
+	case j.Kty == "oct":
+		k, err := b64.DecodeString(j.K)
+		if err != nil || len(k) < 32 {
+			return nil, fmt.Errorf("bad or short secret")
+		}
+		return k, nil
+	}
+	return nil, nil
+}
+
+// Defaults for JWKSConfig.
+const (
+	DefaultRefresh    = time.Hour
+	DefaultMinRefresh = time.Minute
+)
+
+// fetchTimeout bounds one fetch of the key set.
+const fetchTimeout = 10 * time.Second
+
+// JWKSConfig configures NewJWKS. one of URL and File is needed.
+type JWKSConfig struct {
+	URL  string
+	File string
+	// Refresh is how often the keys are fetched again, DefaultRefresh if 0.
+	Refresh time.Duration
+	// MinRefresh is the least time between fetches when a token names a
+	// key we don't have, as after a key rotation. DefaultMinRefresh if 0.
+	MinRefresh time.Duration
+	// Client fetches URL, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// JWKS is a KeyStore that loads a JWKS document and keeps it fresh. if a
+// refresh fails the keys it has are used until one succeeds.
+type JWKS struct {
+	cfg JWKSConfig
+	now func() time.Time
+
+	mu      sync.Mutex
+	keys    KeySet
+	fetched time.Time // last attempt
+	loaded  bool
+	pending *fetchCall // the fetch in flight, shared by everyone waiting
+}
+
+// fetchCall is one fetch of the key set.
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// NewJWKS creates a JWKS. the keys are loaded on first use.
+func NewJWKS(cfg JWKSConfig) *JWKS {
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = DefaultRefresh
+	}
+	if cfg.MinRefresh <= 0 {
+		cfg.MinRefresh = DefaultMinRefresh
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &JWKS{cfg: cfg, now: time.Now}
+}
+
+// Lookup implements KeyStore. keys due for a refresh are fetched in the
+// background while the old ones are used, lookups only wait for the first
+// load and for an unknown kid, which triggers a fetch at most once per
+// MinRefresh.
+func (j *JWKS) Lookup(ctx context.Context, kid, alg string) ([]Key, error) {
+	j.mu.Lock()
+	keys, loaded, age := j.keys, j.loaded, j.now().Sub(j.fetched)
+	var call *fetchCall
+	if !loaded || age >= j.cfg.Refresh {
+		call = j.startFetch()
+	}
+	j.mu.Unlock()
+
+	var err error
+	if !loaded {
+		if keys, err = j.wait(ctx, call); err != nil {
+			return nil, err
+		}
+	}
+	found, _ := keys.Lookup(ctx, kid, alg)
+	if len(found) == 0 && loaded && age >= j.cfg.MinRefresh {
+		j.mu.Lock()
+		call = j.startFetch()
+		j.mu.Unlock()
+		if keys, err = j.wait(ctx, call); err == nil {
+			found, _ = keys.Lookup(ctx, kid, alg)
+		}
+	}
+	return found, nil
+}
+
+// startFetch returns the fetch in flight, starting one if there is none.
+// j.mu is held.
+func (j *JWKS) startFetch() *fetchCall {
+	if j.pending != nil {
+		return j.pending
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	j.pending = call
+	j.fetched = j.now()
+	go j.load(call)
+	return call
+}
+
+// load runs a fetch. it isn't tied to the request that started it, a
+// client hanging up mustn't cut off the fetch everyone else waits for.
+func (j *JWKS) load(call *fetchCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	data, err := j.fetch(ctx)
+	var keys KeySet
+	if err == nil {
+		keys, err = ParseJWKS(data)
+	}
+
+	j.mu.Lock()
+	if err == nil {
+		j.keys, j.loaded = keys, true
+	}
+	j.pending = nil
+	call.err = err
+	j.mu.Unlock()
+	close(call.done)
+}
+
+// wait waits for call to finish, or ctx to end, and returns the keys.
+func (j *JWKS) wait(ctx context.Context, call *fetchCall) (KeySet, error) {
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.keys, call.err
+}
+
+func (j *JWKS) fetch(ctx context.Context) ([]byte, error) {
+	if j.cfg.File != "" {
+		return os.ReadFile(j.cfg.File)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwk-set+json, application/json")
+	resp, err := j.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: %s: %s", j.cfg.URL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
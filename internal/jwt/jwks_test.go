@@ -0,0 +1,112 @@
+package jwt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWKSURL(t *testing.T) {
+	old := newKeys(t)
+	var current atomic.Pointer[[]byte]
+	doc := old.jwks(t)
+	current.Store(&doc)
+	var fetches atomic.Int32
+
+	// the identity provider is a hermes-lite instance too
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		_, _ = w.Write(*current.Load())
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	clk := &clock{time.Unix(1700000000, 0)}
+	j := NewJWKS(JWKSConfig{URL: fmt.Sprintf("http://%s/.well-known/jwks.json", s.Addr()), Refresh: time.Hour, MinRefresh: time.Minute})
+	j.now = clk.now
+	v := New(Config{Keys: j})
+	ctx := context.Background()
+
+	_, err = v.Verify(ctx, old.sign(t, RS256, "rs", nil))
+	require.NoError(t, err)
+	_, err = v.Verify(ctx, old.sign(t, EdDSA, "ed", nil))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, fetches.Load())
+
+	// Test: A key rotation is picked up on the first unknown kid, but not
+	// more often than MinRefresh
+	rotatedDoc := []byte(`{"keys":[{"kty":"oct","kid":"new","k":"` + b64.EncodeToString([]byte("a different secret, 32 bytes long")) + `"}]}`)
+	current.Store(&rotatedDoc)
+	_, err = v.Verify(ctx, old.sign(t, HS256, "new", nil))
+	assert.ErrorIs(t, err, ErrNoKey)
+	assert.EqualValues(t, 1, fetches.Load())
+
+	clk.t = clk.t.Add(time.Minute)
+	_, err = v.Verify(ctx, old.sign(t, HS256, "new", nil))
+	assert.ErrorIs(t, err, ErrSignature)
+	assert.EqualValues(t, 2, fetches.Load())
+	_, err = v.Verify(ctx, old.sign(t, RS256, "rs", nil))
+	assert.ErrorIs(t, err, ErrNoKey)
+
+	// Test: A failed refresh keeps the keys we have
+	broken := []byte("not json")
+	current.Store(&broken)
+	clk.t = clk.t.Add(time.Hour)
+	keys, err := j.Lookup(ctx, "new", HS256)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.Eventually(t, func() bool { return fetches.Load() == 3 }, time.Second, 5*time.Millisecond)
+	keys, err = j.Lookup(ctx, "new", HS256)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	// Test: A caller that gives up doesn't cut off the fetch, the next
+	// one gets its keys
+	current.Store(&doc)
+	j = NewJWKS(JWKSConfig{URL: fmt.Sprintf("http://%s/.well-known/jwks.json", s.Addr())})
+	gone, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _ = j.Lookup(gone, "rs", RS256)
+	keys, err = j.Lookup(ctx, "rs", RS256)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.EqualValues(t, 4, fetches.Load())
+}
+
+func TestJWKSFile(t *testing.T) {
+	k := newKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, k.jwks(t), 0o600))
+
+	v := New(Config{Keys: NewJWKS(JWKSConfig{File: path})})
+	_, err := v.Verify(context.Background(), k.sign(t, ES256, "es", nil))
+	assert.NoError(t, err)
+
+	_, err = New(Config{Keys: NewJWKS(JWKSConfig{File: path + ".missing"})}).Verify(context.Background(), k.sign(t, ES256, "es", nil))
+	assert.ErrorIs(t, err, ErrNoKey)
+
+	// Test: Broken keys are an error, unusable ones are skipped
+	for _, doc := range []string{
+		`{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`,
+		`{"keys":[{"kty":"EC","crv":"P-256","x":"` + b64.EncodeToString(make([]byte, 32)) + `","y":"` + b64.EncodeToString(make([]byte, 32)) + `"}]}`,
+		`{"keys":[{"kty":"oct","k":"c2hvcnQ"}]}`,
+		`{"keys":`,
+	} {
+		_, err := ParseJWKS([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+	ks, err := ParseJWKS([]byte(`{"keys":[{"kty":"RSA","use":"enc"},{"kty":"EC","crv":"secp256k1"}]}`))
+	require.NoError(t, err)
+	assert.Empty(t, ks)
+}
@@ -0,0 +1,258 @@
+// Package jwt verifies JSON Web Tokens: compact JWS (RFC 7515) signed with
+// HS256, RS256, ES256 or EdDSA, with keys from a JWKS (RFC 7517) file or
+// URL, and the exp, nbf, iss and aud claims of RFC 7519.
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// errors a token is turned away with. their text goes to the client as the
+// error_description of the Bearer challenge.
+var (
+	ErrMalformed      = errors.New("malformed token")
+	ErrUnsupportedAlg = errors.New("unsupported algorithm")
+	ErrNoKey          = errors.New("no key to verify the token")
+	ErrSignature      = errors.New("invalid signature")
+	ErrExpired        = errors.New("token expired")
+	ErrNotYetValid    = errors.New("token not valid yet")
+	ErrIssuer         = errors.New("wrong issuer")
+	ErrAudience       = errors.New("wrong audience")
+)
+
+// Signing algorithms.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Claims are a token's claims. JSON numbers are float64.
+type Claims map[string]any
+
+// String returns a string claim, "" if it is missing or not a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Subject returns the sub claim.
+func (c Claims) Subject() string { return c.String("sub") }
+
+// Issuer returns the iss claim.
+func (c Claims) Issuer() string { return c.String("iss") }
+
+// Audience returns the aud claim, which may be a string or a list.
+func (c Claims) Audience() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []any:
+		var out []string
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Time returns a NumericDate claim like exp.
+func (c Claims) Time(name string) (time.Time, bool) {
+	f, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, frac := int64(f), f-float64(int64(f))
+	return time.Unix(sec, int64(frac*1e9)), true
+}
+
+// Scopes returns the space separated scope claim, or the scp list some
+// providers use instead.
+func (c Claims) Scopes() []string {
+	if s := c.String("scope"); s != "" {
+		return strings.Fields(s)
+	}
+	if scp, ok := c["scp"].([]any); ok {
+		var out []string
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Token is a parsed, not yet verified, token.
+type Token struct {
+	Header Header
+	Claims Claims
+
+	signingInput string
+	signature    []byte
+}
+
+// Parse splits a compact JWS and decodes its header and claims. it checks
+// nothing, see Verifier.
+func Parse(token string) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrMalformed, len(parts))
+	}
+	var t Token
+	if err := decodeJSON(parts[0], &t.Header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrMalformed, err)
+	}
+	if err := decodeJSON(parts[1], &t.Claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrMalformed, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrMalformed, err)
+	}
+	t.signingInput = parts[0] + "." + parts[1]
+	t.signature = sig
+	return &t, nil
+}
+
+func decodeJSON(part string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if d.More() {
+		return errors.New("trailing data")
+	}
+	return nil
+}
+
+// VerifySignature checks the token's signature with key, which must suit
+// the token's algorithm: []byte for HS256, *rsa.PublicKey for RS256,
+// *ecdsa.PublicKey on P-256 for ES256 and ed25519.PublicKey for EdDSA.
+// the key type is what decides, so an RSA public key can never be used as
+// an HMAC secret.
+func (t *Token) VerifySignature(key any) error {
+	input := []byte(t.signingInput)
+	switch t.Header.Algorithm {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrNoKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		if !hmac.Equal(mac.Sum(nil), t.signature) {
+			return ErrSignature
+		}
+	case RS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrNoKey
+		}
+		sum := sha256.Sum256(input)
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], t.signature) != nil {
+			return ErrSignature
+		}
+	case ES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().Name != "P-256" {
+			return ErrNoKey
+		}
+		// r and s, 32 bytes each, not ASN.1
+		if len(t.signature) != 64 {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(t.signature[:32])
+		s := new(big.Int).SetBytes(t.signature[32:])
+		sum := sha256.Sum256(input)
+		if !ecdsa.Verify(pub, sum[:], r, s) {
+			return ErrSignature
+		}
+	case EdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrNoKey
+		}
+		if !ed25519.Verify(pub, input, t.signature) {
+			return ErrSignature
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedAlg, t.Header.Algorithm)
+	}
+	return nil
+}
+
+// Expectations are what the claims are checked against.
+type Expectations struct {
+	// Issuer must equal iss when set.
+	Issuer string
+	// Audience must be one of aud when set.
+	Audience string
+	// Leeway is the clock skew allowed on exp and nbf.
+	Leeway time.Duration
+	// RequireExp turns away tokens without exp.
+	RequireExp bool
+}
+
+// Validate checks the time and identity claims at now.
+func (c Claims) Validate(want Expectations, now time.Time) error {
+	if exp, ok := c.Time("exp"); ok {
+		if !now.Before(exp.Add(want.Leeway)) {
+			return ErrExpired
+		}
+	} else if _, present := c["exp"]; present || want.RequireExp {
+		return fmt.Errorf("%w: exp missing or not a number", ErrMalformed)
+	}
+	if nbf, ok := c.Time("nbf"); ok {
+		if now.Add(want.Leeway).Before(nbf) {
+			return ErrNotYetValid
+		}
+	} else if _, present := c["nbf"]; present {
+		return fmt.Errorf("%w: nbf not a number", ErrMalformed)
+	}
+	if want.Issuer != "" && c.Issuer() != want.Issuer {
+		return ErrIssuer
+	}
+	if want.Audience != "" {
+		found := false
+		for _, aud := range c.Audience() {
+			if aud == want.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrAudience
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/auth"
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+var b64 = base64.RawURLEncoding
+
+// keys are the test keys, one per algorithm.
+type keys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	ed     ed25519.PrivateKey
+}
+
+func newKeys(t *testing.T) *keys {
+	t.Helper()
+	k := &keys{secret: bytes.Repeat([]byte("k"), 32)}
+	var err error
+	k.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	k.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, k.ed, err = ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return k
+}
+
+// sign makes a token like an identity provider would.
+func (k *keys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	h, err := json.Marshal(Header{Algorithm: alg, KeyID: kid, Type: "JWT"})
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	input := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	sum := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch alg {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case RS256:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, sum[:])
+		require.NoError(t, err)
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, sum[:])
+		require.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case EdDSA:
+		sig = ed25519.Sign(k.ed, []byte(input))
+	}
+	return input + "." + b64.EncodeToString(sig)
+}
+
+// jwks renders the public keys as a JWKS document.
+func (k *keys) jwks(t *testing.T) []byte {
+	t.Helper()
+	ecPub := k.ec.PublicKey
+	point, err := ecPub.Bytes()
+	require.NoError(t, err)
+	doc := map[string]any{"keys": []map[string]any{
+		{"kty": "oct", "kid": "hs", "alg": "HS256", "k": b64.EncodeToString(k.secret)},
+		{"kty": "RSA", "kid": "rs", "use": "sig", "n": b64.EncodeToString(k.rsa.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "es", "crv": "P-256", "x": b64.EncodeToString(point[1:33]), "y": b64.EncodeToString(point[33:])},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64.EncodeToString(k.ed.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "EC", "kid": "p384", "crv": "P-384", "x": "AA", "y": "AA"},
+	}}
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	return data
+}
+
+func TestVerify(t *testing.T) {
+	k := newKeys(t)
+	ks, err := ParseJWKS(k.jwks(t))
+	require.NoError(t, err)
+	require.Len(t, ks, 4)
+
+	clk := &clock{time.Unix(1700000000, 0)}
+	v := New(Config{
+		Keys:         ks,
+		Expectations: Expectations{Issuer: "https://id.example.com", Audience: "hermes", Leeway: 30 * time.Second},
+	})
+	v.now = clk.now
+	claims := map[string]any{
+		"sub": "alice",
+		"iss": "https://id.example.com",
+		"aud": []string{"other", "hermes"},
+		"exp": 1700000060,
+		"nbf": 1699999990.5,
+	}
+
+	for alg, kid := range map[string]string{HS256: "hs", RS256: "rs", ES256: "es", EdDSA: "ed"} {
+		c, err := v.Verify(context.Background(), k.sign(t, alg, kid, claims))
+		require.NoError(t, err, alg)
+		assert.Equal(t, "alice", c.Subject())
+
+		// without a kid every key for the algorithm is tried
+		_, err = v.Verify(context.Background(), k.sign(t, alg, "", claims))
+		assert.NoError(t, err, alg)
+	}
+
+	// Test: Tampered tokens and swapped keys
+	token := k.sign(t, RS256, "rs", claims)
+	_, err = v.Verify(context.Background(), token[:len(token)-4]+"AAAA")
+	assert.ErrorIs(t, err, ErrSignature)
+	_, err = v.Verify(context.Background(), k.sign(t, HS256, "rs", claims))
+	assert.ErrorIs(t, err, ErrNoKey)
+	_, err = v.Verify(context.Background(), k.sign(t, "none", "", claims))
+	assert.ErrorIs(t, err, ErrUnsupportedAlg)
+	_, err = v.Verify(context.Background(), "a.b")
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Claims, with the leeway
+	for _, tc := range []struct {
+		name  string
+		at    int64
+		claim string
+		value any
+		err   error
+	}{
+		{"expired within leeway", 1700000080, "", nil, nil},
+		{"expired", 1700000090, "", nil, ErrExpired},
+		{"early within leeway", 1699999961, "", nil, nil},
+		{"early", 1699999960, "", nil, ErrNotYetValid},
+		{"issuer", 1700000000, "iss", "https://evil.example.com", ErrIssuer},
+		{"audience", 1700000000, "aud", "other", ErrAudience},
+		{"bad exp", 1700000000, "exp", "tomorrow", ErrMalformed},
+	} {
+		c := map[string]any{}
+		for name, value := range claims {
+			c[name] = value
+		}
+		if tc.claim != "" {
+			c[tc.claim] = tc.value
+		}
+		clk.t = time.Unix(tc.at, 0)
+		_, err := v.Verify(context.Background(), k.sign(t, ES256, "es", c))
+		if tc.err == nil {
+			assert.NoError(t, err, tc.name)
+		} else {
+			assert.ErrorIs(t, err, tc.err, tc.name)
+		}
+	}
+}
+
+// do runs a request through the middleware and returns the response and
+// the principal the handler saw, nil if it wasn't reached.
+func do(t *testing.T, v *Verifier, h headers.Headers) (*http.Response, *auth.Principal) {
+	t.Helper()
+	req := &request.Request{RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/"}, Headers: h}
+	var seen *auth.Principal
+	resp := servertest.Do(t, v.Middleware()(func(w *response.Writer, req *request.Request) {
+		seen = auth.Get(req)
+		_, _ = w.Write([]byte("ok"))
+	}), req)
+	return resp, seen
+}
+
+func TestMiddleware(t *testing.T) {
+	k := newKeys(t)
+	ks, err := ParseJWKS(k.jwks(t))
+	require.NoError(t, err)
+	v := New(Config{Keys: ks, Algorithms: []string{EdDSA}, Scopes: []string{"read"}, Cookie: "id_token", Realm: "api"})
+	good := k.sign(t, EdDSA, "ed", map[string]any{"sub": "alice", "scope": "read write"})
+
+	resp, p := do(t, v, headers.Headers{"authorization": "Bearer " + good})
+	assert.Equal(t, 200, resp.StatusCode)
+	require.NotNil(t, p)
+	assert.Equal(t, "alice", p.Name)
+	assert.Equal(t, "read write", p.Claims["scope"])
+
+	resp, p = do(t, v, headers.Headers{"cookie": "theme=dark; id_token=" + good})
+	assert.Equal(t, 200, resp.StatusCode)
+	require.NotNil(t, p)
+	assert.Equal(t, "alice", p.Name)
+
+	for _, tc := range []struct {
+		name      string
+		h         headers.Headers
+		status    int
+		challenge string
+	}{
+		{"no token", headers.Headers{}, 401, `Bearer realm="api"`},
+		{"other alg", headers.Headers{"authorization": "Bearer " + k.sign(t, ES256, "es", map[string]any{"scope": "read"})}, 401,
+			`Bearer realm="api", error="invalid_token", error_description="unsupported algorithm: ES256"`},
+		{"expired", headers.Headers{"cookie": "id_token=" + k.sign(t, EdDSA, "ed", map[string]any{"exp": 1})}, 401,
+			`Bearer realm="api", error="invalid_token", error_description="token expired"`},
+		{"scope", headers.Headers{"authorization": "Bearer " + k.sign(t, EdDSA, "ed", map[string]any{"scp": []string{"write"}})}, 403,
+			`Bearer realm="api", error="insufficient_scope"`},
+	} {
+		resp, p := do(t, v, tc.h)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.name)
+		assert.Nil(t, p, tc.name)
+		assert.Equal(t, tc.challenge, resp.Header.Get("WWW-Authenticate"), tc.name)
+	}
+}
@@ -0,0 +1,114 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/auth"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// Config configures a Verifier.
+type Config struct {
+	Keys KeyStore
+	// Algorithms are the algorithms accepted, all four if empty. "none" is
+	// never accepted.
+	Algorithms []string
+	Expectations
+	// Scopes must all be granted by the token, or the request gets 403.
+	Scopes []string
+	// Cookie is a cookie the token may come in when there's no
+	// Authorization header, for browser sessions.
+	Cookie string
+	// Realm goes in the Bearer challenge.
+	Realm string
+}
+
+// Verifier checks tokens against a Config.
+type Verifier struct {
+	cfg Config
+	now func() time.Time
+}
+
+// New creates a Verifier.
+func New(cfg Config) *Verifier {
+	if len(cfg.Algorithms) == 0 {
+		cfg.Algorithms = []string{HS256, RS256, ES256, EdDSA}
+	}
+	return &Verifier{cfg: cfg, now: time.Now}
+}
+
+// Verify parses token, checks its signature against the key store and
+// validates its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	t, err := Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(v.cfg.Algorithms, t.Header.Algorithm) {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlg, t.Header.Algorithm)
+	}
+	// why the keys couldn't be loaded is none of the client's business
+	keys, err := v.cfg.Keys.Lookup(ctx, t.Header.KeyID, t.Header.Algorithm)
+	if err != nil {
+		return nil, ErrNoKey
+	}
+	err = ErrNoKey
+	for _, k := range keys {
+		if err = t.VerifySignature(k.Key); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Claims.Validate(v.cfg.Expectations, v.now()); err != nil {
+		return nil, err
+	}
+	granted := t.Claims.Scopes()
+	for _, s := range v.cfg.Scopes {
+		if !slices.Contains(granted, s) {
+			return nil, fmt.Errorf("%w: %s required", auth.ErrInsufficientScope, s)
+		}
+	}
+	return t.Claims, nil
+}
+
+// VerifyToken implements auth.TokenVerifier, so a Verifier can back an
+// auth.Bearer next to other schemes. the principal is named after sub.
+func (v *Verifier) VerifyToken(req *request.Request, token string) (*auth.Principal, error) {
+	claims, err := v.Verify(req.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Principal{Name: claims.Subject(), Scheme: "Bearer", Claims: claims}, nil
+}
+
+// Middleware requires a valid token in Authorization or in the cookie.
+// failures get 401, or 403 for missing scopes, with a Bearer challenge
+// saying what was wrong. handlers read the claims with auth.Get.
+func (v *Verifier) Middleware() server.Middleware {
+	bearer := &auth.Bearer{Realm: v.cfg.Realm, Verifier: v}
+	a := auth.New(auth.Config{Schemes: []auth.Scheme{bearer}})
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			p, _, err := a.Authenticate(req)
+			if errors.Is(err, auth.ErrNoCredentials) && v.cfg.Cookie != "" && req.Headers["authorization"] == "" {
+				if c, ok := req.Cookie(v.cfg.Cookie); ok && c.Value != "" {
+					p, err = bearer.Authenticate(req, c.Value)
+				}
+			}
+			if err != nil {
+				a.Unauthorized(w, req, bearer, err)
+				return
+			}
+			auth.SetPrincipal(req, p)
+			next(w, req)
+		}
+	}
+}
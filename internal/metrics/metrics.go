@@ -0,0 +1,328 @@
+// Package metrics is a small set of counters, gauges and histograms that
+// render in the Prometheus text exposition format (version 0.0.4).
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the media type of the exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are latency buckets in seconds, the same as the Prometheus
+// client libraries use.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families and writes them out in registration order.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// family is every series of one metric name.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string // label values, in family label order
+
+	value atomic.Int64 // counter or gauge
+
+	mu     sync.Mutex // histogram
+	counts []uint64   // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) register(name, help string, k kind, buckets []float64, labels []string) *family {
+	if !validName(name, true) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	for _, l := range labels {
+		if !validName(l, false) || l == "le" {
+			panic(fmt.Sprintf("metrics: invalid label name %q", l))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic(fmt.Sprintf("metrics: %s registered twice", name))
+		}
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    k,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter only goes up.
+type Counter struct{ s *series }
+
+// Inc adds one.
+func (c Counter) Inc() { c.s.value.Add(1) }
+
+// Add adds n, which must not be negative.
+func (c Counter) Add(n int64) {
+	if n < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.s.value.Add(n)
+}
+
+// Value returns the current count.
+func (c Counter) Value() int64 { return c.s.value.Load() }
+
+// Gauge goes up and down.
+type Gauge struct{ s *series }
+
+// Inc adds one.
+func (g Gauge) Inc() { g.s.value.Add(1) }
+
+// Dec subtracts one.
+func (g Gauge) Dec() { g.s.value.Add(-1) }
+
+// Set replaces the value.
+func (g Gauge) Set(v int64) { g.s.value.Store(v) }
+
+// Value returns the current value.
+func (g Gauge) Value() int64 { return g.s.value.Load() }
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe records v.
+func (h Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if i < len(h.s.counts) {
+		h.s.counts[i]++
+	}
+	h.s.sum += v
+	h.s.count++
+}
+
+// NewCounter registers a counter without labels.
+func (r *Registry) NewCounter(name, help string) Counter {
+	return Counter{r.register(name, help, kindCounter, nil, nil).with(nil)}
+}
+
+// NewGauge registers a gauge without labels.
+func (r *Registry) NewGauge(name, help string) Gauge {
+	return Gauge{r.register(name, help, kindGauge, nil, nil).with(nil)}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ f *family }
+
+// NewCounterVec registers a counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) CounterVec {
+	return CounterVec{r.register(name, help, kindCounter, nil, labels)}
+}
+
+// With returns the counter for the label values, in label order.
+func (v CounterVec) With(values ...string) Counter {
+	return Counter{v.f.with(values)}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct{ f *family }
+
+// NewHistogramVec registers a histogram with the given upper bounds, which
+// must be sorted. the +Inf bucket is implied.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %s buckets are not sorted", name))
+	}
+	return HistogramVec{r.register(name, help, kindHistogram, slices.Clone(buckets), labels)}
+}
+
+// With returns the histogram for the label values, in label order.
+func (v HistogramVec) With(values ...string) Histogram {
+	return Histogram{v.f.with(values), v.f.buckets}
+}
+
+// WriteTo writes every family in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	slices.SortFunc(all, func(a, b *series) int {
+		return slices.Compare(a.values, b.values)
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range all {
+		if f.kind != kindHistogram {
+			writeSample(w, f.name, f.labels, s.values, "", strconv.FormatInt(s.value.Load(), 10))
+			continue
+		}
+
+		s.mu.Lock()
+		counts := slices.Clone(s.counts)
+		sum, count := s.sum, s.count
+		s.mu.Unlock()
+
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += counts[i]
+			writeSample(w, f.name+"_bucket", f.labels, s.values, formatFloat(le), strconv.FormatUint(cumulative, 10))
+		}
+		writeSample(w, f.name+"_bucket", f.labels, s.values, "+Inf", strconv.FormatUint(count, 10))
+		writeSample(w, f.name+"_sum", f.labels, s.values, "", formatFloat(sum))
+		writeSample(w, f.name+"_count", f.labels, s.values, "", strconv.FormatUint(count, 10))
+	}
+}
+
+// writeSample writes one line, le is the extra histogram label if not empty.
+func writeSample(w *bufio.Writer, name string, labels, values []string, le, value string) {
+	w.WriteString(name)
+	if len(labels) > 0 || le != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(values[i]))
+			w.WriteByte('"')
+		}
+		if le != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(`le="`)
+			w.WriteString(le)
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// validName checks [a-zA-Z_:][a-zA-Z0-9_:]*, label names can't have colons.
+func validName(s string, colon bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		ok := c == '_' || (colon && c == ':') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(i > 0 && c >= '0' && c <= '9')
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
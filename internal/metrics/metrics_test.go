@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExposition(t *testing.T) {
+	reg := NewRegistry()
+	g := reg.NewGauge("conns", "Open connections.")
+	c := reg.NewCounterVec("reqs_total", "Requests\nby \\ code.", "code", "path")
+	h := reg.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	c.With("2xx", `/a"b`).Add(3)
+	c.With("2xx", "/").Inc()
+	h.With("x").Observe(0.05)
+	h.With("x").Observe(0.1)
+	h.With("x").Observe(5)
+
+	var b strings.Builder
+	n, err := reg.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Equal(t, int64(b.Len()), n)
+	assert.Equal(t, `# HELP conns Open connections.
+# TYPE conns gauge
+conns 1
+# HELP reqs_total Requests\nby \\ code.
+# TYPE reqs_total counter
+reqs_total{code="2xx",path="/"} 1
+reqs_total{code="2xx",path="/a\"b"} 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="x",le="0.1"} 2
+latency_seconds_bucket{route="x",le="1"} 2
+latency_seconds_bucket{route="x",le="+Inf"} 3
+latency_seconds_sum{route="x"} 5.15
+latency_seconds_count{route="x"} 3
+`, b.String())
+}
+
+func TestRegisterChecks(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("a_total", "")
+	assert.Panics(t, func() { reg.NewCounter("a_total", "") }, "duplicate name")
+	assert.Panics(t, func() { reg.NewGauge("1bad", "") }, "bad metric name")
+	assert.Panics(t, func() { reg.NewCounterVec("b_total", "", "a:b") }, "colon in label")
+	assert.Panics(t, func() { reg.NewHistogramVec("c", "", []float64{1}, "le") }, "reserved label")
+	assert.Panics(t, func() { reg.NewHistogramVec("d", "", []float64{2, 1}) }, "unsorted buckets")
+
+	c := reg.NewCounterVec("e_total", "", "x")
+	assert.Panics(t, func() { c.With() }, "missing label value")
+}
@@ -0,0 +1,132 @@
+package mtls
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrRevoked is returned for a certificate on a CRL.
+var ErrRevoked = errors.New("certificate revoked")
+
+// CRL is a certificate revocation list file, PEM (one or more X509 CRL
+// blocks) or DER. the file is read again when its modification time
+// changes, so a cron job fetching a fresh list is all that's needed. a
+// list past its NextUpdate is still used.
+type CRL struct {
+	path string
+
+	mu      sync.RWMutex
+	lists   []*x509.RevocationList
+	revoked []map[string]bool // serial numbers per list
+	modTime time.Time
+}
+
+// LoadCRL reads a CRL file.
+func LoadCRL(path string) (*CRL, error) {
+	c := &CRL{path: path}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload rereads the file. the old lists stay if it fails.
+func (c *CRL) Reload() error {
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	lists, err := parseCRLs(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.path, err)
+	}
+	revoked := make([]map[string]bool, len(lists))
+	for i, l := range lists {
+		revoked[i] = make(map[string]bool, len(l.RevokedCertificateEntries))
+		for _, e := range l.RevokedCertificateEntries {
+			revoked[i][e.SerialNumber.String()] = true
+		}
+	}
+	c.mu.Lock()
+	c.lists, c.revoked, c.modTime = lists, revoked, fi.ModTime()
+	c.mu.Unlock()
+	return nil
+}
+
+func parseCRLs(data []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		l, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{l}, nil
+	}
+	var lists []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		l, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	if len(lists) == 0 {
+		return nil, errors.New("no X509 CRL blocks found")
+	}
+	return lists, nil
+}
+
+// reloadIfChanged picks up a new file. one that doesn't parse is tried
+// again on the next handshake, the old lists go on working meanwhile.
+func (c *CRL) reloadIfChanged() {
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return
+	}
+	c.mu.RLock()
+	changed := !fi.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+	if changed {
+		_ = c.Reload()
+	}
+}
+
+// Check fails if a certificate in any of the verified chains is revoked by
+// a list its issuer signed.
+func (c *CRL) Check(chains [][]*x509.Certificate) error {
+	c.reloadIfChanged()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for j, l := range c.lists {
+				if !bytes.Equal(l.RawIssuer, cert.RawIssuer) || !c.revoked[j][cert.SerialNumber.String()] {
+					continue
+				}
+				// only a list the issuer really signed counts
+				if l.CheckSignatureFrom(issuer) == nil {
+					return fmt.Errorf("%w: serial %s", ErrRevoked, cert.SerialNumber)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Package mtls authenticates clients by their TLS certificate: it sets up
+// the server's tls.Config to ask for client certificates and verify them
+// against a CA pool and a CRL, exposes the verified identity, lets routes
+// allow only certain identities, and forwards identities to upstreams.
+package mtls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+)
+
+// ClientAuth is the server side of mutual TLS.
+type ClientAuth struct {
+	// CAs are the roots client certificates must chain to.
+	CAs *x509.CertPool
+	// Require turns away handshakes without a certificate. otherwise one is
+	// asked for and verified if sent, and a Policy decides per route.
+	Require bool
+	// CRL turns away revoked certificates when set.
+	CRL *CRL
+}
+
+// Apply sets cfg up to verify client certificates. call it before handing
+// cfg to server.WithTLS, which takes a copy.
+func (c ClientAuth) Apply(cfg *tls.Config) {
+	cfg.ClientCAs = c.CAs
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.Require {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if c.CRL != nil {
+		crl := c.CRL
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return crl.Check(cs.VerifiedChains)
+		}
+	}
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: %w", path, errNoCerts)
+	}
+	return pool, nil
+}
+
+var errNoCerts = errors.New("no PEM certificates found")
+
+// Identity is what a verified client certificate says about the client.
+type Identity struct {
+	// Subject is the distinguished name, e.g. "CN=billing,O=Example".
+	Subject    string
+	CommonName string
+	// the subject alternative names
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	IPAddresses    []string
+	// Fingerprint is the SHA-256 of the certificate, lowercase hex.
+	Fingerprint string
+	Cert        *x509.Certificate
+}
+
+// NewIdentity describes cert.
+func NewIdentity(cert *x509.Certificate) *Identity {
+	sum := sha256.Sum256(cert.Raw)
+	id := &Identity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Fingerprint:    hex.EncodeToString(sum[:]),
+		Cert:           cert,
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		id.IPAddresses = append(id.IPAddresses, ip.String())
+	}
+	return id
+}
+
+// Get returns the identity of the request's verified client certificate,
+// nil without one.
+func Get(req *request.Request) *Identity {
+	cert := req.PeerCertificate()
+	if cert == nil {
+		return nil
+	}
+	return NewIdentity(cert)
+}
+
+// Name is the name an identity goes by: the first URI SAN (a SPIFFE ID
+// for instance), else the common name, else the first DNS name.
+func (id *Identity) Name() string {
+	switch {
+	case len(id.URIs) > 0:
+		return id.URIs[0]
+	case id.CommonName != "":
+		return id.CommonName
+	case len(id.DNSNames) > 0:
+		return id.DNSNames[0]
+	}
+	return id.Subject
+}
+
+// ForwardHeader carries the client's identity to upstreams, in the format
+// Envoy uses.
+const ForwardHeader = "X-Forwarded-Client-Cert"
+
+// Forward sets ForwardHeader through set, e.g. an outgoing request's
+// Header.Set, when the request came with a verified certificate:
+//
+//	Hash=<fingerprint>;Subject="CN=billing";URI=spiffe://example.com/billing;DNS=billing.internal
+//
+// whatever the client sent in that header itself must not be passed on.
+func Forward(req *request.Request, set func(key, value string)) {
+	id := Get(req)
+	if id == nil {
+		return
+	}
+	set(ForwardHeader, id.forwardValue())
+}
+
+func (id *Identity) forwardValue() string {
+	var b strings.Builder
+	b.WriteString("Hash=" + id.Fingerprint)
+	b.WriteString(";Subject=" + xfccQuote(id.Subject))
+	for _, u := range id.URIs {
+		b.WriteString(";URI=" + xfccEscape(u))
+	}
+	for _, d := range id.DNSNames {
+		b.WriteString(";DNS=" + xfccEscape(d))
+	}
+	return b.String()
+}
+
+var xfccEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func xfccQuote(s string) string {
+	return `"` + xfccEscaper.Replace(s) + `"`
+}
+
+// xfccEscape quotes a value holding one of the separators.
+func xfccEscape(s string) string {
+	if strings.ContainsAny(s, `,;="\`) {
+		return xfccQuote(s)
+	}
+	return s
+}
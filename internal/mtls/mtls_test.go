@@ -0,0 +1,212 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/auth"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ca is a throwaway certificate authority.
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newCA(t *testing.T) *ca {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &ca{cert: cert, key: key, pool: pool}
+}
+
+// issue signs a leaf certificate, tmpl gives the serial and names.
+func (c *ca) issue(t *testing.T, tmpl *x509.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCRL writes a PEM CRL revoking serials.
+func (c *ca) writeCRL(t *testing.T, path string, serials ...int64) {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, s := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, c.cert, c.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600))
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newCA(t)
+	serverCert := pki.issue(t, &x509.Certificate{SerialNumber: big.NewInt(10), DNSNames: []string{"localhost"}}, x509.ExtKeyUsageServerAuth)
+	spiffe, _ := url.Parse("spiffe://example.com/billing")
+	alice := pki.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(11),
+		Subject:      pkix.Name{CommonName: "alice", Organization: []string{"Example"}},
+		URIs:         []*url.URL{spiffe},
+		DNSNames:     []string{"billing.internal"},
+	}, x509.ExtKeyUsageClientAuth)
+	bob := pki.issue(t, &x509.Certificate{SerialNumber: big.NewInt(12), Subject: pkix.Name{CommonName: "bob"}}, x509.ExtKeyUsageClientAuth)
+	stranger := newCA(t).issue(t, &x509.Certificate{SerialNumber: big.NewInt(11), Subject: pkix.Name{CommonName: "alice"}}, x509.ExtKeyUsageClientAuth)
+
+	crlPath := filepath.Join(t.TempDir(), "ca.crl")
+	pki.writeCRL(t, crlPath, 12)
+	crl, err := LoadCRL(crlPath)
+	require.NoError(t, err)
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	ClientAuth{CAs: pki.pool, CRL: crl}.Apply(cfg)
+	policy := New(Config{
+		Route:  func(req *request.Request) string { return req.RequestLine.URL.Path },
+		Routes: map[string]*Rule{"/admin": {URIs: []string{"spiffe://example.com/billing"}}, "/any": {}},
+	})
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		var b strings.Builder
+		if p := auth.Get(req); p != nil {
+			b.WriteString(p.Scheme + " " + p.Name + "\n")
+		}
+		Forward(req, func(k, v string) { b.WriteString(k + ": " + v) })
+		_, _ = w.Write([]byte(b.String()))
+	}, policy.Middleware())
+	s, err := server.Serve(0, handler, server.WithTLS(cfg))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	get := func(cert *tls.Certificate, path string) (int, string, error) {
+		tlsCfg := &tls.Config{RootCAs: pki.pool, ServerName: "localhost"}
+		if cert != nil {
+			tlsCfg.Certificates = []tls.Certificate{*cert}
+		}
+		tr := &http.Transport{TLSClientConfig: tlsCfg}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Get("https://" + s.Addr().String() + path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), nil
+	}
+
+	// Test: Without a certificate only open routes work
+	status, body, err := get(nil, "/")
+	require.NoError(t, err)
+	assert.Equal(t, 200, status)
+	assert.Empty(t, body)
+	status, _, err = get(nil, "/any")
+	require.NoError(t, err)
+	assert.Equal(t, 403, status)
+
+	// Test: The identity reaches the handler and the upstream header
+	status, body, err = get(&alice, "/admin")
+	require.NoError(t, err)
+	assert.Equal(t, 200, status)
+	lines := strings.Split(body, "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, "mTLS spiffe://example.com/billing", lines[0])
+	assert.Regexp(t, `^X-Forwarded-Client-Cert: Hash=[0-9a-f]{64};Subject="CN=alice,O=Example";URI=spiffe://example.com/billing;DNS=billing.internal$`, lines[1])
+
+	// Test: Routes only let in the identities they list
+	status, _, err = get(&bob, "/admin")
+	require.Error(t, err, "bob is revoked")
+	pki.writeCRL(t, crlPath)
+	require.NoError(t, os.Chtimes(crlPath, time.Now(), time.Now().Add(time.Second)))
+	status, _, err = get(&bob, "/admin")
+	require.NoError(t, err)
+	assert.Equal(t, 403, status)
+	status, body, err = get(&bob, "/any")
+	require.NoError(t, err)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "mTLS bob\n", body[:9])
+
+	// Test: Certificates from another CA fail the handshake
+	_, _, err = get(&stranger, "/")
+	assert.Error(t, err)
+
+	// Test: A reloaded CRL revokes alice
+	pki.writeCRL(t, crlPath, 11)
+	require.NoError(t, os.Chtimes(crlPath, time.Now(), time.Now().Add(2*time.Second)))
+	_, _, err = get(&alice, "/admin")
+	assert.Error(t, err)
+}
+
+func TestRequireClientCert(t *testing.T) {
+	pki := newCA(t)
+	cfg := &tls.Config{}
+	ClientAuth{CAs: pki.pool, Require: true}.Apply(cfg)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	assert.Nil(t, cfg.VerifyConnection)
+	ClientAuth{CAs: pki.pool}.Apply(cfg)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, cfg.ClientAuth)
+}
+
+func TestRule(t *testing.T) {
+	pki := newCA(t)
+	cert := pki.issue(t, &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "svc"},
+		EmailAddresses: []string{"ops@example.com"},
+	}, x509.ExtKeyUsageClientAuth)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	id := NewIdentity(leaf)
+	assert.Equal(t, "svc", id.Name())
+
+	colons := strings.ToUpper(id.Fingerprint[:2]) + ":" + id.Fingerprint[2:]
+	for _, r := range []Rule{{}, {CommonNames: []string{"svc"}}, {Emails: []string{"ops@example.com"}}, {Fingerprints: []string{colons}}} {
+		assert.True(t, r.Allows(id), r)
+		assert.False(t, r.Allows(nil), r)
+	}
+	for _, r := range []Rule{{CommonNames: []string{"other"}}, {DNSNames: []string{"svc"}}, {Fingerprints: []string{"00"}}} {
+		assert.False(t, r.Allows(id), r)
+	}
+}
@@ -0,0 +1,103 @@
+package mtls
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/auth"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// Rule lists the identities allowed on a route. an identity matching any
+// entry is allowed, an empty Rule allows any verified certificate.
+type Rule struct {
+	CommonNames []string
+	DNSNames    []string
+	URIs        []string
+	Emails      []string
+	// Fingerprints are SHA-256 fingerprints in hex, colons and case don't
+	// matter.
+	Fingerprints []string
+}
+
+// Allows reports whether the rule lets id through.
+func (r *Rule) Allows(id *Identity) bool {
+	if id == nil {
+		return false
+	}
+	if len(r.CommonNames)+len(r.DNSNames)+len(r.URIs)+len(r.Emails)+len(r.Fingerprints) == 0 {
+		return true
+	}
+	if slices.Contains(r.CommonNames, id.CommonName) {
+		return true
+	}
+	for _, fp := range r.Fingerprints {
+		if strings.EqualFold(strings.ReplaceAll(fp, ":", ""), id.Fingerprint) {
+			return true
+		}
+	}
+	return anyIn(r.DNSNames, id.DNSNames) || anyIn(r.URIs, id.URIs) || anyIn(r.Emails, id.EmailAddresses)
+}
+
+func anyIn(allowed, have []string) bool {
+	for _, h := range have {
+		if slices.Contains(allowed, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Config configures a Policy.
+type Config struct {
+	// Default applies to routes without an entry in Routes. nil lets
+	// requests through with or without a certificate.
+	Default *Rule
+	// Route names the route of a request for Routes. a route listed with a
+	// nil Rule is open.
+	Route  server.RouteFunc
+	Routes map[string]*Rule
+}
+
+// Policy is the middleware state.
+type Policy struct {
+	cfg Config
+}
+
+// New creates a Policy.
+func New(cfg Config) *Policy {
+	return &Policy{cfg: cfg}
+}
+
+// rule returns the rule for req, nil if it is open.
+func (p *Policy) rule(req *request.Request) *Rule {
+	if p.cfg.Route != nil {
+		if r, ok := p.cfg.Routes[p.cfg.Route(req)]; ok {
+			return r
+		}
+	}
+	return p.cfg.Default
+}
+
+// Middleware answers 403 Forbidden to requests whose certificate the
+// route's rule doesn't allow, or that have none. allowed clients become
+// the request's auth principal, scheme "mTLS".
+func (p *Policy) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id := Get(req)
+			if r := p.rule(req); r != nil && !r.Allows(id) {
+				w.Header().Set("Content-Type", "text/plain")
+				_ = w.WriteStatusLine(response.StatusForbidden)
+				_, _ = w.Write([]byte(response.StatusText(response.StatusForbidden) + "\n"))
+				return
+			}
+			if id != nil {
+				auth.SetPrincipal(req, &auth.Principal{Name: id.Name(), Scheme: "mTLS"})
+			}
+			next(w, req)
+		}
+	}
+}
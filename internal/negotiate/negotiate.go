@@ -0,0 +1,253 @@
+// Package negotiate implements proactive content negotiation (RFC 9110
+// 12.5): parsing the Accept* request headers and picking the best of what
+// the server can send.
+package negotiate
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+)
+
+// MediaRange is one element of an Accept header.
+type MediaRange struct {
+	Type    string // lowercase, "*" for any
+	Subtype string // lowercase, "*" for any
+	Params  map[string]string
+	Q       float64
+}
+
+// specificity ranks how narrowly a range matches: */* < type/* < type/sub <
+// type/sub with parameters.
+func (r MediaRange) specificity() int {
+	switch {
+	case r.Type == "*":
+		return 0
+	case r.Subtype == "*":
+		return 1
+	}
+	return 2 + len(r.Params)
+}
+
+// Preference is one element of Accept-Language, Accept-Charset or
+// Accept-Encoding.
+type Preference struct {
+	Value string // lowercase, "*" for any
+	Q     float64
+}
+
+// ParseAccept parses an Accept header, most preferred first: by q-value,
+// then by specificity. malformed elements are dropped.
+func ParseAccept(v string) []MediaRange {
+	var ranges []MediaRange
+	for _, elem := range splitList(v) {
+		mt, params, q, ok := parseElement(elem)
+		if !ok {
+			continue
+		}
+		typ, sub, ok := strings.Cut(mt, "/")
+		if !ok || typ == "" || sub == "" || (typ == "*" && sub != "*") {
+			continue
+		}
+		ranges = append(ranges, MediaRange{Type: typ, Subtype: sub, Params: params, Q: q})
+	}
+	slices.SortStableFunc(ranges, func(a, b MediaRange) int {
+		if a.Q != b.Q {
+			return cmpDesc(a.Q, b.Q)
+		}
+		return b.specificity() - a.specificity()
+	})
+	return ranges
+}
+
+// ParsePreferences parses Accept-Language, Accept-Charset or
+// Accept-Encoding, most preferred first.
+func ParsePreferences(v string) []Preference {
+	var prefs []Preference
+	for _, elem := range splitList(v) {
+		value, _, q, ok := parseElement(elem)
+		if !ok {
+			continue
+		}
+		prefs = append(prefs, Preference{Value: value, Q: q})
+	}
+	slices.SortStableFunc(prefs, func(a, b Preference) int { return cmpDesc(a.Q, b.Q) })
+	return prefs
+}
+
+func cmpDesc(a, b float64) int {
+	switch {
+	case a > b:
+		return -1
+	case a < b:
+		return 1
+	}
+	return 0
+}
+
+// ContentType returns the offer the Accept header likes best, "" if it
+// accepts none of them. offers are media types, optionally with
+// parameters, in the server's order of preference, which breaks ties. a
+// missing Accept header accepts anything.
+func ContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return first(offers)
+	}
+	ranges := ParseAccept(accept)
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		mt, params, _, ok := parseElement(offer)
+		if !ok {
+			continue
+		}
+		typ, sub, _ := strings.Cut(mt, "/")
+		// the most specific matching range decides the offer's quality
+		q, spec := 0.0, -1
+		for _, r := range ranges {
+			if !r.matches(typ, sub, params) || r.specificity() <= spec {
+				continue
+			}
+			q, spec = r.Q, r.specificity()
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+func (r MediaRange) matches(typ, sub string, params map[string]string) bool {
+	if r.Type != "*" && r.Type != typ {
+		return false
+	}
+	if r.Subtype != "*" && r.Subtype != sub {
+		return false
+	}
+	for k, v := range r.Params {
+		if !strings.EqualFold(params[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Language returns the offered language tag Accept-Language likes best,
+// matching ranges by prefix (RFC 4647 3.3.1 basic filtering: "en" matches
+// "en-GB"). "" if none is acceptable; a missing header accepts the first.
+func Language(acceptLanguage string, offers []string) string {
+	return bestPreference(acceptLanguage, offers, func(rng, offer string) bool {
+		return rng == offer || strings.HasPrefix(offer, rng+"-")
+	})
+}
+
+// Charset returns the offered charset Accept-Charset likes best, "" if none
+// is acceptable; a missing header accepts the first.
+func Charset(acceptCharset string, offers []string) string {
+	return bestPreference(acceptCharset, offers, func(rng, offer string) bool {
+		return rng == offer
+	})
+}
+
+// bestPreference scores each offer by the longest range that matches it,
+// "*" being the shortest.
+func bestPreference(header string, offers []string, match func(rng, offer string) bool) string {
+	if strings.TrimSpace(header) == "" {
+		return first(offers)
+	}
+	prefs := ParsePreferences(header)
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		o := strings.ToLower(offer)
+		q, matched := 0.0, -1
+		for _, p := range prefs {
+			length := len(p.Value)
+			if p.Value == "*" {
+				length = 0
+			} else if !match(p.Value, o) {
+				continue
+			}
+			if length > matched {
+				q, matched = p.Q, length
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+func first(offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	return offers[0]
+}
+
+// Negotiate picks the content type to answer req with and adds Accept to
+// Vary, since the answer depends on it. if nothing offered is acceptable it
+// sends 406 Not Acceptable listing the offers and returns false; the
+// handler should just return.
+func Negotiate(w *response.Writer, req *request.Request, offers ...string) (string, bool) {
+	w.Header().AddToken("Vary", "Accept")
+	if ct := ContentType(req.Headers["accept"], offers); ct != "" {
+		return ct, true
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_ = w.WriteStatusLine(response.StatusNotAcceptable)
+	_, _ = w.Write([]byte("Not Acceptable, available: " + strings.Join(offers, ", ") + "\n"))
+	return "", false
+}
+
+// parseElement parses `value;name=param;q=0.5` into the lowercased value,
+// its parameters and its q-value (1 if absent). ok is false for an empty
+// value or an invalid q.
+func parseElement(elem string) (value string, params map[string]string, q float64, ok bool) {
+	parts := headers.SplitQuoted(elem, ';')
+	value = strings.ToLower(strings.TrimSpace(parts[0]))
+	if value == "" {
+		return "", nil, 0, false
+	}
+	q = 1
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		k = strings.ToLower(strings.TrimSpace(k))
+		v = strings.TrimSpace(v)
+		if k == "" {
+			continue
+		}
+		if k == "q" {
+			// weight = OWS ";" OWS "q=" qvalue, 0 to 1 with up to 3 decimals
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 || len(v) > 5 {
+				return "", nil, 0, false
+			}
+			q = f
+			// anything after q is an accept-ext, not a media type parameter
+			break
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[k] = headers.Unquote(v)
+	}
+	return value, params, q, true
+}
+
+// splitList splits a comma separated field value, skipping empty elements
+// and commas inside quoted strings.
+func splitList(v string) []string {
+	var out []string
+	for _, e := range headers.SplitQuoted(v, ',') {
+		if e = strings.TrimSpace(e); e != "" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
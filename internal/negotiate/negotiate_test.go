@@ -0,0 +1,89 @@
+package negotiate
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccept(t *testing.T) {
+	ranges := ParseAccept(`text/*;q=0.3, text/html;q=0.7, text/html;level=1, text/html;level=2;q=0.4, */*;q=0.5, bogus, a/b;q=2`)
+	var got []string
+	for _, r := range ranges {
+		got = append(got, r.Type+"/"+r.Subtype+" "+r.Params["level"])
+	}
+	assert.Equal(t, []string{
+		"text/html 1", "text/html ", "*/* ", "text/html 2", "text/* ",
+	}, got)
+
+	// Test: Quoted parameters may hold commas and semicolons
+	ranges = ParseAccept(`text/plain; format="a,b;c", text/csv`)
+	require.Len(t, ranges, 2)
+	assert.Equal(t, "a,b;c", ranges[0].Params["format"])
+	assert.Equal(t, "csv", ranges[1].Subtype)
+}
+
+func TestContentType(t *testing.T) {
+	offers := []string{"application/json", "text/html", "text/plain"}
+	for accept, want := range map[string]string{
+		"":                                      "application/json",
+		"text/html":                             "text/html",
+		"TEXT/HTML":                             "text/html",
+		"text/*":                                "text/html",
+		"text/*;q=0.5, text/plain":              "text/plain",
+		"*/*;q=0.1, application/json;q=0":       "text/html",
+		"image/png":                             "",
+		"text/*, text/html;q=0, text/plain;q=0": "",
+		// browsers: html beats the */* fallback
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": "text/html",
+		// ties go to the server's order
+		"text/plain, application/json": "application/json",
+	} {
+		assert.Equal(t, want, ContentType(accept, offers), "Accept: %s", accept)
+	}
+
+	// Test: Range parameters must match the offer's
+	assert.Equal(t, "text/html;level=1", ContentType("text/html;level=1", []string{"text/html", "text/html;level=1"}))
+}
+
+func TestLanguageAndCharset(t *testing.T) {
+	langs := []string{"en-US", "fr", "de-CH"}
+	assert.Equal(t, "fr", Language("fr-CA, fr;q=0.8, en;q=0.5", langs))
+	assert.Equal(t, "en-US", Language("en", langs))
+	assert.Equal(t, "de-CH", Language("DE, *;q=0.1", langs))
+	assert.Equal(t, "fr", Language("*, en;q=0", langs))
+	assert.Equal(t, "", Language("ja", langs))
+	assert.Equal(t, "en-US", Language("", langs))
+
+	assert.Equal(t, "utf-8", Charset("iso-8859-5, UTF-8;q=0.9", []string{"utf-8"}))
+	assert.Equal(t, "", Charset("iso-8859-5", []string{"utf-8"}))
+	assert.Equal(t, "utf-8", Charset("*;q=0.1", []string{"utf-8"}))
+}
+
+func TestNegotiate(t *testing.T) {
+	run := func(accept string) (string, bool, *http.Response) {
+		var ct string
+		var ok bool
+		resp := servertest.Do(t, func(w *response.Writer, req *request.Request) {
+			ct, ok = Negotiate(w, req, "application/json", "text/html")
+		}, &request.Request{Headers: headers.Headers{"accept": accept}})
+		return ct, ok, resp
+	}
+
+	ct, ok, resp := run("text/html")
+	assert.True(t, ok)
+	assert.Equal(t, "text/html", ct)
+	assert.Equal(t, "Accept", resp.Header.Get("Vary"))
+
+	// Test: Nothing acceptable is a 406
+	_, ok, resp = run("image/*")
+	assert.False(t, ok)
+	assert.Equal(t, 406, resp.StatusCode)
+	assert.Equal(t, "Accept", resp.Header.Get("Vary"))
+}
@@ -0,0 +1,224 @@
+// Package proxyproto reads the PROXY protocol header (versions 1 and 2) a
+// load balancer puts in front of a connection to pass on the real client
+// and server addresses.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoHeader means the connection doesn't start with a PROXY header.
+	// nothing has been consumed.
+	ErrNoHeader = errors.New("proxyproto: no PROXY header")
+	// ErrInvalidHeader means the connection starts like a PROXY header but
+	// the header is malformed.
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+)
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLen is the longest a version 1 line can be, CRLF included.
+const v1MaxLen = 107
+
+// Header is a parsed PROXY header.
+type Header struct {
+	Version int
+	// Local is set for v2 LOCAL and v1 UNKNOWN: the connection was made by
+	// the proxy itself (health checks) and the real addresses apply.
+	Local       bool
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// Read parses a PROXY header off r. it returns ErrNoHeader, with nothing
+// read, if r doesn't start with one.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		sig, err := r.Peek(6)
+		if err != nil || string(sig) != "PROXY " {
+			return nil, ErrNoHeader
+		}
+		return readV1(r)
+	case '\r':
+		sig, err := r.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(sig, v2Signature) {
+			return nil, ErrNoHeader
+		}
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n".
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 line too long or not CRLF terminated", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// the rest of the line is to be ignored
+		h.Local = true
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	src, err1 := parseV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	dst, err2 := parseV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip, port string, v4 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != v4 || addr.Zone() != "" {
+		return netip.AddrPort{}, ErrInvalidHeader
+	}
+	// ports are plain decimal, no sign and no leading zeros
+	if port == "" || (len(port) > 1 && port[0] == '0') || strings.ContainsAny(port, "+-") {
+		return netip.AddrPort{}, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, ErrInvalidHeader
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// v2 commands, address families and transport protocols.
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famUnspec = 0x0
+	famInet   = 0x1
+	famInet6  = 0x2
+	famUnix   = 0x3
+
+	protoStream = 0x1
+)
+
+// readV2 parses the binary header: signature, version and command, family
+// and protocol, length, addresses and TLVs. TLVs are skipped.
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidHeader, fixed[12]>>4)
+	}
+	cmd := fixed[12] & 0xf
+	fam, proto := fixed[13]>>4, fixed[13]&0xf
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
+	}
+
+	h := &Header{Version: 2}
+	switch cmd {
+	case cmdLocal:
+		h.Local = true
+		return h, nil
+	case cmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: command %d", ErrInvalidHeader, cmd)
+	}
+	if proto != protoStream {
+		// a datagram or unknown transport has no business on a TCP conn
+		return nil, fmt.Errorf("%w: transport protocol %d", ErrInvalidHeader, proto)
+	}
+
+	switch fam {
+	case famInet:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidHeader)
+		}
+		h.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[0:4])), binary.BigEndian.Uint16(body[8:]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[4:8])), binary.BigEndian.Uint16(body[10:]))
+	case famInet6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidHeader)
+		}
+		h.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[0:16])), binary.BigEndian.Uint16(body[32:]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[16:32])), binary.BigEndian.Uint16(body[34:]))
+	case famUnspec, famUnix:
+		// nothing we can use as an IP address, keep the real ones
+		h.Local = true
+	default:
+		return nil, fmt.Errorf("%w: address family %d", ErrInvalidHeader, fam)
+	}
+	return h, nil
+}
+
+// Conn is a connection with its PROXY header read. reads continue after the
+// header and the addresses are the ones the header carried.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	Header *Header
+}
+
+// NewConn reads the header off conn. without one it returns ErrNoHeader
+// and a Conn that still replays whatever was peeked.
+func NewConn(conn net.Conn) (*Conn, error) {
+	c := &Conn{Conn: conn, r: bufio.NewReader(conn)}
+	h, err := Read(c.r)
+	if err != nil {
+		return c, err
+	}
+	c.Header = h
+	return c, nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the header.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header == nil || c.Header.Local {
+		return c.Conn.RemoteAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.Header.Source)
+}
+
+// LocalAddr returns the address the client connected to, from the header.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Header == nil || c.Header.Local {
+		return c.Conn.LocalAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.Header.Destination)
+}
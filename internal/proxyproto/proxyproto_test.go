@@ -0,0 +1,100 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nGET / HTTP/1.1\r\n"))
+	h, err := Read(r)
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Version)
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.1:56324"), h.Source)
+	assert.Equal(t, netip.MustParseAddrPort("198.51.100.2:443"), h.Destination)
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest), "only the header is consumed")
+
+	h, err = Read(bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n")))
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("[2001:db8::1]:1"), h.Source)
+
+	h, err = Read(bufio.NewReader(strings.NewReader("PROXY UNKNOWN ff ff\r\n")))
+	require.NoError(t, err)
+	assert.True(t, h.Local)
+
+	for _, bad := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 056324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n",
+		"PROXY " + strings.Repeat("x", 200) + "\r\n",
+	} {
+		_, err := Read(bufio.NewReader(strings.NewReader(bad)))
+		assert.ErrorIs(t, err, ErrInvalidHeader, bad)
+	}
+}
+
+func v2Header(cmd, fam byte, addrs []byte) string {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|cmd, fam<<4|1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return string(append(b, addrs...))
+}
+
+func TestV2(t *testing.T) {
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 2}
+	addrs = binary.BigEndian.AppendUint16(addrs, 56324)
+	addrs = binary.BigEndian.AppendUint16(addrs, 443)
+	addrs = append(addrs, 0x04, 0, 1, 'x') // a NOOP TLV, skipped
+	r := bufio.NewReader(strings.NewReader(v2Header(cmdProxy, famInet, addrs) + "GET"))
+	h, err := Read(r)
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.1:56324"), h.Source)
+	assert.Equal(t, netip.MustParseAddrPort("198.51.100.2:443"), h.Destination)
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "GET", string(rest))
+
+	src, dst := netip.MustParseAddr("2001:db8::1").As16(), netip.MustParseAddr("2001:db8::2").As16()
+	addrs = append(append(src[:], dst[:]...), 0, 80, 1, 187)
+	h, err = Read(bufio.NewReader(strings.NewReader(v2Header(cmdProxy, famInet6, addrs))))
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("[2001:db8::2]:443"), h.Destination)
+
+	h, err = Read(bufio.NewReader(strings.NewReader(v2Header(cmdLocal, famUnspec, nil))))
+	require.NoError(t, err)
+	assert.True(t, h.Local)
+
+	_, err = Read(bufio.NewReader(strings.NewReader(v2Header(cmdProxy, famInet, []byte{1, 2, 3}))))
+	assert.ErrorIs(t, err, ErrInvalidHeader, "short addresses")
+	_, err = Read(bufio.NewReader(strings.NewReader(v2Header(0x5, famInet, addrs))))
+	assert.ErrorIs(t, err, ErrInvalidHeader, "unknown command")
+
+	// Test: Only STREAM transports are proxied
+	for _, proto := range []byte{0x0, 0x2} {
+		hdr := []byte(v2Header(cmdProxy, famInet, addrs))
+		hdr[13] = famInet<<4 | proto
+		_, err = Read(bufio.NewReader(strings.NewReader(string(hdr))))
+		assert.ErrorIs(t, err, ErrInvalidHeader, "protocol %d", proto)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	for _, in := range []string{"GET / HTTP/1.1\r\n", "PRI * HTTP/2.0\r\n", "POST / HTTP/1.1\r\n", "\r\n\r\nnope"} {
+		r := bufio.NewReader(strings.NewReader(in))
+		_, err := Read(r)
+		assert.ErrorIs(t, err, ErrNoHeader, in)
+		rest, _ := io.ReadAll(r)
+		assert.Equal(t, in, string(rest), "nothing consumed")
+	}
+}
@@ -0,0 +1,258 @@
+// Package ratelimit limits how often a client can make requests, with a
+// token bucket or a sliding window per key, and reports the quota in the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// Algorithm picks how requests are counted.
+type Algorithm int
+
+const (
+	// TokenBucket refills Requests tokens per Period up to Burst, so short
+	// bursts go through while the average rate is kept.
+	TokenBucket Algorithm = iota
+	// SlidingWindow allows Requests per Period, weighing the previous window
+	// by how much of it still overlaps the last Period. Burst is not used.
+	SlidingWindow
+)
+
+// Limit is a quota.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	// Burst is the token bucket size, Requests if 0.
+	Burst int
+}
+
+// PerSecond, PerMinute and PerHour are shorthands for a Limit.
+func PerSecond(n int) Limit { return Limit{Requests: n, Period: time.Second} }
+func PerMinute(n int) Limit { return Limit{Requests: n, Period: time.Minute} }
+func PerHour(n int) Limit   { return Limit{Requests: n, Period: time.Hour} }
+
+// WithBurst returns l with the given burst.
+func (l Limit) WithBurst(n int) Limit {
+	l.Burst = n
+	return l
+}
+
+func (l Limit) capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// Decision is the outcome of one check.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the quota is back to full
+	RetryAfter time.Duration // until the next request would be allowed, 0 if allowed
+}
+
+// KeyFunc picks what a request is counted against. returning "" skips the
+// limit for the request.
+type KeyFunc func(req *request.Request) string
+
+// ByClientIP counts requests per effective client address.
+func ByClientIP(req *request.Request) string {
+	if req.ClientIP.IsValid() {
+		return req.ClientIP.String()
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// ByHeader counts requests per value of a header, e.g. an API key.
+func ByHeader(name string) KeyFunc {
+	name = strings.ToLower(name)
+	return func(req *request.Request) string {
+		return req.Headers[name]
+	}
+}
+
+// ByRoute counts all requests to a route together, whoever makes them.
+func ByRoute(route server.RouteFunc) KeyFunc {
+	return func(req *request.Request) string {
+		return route(req)
+	}
+}
+
+// Config configures a Limiter.
+type Config struct {
+	Algorithm Algorithm
+	// Limit applies to every route without its own entry in Routes.
+	Limit Limit
+	// Key defaults to ByClientIP.
+	Key KeyFunc
+	// Route names the route of a request for Routes. a route listed with
+	// a zero Limit is not limited.
+	Route  server.RouteFunc
+	Routes map[string]Limit
+	// MaxKeys bounds the number of tracked keys, DefaultMaxKeys if 0.
+	MaxKeys int
+}
+
+// Limiter enforces a Config.
+type Limiter struct {
+	cfg   Config
+	store *store
+	now   func() time.Time
+}
+
+// New creates a Limiter.
+func New(cfg Config) *Limiter {
+	if cfg.Key == nil {
+		cfg.Key = ByClientIP
+	}
+	return &Limiter{cfg: cfg, store: newStore(cfg.MaxKeys), now: time.Now}
+}
+
+// state is the per-key bookkeeping of either algorithm.
+type state struct {
+	// token bucket
+	tokens float64
+	last   time.Time
+
+	// sliding window
+	windowStart time.Time
+	prev, curr  int
+}
+
+// Allow counts one request for key against limit.
+func (l *Limiter) Allow(key string, limit Limit) Decision {
+	now := l.now()
+	return l.store.update(key, func(st *state) Decision {
+		if l.cfg.Algorithm == SlidingWindow {
+			return slidingWindow(st, limit, now)
+		}
+		return tokenBucket(st, limit, now)
+	})
+}
+
+func tokenBucket(st *state, limit Limit, now time.Time) Decision {
+	capacity := float64(limit.capacity())
+	perSec := float64(limit.Requests) / limit.Period.Seconds()
+
+	if st.last.IsZero() {
+		st.tokens = capacity
+	} else {
+		st.tokens = math.Min(capacity, st.tokens+now.Sub(st.last).Seconds()*perSec)
+	}
+	st.last = now
+
+	d := Decision{Limit: int(capacity)}
+	if st.tokens >= 1 {
+		st.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = seconds((1 - st.tokens) / perSec)
+	}
+	d.Remaining = int(st.tokens)
+	d.Reset = seconds((capacity - st.tokens) / perSec)
+	return d
+}
+
+func slidingWindow(st *state, limit Limit, now time.Time) Decision {
+	period := limit.Period
+	switch {
+	case st.windowStart.IsZero() || now.Sub(st.windowStart) >= 2*period:
+		st.windowStart = now.Truncate(period)
+		st.prev, st.curr = 0, 0
+	case now.Sub(st.windowStart) >= period:
+		st.windowStart = st.windowStart.Add(period)
+		st.prev, st.curr = st.curr, 0
+	}
+
+	elapsed := now.Sub(st.windowStart)
+	overlap := 1 - float64(elapsed)/float64(period)
+	used := float64(st.prev)*overlap + float64(st.curr)
+
+	d := Decision{Limit: limit.Requests, Reset: period - elapsed}
+	if used+1 <= float64(limit.Requests) {
+		st.curr++
+		used++
+		d.Allowed = true
+	} else {
+		d.RetryAfter = slidingRetry(st, limit, elapsed)
+	}
+	d.Remaining = max(0, limit.Requests-int(math.Ceil(used)))
+	return d
+}
+
+// slidingRetry works out when the weighted count leaves room for one more
+// request: later in this window as the previous one fades out, or in the
+// next window once this one has faded enough. rounded to the millisecond to
+// keep float noise out.
+func slidingRetry(st *state, limit Limit, elapsed time.Duration) time.Duration {
+	period := float64(limit.Period)
+	room := float64(limit.Requests - 1 - st.curr)
+	if room >= 0 && st.prev > 0 {
+		// prev * (1 - x) <= room
+		x := 1 - room/float64(st.prev)
+		return (time.Duration(x*period) - elapsed).Round(time.Millisecond)
+	}
+	// next window: curr * (1 - y) <= Requests - 1
+	y := 1 - float64(limit.Requests-1)/float64(st.curr)
+	return (limit.Period - elapsed + time.Duration(max(y, 0)*period)).Round(time.Millisecond)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ceilSeconds rounds d up to whole seconds for the headers.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Middleware limits requests and answers 429 Too Many Requests with
+// Retry-After once a client is over its quota.
+func (l *Limiter) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			limit := l.cfg.Limit
+			var route string
+			if l.cfg.Route != nil {
+				route = l.cfg.Route(req)
+				if rl, ok := l.cfg.Routes[route]; ok {
+					limit = rl
+				}
+			}
+			key := l.cfg.Key(req)
+			if limit.Requests <= 0 || limit.Period <= 0 || key == "" {
+				next(w, req)
+				return
+			}
+
+			// routes with their own limit get their own counters
+			d := l.Allow(route+"\x00"+key, limit)
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+			h.Set("RateLimit-Reset", ceilSeconds(d.Reset))
+			if !d.Allowed {
+				h.Set("Retry-After", ceilSeconds(d.RetryAfter))
+				h.Set("Content-Type", "text/plain")
+				_ = w.WriteStatusLine(response.StatusTooManyRequests)
+				_, _ = w.Write([]byte(response.StatusText(response.StatusTooManyRequests) + "\n"))
+				return
+			}
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clock is a fake time source tests move by hand.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newLimiter(cfg Config) (*Limiter, *clock) {
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(cfg)
+	l.now = c.now
+	return l, c
+}
+
+func TestTokenBucket(t *testing.T) {
+	l, c := newLimiter(Config{})
+	limit := PerSecond(2).WithBurst(4)
+
+	for i := range 4 {
+		d := l.Allow("k", limit)
+		require.True(t, d.Allowed, "burst request %d", i)
+		assert.Equal(t, 3-i, d.Remaining)
+	}
+	d := l.Allow("k", limit)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 4, d.Limit)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter)
+	assert.Equal(t, 2*time.Second, d.Reset)
+
+	c.advance(500 * time.Millisecond)
+	assert.True(t, l.Allow("k", limit).Allowed, "one token refilled")
+	assert.False(t, l.Allow("k", limit).Allowed)
+	assert.True(t, l.Allow("other", limit).Allowed, "keys are independent")
+
+	c.advance(time.Hour)
+	assert.Equal(t, 3, l.Allow("k", limit).Remaining, "refill stops at the burst size")
+}
+
+func TestSlidingWindow(t *testing.T) {
+	l, c := newLimiter(Config{Algorithm: SlidingWindow})
+	limit := PerMinute(10)
+
+	for range 10 {
+		require.True(t, l.Allow("k", limit).Allowed)
+	}
+	d := l.Allow("k", limit)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+	assert.Equal(t, time.Minute, d.Reset)
+	assert.Equal(t, time.Minute+6*time.Second, d.RetryAfter, "next window, once 10*(1-y) <= 9")
+
+	// a quarter into the next window, 7.5 of the previous 10 still count
+	c.advance(time.Minute + 15*time.Second)
+	d = l.Allow("k", limit)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+	assert.True(t, l.Allow("k", limit).Allowed)
+	d = l.Allow("k", limit)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 3*time.Second, d.RetryAfter, "at 18s only 7 of the previous count")
+
+	c.advance(2 * time.Minute)
+	assert.Equal(t, 9, l.Allow("k", limit).Remaining, "an idle window resets the count")
+}
+
+func TestStoreEviction(t *testing.T) {
+	l, _ := newLimiter(Config{MaxKeys: 2})
+	limit := PerHour(1)
+
+	assert.True(t, l.Allow("a", limit).Allowed)
+	assert.True(t, l.Allow("b", limit).Allowed)
+	assert.False(t, l.Allow("a", limit).Allowed, "a is now the most recent")
+	assert.True(t, l.Allow("c", limit).Allowed, "evicts b")
+	assert.Equal(t, 2, l.store.len())
+	assert.True(t, l.Allow("b", limit).Allowed, "b starts over")
+	assert.False(t, l.Allow("c", limit).Allowed)
+}
+
+func TestMiddleware(t *testing.T) {
+	l, _ := newLimiter(Config{
+		Limit: PerMinute(1),
+		Route: func(req *request.Request) string { return req.RequestLine.RequestTarget },
+		Routes: map[string]Limit{
+			"/login":  PerMinute(2),
+			"/health": {},
+		},
+	})
+	handler := l.Middleware()(func(w *response.Writer, req *request.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	do := func(target, ip string) (string, response.StatusCode) {
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: "GET", RequestTarget: target, HTTPVersion: "1.1"},
+			Headers:     headers.NewHeaders(),
+			ClientIP:    netip.MustParseAddr(ip),
+		}
+		var out bytes.Buffer
+		w := response.NewWriter(&out)
+		handler(w, req)
+		_ = w.Close()
+		return out.String(), w.Status()
+	}
+
+	out, status := do("/", "192.0.2.1")
+	assert.Equal(t, response.StatusOK, status)
+	assert.Contains(t, out, "RateLimit-Limit: 1\r\n")
+	assert.Contains(t, out, "RateLimit-Remaining: 0\r\n")
+	assert.Contains(t, out, "RateLimit-Reset: 60\r\n")
+
+	out, status = do("/", "192.0.2.1")
+	assert.Equal(t, response.StatusTooManyRequests, status)
+	assert.Contains(t, out, "Retry-After: 60\r\n")
+
+	_, status = do("/", "192.0.2.2")
+	assert.Equal(t, response.StatusOK, status, "another client")
+
+	for i := range 2 {
+		_, status = do("/login", "192.0.2.1")
+		assert.Equal(t, response.StatusOK, status, fmt.Sprint("login ", i))
+	}
+	_, status = do("/login", "192.0.2.1")
+	assert.Equal(t, response.StatusTooManyRequests, status)
+
+	for range 5 {
+		out, status = do("/health", "192.0.2.1")
+		assert.Equal(t, response.StatusOK, status)
+		assert.NotContains(t, out, "RateLimit-")
+	}
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultMaxKeys bounds the store unless configured otherwise.
+const DefaultMaxKeys = 10_000
+
+// store keeps per-key limiter state, dropping the least recently used key
+// once it holds maxKeys. a dropped client starts over with a full quota,
+// which is the price of bounded memory.
+type store struct {
+	mu      sync.Mutex
+	maxKeys int
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key   string
+	state state
+}
+
+func newStore(maxKeys int) *store {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	return &store{
+		maxKeys: maxKeys,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// update runs fn on the state for key under the store lock, creating it
+// zeroed if the key is new.
+func (s *store) update(key string, fn func(st *state) Decision) Decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if ok {
+		s.order.MoveToFront(el)
+	} else {
+		el = s.order.PushFront(&entry{key: key})
+		s.entries[key] = el
+		if s.order.Len() > s.maxKeys {
+			oldest := s.order.Back()
+			s.order.Remove(oldest)
+			delete(s.entries, oldest.Value.(*entry).key)
+		}
+	}
+	return fn(&el.Value.(*entry).state)
+}
+
+func (s *store) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
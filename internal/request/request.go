@@ -4,12 +4,19 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/devwelkin/hermes-lite/internal/cookie"
+	"github.com/devwelkin/hermes-lite/internal/form"
 	"github.com/devwelkin/hermes-lite/internal/headers"
 )
 
@@ -17,8 +24,18 @@ import (
 var (
 	ErrInvalidRequestFormat = errors.New("invalid request line format")
 	ErrUnsupportedHTTP      = errors.New("unsupported http version")
+	// ErrUnsupportedTransferEncoding means the body can't be framed, so
+	// nothing after it on the connection can be trusted either.
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+	ErrInvalidContentLength        = errors.New("invalid content-length")
+	// ErrHeaderTooLarge means the request line and headers ran past the
+	// Reader's MaxHeaderBytes.
+	ErrHeaderTooLarge = errors.New("request header too large")
 )
 
+// DefaultMaxHeaderBytes caps the request line and headers together.
+const DefaultMaxHeaderBytes = 1 << 20
+
 const (
 	stateRequestLine = iota // 0
 	stateHeaders            // 1
@@ -31,70 +48,448 @@ type Request struct {
 	Headers     headers.Headers
 	state       int
 	Body        []byte
+	// Trailers holds trailer fields sent after the body, HTTP/2 only.
+	Trailers headers.Headers
+	// RemoteAddr is the address of the peer that sent the request. it and
+	// the connection details below are set by the server.
+	RemoteAddr string
+	// ClientIP is the effective client address: the peer, or the client
+	// behind it when the peer is a trusted proxy.
+	ClientIP netip.Addr
+	// LocalAddr is the server address the request came in on.
+	LocalAddr string
+	// ConnID identifies the connection, unique within the server.
+	ConnID uint64
+	// Seq is the request's position on its connection, starting at 1.
+	Seq uint64
+	// TLS is the connection's TLS state, nil for plain TCP.
+	TLS *tls.ConnectionState
+	// ReceivedAt is when the request head was read.
+	ReceivedAt time.Time
+
+	ctx      context.Context
+	deferred *deferredBody // set while the body waits on the connection
+	streamed int64         // body bytes read through a stream
+	form     *form.Form    // parsed by ParseForm
+}
+
+// deferredBody is a body left on the connection for the handler.
+type deferredBody struct {
+	rd     *Reader
+	before func() error
 }
 
 type RequestLine struct {
-	HTTPVersion   string
+	HTTPVersion string
+	// RequestTarget is the target as sent, URL is it parsed.
 	RequestTarget string
+	URL           URL
 	Method        string
 }
 
+// RequestFromReader reads one complete request, body included.
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	rd := NewReader(reader)
+	req, err := rd.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	if err := rd.ReadBody(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Reader parses requests off a connection in two steps, the head first and
+// the body when asked for, so the server can look at the headers before the
+// body is pulled in.
+type Reader struct {
+	// MaxHeaderBytes caps the request line and headers of each request, 0
+	// means DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+
+	r       io.Reader
+	buf     []byte // read but not yet parsed
+	readBuf []byte
+	err     error // sticky read error
+	head    int   // bytes of the current request head parsed so far
+}
+
+// NewReader creates a Reader on top of r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:       r,
+		readBuf: make([]byte, 1024),
+	}
+}
+
+// ReadHeader parses the request line and headers. the body is left for
+// ReadBody. it returns io.EOF if the connection ended before the first byte
+// of a request.
+func (rd *Reader) ReadHeader() (*Request, error) {
 	req := &Request{
 		state:   stateRequestLine,
 		Headers: headers.NewHeaders(),
 	}
-	var accumulatedData []byte
+	rd.head = 0
+	if err := rd.advance(req, stateBody); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ReadBody reads the body of a request returned by ReadHeader.
+func (rd *Reader) ReadBody(req *Request) error {
+	req.deferred = nil
+	return rd.advance(req, stateDone)
+}
+
+// DeferBody leaves the body of req unread until the handler calls
+// Request.ReadBody, or streams it with ParseForm or MultipartReader. before,
+// if not nil, runs first, the server uses it to send 100 Continue.
+func (rd *Reader) DeferBody(req *Request, before func() error) {
+	req.deferred = &deferredBody{rd: rd, before: before}
+}
+
+// DiscardBody skips whatever the handler left unread of a deferred body,
+// so the next request can be read.
+func (rd *Reader) DiscardBody(req *Request) error {
+	if req.state >= stateDone {
+		return nil
+	}
+	req.deferred = nil
+	_, err := io.Copy(io.Discard, &bodyReader{rd: rd, req: req})
+	return err
+}
 
-	readBuf := make([]byte, 1024)
+// bodyReader streams a request body straight off the connection.
+type bodyReader struct {
+	rd  *Reader
+	req *Request
+}
 
-	for req.state != stateDone {
-		n, err := reader.Read(readBuf)
+func (b *bodyReader) Read(p []byte) (int, error) {
+	rd, req := b.rd, b.req
+	if req.state >= stateDone {
+		return 0, io.EOF
+	}
+	length, err := req.contentLength()
+	if err != nil {
+		return 0, err
+	}
+	left := int64(length) - req.streamed
+	if left <= 0 {
+		req.state = stateDone
+		return 0, io.EOF
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
 
-		if n > 0 {
-			accumulatedData = append(accumulatedData, readBuf[:n]...)
+	var n int
+	if len(rd.buf) > 0 {
+		n = copy(p, rd.buf)
+		rd.buf = rd.buf[n:]
+	} else {
+		if rd.err != nil {
+			if rd.err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, rd.err
 		}
+		n, rd.err = rd.r.Read(p)
+	}
+	req.streamed += int64(n)
+	if req.streamed == int64(length) {
+		req.state = stateDone
+	}
+	return n, nil
+}
 
-		// keep parsing the buffer until it's empty
-		for {
-			consumed, pErr := req.parse(accumulatedData)
-			if pErr != nil {
-				return nil, pErr
+// advance parses buffered data, reading more as needed, until req reaches
+// the until state.
+func (rd *Reader) advance(req *Request, until int) error {
+	for {
+		// keep parsing the buffer until it runs dry
+		for req.state < until {
+			prev := req.state
+			consumed, err := req.parse(rd.buf)
+			if err != nil {
+				return err
+			}
+			rd.buf = rd.buf[consumed:]
+			if prev < stateBody {
+				rd.head += consumed
+				if rd.head > rd.maxHeaderBytes() {
+					return ErrHeaderTooLarge
+				}
 			}
 
-			if consumed == 0 && req.state != stateDone {
+			if consumed == 0 && req.state == prev {
 				// not enough data in the buffer to parse a full line.
-				// break the *inner* loop to read more data.
 				break
 			}
+		}
 
-			accumulatedData = accumulatedData[consumed:]
+		if req.state >= until {
+			return nil
+		}
+		if req.state < stateBody && rd.head+len(rd.buf) > rd.maxHeaderBytes() {
+			return ErrHeaderTooLarge
+		}
 
-			if req.state == stateDone {
-				// break the *inner* loop.
-				break
+		if rd.err != nil {
+			if rd.err == io.EOF {
+				if req.state == stateRequestLine && len(rd.buf) == 0 {
+					return io.EOF
+				}
+				// If we hit EOF but we are not done parsing, it's an unexpected EOF.
+				return io.ErrUnexpectedEOF
 			}
+			return rd.err
 		}
 
-		if req.state == stateDone {
-			// break the *outer* loop.
-			break
+		n, err := rd.r.Read(rd.readBuf)
+		if n > 0 {
+			rd.buf = append(rd.buf, rd.readBuf[:n]...)
 		}
+		rd.err = err
+	}
+}
 
-		if err == io.EOF {
-			// If we hit EOF but we are not done parsing, it's an unexpected EOF.
-			if req.state != stateDone {
-				return nil, io.ErrUnexpectedEOF
-			}
-			break
+func (rd *Reader) maxHeaderBytes() int {
+	if rd.MaxHeaderBytes > 0 {
+		return rd.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+// Buffered returns the bytes read off the connection but not parsed yet,
+// for handing the connection over to another protocol.
+func (rd *Reader) Buffered() []byte {
+	return rd.buf
+}
+
+// IsHTTP2Preface reports whether this "request" is really the start of the
+// HTTP/2 connection preface (PRI * HTTP/2.0).
+func (r *Request) IsHTTP2Preface() bool {
+	return r.RequestLine.Method == "PRI" && r.RequestLine.RequestTarget == "*" &&
+		r.RequestLine.HTTPVersion == "2.0"
+}
+
+// ExpectsContinue reports whether the client is waiting for 100 Continue
+// before it sends the body. HTTP/1.0 clients don't get one.
+func (r *Request) ExpectsContinue() bool {
+	return r.RequestLine.HTTPVersion != "1.0" &&
+		strings.EqualFold(r.Headers["expect"], "100-continue")
+}
+
+// KeepAlive reports whether the client wants the connection kept open after
+// this request: the default for HTTP/1.1, opt-in for HTTP/1.0.
+func (r *Request) KeepAlive() bool {
+	keep := r.RequestLine.HTTPVersion == "1.1"
+	for _, opt := range strings.Split(r.Headers["connection"], ",") {
+		switch strings.ToLower(strings.TrimSpace(opt)) {
+		case "close":
+			return false
+		case "keep-alive":
+			keep = true
 		}
+	}
+	return keep
+}
+
+// PeerCertificate returns the client certificate the TLS handshake
+// verified, nil if there was none or the server doesn't verify them.
+func (r *Request) PeerCertificate() *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Cookies returns the cookies sent with the request.
+func (r *Request) Cookies() []cookie.Cookie {
+	return cookie.Parse(r.Headers["cookie"])
+}
+
+// Cookie returns the first cookie called name.
+func (r *Request) Cookie(name string) (cookie.Cookie, bool) {
+	return cookie.Get(r.Headers["cookie"], name)
+}
+
+// ParseForm parses a urlencoded or multipart/form-data body within lim. a
+// deferred body is parsed as it comes off the connection, the body as sent,
+// multipart framing included, may be at most lim.MaxTotalSize. the result is
+// kept, later calls return it whatever limits they pass.
+func (r *Request) ParseForm(lim form.Limits) (*form.Form, error) {
+	if r.form != nil {
+		return r.form, nil
+	}
+	body, err := r.formBody(lim.MaxTotalSize)
+	if err != nil {
+		return nil, err
+	}
+	f, err := form.Parse(r.Headers["content-type"], body, lim)
+	if err != nil {
+		return nil, err
+	}
+	r.form = f
+	return f, nil
+}
+
+// Form is ParseForm with form.DefaultLimits.
+func (r *Request) Form() (*form.Form, error) {
+	return r.ParseForm(form.DefaultLimits)
+}
+
+// FormValue returns the first value of a form field, "" if it is missing
+// or the body isn't a form.
+func (r *Request) FormValue(key string) string {
+	f, err := r.Form()
+	if err != nil {
+		return ""
+	}
+	return f.Value.Get(key)
+}
+
+// MultipartReader returns a reader over the parts of a multipart/form-data
+// body, for handlers that stream uploads instead of calling ParseForm. the
+// parts are read off the connection as the handler reads them, up to
+// form.DefaultLimits.MaxTotalSize bytes of body.
+func (r *Request) MultipartReader() (*form.Reader, error) {
+	boundary, err := form.MultipartBoundary(r.Headers["content-type"])
+	if err != nil {
+		return nil, err
+	}
+	body, err := r.formBody(form.DefaultLimits.MaxTotalSize)
+	if err != nil {
+		return nil, err
+	}
+	return form.NewReader(body, boundary), nil
+}
 
+// formBody returns the body for the form parsers, capped at max bytes (0
+// for the default). a body that says up front it is larger is refused
+// without reading it.
+func (r *Request) formBody(max int64) (io.Reader, error) {
+	if max <= 0 {
+		max = form.DefaultLimits.MaxTotalSize
+	}
+	if n, err := r.contentLength(); err == nil && int64(n) > max {
+		return nil, form.ErrBodyTooLarge
+	}
+	return &limitedBody{req: r, left: max}, nil
+}
+
+// limitedBody opens the body on the first read, so a request that turns
+// out not to be a form keeps it, and fails with form.ErrBodyTooLarge past
+// its limit.
+type limitedBody struct {
+	req  *Request
+	r    io.Reader
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.r == nil {
+		r, err := b.req.openBody()
 		if err != nil {
+			return 0, err
+		}
+		b.r = r
+	}
+	if b.left < 0 {
+		return 0, form.ErrBodyTooLarge
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.r.Read(p)
+	if int64(n) > b.left {
+		n, b.left = int(b.left), -1
+		return n, form.ErrBodyTooLarge
+	}
+	b.left -= int64(n)
+	return n, err
+}
+
+// Cleanup removes the temporary files ParseForm spilled uploads into. the
+// server calls it once the handler has returned.
+func (r *Request) Cleanup() error {
+	if r.form == nil {
+		return nil
+	}
+	return r.form.RemoveAll()
+}
+
+// Context returns the request's context, context.Background() if none was
+// set. the server cancels it when the client goes away, when the server is
+// closed, or once the handler has returned.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the request's context. middleware that attaches values
+// derives a context from Context and sets it before calling the next handler.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// ReadBody returns the body, reading it first if the server deferred it
+// (Expect: 100-continue, multipart forms). for every other request Body is
+// already filled in and this just returns it. a deferred body that was
+// streamed by ParseForm or MultipartReader is gone, ReadBody returns nothing.
+func (r *Request) ReadBody() ([]byte, error) {
+	if d := r.deferred; d != nil {
+		r.deferred = nil
+		if d.before != nil {
+			if err := d.before(); err != nil {
+				return nil, err
+			}
+		}
+		if err := d.rd.ReadBody(r); err != nil {
 			return nil, err
 		}
 	}
+	return r.Body, nil
+}
 
-	return req, nil
+// openBody returns a reader over the body, streaming it off the connection
+// if it was deferred.
+func (r *Request) openBody() (io.Reader, error) {
+	d := r.deferred
+	if d == nil {
+		return bytes.NewReader(r.Body), nil
+	}
+	r.deferred = nil
+	if d.before != nil {
+		if err := d.before(); err != nil {
+			return nil, err
+		}
+	}
+	return &bodyReader{rd: d.rd, req: r}, nil
+}
+
+// contentLength returns the declared body length, 0 without one. bodies
+// framed any other way can't be read.
+func (r *Request) contentLength() (int, error) {
+	if _, ok := r.Headers["transfer-encoding"]; ok {
+		return 0, ErrUnsupportedTransferEncoding
+	}
+	value, ok := r.Headers["content-length"]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		// A malformed content-length is a client error.
+		return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+	}
+	return n, nil
 }
 
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
@@ -115,13 +510,23 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 
 	http, httpv, ok := strings.Cut(versionRaw, "/")
 
-	if !ok || http != "HTTP" || (httpv != "1.1" && httpv != "1.0") {
+	// the HTTP/2 connection preface starts out looking like a request line,
+	// the server decides what to do with it
+	isPreface := method == "PRI" && target == "*" && httpv == "2.0"
+
+	if !ok || http != "HTTP" || (httpv != "1.1" && httpv != "1.0" && !isPreface) {
 		return nil, 0, fmt.Errorf("%w: expected 'HTTP/1.1', got '%s'", ErrUnsupportedHTTP, versionRaw)
 	}
 
+	u, err := ParseTarget(method, target)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	reqLine := RequestLine{
 		Method:        method,
 		RequestTarget: target,
+		URL:           u,
 		HTTPVersion:   httpv,
 	}
 
@@ -160,17 +565,9 @@ func (r *Request) parse(data []byte) (int, error) {
 		return 0, nil
 
 	case stateBody:
-		value, ok := r.Headers["content-length"]
-		if !ok {
-			// No content-length
-			r.state = stateDone
-			return 0, nil
-		}
-
-		contentLength, err := strconv.Atoi(value)
+		contentLength, err := r.contentLength()
 		if err != nil {
-			// A malformed content-length is a client error.
-			return 0, fmt.Errorf("invalid content-length value: %q", value)
+			return 0, err
 		}
 
 		if contentLength == 0 {
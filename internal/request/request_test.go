@@ -2,8 +2,10 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
+	"github.com/devwelkin/hermes-lite/internal/form"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -53,17 +55,13 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
 
-	// Test: Invalid method (out of order) Request line -- PARSER BUNU YUTUYOR
+	// Test: Invalid method (out of order) Request line, caught by the target
 	reader = &chunkReader{
 		data:            "/coffee POST HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
 		numBytesPerRead: 3,
 	}
-	r, err = RequestFromReader(reader)
-	require.NoError(t, err) //
-	require.NotNil(t, r)
-	assert.Equal(t, "/coffee", r.RequestLine.Method)
-	assert.Equal(t, "POST", r.RequestLine.RequestTarget)
-	assert.Equal(t, "1.1", r.RequestLine.HTTPVersion)
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidTarget)
 
 	// Test: Invalid version in Request line
 	reader = &chunkReader{
@@ -135,6 +133,38 @@ func TestHeadersParse(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestHeaderSizeLimit(t *testing.T) {
+	head := "GET / HTTP/1.1\r\nHost: localhost\r\nX-Pad: " + strings.Repeat("a", 100) + "\r\n\r\n"
+
+	// Test: A head within the limit parses
+	rd := NewReader(&chunkReader{data: head, numBytesPerRead: 7})
+	rd.MaxHeaderBytes = len(head)
+	_, err := rd.ReadHeader()
+	require.NoError(t, err)
+
+	// Test: One byte over is refused
+	rd = NewReader(&chunkReader{data: head, numBytesPerRead: 7})
+	rd.MaxHeaderBytes = len(head) - 1
+	_, err = rd.ReadHeader()
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: A header line that never ends is cut off at the default
+	endless := "GET / HTTP/1.1\r\nX-Pad: " + strings.Repeat("a", DefaultMaxHeaderBytes)
+	_, err = RequestFromReader(strings.NewReader(endless))
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: The limit is per request, the body doesn't count
+	pipelined := "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 200\r\n\r\n" + strings.Repeat("b", 200) +
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	rd = NewReader(strings.NewReader(pipelined))
+	rd.MaxHeaderBytes = 64
+	req, err := rd.ReadHeader()
+	require.NoError(t, err)
+	require.NoError(t, rd.ReadBody(req))
+	_, err = rd.ReadHeader()
+	require.NoError(t, err)
+}
+
 func TestBodyParse(t *testing.T) {
 	// Test: Standard Body
 	reader := &chunkReader{
@@ -163,6 +193,181 @@ func TestBodyParse(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestDeferredBody(t *testing.T) {
+	// Test: Expect: 100-continue leaves the body unread until asked for
+	reader := &chunkReader{
+		data: "PUT /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"Expect: 100-Continue\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 4,
+	}
+	rd := NewReader(reader)
+	r, err := rd.ReadHeader()
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+	assert.Nil(t, r.Body)
+
+	continued := false
+	rd.DeferBody(r, func() error {
+		continued = true
+		return nil
+	})
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.True(t, continued)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: HTTP/1.0 clients don't get 100 Continue
+	reader = &chunkReader{
+		data:            "PUT /upload HTTP/1.0\r\nExpect: 100-continue\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = NewReader(reader).ReadHeader()
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+
+	// Test: Empty connection is a clean EOF
+	_, err = NewReader(&chunkReader{data: "", numBytesPerRead: 1}).ReadHeader()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Negative Content-Length is rejected
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+}
+
+func TestPipelinedParse(t *testing.T) {
+	data := "POST /one HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nfirst" +
+		"GET /two HTTP/1.1\r\nHost: localhost:42069\r\n\r\n" +
+		"PUT /three HTTP/1.0\r\nConnection: keep-alive\r\nContent-Length: 3\r\n\r\nend"
+
+	// Test: Every read boundary yields the same three requests
+	for perRead := 1; perRead <= len(data); perRead++ {
+		rd := NewReader(&chunkReader{data: data, numBytesPerRead: perRead})
+
+		r, err := rd.ReadHeader()
+		require.NoError(t, err, "perRead=%d", perRead)
+		require.NoError(t, rd.ReadBody(r))
+		assert.Equal(t, "/one", r.RequestLine.RequestTarget)
+		assert.Equal(t, "first", string(r.Body))
+		assert.True(t, r.KeepAlive())
+
+		r, err = rd.ReadHeader()
+		require.NoError(t, err, "perRead=%d", perRead)
+		require.NoError(t, rd.ReadBody(r))
+		assert.Equal(t, "/two", r.RequestLine.RequestTarget)
+		assert.Empty(t, r.Body)
+
+		r, err = rd.ReadHeader()
+		require.NoError(t, err, "perRead=%d", perRead)
+		require.NoError(t, rd.ReadBody(r))
+		assert.Equal(t, "/three", r.RequestLine.RequestTarget)
+		assert.Equal(t, "end", string(r.Body))
+		assert.True(t, r.KeepAlive())
+
+		_, err = rd.ReadHeader()
+		require.ErrorIs(t, err, io.EOF, "perRead=%d", perRead)
+	}
+
+	// Test: Request cut off mid-way is an unexpected EOF, not a clean one
+	rd := NewReader(&chunkReader{data: "GET / HTTP/1.1\r\n\r\nGET /next HT", numBytesPerRead: 7})
+	_, err := rd.ReadHeader()
+	require.NoError(t, err)
+	_, err = rd.ReadHeader()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Keep-alive defaults
+	r, err := RequestFromReader(&chunkReader{data: "GET / HTTP/1.1\r\nConnection: Close\r\n\r\n", numBytesPerRead: 5})
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+	r, err = RequestFromReader(&chunkReader{data: "GET / HTTP/1.0\r\n\r\n", numBytesPerRead: 5})
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Chunked request bodies can't be framed
+	_, err = RequestFromReader(&chunkReader{data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", numBytesPerRead: 5})
+	require.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+}
+
+func TestRequestForm(t *testing.T) {
+	// Test: Urlencoded body
+	body := "a=1&b=two+words"
+	r, err := RequestFromReader(&chunkReader{
+		data:            "POST /f HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 15\r\n\r\n" + body,
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "two words", r.FormValue("b"))
+	assert.Equal(t, "", r.FormValue("c"))
+
+	// Test: Multipart body through the streaming reader
+	body = "--b\r\nContent-Disposition: form-data; name=\"up\"; filename=\"x.txt\"\r\n\r\ndata\r\n--b--\r\n"
+	r, err = RequestFromReader(&chunkReader{
+		data:            "POST /f HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=b\r\nContent-Length: 81\r\n\r\n" + body,
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	mr, err := r.MultipartReader()
+	require.NoError(t, err)
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "x.txt", part.Filename)
+	data, _ := io.ReadAll(part)
+	assert.Equal(t, "data", string(data))
+
+	// Test: A deferred body is parsed straight off the connection, and the
+	// next request is found after it
+	rd := NewReader(&chunkReader{
+		data: "POST /f HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=b\r\nContent-Length: 81\r\n\r\n" + body +
+			"GET /next HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err = rd.ReadHeader()
+	require.NoError(t, err)
+	rd.DeferBody(r, nil)
+	f, err := r.ParseForm(form.Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, "x.txt", f.File["up"][0].Filename)
+	assert.Nil(t, r.Body)
+	require.NoError(t, rd.DiscardBody(r))
+	next, err := rd.ReadHeader()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", next.RequestLine.RequestTarget)
+	require.NoError(t, r.Cleanup())
+
+	// Test: A body declared larger than the limit isn't read, one that
+	// runs past it fails as it streams
+	rd = NewReader(&chunkReader{
+		data:            "POST /f HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=b\r\nContent-Length: 81\r\n\r\n" + body,
+		numBytesPerRead: 7,
+	})
+	r, err = rd.ReadHeader()
+	require.NoError(t, err)
+	rd.DeferBody(r, nil)
+	_, err = r.ParseForm(form.Limits{MaxTotalSize: 80})
+	assert.ErrorIs(t, err, form.ErrBodyTooLarge)
+	require.NoError(t, rd.DiscardBody(r))
+	_, err = rd.ReadHeader()
+	require.ErrorIs(t, err, io.EOF)
+
+	r = &Request{Headers: map[string]string{"content-type": "multipart/form-data; boundary=b"}, Body: []byte(body)}
+	_, err = r.ParseForm(form.Limits{MaxTotalSize: 40})
+	assert.ErrorIs(t, err, form.ErrBodyTooLarge)
+
+	// Test: Not a form
+	r, err = RequestFromReader(&chunkReader{data: "GET / HTTP/1.1\r\n\r\n", numBytesPerRead: 7})
+	require.NoError(t, err)
+	_, err = r.Form()
+	assert.ErrorIs(t, err, form.ErrNotForm)
+	require.NoError(t, r.Cleanup())
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
@@ -0,0 +1,241 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/form"
+)
+
+// ErrInvalidTarget is returned for a request target that doesn't parse, or
+// whose path escapes the root.
+var ErrInvalidTarget = errors.New("invalid request target")
+
+// URL is a parsed request target (RFC 9112 3.2).
+type URL struct {
+	// Scheme and Host are only set for absolute-form targets
+	// (http://host/path), Host alone for CONNECT's authority-form.
+	Scheme string
+	Host   string
+	// Path is the normalized, percent-decoded path: dot segments resolved,
+	// repeated slashes collapsed. it is "*" for an asterisk-form target and
+	// empty for CONNECT. route on this.
+	Path string
+	// RawPath is Path still percent-encoded, with escapes normalized:
+	// unreserved characters decoded, hex digits uppercased. safe to forward.
+	RawPath  string
+	RawQuery string
+}
+
+// Query parses RawQuery. pairs that don't decode are skipped.
+func (u *URL) Query() form.Values {
+	values := form.Values{}
+	for pair := range strings.SplitSeq(u.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err1 := form.Unescape(rawKey)
+		value, err2 := form.Unescape(rawValue)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		values.Add(key, value)
+	}
+	return values
+}
+
+// RequestURI returns the origin-form target: RawPath and the query.
+func (u *URL) RequestURI() string {
+	if u.RawQuery == "" {
+		return u.RawPath
+	}
+	return u.RawPath + "?" + u.RawQuery
+}
+
+// ParseTarget parses the request target of a request with this method.
+func ParseTarget(method, target string) (URL, error) {
+	if target == "" {
+		return URL{}, fmt.Errorf("%w: empty", ErrInvalidTarget)
+	}
+	for i := 0; i < len(target); i++ {
+		if b := target[i]; b <= ' ' || b >= 0x7f {
+			return URL{}, fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+		}
+	}
+	if strings.Contains(target, "#") {
+		// fragments stay on the client
+		return URL{}, fmt.Errorf("%w: fragment in %q", ErrInvalidTarget, target)
+	}
+
+	var u URL
+	switch {
+	case method == "CONNECT":
+		// authority-form, host:port
+		if strings.ContainsAny(target, "/?@") || !strings.Contains(target, ":") {
+			return URL{}, fmt.Errorf("%w: CONNECT to %q", ErrInvalidTarget, target)
+		}
+		u.Host = target
+		return u, nil
+	case target == "*":
+		u.Path, u.RawPath = "*", "*"
+		return u, nil
+	case target[0] != '/':
+		// absolute-form, sent to proxies and allowed everywhere
+		scheme, rest, ok := strings.Cut(target, "://")
+		if !ok || !validScheme(scheme) {
+			return URL{}, fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+		}
+		u.Scheme = strings.ToLower(scheme)
+		i := strings.IndexAny(rest, "/?")
+		if i < 0 {
+			i = len(rest)
+		}
+		u.Host, target = rest[:i], rest[i:]
+		if u.Host == "" || strings.Contains(u.Host, "@") {
+			return URL{}, fmt.Errorf("%w: bad authority in %q", ErrInvalidTarget, target)
+		}
+		if target == "" || target[0] == '?' {
+			target = "/" + target
+		}
+	}
+
+	for i := 0; i < len(target); i++ {
+		if !isTargetChar(target[i]) {
+			// \ and friends mean something else to some file systems
+			// and backends, clients have to escape them
+			return URL{}, fmt.Errorf("%w: %q in %q", ErrInvalidTarget, target[i], target)
+		}
+	}
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	if err := checkEscapes(rawQuery); err != nil {
+		return URL{}, err
+	}
+	u.RawQuery = rawQuery
+	var err error
+	if u.RawPath, u.Path, err = normalizePath(rawPath); err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+func validScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		isLetter := (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+		isOther := (b >= '0' && b <= '9') || b == '+' || b == '-' || b == '.'
+		if !isLetter && (i == 0 || !isOther) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkEscapes makes sure every % starts a valid escape.
+func checkEscapes(s string) error {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && (i+2 >= len(s) || !form.IsHex(s[i+1]) || !form.IsHex(s[i+2])) {
+			return fmt.Errorf("%w: bad escape in %q", ErrInvalidTarget, s)
+		}
+	}
+	return nil
+}
+
+// normalizePath returns the normalized raw and decoded forms of an
+// origin-form path (RFC 3986 6.2.2). escaped slashes, backslashes and NULs
+// are refused since they would change the path's meaning once decoded, and
+// so are dot segments that climb above the root.
+func normalizePath(raw string) (string, string, error) {
+	if raw == "" || raw[0] != '/' {
+		return "", "", fmt.Errorf("%w: path %q", ErrInvalidTarget, raw)
+	}
+
+	// decode what needn't be escaped, so %2E%2E is seen as ..
+	var norm strings.Builder
+	norm.Grow(len(raw))
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '%' {
+			norm.WriteByte(raw[i])
+			continue
+		}
+		if i+2 >= len(raw) || !form.IsHex(raw[i+1]) || !form.IsHex(raw[i+2]) {
+			return "", "", fmt.Errorf("%w: bad escape in %q", ErrInvalidTarget, raw)
+		}
+		c := form.Unhex(raw[i+1])<<4 | form.Unhex(raw[i+2])
+		switch {
+		case c == '/' || c == '\\' || c == 0:
+			return "", "", fmt.Errorf("%w: escaped %q in path", ErrInvalidTarget, c)
+		case isUnreserved(c):
+			norm.WriteByte(c)
+		default:
+			norm.WriteString(strings.ToUpper(raw[i : i+3]))
+		}
+		i += 2
+	}
+
+	// resolve dot segments and empty segments
+	var segs []string
+	rawSegs := strings.Split(norm.String()[1:], "/")
+	for i, seg := range rawSegs {
+		last := i == len(rawSegs)-1
+		switch seg {
+		case ".", "":
+			if last {
+				segs = append(segs, "")
+			}
+		case "..":
+			if len(segs) == 0 {
+				return "", "", fmt.Errorf("%w: %q climbs above the root", ErrInvalidTarget, raw)
+			}
+			segs = segs[:len(segs)-1]
+			if last {
+				segs = append(segs, "")
+			}
+		default:
+			segs = append(segs, seg)
+		}
+	}
+	rawPath := "/" + strings.Join(segs, "/")
+
+	// the path was checked above, every escape is valid
+	path, _ := unescapePath(rawPath)
+	return rawPath, path, nil
+}
+
+// unescapePath decodes %XX escapes; unlike form.Unescape it leaves + alone.
+func unescapePath(s string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+	if err := checkEscapes(s); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' {
+			b.WriteByte(form.Unhex(s[i+1])<<4 | form.Unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+func isUnreserved(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// isTargetChar reports whether c may appear as is in the path or query
+// (RFC 3986 3.3, 3.4): a pchar, % for escapes, / or ?.
+func isTargetChar(c byte) bool {
+	if isUnreserved(c) {
+		return true
+	}
+	return strings.IndexByte("%!$&'()*+,;=:@/?", c) >= 0
+}
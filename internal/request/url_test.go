@@ -0,0 +1,73 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/form"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	// Test: Normalization keeps the meaning of the path
+	for target, want := range map[string][2]string{
+		"/":                     {"/", "/"},
+		"/a/b":                  {"/a/b", "/a/b"},
+		"/a//b///c":             {"/a/b/c", "/a/b/c"},
+		"/a/./b/../c/":          {"/a/c/", "/a/c/"},
+		"/a/b/..":               {"/a/", "/a/"},
+		"/%7Euser/%61bc":        {"/~user/abc", "/~user/abc"},
+		"/caf%c3%a9":            {"/caf%C3%A9", "/café"},
+		"/a%20b+c":              {"/a%20b+c", "/a b+c"},
+		"/x/%2e%2E/y":           {"/y", "/y"},
+		"/yourproblem?x=1&y=2":  {"/yourproblem", "/yourproblem"},
+		"http://Example.com":    {"/", "/"},
+		"HTTP://h:8080/p/../q?": {"/q", "/q"},
+	} {
+		u, err := ParseTarget("GET", target)
+		require.NoError(t, err, target)
+		assert.Equal(t, want[0], u.RawPath, target)
+		assert.Equal(t, want[1], u.Path, target)
+	}
+
+	u, err := ParseTarget("GET", "HTTP://h:8080/p?a=1")
+	require.NoError(t, err)
+	assert.Equal(t, "http", u.Scheme)
+	assert.Equal(t, "h:8080", u.Host)
+	assert.Equal(t, "/p?a=1", u.RequestURI())
+
+	// Test: Traversal, fragments and bad escapes are rejected
+	for _, target := range []string{
+		"/..", "/a/../..", "/%2e%2e/etc/passwd", "/a/%2E%2E/%2e%2e/b",
+		"/a%2fb", "/a%5c..%5cb", "/a%00", "/a%zz", "/a?q=%", "/a#frag",
+		"", "a/b", "http:///p", "http://user@h/", "1http://h/",
+		"/static/..\\..\\secret", `/a"b`, "/a<b>", "/a?q={x}", "http://h/a\\b",
+	} {
+		_, err := ParseTarget("GET", target)
+		assert.ErrorIs(t, err, ErrInvalidTarget, "%q", target)
+	}
+
+	// Test: Asterisk and authority forms
+	u, err = ParseTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, "*", u.Path)
+	u, err = ParseTarget("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", u.Host)
+	_, err = ParseTarget("CONNECT", "/path")
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+}
+
+func TestQuery(t *testing.T) {
+	u, err := ParseTarget("GET", "/s?tag=a&tag=b+c&q=caf%C3%A9&empty=&flag")
+	require.NoError(t, err)
+	q := u.Query()
+	assert.Equal(t, []string{"a", "b c"}, q["tag"])
+	assert.Equal(t, "café", q.Get("q"))
+	assert.Equal(t, []string{""}, q["empty"])
+	assert.Equal(t, []string{""}, q["flag"])
+
+	// Test: Hand-built URLs can hold escapes the parser would refuse
+	u = URL{RawQuery: "bad=%zz&ok=1"}
+	assert.Equal(t, form.Values{"ok": {"1"}}, u.Query())
+}
@@ -1,29 +1,23 @@
 package response
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
 
+	"github.com/devwelkin/hermes-lite/internal/cookie"
 	"github.com/devwelkin/hermes-lite/internal/headers"
 )
 
-// StatusCode and related consts remain the same.
-type StatusCode int
-
-const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+// Custom errors
+var (
+	ErrInvalidStatusCode = errors.New("invalid status code")
+	ErrInvalidReason     = errors.New("invalid reason phrase")
+	ErrBodyNotAllowed    = errors.New("response status does not allow a body")
 )
 
-var reasonPhrases = map[StatusCode]string{
-	StatusOK:                  "OK",
-	StatusBadRequest:          "Bad Request",
-	StatusInternalServerError: "Internal Server Error",
-}
-
 type writerState int
 
 const (
@@ -31,58 +25,236 @@ const (
 	stateHeaders                     // can write headers
 	stateBody                        // can write body
 	stateTrailers                    // can write trailers
+	stateDone                        // response is complete
 )
 
+// DefaultBufferSize is the buffered mode threshold the server uses unless
+// configured otherwise.
+const DefaultBufferSize = 32 << 10
+
 // Writer is a stateful writer for constructing an http response.
+//
+// In buffered mode the status line and headers are held back and body
+// writes collect in memory. if the handler finishes under the threshold the
+// response goes out with a Content-Length, otherwise the writer switches to
+// chunked encoding on its own once the threshold is passed. HTTP/1.0 clients
+// can't read chunked bodies, they get the rest of the body as it is and the
+// connection closed after it (see SetRequestVersion).
 type Writer struct {
-	w     io.Writer   // connection
-	state writerState // state machine
+	wire      Wire            // connection framing
+	state     writerState     // state machine
+	header    headers.Headers // defaults merged into WriteHeaders
+	committed bool            // final head is on the wire
+
+	buffered  bool // status, headers and body are held back
+	threshold int  // max bytes buffered before falling back to chunked
+	buf       bytes.Buffer
+	status    StatusCode
+	reason    string
+	pending   headers.Headers // headers waiting for the buffered commit
+	chunked   bool            // we switched to chunked on our own
+	http10    bool            // the client can't take chunked bodies
+	closeBody bool            // the body ends when the connection closes
+
+	discard   bool // HEAD: body bytes are counted, never sent
+	discarded int
+	written   int64 // body bytes accepted for sending
+
+	onHeaders []func() // run once, right before the headers are written
 }
 
 // NewWriter creates a new response Writer.
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{
-		w:     w,
-		state: stateStatus,
+	return NewWireWriter(http1Wire{w: w}, 0)
+}
+
+// NewBufferedWriter creates a Writer in buffered mode. threshold <= 0 gives
+// a plain unbuffered Writer.
+func NewBufferedWriter(w io.Writer, threshold int) *Writer {
+	return NewWireWriter(http1Wire{w: w}, threshold)
+}
+
+// NewWireWriter creates a Writer that frames the response with wire,
+// buffered when threshold > 0.
+func NewWireWriter(wire Wire, threshold int) *Writer {
+	rw := &Writer{
+		wire:   wire,
+		state:  stateStatus,
+		header: headers.NewHeaders(),
+	}
+	if threshold > 0 {
+		rw.buffered = true
+		rw.threshold = threshold
+	}
+	return rw
+}
+
+// DiscardBody makes the writer drop body bytes while still counting them, so
+// a GET handler can answer a HEAD request and still produce the right
+// Content-Length. must be called before the body is written.
+func (w *Writer) DiscardBody() {
+	w.discard = true
+}
+
+// SetRequestVersion tells the writer the HTTP version of the request, "1.0"
+// or "1.1". a buffered response to an HTTP/1.0 request that outgrows the
+// buffer is sent with Connection: close and no framing instead of chunked,
+// see CloseDelimited.
+func (w *Writer) SetRequestVersion(version string) {
+	w.http10 = version == "1.0"
+}
+
+// CloseDelimited reports whether the body is ended by closing the
+// connection, which the server then has to do once the response is out.
+func (w *Writer) CloseDelimited() bool {
+	return w.closeBody
+}
+
+// bodyAllowed reports whether a response with this status can carry a body.
+func bodyAllowed(statusCode StatusCode) bool {
+	return !statusCode.IsInformational() &&
+		statusCode != StatusNoContent &&
+		statusCode != StatusNotModified
+}
+
+// Status returns the status set so far, 0 if none was set yet. a response
+// that is closed without one goes out as 200.
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// BytesWritten returns the number of body bytes the handler wrote that are
+// (or will be) sent, not counting framing. discarded HEAD bodies count 0.
+func (w *Writer) BytesWritten() int64 {
+	return w.written
+}
+
+// Header returns the default headers for the response. they are merged into
+// whatever the handler passes to WriteHeaders, the handler's values win.
+// changing them after the headers were written has no effect.
+func (w *Writer) Header() headers.Headers {
+	return w.header
+}
+
+// SetCookie adds a Set-Cookie header for c. like Header, it has to be called
+// before the headers are written.
+func (w *Writer) SetCookie(c *cookie.Cookie) error {
+	if w.state > stateHeaders {
+		return errors.New("SetCookie called after the headers were written")
+	}
+	v, err := c.Format()
+	if err != nil {
+		return err
 	}
+	w.header.Add("Set-Cookie", v)
+	return nil
+}
+
+// OnHeaders registers fn to run right before the headers are written, while
+// Header and SetCookie still take effect. middleware uses it to add headers
+// that depend on what the handler did.
+func (w *Writer) OnHeaders(fn func()) {
+	w.onHeaders = append(w.onHeaders, fn)
 }
 
-// WriteStatusLine writes the status line. can only be called once, and first.
+// WriteStatusLine sets the status line with the registered reason phrase, it
+// goes out together with the headers. can only be called once, and first.
+// 1xx codes other than 101 are interim and go through WriteInterimResponse
+// instead.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineReason is WriteStatusLine with a custom reason phrase.
+func (w *Writer) WriteStatusLineReason(statusCode StatusCode, reason string) error {
 	if w.state != stateStatus {
 		return errors.New("WriteStatusLine called in wrong state")
 	}
-	reason, ok := reasonPhrases[statusCode]
-	if !ok {
-		reason = ""
-	}
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reason)
-
-	if _, err := w.w.Write([]byte(statusLine)); err != nil {
+	if err := validateStatus(statusCode, reason); err != nil {
 		return err
 	}
+	if statusCode.IsInformational() && statusCode != StatusSwitchingProtocols {
+		return fmt.Errorf("%w: %d is interim, use WriteInterimResponse", ErrInvalidStatusCode, statusCode)
+	}
+
+	w.status, w.reason = statusCode, reason
 	w.state = stateHeaders
 	return nil
 }
 
+// WriteInterimResponse writes a complete 1xx response (status line, headers
+// and the blank line). it can be called any number of times before the final
+// status line hits the wire; in buffered mode that is until the buffer is
+// flushed. h may be nil.
+func (w *Writer) WriteInterimResponse(statusCode StatusCode, h headers.Headers) error {
+	if w.committed || w.state == stateDone {
+		return errors.New("WriteInterimResponse called in wrong state")
+	}
+	if !statusCode.IsInformational() || statusCode == StatusSwitchingProtocols {
+		return fmt.Errorf("%w: %d is not an interim status", ErrInvalidStatusCode, statusCode)
+	}
+	return w.wire.WriteHead(statusCode, StatusText(statusCode), h)
+}
+
+// validateStatus checks the code is three digits and the reason phrase only
+// holds HTAB, SP, VCHAR or obs-text.
+func validateStatus(statusCode StatusCode, reason string) error {
+	if !statusCode.Valid() {
+		return fmt.Errorf("%w: %d", ErrInvalidStatusCode, statusCode)
+	}
+	for i := 0; i < len(reason); i++ {
+		b := reason[i]
+		if b != '\t' && (b < ' ' || b == 0x7f) {
+			return fmt.Errorf("%w: %q", ErrInvalidReason, reason)
+		}
+	}
+	return nil
+}
+
 // WriteHeaders writes the headers. must be called after status and before body.
+// h is merged over the defaults from Header. in buffered mode the headers are
+// held back, unless h already frames the body with Content-Length or
+// Transfer-Encoding in which case the handler is streaming on its own and
+// everything goes out right away.
 func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.state != stateHeaders {
 		return errors.New("WriteHeaders called in wrong state")
 	}
+	hooks := w.onHeaders
+	w.onHeaders = nil
+	for _, fn := range hooks {
+		fn()
+	}
 
+	merged := headers.NewHeaders()
+	for key, val := range w.header {
+		merged[key] = val
+	}
 	for key, val := range h {
-		line := fmt.Sprintf("%s: %s\r\n", key, val)
-		if _, err := w.w.Write([]byte(line)); err != nil {
-			return err
+		merged.Del(key)
+		merged[key] = val
+	}
+	if w.status.IsInformational() || w.status == StatusNoContent {
+		// never framed, there is no body to frame
+		merged.Del("Content-Length")
+		merged.Del("Transfer-Encoding")
+	}
+
+	if w.buffered {
+		_, hasLength := merged.Lookup("Content-Length")
+		_, hasEncoding := merged.Lookup("Transfer-Encoding")
+		w.pending = merged
+		if !hasLength && !hasEncoding {
+			w.state = stateBody
+			return nil
 		}
+		w.buffered = false
 	}
 
-	// final crlf to separate headers from body
-	if _, err := w.w.Write([]byte("\r\n")); err != nil {
+	w.pending = merged
+	if err := w.writeHead(); err != nil {
 		return err
 	}
-
 	w.state = stateBody
 	return nil
 }
@@ -93,46 +265,180 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.state != stateBody {
 		return 0, errors.New("WriteBody called in wrong state")
 	}
-	return w.w.Write(p)
+	if err := w.checkBody(p); err != nil {
+		return 0, err
+	}
+	if w.discard {
+		w.discarded += len(p)
+		return len(p), nil
+	}
+	w.written += int64(len(p))
+	if w.chunked {
+		return w.writeChunk(p)
+	}
+	if !w.buffered {
+		return w.wire.WriteBody(p)
+	}
+
+	w.buf.Write(p)
+	if w.buf.Len() > w.threshold {
+		if err := w.switchToChunked(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
 }
 
-// WriteChunkedBody writes a chunk of data for a chunked response.
-// It writes the chunk size in hex, followed by the data, and a CRLF.
-func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	if w.state != stateBody {
-		return 0, errors.New("WriteChunkedBody called in wrong state")
+// checkBody refuses body bytes for statuses that can't have a body.
+func (w *Writer) checkBody(p []byte) error {
+	if len(p) > 0 && !bodyAllowed(w.status) {
+		return fmt.Errorf("%w: %d %s", ErrBodyNotAllowed, w.status, StatusText(w.status))
+	}
+	return nil
+}
+
+// Write makes Writer an io.Writer. it fills in a 200 status and the default
+// headers if the handler didn't write them, so a handler can just write bytes.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.state == stateStatus {
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return 0, err
+		}
+	}
+	if w.state == stateHeaders {
+		if err := w.WriteHeaders(nil); err != nil {
+			return 0, err
+		}
 	}
+	return w.WriteBody(p)
+}
 
-	// Don't write empty chunks unless it's the final one.
-	if len(p) == 0 {
-		return 0, nil
+// switchToChunked commits the held back head with Transfer-Encoding: chunked
+// and sends what's been buffered so far as the first chunk. HTTP/1.0 clients
+// get a close-delimited body instead.
+func (w *Writer) switchToChunked() error {
+	w.buffered = false
+	var err error
+	if w.http10 {
+		w.closeBody = true
+		w.pending.Del("Content-Length")
+		w.pending.Del("Connection")
+		w.pending.Set("Connection", "close")
+		if err := w.writeHead(); err != nil {
+			return err
+		}
+		_, err = w.wire.WriteBody(w.buf.Bytes())
+	} else {
+		w.chunked = true
+		w.pending.Set("Transfer-Encoding", "chunked")
+		if err := w.writeHead(); err != nil {
+			return err
+		}
+		_, err = w.writeChunk(w.buf.Bytes())
 	}
+	w.buf.Reset()
+	return err
+}
 
-	// Format: <chunk size in hex>\r\n<chunk data>\r\n
-	chunkHeader := fmt.Sprintf("%x\r\n", len(p))
-	chunkTrailer := "\r\n"
+// commitChunked commits a held back head for the explicit chunked calls,
+// which write straight to the wire.
+func (w *Writer) commitChunked() error {
+	if !w.buffered {
+		return nil
+	}
+	if bodyAllowed(w.status) {
+		return w.switchToChunked()
+	}
+	w.buffered = false
+	return w.writeHead()
+}
 
-	totalWritten := 0
+func (w *Writer) writeHead() error {
+	w.committed = true
+	return w.wire.WriteHead(w.status, w.reason, w.pending)
+}
 
-	n, err := w.w.Write([]byte(chunkHeader))
-	totalWritten += n
-	if err != nil {
-		return totalWritten, err
+// Close finishes the response: it writes anything the handler left out, the
+// buffered body with its Content-Length, or the end of an automatic chunked
+// body. the server calls it once the handler returns. it is safe to call more
+// than once.
+func (w *Writer) Close() error {
+	if w.state == stateDone {
+		return nil
+	}
+	if w.state == stateStatus {
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+	}
+	if w.state == stateHeaders {
+		if err := w.WriteHeaders(nil); err != nil {
+			return err
+		}
 	}
 
-	n, err = w.w.Write(p)
-	totalWritten += n
-	if err != nil {
-		return totalWritten, err
+	switch {
+	case w.state == stateBody && w.buffered:
+		w.buffered = false
+		switch {
+		case !bodyAllowed(w.status):
+		case w.discard:
+			// a HEAD handler that wrote nothing tells us nothing about the size
+			if w.discarded > 0 {
+				w.pending.Set("Content-Length", strconv.Itoa(w.discarded))
+			}
+		default:
+			w.pending.Set("Content-Length", strconv.Itoa(w.buf.Len()))
+		}
+		if err := w.writeHead(); err != nil {
+			return err
+		}
+		if _, err := w.wire.WriteBody(w.buf.Bytes()); err != nil {
+			return err
+		}
+		w.buf.Reset()
+	case w.state == stateBody && w.chunked:
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		fallthrough
+	case w.state == stateTrailers:
+		if err := w.WriteTrailers(nil); err != nil {
+			return err
+		}
 	}
 
-	n, err = w.w.Write([]byte(chunkTrailer))
-	totalWritten += n
-	if err != nil {
-		return totalWritten, err
+	w.state = stateDone
+	return w.wire.Finish()
+}
+
+// WriteChunkedBody writes a chunk of data for a chunked response.
+// It writes the chunk size in hex, followed by the data, and a CRLF. in
+// buffered mode without a Transfer-Encoding from the handler it commits the
+// head as chunked first.
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.state != stateBody {
+		return 0, errors.New("WriteChunkedBody called in wrong state")
+	}
+	if err := w.checkBody(p); err != nil {
+		return 0, err
+	}
+	if w.discard {
+		w.discarded += len(p)
+		return len(p), nil
+	}
+	if err := w.commitChunked(); err != nil {
+		return 0, err
 	}
+	w.written += int64(len(p))
+	if w.closeBody {
+		return w.wire.WriteBody(p)
+	}
+	return w.writeChunk(p)
+}
 
-	return totalWritten, nil
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	return w.wire.WriteChunk(p)
 }
 
 // WriteChunkedBodyDone writes the zero-length chunk to signal the end
@@ -141,10 +447,16 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.state != stateBody {
 		return 0, errors.New("WriteChunkedBodyDone called in wrong state")
 	}
+	if err := w.commitChunked(); err != nil {
+		return 0, err
+	}
+	if w.discard || !bodyAllowed(w.status) || w.closeBody {
+		w.state = stateTrailers
+		return 0, nil
+	}
 
-	n, err := w.w.Write([]byte("0\r\n"))
 	w.state = stateTrailers
-	return n, err
+	return w.wire.WriteLastChunk()
 }
 
 // WriteTrailers writes the trailers. Must be called after WriteChunkedBodyDone.
@@ -152,17 +464,16 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	if w.state != stateTrailers {
 		return errors.New("WriteTrailers called in wrong state")
 	}
-
-	for key, val := range h {
-		line := fmt.Sprintf("%s: %s\r\n", key, val)
-		if _, err := w.w.Write([]byte(line)); err != nil {
-			return err
-		}
+	if w.discard || !bodyAllowed(w.status) || w.closeBody {
+		w.state = stateDone
+		return w.wire.Finish()
 	}
 
-	// final crlf to terminate the response
-	_, err := w.w.Write([]byte("\r\n"))
-	return err
+	w.state = stateDone
+	if err := w.wire.WriteTrailers(h); err != nil {
+		return err
+	}
+	return w.wire.Finish()
 }
 
 // GetDefaultHeaders is still a useful helper for the handler.
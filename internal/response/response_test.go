@@ -0,0 +1,269 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/cookie"
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusLine(t *testing.T) {
+	// Test: Registered code gets its reason phrase
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	assert.Empty(t, buf.String(), "status line goes out with the headers")
+	require.NoError(t, w.WriteHeaders(nil))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n\r\n", buf.String())
+
+	// Test: Unregistered code gets an empty reason
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCode(299)))
+	require.NoError(t, w.WriteHeaders(nil))
+	assert.Equal(t, "HTTP/1.1 299 \r\n\r\n", buf.String())
+
+	// Test: Custom reason phrase
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLineReason(StatusOK, "Totally Fine"))
+	require.NoError(t, w.WriteHeaders(nil))
+	assert.Equal(t, "HTTP/1.1 200 Totally Fine\r\n\r\n", buf.String())
+
+	// Test: Reason phrase with CRLF is rejected
+	buf.Reset()
+	w = NewWriter(&buf)
+	err := w.WriteStatusLineReason(StatusOK, "OK\r\nX-Injected: 1")
+	require.ErrorIs(t, err, ErrInvalidReason)
+	assert.Empty(t, buf.String())
+
+	// Test: Out of range codes are rejected
+	for _, code := range []StatusCode{0, 99, 1000, -200} {
+		w = NewWriter(&buf)
+		require.ErrorIs(t, w.WriteStatusLine(code), ErrInvalidStatusCode)
+	}
+
+	// Test: Interim code can't be the final status
+	w = NewWriter(&buf)
+	require.ErrorIs(t, w.WriteStatusLine(StatusContinue), ErrInvalidStatusCode)
+
+	// Test: 101 is allowed as a final status
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusSwitchingProtocols))
+}
+
+func TestInterimResponse(t *testing.T) {
+	// Test: 1xx responses go out before the final response
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteInterimResponse(StatusContinue, nil))
+	require.NoError(t, w.WriteInterimResponse(StatusEarlyHints, headers.Headers{"Link": "</style.css>; rel=preload"}))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(nil))
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\n\r\n", buf.String())
+
+	// Test: Interim after the final head is rejected
+	require.Error(t, w.WriteInterimResponse(StatusContinue, nil))
+
+	// Test: Non-1xx code can't be interim
+	w = NewWriter(&buf)
+	require.ErrorIs(t, w.WriteInterimResponse(StatusOK, nil), ErrInvalidStatusCode)
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.True(t, StatusContinue.IsInformational())
+	assert.True(t, StatusNoContent.IsSuccess())
+	assert.True(t, StatusPermanentRedirect.IsRedirect())
+	assert.True(t, StatusTooManyRequests.IsClientError())
+	assert.True(t, StatusBadGateway.IsServerError())
+	assert.False(t, StatusCode(600).IsServerError())
+	assert.True(t, StatusCode(600).Valid())
+	assert.Equal(t, "Unavailable For Legal Reasons", StatusText(StatusUnavailableForLegalReasons))
+	assert.Equal(t, "", StatusText(StatusCode(599)))
+}
+
+// splitResponse splits raw response bytes into the status line, the header
+// lines keyed by name, and the rest.
+func splitResponse(t *testing.T, raw string) (string, map[string]string, string) {
+	t.Helper()
+	head, body, ok := strings.Cut(raw, "\r\n\r\n")
+	require.True(t, ok, "no end of headers in %q", raw)
+	lines := strings.Split(head, "\r\n")
+	fields := map[string]string{}
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, ": ")
+		fields[k] = v
+	}
+	return lines[0], fields, body
+}
+
+func TestBufferedWriter(t *testing.T) {
+	// Test: Small body gets a Content-Length
+	var buf bytes.Buffer
+	w := NewBufferedWriter(&buf, 64)
+	w.Header().Set("Date", "Sun, 18 Oct 2026 10:00:00 GMT")
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := w.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	assert.Empty(t, buf.String(), "nothing goes out before Close")
+	require.NoError(t, w.Close())
+
+	status, fields, body := splitResponse(t, buf.String())
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "11", fields["Content-Length"])
+	assert.Equal(t, "Sun, 18 Oct 2026 10:00:00 GMT", fields["Date"])
+	assert.Equal(t, "hello world", body)
+
+	// Test: Handler headers override defaults regardless of case
+	buf.Reset()
+	w = NewBufferedWriter(&buf, 64)
+	w.Header().Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"content-type": "text/html"}))
+	require.NoError(t, w.Close())
+	status, fields, body = splitResponse(t, buf.String())
+	assert.Equal(t, "HTTP/1.1 404 Not Found", status)
+	assert.Equal(t, "text/html", fields["content-type"])
+	assert.NotContains(t, fields, "Content-Type")
+	assert.Equal(t, "0", fields["Content-Length"])
+	assert.Empty(t, body)
+
+	// Test: Passing the threshold falls back to chunked
+	buf.Reset()
+	w = NewBufferedWriter(&buf, 8)
+	_, err = w.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	status, fields, body = splitResponse(t, buf.String())
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "chunked", fields["Transfer-Encoding"])
+	assert.NotContains(t, fields, "Content-Length")
+	assert.Equal(t, "a\r\n0123456789\r\n3\r\nabc\r\n0\r\n\r\n", body)
+
+	// Test: Handler framing its own body is written through
+	buf.Reset()
+	w = NewBufferedWriter(&buf, 64)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	assert.Contains(t, buf.String(), "Content-Length: 2\r\n")
+	_, err = w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, fields, body = splitResponse(t, buf.String())
+	assert.Equal(t, "2", fields["Content-Length"])
+	assert.Equal(t, "ok", body)
+
+	// Test: Close twice is harmless
+	require.NoError(t, w.Close())
+
+	// Test: HTTP/1.0 clients get a close-delimited body instead of chunked
+	buf.Reset()
+	w = NewBufferedWriter(&buf, 8)
+	w.SetRequestVersion("1.0")
+	w.Header().Set("Connection", "keep-alive")
+	_, err = w.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.True(t, w.CloseDelimited())
+	_, fields, body = splitResponse(t, buf.String())
+	assert.Equal(t, "close", fields["Connection"])
+	assert.NotContains(t, fields, "Transfer-Encoding")
+	assert.NotContains(t, fields, "Content-Length")
+	assert.Equal(t, "0123456789abc", body)
+
+	// Test: Explicit chunks commit the held back head first
+	buf.Reset()
+	w = NewBufferedWriter(&buf, 64)
+	_, err = w.Write([]byte("ab"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("cd"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, fields, body = splitResponse(t, buf.String())
+	assert.Equal(t, "chunked", fields["Transfer-Encoding"])
+	assert.Equal(t, "2\r\nab\r\n2\r\ncd\r\n0\r\n\r\n", body)
+}
+
+func TestBodySuppression(t *testing.T) {
+	// Test: HEAD keeps the Content-Length but sends no body
+	var buf bytes.Buffer
+	w := NewBufferedWriter(&buf, 4)
+	w.DiscardBody()
+	_, err := w.Write([]byte("a body longer than the threshold"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, fields, body := splitResponse(t, buf.String())
+	assert.Equal(t, "32", fields["Content-Length"])
+	assert.NotContains(t, fields, "Transfer-Encoding")
+	assert.Empty(t, body)
+
+	// Test: HEAD with handler framing keeps the handler's headers
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"}))
+	_, err = w.WriteChunkedBody([]byte("hidden"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(nil))
+	_, fields, body = splitResponse(t, buf.String())
+	assert.Equal(t, "chunked", fields["Transfer-Encoding"])
+	assert.Empty(t, body)
+
+	// Test: 204 has no framing and refuses a body
+	buf.Reset()
+	w = NewBufferedWriter(&buf, 64)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "5"}))
+	_, err = w.Write([]byte("nope!"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Close())
+	status, fields, body := splitResponse(t, buf.String())
+	assert.Equal(t, "HTTP/1.1 204 No Content", status)
+	assert.NotContains(t, fields, "Content-Length")
+	assert.Empty(t, body)
+
+	// Test: 304 refuses a body and gets no automatic Content-Length
+	buf.Reset()
+	w = NewBufferedWriter(&buf, 64)
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	_, err = w.Write([]byte("stale"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Close())
+	_, fields, body = splitResponse(t, buf.String())
+	assert.NotContains(t, fields, "Content-Length")
+	assert.Empty(t, body)
+}
+
+func TestSetCookie(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewBufferedWriter(&buf, 64)
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "a", Value: "1", HttpOnly: true}))
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "b", Value: "2"}))
+	assert.ErrorIs(t, w.SetCookie(&cookie.Cookie{Name: "bad name"}), cookie.ErrInvalidName)
+	_, err := w.Write([]byte("ok"))
+	require.NoError(t, err)
+
+	// Test: Too late once the headers are out
+	assert.Error(t, w.SetCookie(&cookie.Cookie{Name: "c", Value: "3"}))
+	require.NoError(t, w.Close())
+
+	// Test: One Set-Cookie line per cookie
+	assert.Contains(t, buf.String(), "Set-Cookie: a=1; HttpOnly\r\n")
+	assert.Contains(t, buf.String(), "Set-Cookie: b=2\r\n")
+	assert.NotContains(t, buf.String(), "c=3")
+}
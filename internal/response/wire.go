@@ -0,0 +1,108 @@
+package response
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+)
+
+// Wire puts a response on the connection. Writer keeps the response state
+// machine and leaves the framing to a Wire: HTTP/1.1 text by default, frames
+// on a stream for HTTP/2.
+type Wire interface {
+	// WriteHead writes a status and its header block. interim (1xx) heads
+	// can come before the final one.
+	WriteHead(code StatusCode, reason string, h headers.Headers) error
+	// WriteBody writes body bytes as they are, the headers frame them.
+	WriteBody(p []byte) (int, error)
+	// WriteChunk writes one chunk of a chunked body.
+	WriteChunk(p []byte) (int, error)
+	// WriteLastChunk ends a chunked body, trailers may follow.
+	WriteLastChunk() (int, error)
+	// WriteTrailers writes the trailer block after the last chunk.
+	WriteTrailers(h headers.Headers) error
+	// Finish is called once when the response is complete.
+	Finish() error
+}
+
+// http1Wire writes HTTP/1.1 messages.
+type http1Wire struct {
+	w io.Writer // connection
+}
+
+func (hw http1Wire) WriteHead(code StatusCode, reason string, h headers.Headers) error {
+	statusLine := fmt.Sprintf("HTTP/1.1 %03d %s\r\n", code, reason)
+	if _, err := hw.w.Write([]byte(statusLine)); err != nil {
+		return err
+	}
+	return hw.writeFields(h)
+}
+
+// writeFields writes header lines and the final crlf that ends the block.
+func (hw http1Wire) writeFields(h headers.Headers) error {
+	for key, val := range h {
+		// multiple values from Headers.Add get a line each
+		for _, v := range strings.Split(val, "\n") {
+			line := fmt.Sprintf("%s: %s\r\n", key, v)
+			if _, err := hw.w.Write([]byte(line)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// final crlf to separate headers from body
+	_, err := hw.w.Write([]byte("\r\n"))
+	return err
+}
+
+func (hw http1Wire) WriteBody(p []byte) (int, error) {
+	return hw.w.Write(p)
+}
+
+func (hw http1Wire) WriteChunk(p []byte) (int, error) {
+	// Don't write empty chunks unless it's the final one.
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Format: <chunk size in hex>\r\n<chunk data>\r\n
+	chunkHeader := fmt.Sprintf("%x\r\n", len(p))
+	chunkTrailer := "\r\n"
+
+	totalWritten := 0
+
+	n, err := hw.w.Write([]byte(chunkHeader))
+	totalWritten += n
+	if err != nil {
+		return totalWritten, err
+	}
+
+	n, err = hw.w.Write(p)
+	totalWritten += n
+	if err != nil {
+		return totalWritten, err
+	}
+
+	n, err = hw.w.Write([]byte(chunkTrailer))
+	totalWritten += n
+	if err != nil {
+		return totalWritten, err
+	}
+
+	return totalWritten, nil
+}
+
+func (hw http1Wire) WriteLastChunk() (int, error) {
+	return hw.w.Write([]byte("0\r\n"))
+}
+
+func (hw http1Wire) WriteTrailers(h headers.Headers) error {
+	// final crlf terminates the response
+	return hw.writeFields(h)
+}
+
+func (hw http1Wire) Finish() error {
+	return nil
+}
@@ -0,0 +1,181 @@
+package secure
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/devwelkin/hermes-lite/internal/ratelimit"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// MaxReportSize bounds a violation report body.
+const MaxReportSize = 64 << 10
+
+// MaxReportLogRate caps the violations LogReport logs per second. a page
+// can set off a flood of them, and anyone can post made up ones.
+const MaxReportLogRate = 10
+
+var (
+	reportLog     = ratelimit.New(ratelimit.Config{})
+	reportDropped atomic.Int64 // since the last line logged
+)
+
+// Report is one CSP violation, from either report format.
+type Report struct {
+	DocumentURI        string `json:"document_uri"`
+	Referrer           string `json:"referrer,omitempty"`
+	BlockedURI         string `json:"blocked_uri"`
+	EffectiveDirective string `json:"effective_directive"`
+	OriginalPolicy     string `json:"original_policy"`
+	// Disposition is "enforce" or "report".
+	Disposition  string `json:"disposition"`
+	SourceFile   string `json:"source_file,omitempty"`
+	LineNumber   int    `json:"line_number,omitempty"`
+	ColumnNumber int    `json:"column_number,omitempty"`
+	// Sample is the start of the offending inline code, if the policy asks
+	// for it with 'report-sample'.
+	Sample     string `json:"sample,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+}
+
+// legacyReport is the application/csp-report body of report-uri.
+type legacyReport struct {
+	Body struct {
+		DocumentURI        string `json:"document-uri"`
+		Referrer           string `json:"referrer"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		OriginalPolicy     string `json:"original-policy"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+		ColumnNumber       int    `json:"column-number"`
+		ScriptSample       string `json:"script-sample"`
+		StatusCode         int    `json:"status-code"`
+	} `json:"csp-report"`
+}
+
+// apiReport is one element of the application/reports+json body of the
+// Reporting API (report-to).
+type apiReport struct {
+	Type      string `json:"type"`
+	UserAgent string `json:"user_agent"`
+	Body      struct {
+		DocumentURL        string `json:"documentURL"`
+		Referrer           string `json:"referrer"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		OriginalPolicy     string `json:"originalPolicy"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+		ColumnNumber       int    `json:"columnNumber"`
+		Sample             string `json:"sample"`
+		StatusCode         int    `json:"statusCode"`
+	} `json:"body"`
+}
+
+// ParseReports reads the violations in a report body of the given content
+// type. reports of other types in a Reporting API batch are skipped.
+func ParseReports(contentType string, body []byte) ([]Report, error) {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if mt == "application/reports+json" {
+		var batch []apiReport
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+		var out []Report
+		for _, r := range batch {
+			if r.Type != "csp-violation" {
+				continue
+			}
+			b := r.Body
+			out = append(out, Report{
+				DocumentURI: b.DocumentURL, Referrer: b.Referrer, BlockedURI: b.BlockedURL,
+				EffectiveDirective: b.EffectiveDirective, OriginalPolicy: b.OriginalPolicy,
+				Disposition: b.Disposition, SourceFile: b.SourceFile, LineNumber: b.LineNumber,
+				ColumnNumber: b.ColumnNumber, Sample: b.Sample, StatusCode: b.StatusCode,
+				UserAgent: r.UserAgent,
+			})
+		}
+		return out, nil
+	}
+
+	// application/csp-report, some browsers send it as application/json
+	var r legacyReport
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	b := r.Body
+	directive := b.EffectiveDirective
+	if directive == "" {
+		directive = b.ViolatedDirective
+	}
+	return []Report{{
+		DocumentURI: b.DocumentURI, Referrer: b.Referrer, BlockedURI: b.BlockedURI,
+		EffectiveDirective: directive, OriginalPolicy: b.OriginalPolicy,
+		Disposition: b.Disposition, SourceFile: b.SourceFile, LineNumber: b.LineNumber,
+		ColumnNumber: b.ColumnNumber, Sample: b.ScriptSample, StatusCode: b.StatusCode,
+	}}, nil
+}
+
+// LogReport logs a violation as one JSON line, the default for
+// ReportHandler. past MaxReportLogRate violations are dropped, the next
+// line logged says how many.
+func LogReport(r Report) {
+	if !reportLog.Allow("", ratelimit.PerSecond(MaxReportLogRate)).Allowed {
+		reportDropped.Add(1)
+		return
+	}
+	b, _ := json.Marshal(r)
+	if n := reportDropped.Swap(0); n > 0 {
+		log.Printf("csp violation: %s (%d dropped before it)", b, n)
+		return
+	}
+	log.Printf("csp violation: %s", b)
+}
+
+// ReportHandler collects the violation reports browsers post to
+// CSP.ReportURI and hands each to collect, LogReport if nil. it answers
+// 204, or 405, 413 and 400 for anything that isn't a report.
+func ReportHandler(collect func(Report)) server.Handler {
+	if collect == nil {
+		collect = LogReport
+	}
+	return func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			_ = w.WriteStatusLine(response.StatusMethodNotAllowed)
+			return
+		}
+		if n, err := strconv.Atoi(req.Headers["content-length"]); err == nil && n > MaxReportSize {
+			_ = w.WriteStatusLine(response.StatusContentTooLarge)
+			return
+		}
+		body, err := req.ReadBody()
+		if err != nil {
+			_ = w.WriteStatusLine(response.StatusBadRequest)
+			return
+		}
+		ua := req.Headers["user-agent"]
+		reports, err := ParseReports(req.Headers["content-type"], body)
+		if err != nil {
+			_ = w.WriteStatusLine(response.StatusBadRequest)
+			return
+		}
+		for _, r := range reports {
+			if r.UserAgent == "" {
+				r.UserAgent = ua
+			}
+			collect(r)
+		}
+		_ = w.WriteStatusLine(response.StatusNoContent)
+	}
+}
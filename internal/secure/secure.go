@@ -0,0 +1,250 @@
+// Package secure sets the response headers that harden a site in
+// browsers: HSTS, X-Content-Type-Options, X-Frame-Options, Referrer-Policy,
+// Permissions-Policy, the Cross-Origin-* policies and a Content-Security-
+// Policy with a fresh nonce per request.
+package secure
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// NoncePlaceholder in a CSP source list is replaced by 'nonce-<nonce>'.
+const NoncePlaceholder = "{nonce}"
+
+// HSTS is the Strict-Transport-Security policy. it only goes out over
+// TLS, browsers ignore it on plain HTTP.
+type HSTS struct {
+	MaxAge            time.Duration
+	IncludeSubdomains bool
+	// Preload asks to be put on the browsers' preload list, which needs a
+	// MaxAge of a year and IncludeSubdomains.
+	Preload bool
+}
+
+// CSP is a Content-Security-Policy.
+type CSP struct {
+	// Directives map a directive to its sources, e.g. "script-src":
+	// {"'self'", NoncePlaceholder}. a directive without sources, like
+	// upgrade-insecure-requests, gets an empty list.
+	Directives map[string][]string
+	// ReportOnly sends Content-Security-Policy-Report-Only, so violations
+	// are reported but nothing is blocked. the way to try out a policy.
+	ReportOnly bool
+	// ReportURI is where browsers post violations, see ReportHandler.
+	ReportURI string
+}
+
+// Policy is the set of headers to send. empty fields send nothing.
+type Policy struct {
+	HSTS HSTS
+	// NoSniff sends X-Content-Type-Options: nosniff.
+	NoSniff bool
+	// FrameOptions is X-Frame-Options, DENY or SAMEORIGIN. the CSP gets
+	// the matching frame-ancestors unless it has one.
+	FrameOptions string
+	// ReferrerPolicy is e.g. strict-origin-when-cross-origin.
+	ReferrerPolicy string
+	// Permissions maps a feature to its allowlist, e.g. "camera": {} to
+	// turn it off, "geolocation": {"self", "https://maps.example.com"}.
+	Permissions map[string][]string
+	// CrossOriginOpenerPolicy, CrossOriginEmbedderPolicy and
+	// CrossOriginResourcePolicy are the Cross-Origin-* headers.
+	CrossOriginOpenerPolicy   string
+	CrossOriginEmbedderPolicy string
+	CrossOriginResourcePolicy string
+	CSP                       CSP
+}
+
+// DefaultPolicy is a strict starting point for a site serving its own
+// pages: only same-origin content, inline scripts and styles only with the
+// nonce, no framing.
+func DefaultPolicy() Policy {
+	return Policy{
+		HSTS:           HSTS{MaxAge: 365 * 24 * time.Hour, IncludeSubdomains: true},
+		NoSniff:        true,
+		FrameOptions:   "DENY",
+		ReferrerPolicy: "strict-origin-when-cross-origin",
+		Permissions: map[string][]string{
+			"camera": {}, "microphone": {}, "geolocation": {}, "payment": {},
+		},
+		CrossOriginOpenerPolicy:   "same-origin",
+		CrossOriginResourcePolicy: "same-origin",
+		CSP: CSP{Directives: map[string][]string{
+			"default-src":     {"'self'"},
+			"script-src":      {"'self'", NoncePlaceholder},
+			"style-src":       {"'self'", NoncePlaceholder},
+			"object-src":      {"'none'"},
+			"base-uri":        {"'self'"},
+			"form-action":     {"'self'"},
+			"frame-ancestors": {"'none'"},
+		}},
+	}
+}
+
+// Secure is the middleware state.
+type Secure struct {
+	static    [][2]string // headers that are the same for every response
+	hsts      string
+	csp       string // with NoncePlaceholder still in it
+	cspHeader string
+	nonce     bool
+}
+
+// New creates the middleware for p.
+func New(p Policy) *Secure {
+	s := &Secure{}
+	add := func(k, v string) {
+		if v != "" {
+			s.static = append(s.static, [2]string{k, v})
+		}
+	}
+	if p.NoSniff {
+		add("X-Content-Type-Options", "nosniff")
+	}
+	add("X-Frame-Options", p.FrameOptions)
+	add("Referrer-Policy", p.ReferrerPolicy)
+	add("Permissions-Policy", permissions(p.Permissions))
+	add("Cross-Origin-Opener-Policy", p.CrossOriginOpenerPolicy)
+	add("Cross-Origin-Embedder-Policy", p.CrossOriginEmbedderPolicy)
+	add("Cross-Origin-Resource-Policy", p.CrossOriginResourcePolicy)
+
+	if p.HSTS.MaxAge > 0 {
+		s.hsts = "max-age=" + strconv.FormatInt(int64(p.HSTS.MaxAge/time.Second), 10)
+		if p.HSTS.IncludeSubdomains {
+			s.hsts += "; includeSubDomains"
+		}
+		if p.HSTS.Preload {
+			s.hsts += "; preload"
+		}
+	}
+
+	directives := make(map[string][]string, len(p.CSP.Directives)+2)
+	for k, v := range p.CSP.Directives {
+		directives[strings.ToLower(k)] = v
+	}
+	if len(directives) > 0 {
+		if _, ok := directives["frame-ancestors"]; !ok {
+			switch strings.ToUpper(p.FrameOptions) {
+			case "DENY":
+				directives["frame-ancestors"] = []string{"'none'"}
+			case "SAMEORIGIN":
+				directives["frame-ancestors"] = []string{"'self'"}
+			}
+		}
+		if p.CSP.ReportURI != "" {
+			directives["report-uri"] = []string{p.CSP.ReportURI}
+			directives["report-to"] = []string{reportGroup}
+			add("Reporting-Endpoints", reportGroup+`="`+p.CSP.ReportURI+`"`)
+		}
+		s.csp = csp(directives)
+		s.nonce = strings.Contains(s.csp, NoncePlaceholder)
+		s.cspHeader = "Content-Security-Policy"
+		if p.CSP.ReportOnly {
+			s.cspHeader = "Content-Security-Policy-Report-Only"
+		}
+	}
+	return s
+}
+
+// reportGroup names the Reporting API endpoint for report-to.
+const reportGroup = "csp-endpoint"
+
+// csp renders directives, default-src first and the rest sorted so the
+// header is the same every time.
+func csp(directives map[string][]string) string {
+	names := make([]string, 0, len(directives))
+	for name := range directives {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		switch {
+		case a == b:
+			return 0
+		case a == "default-src":
+			return -1
+		case b == "default-src":
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = strings.TrimSpace(name + " " + strings.Join(directives[name], " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// permissions renders a Permissions-Policy: self and * as they are, origins
+// quoted.
+func permissions(features map[string][]string) string {
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		list := make([]string, len(features[name]))
+		for j, origin := range features[name] {
+			if origin == "self" || origin == "*" {
+				list[j] = origin
+			} else {
+				list[j] = strconv.Quote(origin)
+			}
+		}
+		parts[i] = name + "=(" + strings.Join(list, " ") + ")"
+	}
+	return strings.Join(parts, ", ")
+}
+
+type ctxKey struct{}
+
+// Nonce returns the request's CSP nonce, for the nonce attribute of inline
+// <script> and <style> elements. "" outside the middleware or when the
+// policy has no NoncePlaceholder.
+func Nonce(req *request.Request) string {
+	n, _ := req.Context().Value(ctxKey{}).(string)
+	return n
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Middleware sets the headers before the handler runs, handlers can still
+// change or delete them.
+func (s *Secure) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			h := w.Header()
+			for _, kv := range s.static {
+				h.Set(kv[0], kv[1])
+			}
+			if s.hsts != "" && req.TLS != nil {
+				h.Set("Strict-Transport-Security", s.hsts)
+			}
+			if s.csp != "" {
+				policy := s.csp
+				if s.nonce {
+					nonce := newNonce()
+					req.SetContext(context.WithValue(req.Context(), ctxKey{}, nonce))
+					policy = strings.ReplaceAll(policy, NoncePlaceholder, "'nonce-"+nonce+"'")
+				}
+				h.Set(s.cspHeader, policy)
+			}
+			next(w, req)
+		}
+	}
+}
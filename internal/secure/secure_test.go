@@ -0,0 +1,141 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/servertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	var nonce string
+	h := New(DefaultPolicy()).Middleware()(func(w *response.Writer, req *request.Request) {
+		nonce = Nonce(req)
+		_, _ = w.Write([]byte(`<script nonce="` + nonce + `"></script>`))
+	})
+
+	resp := servertest.Do(t, h, &request.Request{TLS: &tls.ConnectionState{}})
+	assert.Equal(t, "max-age=31536000; includeSubDomains", resp.Header.Get("Strict-Transport-Security"))
+	assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"))
+	assert.Equal(t, "strict-origin-when-cross-origin", resp.Header.Get("Referrer-Policy"))
+	assert.Equal(t, "camera=(), geolocation=(), microphone=(), payment=()", resp.Header.Get("Permissions-Policy"))
+	assert.Equal(t, "same-origin", resp.Header.Get("Cross-Origin-Opener-Policy"))
+	assert.Equal(t, "same-origin", resp.Header.Get("Cross-Origin-Resource-Policy"))
+	assert.Empty(t, resp.Header.Get("Cross-Origin-Embedder-Policy"))
+
+	assert.Regexp(t, `^[A-Za-z0-9+/]{22}==$`, nonce)
+	assert.Equal(t, "default-src 'self'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'; object-src 'none'; "+
+		"script-src 'self' 'nonce-"+nonce+"'; style-src 'self' 'nonce-"+nonce+"'", resp.Header.Get("Content-Security-Policy"))
+
+	// Test: Every request gets its own nonce, plain HTTP gets no HSTS
+	first := nonce
+	resp = servertest.Do(t, h, &request.Request{})
+	assert.NotEqual(t, first, nonce)
+	assert.Contains(t, resp.Header.Get("Content-Security-Policy"), "'nonce-"+nonce+"'")
+	assert.Empty(t, resp.Header.Get("Strict-Transport-Security"))
+}
+
+func TestPolicy(t *testing.T) {
+	s := New(Policy{
+		HSTS:         HSTS{MaxAge: 2 * 365 * 24 * time.Hour, IncludeSubdomains: true, Preload: true},
+		FrameOptions: "SAMEORIGIN",
+		Permissions:  map[string][]string{"geolocation": {"self", "https://maps.example.com"}, "fullscreen": {"*"}},
+		CSP: CSP{
+			Directives: map[string][]string{"Script-Src": {"'strict-dynamic'"}, "upgrade-insecure-requests": {}},
+			ReportOnly: true,
+			ReportURI:  "/csp-report",
+		},
+	})
+	var nonce string
+	h := s.Middleware()(func(w *response.Writer, req *request.Request) {
+		nonce = Nonce(req)
+		w.Header().Del("X-Frame-Options")
+	})
+	resp := servertest.Do(t, h, &request.Request{TLS: &tls.ConnectionState{}})
+
+	assert.Empty(t, nonce, "no placeholder, no nonce")
+	assert.Equal(t, "max-age=63072000; includeSubDomains; preload", resp.Header.Get("Strict-Transport-Security"))
+	assert.Empty(t, resp.Header.Get("X-Frame-Options"), "handlers have the last word")
+	assert.Empty(t, resp.Header.Get("X-Content-Type-Options"))
+	assert.Equal(t, `fullscreen=(*), geolocation=(self "https://maps.example.com")`, resp.Header.Get("Permissions-Policy"))
+	assert.Empty(t, resp.Header.Get("Content-Security-Policy"))
+	assert.Equal(t, "frame-ancestors 'self'; report-to csp-endpoint; report-uri /csp-report; script-src 'strict-dynamic'; upgrade-insecure-requests",
+		resp.Header.Get("Content-Security-Policy-Report-Only"))
+	assert.Equal(t, `csp-endpoint="/csp-report"`, resp.Header.Get("Reporting-Endpoints"))
+
+	// Test: An empty policy sends nothing
+	resp = servertest.Do(t, New(Policy{}).Middleware()(func(w *response.Writer, req *request.Request) {}), &request.Request{TLS: &tls.ConnectionState{}})
+	for k := range resp.Header {
+		assert.NotContains(t, []string{"Strict-Transport-Security", "Content-Security-Policy", "Permissions-Policy", "Reporting-Endpoints"}, k)
+	}
+}
+
+func TestReportHandler(t *testing.T) {
+	var got []Report
+	h := ReportHandler(func(r Report) { got = append(got, r) })
+	post := func(contentType, body string) *http.Response {
+		return servertest.Do(t, h, &request.Request{
+			RequestLine: request.RequestLine{Method: "POST"},
+			Headers:     headers.Headers{"content-type": contentType, "user-agent": "Firefox"},
+			Body:        []byte(body),
+		})
+	}
+
+	resp := post("application/csp-report", `{"csp-report":{"document-uri":"https://example.com/","blocked-uri":"inline",
+		"violated-directive":"script-src-elem","original-policy":"script-src 'self'","disposition":"report","line-number":7}}`)
+	assert.Equal(t, 204, resp.StatusCode)
+	resp = post("application/reports+json", `[{"type":"csp-violation","user_agent":"Chrome","body":{"documentURL":"https://example.com/a",
+		"blockedURL":"https://evil.example/x.js","effectiveDirective":"script-src-elem","disposition":"enforce","sample":"alert(1)"}},
+		{"type":"deprecation","body":{}}]`)
+	assert.Equal(t, 204, resp.StatusCode)
+
+	assert.Equal(t, []Report{
+		{DocumentURI: "https://example.com/", BlockedURI: "inline", EffectiveDirective: "script-src-elem",
+			OriginalPolicy: "script-src 'self'", Disposition: "report", LineNumber: 7, UserAgent: "Firefox"},
+		{DocumentURI: "https://example.com/a", BlockedURI: "https://evil.example/x.js", EffectiveDirective: "script-src-elem",
+			Disposition: "enforce", Sample: "alert(1)", UserAgent: "Chrome"},
+	}, got)
+
+	// Test: Anything else is refused
+	assert.Equal(t, 400, post("application/csp-report", "not json").StatusCode)
+	resp = servertest.Do(t, h, &request.Request{RequestLine: request.RequestLine{Method: "GET"}})
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Header.Get("Allow"))
+	resp = servertest.Do(t, h, &request.Request{
+		RequestLine: request.RequestLine{Method: "POST"},
+		Headers:     headers.Headers{"content-length": "100000"},
+	})
+	assert.Equal(t, 413, resp.StatusCode)
+	assert.Len(t, got, 2)
+}
+
+func TestLogReportRate(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// Test: A flood of reports logs no more than the rate allows
+	for range 5 * MaxReportLogRate {
+		LogReport(Report{DocumentURI: "https://example.com/"})
+	}
+	assert.LessOrEqual(t, strings.Count(out.String(), "\n"), MaxReportLogRate+1)
+	assert.Positive(t, reportDropped.Load())
+}
+
+func TestCSPOrder(t *testing.T) {
+	got := csp(map[string][]string{"img-src": {"*"}, "default-src": {"'none'"}, "block-all-mixed-content": nil})
+	assert.Equal(t, "default-src 'none'; block-all-mixed-content; img-src *", got)
+	assert.Equal(t, "usb=()", permissions(map[string][]string{"usb": nil}))
+	assert.Empty(t, permissions(nil))
+}
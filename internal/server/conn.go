@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+)
+
+// connInfo is what the server knows about a connection, it rides along in
+// the connection context so the HTTP/2 side can find it too.
+type connInfo struct {
+	id   uint64
+	conn net.Conn
+	tls  *tls.ConnectionState
+}
+
+type connInfoKey struct{}
+
+// fill sets the connection details of a request read off ci.
+func (ci *connInfo) fill(req *request.Request, seq uint64) {
+	req.RemoteAddr = ci.conn.RemoteAddr().String()
+	req.LocalAddr = ci.conn.LocalAddr().String()
+	req.ConnID = ci.id
+	req.Seq = seq
+	req.TLS = ci.tls
+	req.ReceivedAt = time.Now()
+}
+
+// clientGone reports whether a read error means the client closed or reset
+// the connection, as opposed to sending something we couldn't parse.
+func clientGone(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// watchClose blocks on a read and calls cancel if it fails because the
+// client went away. it returns once the connection is closed.
+func watchClose(conn net.Conn, cancel func()) {
+	var b [1]byte
+	if _, err := conn.Read(b[:]); err != nil && clientGone(err) {
+		cancel()
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate layout used by the Date header.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+// dateCache formats the Date header at most once per second no matter how
+// many requests are in flight.
+type dateCache struct {
+	cur atomic.Pointer[cachedDate]
+	now func() time.Time
+}
+
+func newDateCache() *dateCache {
+	return &dateCache{now: time.Now}
+}
+
+// Get returns the current time formatted for the Date header.
+func (d *dateCache) Get() string {
+	now := d.now()
+	if c := d.cur.Load(); c != nil && c.unix == now.Unix() {
+		return c.value
+	}
+	c := &cachedDate{unix: now.Unix(), value: now.UTC().Format(TimeFormat)}
+	d.cur.Store(c)
+	return c.value
+}
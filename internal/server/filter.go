@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+)
+
+// ConnFilter decides whether a client may connect at all.
+type ConnFilter func(addr netip.Addr) bool
+
+// WithConnFilter drops connections from addresses f refuses as soon as they
+// are accepted, before TLS or a single byte read, for networks that are
+// blocked everywhere. with WithProxyProtocol the address from the PROXY
+// header is checked instead of the load balancer's. trusted proxies, see
+// WithTrustedProxies, are let through: their clients are only known from
+// each request's forwarding headers, which is for the request middleware
+// to judge. f is called on every connection and must be fast.
+func WithConnFilter(f ConnFilter) Option {
+	return func(s *Server) {
+		s.connFilter = f
+	}
+}
+
+// allowConn checks a connection's peer at accept. peers that send a PROXY
+// header are checked by allowProxied once it's read.
+func (s *Server) allowConn(peer netip.Addr) bool {
+	if s.sendsProxyHeader(peer) {
+		return true
+	}
+	return s.allowAddr(peer)
+}
+
+// allowProxied checks the client address a PROXY header replaced the peer
+// with.
+func (s *Server) allowProxied(conn net.Conn) bool {
+	if s.connFilter == nil || s.proxyProto == nil {
+		return true
+	}
+	return s.allowAddr(addrOf(conn.RemoteAddr().String()))
+}
+
+// allowAddr reports whether the filter lets addr connect, counting the
+// connections it doesn't.
+func (s *Server) allowAddr(addr netip.Addr) bool {
+	if s.connFilter == nil || s.connFilter(addr) {
+		return true
+	}
+	if s.proxies != nil && s.proxies.IsTrusted(addr) {
+		return true
+	}
+	if s.metrics != nil {
+		s.metrics.connsBlocked.Inc()
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnFilter(t *testing.T) {
+	blocked := netip.MustParsePrefix("192.0.2.0/24")
+	filter := func(addr netip.Addr) bool { return !blocked.Contains(addr) }
+
+	// Test: Blocked peers are closed on without a response
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {},
+		WithConnFilter(func(netip.Addr) bool { return false }), WithMaxConns(1, Backoff))
+	for range 3 {
+		conn := dial()
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+		_, err := bufio.NewReader(conn).ReadByte()
+		assert.Error(t, err)
+	}
+
+	// Test: Addresses from PROXY headers are checked too
+	dial = startServer(t, func(w *response.Writer, req *request.Request) {},
+		WithProxyProtocol(), WithConnFilter(filter))
+	conn := dial()
+	_, err := io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.2 5000 443\r\nGET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	conn = dial()
+	_, err = io.WriteString(conn, "PROXY TCP4 203.0.113.1 198.51.100.2 5000 443\r\nGET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestConnFilterTrustedProxies(t *testing.T) {
+	allowed := netip.MustParsePrefix("203.0.113.0/24")
+	filter := func(addr netip.Addr) bool { return allowed.Contains(addr) }
+	clients := make(chan netip.Addr, 1)
+	handler := func(w *response.Writer, req *request.Request) { clients <- req.ClientIP }
+	get := "GET / HTTP/1.1\r\nHost: x\r\nX-Forwarded-For: 203.0.113.7\r\n\r\n"
+
+	// Test: A trusted proxy outside the allow-list still gets in, its
+	// clients are left to the request middleware
+	dial := startServer(t, handler, WithConnFilter(filter),
+		WithTrustedProxies(netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")))
+	conn := dial()
+	_, err := io.WriteString(conn, get)
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, netip.MustParseAddr("203.0.113.7"), <-clients)
+
+	// Test: Any other peer outside it is still dropped
+	dial = startServer(t, handler, WithConnFilter(filter),
+		WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")))
+	conn = dial()
+	_, _ = io.WriteString(conn, get)
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.Error(t, err)
+
+	// Test: Behind a PROXY protocol load balancer only the address in the
+	// header is checked
+	dial = startServer(t, handler, WithConnFilter(filter), WithProxyProtocol())
+	conn = dial()
+	_, err = io.WriteString(conn, "PROXY TCP4 203.0.113.9 198.51.100.2 5000 443\r\nGET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, netip.MustParseAddr("203.0.113.9"), <-clients)
+}
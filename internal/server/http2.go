@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/devwelkin/hermes-lite/internal/http2"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+)
+
+// WithTLS serves TLS with cfg. HTTP/2 is offered through ALPN unless turned
+// off with WithHTTP2(false).
+func WithTLS(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = cfg.Clone()
+	}
+}
+
+// WithHTTP2 turns HTTP/2 over TLS on or off, it is on by default.
+func WithHTTP2(enabled bool) Option {
+	return func(s *Server) {
+		s.http2 = enabled
+	}
+}
+
+// WithH2C turns on cleartext HTTP/2, both with prior knowledge (the client
+// opens with the HTTP/2 preface) and through Upgrade: h2c.
+func WithH2C() Option {
+	return func(s *Server) {
+		s.h2c = true
+	}
+}
+
+// setupTLS fills in the ALPN protocols once the options are known. the
+// handshake itself happens per connection in handle, after any PROXY header.
+func (s *Server) setupTLS() {
+	if s.tlsConfig == nil {
+		return
+	}
+	if s.http2 && !slices.Contains(s.tlsConfig.NextProtos, http2.NextProto) {
+		s.tlsConfig.NextProtos = append([]string{http2.NextProto}, s.tlsConfig.NextProtos...)
+	}
+	if !slices.Contains(s.tlsConfig.NextProtos, "http/1.1") {
+		s.tlsConfig.NextProtos = append(s.tlsConfig.NextProtos, "http/1.1")
+	}
+}
+
+func (s *Server) newHTTP2() *http2.Server {
+	return &http2.Server{
+		MaxBodySize:       s.maxBodySize,
+		MaxHeaderListSize: uint32(s.maxHeaderBytes),
+		Handler: func(wire response.Wire, req *request.Request) {
+			if ci, ok := req.Context().Value(connInfoKey{}).(*connInfo); ok {
+				req.ConnID = ci.id
+			}
+			s.resolveClientIP(req)
+			w := response.NewWireWriter(wire, s.bufferSize)
+			s.setDefaultHeaders(w)
+			s.serve(w, req)
+		},
+	}
+}
+
+// serveHTTP2 hands conn over to the HTTP/2 engine. buffered are bytes the
+// HTTP/1 reader already pulled off the connection.
+func (s *Server) serveHTTP2(ctx context.Context, conn net.Conn, buffered []byte) {
+	logHTTP2End(s.h2.ServeConn(ctx, conn, buffered))
+}
+
+func logHTTP2End(err error) {
+	// a client hanging up is the normal way for a connection to end
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, syscall.ECONNRESET) {
+		log.Printf("http2 connection ended: %v", err)
+	}
+}
+
+// isH2CUpgrade reports whether req asks to switch to cleartext HTTP/2
+// (RFC 7540 3.2).
+func isH2CUpgrade(req *request.Request) bool {
+	if !hasToken(req.Headers["upgrade"], "h2c") {
+		return false
+	}
+	_, hasSettings := req.Headers["http2-settings"]
+	conn := req.Headers["connection"]
+	return hasSettings && hasToken(conn, "upgrade") && hasToken(conn, "http2-settings")
+}
+
+// upgradeH2C answers an Upgrade: h2c request with 101 and runs the rest of
+// the connection as HTTP/2. it returns false if the settings were bad and the
+// request should be served over HTTP/1 instead.
+func (s *Server) upgradeH2C(conn net.Conn, slot *slot, rd *request.Reader, req *request.Request) bool {
+	settings := req.Headers["http2-settings"]
+	if _, err := http2.DecodeSettings(settings); err != nil {
+		return false
+	}
+
+	w := response.NewWriter(slot)
+	_ = w.WriteStatusLine(response.StatusSwitchingProtocols)
+	_ = w.WriteHeaders(map[string]string{
+		"Connection": "Upgrade",
+		"Upgrade":    "h2c",
+	})
+	_ = w.Close()
+	slot.finish()
+
+	logHTTP2End(s.h2.ServeUpgrade(req.Context(), conn, rd.Buffered(), req, settings))
+	return true
+}
+
+// hasToken reports whether the comma separated list v contains token,
+// ignoring case.
+func hasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoTrailerHandler echoes the method, target and body, and sends a trailer
+// when asked to.
+func echoTrailerHandler(w *response.Writer, req *request.Request) {
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body)
+	if req.Headers["x-want-trailer"] == "" {
+		_, _ = w.Write([]byte(body))
+		return
+	}
+	_ = w.WriteStatusLine(response.StatusOK)
+	_ = w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked", "Trailer": "X-Checksum"})
+	_, _ = w.WriteChunkedBody([]byte(body))
+	_, _ = w.WriteChunkedBodyDone()
+	_ = w.WriteTrailers(headers.Headers{"X-Checksum": "abc123"})
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	s, err := Serve(0, echoTrailerHandler, WithH2C())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(tr.CloseIdleConnections)
+	client := &http.Client{Transport: tr}
+	base := "http://" + s.Addr().String()
+
+	// Test: Streams multiplexed over one connection
+	done := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			resp, err := client.Post(base+"/echo", "text/plain", strings.NewReader("hello"))
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			done <- resp.Proto + " " + string(body)
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "HTTP/2.0 POST /echo hello", <-done)
+	}
+
+	// Test: Large body crosses the flow control window
+	big := strings.Repeat("x", 200_000)
+	resp, err := client.Post(base+"/big", "text/plain", strings.NewReader(big))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, "POST /big "+big, string(body))
+
+	// Test: Trailers and default headers
+	req, _ := http.NewRequest("GET", base+"/trailer", nil)
+	req.Header.Set("X-Want-Trailer", "1")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, "GET /trailer ", string(body))
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+	assert.Equal(t, DefaultServerName, resp.Header.Get("Server"))
+	assert.NotEmpty(t, resp.Header.Get("Date"))
+
+	// Test: HEAD keeps the length, drops the body
+	resp, err = client.Head(base + "/")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, int64(len("HEAD / ")), resp.ContentLength)
+}
+
+func TestHTTP2TLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	s, err := Serve(0, echoTrailerHandler, WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	for _, proto := range []string{"HTTP/2.0", "HTTP/1.1"} {
+		tr := &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: proto == "HTTP/2.0",
+		}
+		if proto == "HTTP/1.1" {
+			tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		resp, err := (&http.Client{Transport: tr}).Get("https://" + s.Addr().String() + "/tls")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		tr.CloseIdleConnections()
+		assert.Equal(t, proto, resp.Proto)
+		assert.Equal(t, "GET /tls ", string(body))
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	dial := startServer(t, echoTrailerHandler, WithH2C())
+	conn := dial()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err := io.WriteString(conn, "GET /up HTTP/1.1\r\nHost: x\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	// client preface and an empty SETTINGS
+	_, err = io.WriteString(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04\x00\x00\x00\x00\x00")
+	require.NoError(t, err)
+
+	// the answer to the upgrade request comes on stream 1
+	var body []byte
+	sawHeaders := false
+	for {
+		var hdr [9]byte
+		_, err := io.ReadFull(br, hdr[:])
+		require.NoError(t, err)
+		length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+		typ, flags, stream := hdr[3], hdr[4], binary.BigEndian.Uint32(hdr[5:])
+		payload := make([]byte, length)
+		_, err = io.ReadFull(br, payload)
+		require.NoError(t, err)
+
+		if stream != 1 {
+			continue
+		}
+		if typ == 0x1 {
+			sawHeaders = true
+		}
+		if typ == 0x0 {
+			body = append(body, payload...)
+		}
+		if flags&0x1 != 0 {
+			break
+		}
+	}
+	assert.True(t, sawHeaders)
+	assert.Equal(t, "GET /up ", string(body))
+}
+
+func TestHTTP2PrefaceWithoutH2C(t *testing.T) {
+	dial := startServer(t, echoTrailerHandler)
+	conn := dial()
+	_, err := io.WriteString(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 505, resp.StatusCode)
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHTTP2RequestContext(t *testing.T) {
+	reqs := make(chan *request.Request, 2)
+	cancelled := make(chan struct{}, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		reqs <- req
+		if req.RequestLine.RequestTarget == "/wait" {
+			<-req.Context().Done()
+			cancelled <- struct{}{}
+		}
+	}, WithH2C())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(tr.CloseIdleConnections)
+	client := &http.Client{Transport: tr}
+	base := "http://" + s.Addr().String()
+
+	resp, err := client.Get(base + "/a")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	req := <-reqs
+	assert.NotZero(t, req.ConnID)
+	assert.Equal(t, uint64(1), req.Seq)
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+	assert.True(t, strings.HasSuffix(req.LocalAddr, ":"+port), req.LocalAddr)
+
+	// Test: Cancelling the client request resets the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	hreq, _ := http.NewRequestWithContext(ctx, "GET", base+"/wait", nil)
+	go func() {
+		<-reqs
+		cancel()
+	}()
+	_, err = client.Do(hreq)
+	assert.ErrorIs(t, err, context.Canceled)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled on RST_STREAM")
+	}
+}
+
+func TestHTTP2MaxBodySize(t *testing.T) {
+	s, err := Serve(0, echoTrailerHandler, WithH2C(), WithMaxBodySize(100_000))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(tr.CloseIdleConnections)
+	client := &http.Client{Transport: tr}
+	base := "http://" + s.Addr().String()
+
+	// Test: Over the cap, with and without a Content-Length
+	resp, err := client.Post(base+"/", "text/plain", strings.NewReader(strings.Repeat("x", 100_001)))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp, err = client.Post(base+"/", "text/plain", io.MultiReader(strings.NewReader(strings.Repeat("x", 300_000))))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// Test: Right at the cap goes through, and the connection windows came
+	// back for the streams that were refused
+	for range 3 {
+		resp, err = client.Post(base+"/", "text/plain", io.MultiReader(strings.NewReader(strings.Repeat("x", 100_000))))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, body, len("POST / ")+100_000)
+	}
+
+	// Test: HTTP/1 is refused up front
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: 100001\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+// writeFrame writes one raw HTTP/2 frame.
+func writeFrame(t *testing.T, w io.Writer, typ, flags byte, stream uint32, payload []byte) {
+	t.Helper()
+	hdr := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(hdr[5:], stream)
+	_, err := w.Write(append(hdr, payload...))
+	require.NoError(t, err)
+}
+
+func TestHTTP2SelfDependency(t *testing.T) {
+	dial := startServer(t, echoTrailerHandler, WithH2C())
+	conn := dial()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	require.NoError(t, err)
+	writeFrame(t, conn, 0x4, 0, 0, nil)
+
+	// Test: A stream that depends on itself is reset, but its header block,
+	// split over a CONTINUATION, still lands in the decoder's table
+	priority := []byte{0, 0, 0, 1, 16}
+	block := []byte{0x82, 0x86, 0x84, 0x41, 1, 'x', 0x40, 3, 'x', '-', 'a', 1, '1'}
+	writeFrame(t, conn, 0x1, 0x1|0x20, 1, append(priority, block[:5]...))
+	writeFrame(t, conn, 0x9, 0x4, 1, block[5:])
+	// x-a: 1 is indexed 62 now, and :authority x 63
+	writeFrame(t, conn, 0x1, 0x1|0x4, 3, []byte{0x82, 0x86, 0x84, 0xbf, 0xbe})
+
+	br := bufio.NewReader(conn)
+	reset, answered := false, false
+	for !reset || !answered {
+		var hdr [9]byte
+		_, err := io.ReadFull(br, hdr[:])
+		require.NoError(t, err)
+		length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+		typ, stream := hdr[3], binary.BigEndian.Uint32(hdr[5:])
+		payload := make([]byte, length)
+		_, err = io.ReadFull(br, payload)
+		require.NoError(t, err)
+
+		require.NotEqual(t, byte(0x7), typ, "GOAWAY")
+		switch {
+		case typ == 0x3 && stream == 1:
+			assert.Equal(t, uint32(0x1), binary.BigEndian.Uint32(payload), "PROTOCOL_ERROR")
+			reset = true
+		case typ == 0x1 && stream == 3:
+			assert.Equal(t, byte(0x88), payload[0], ":status 200")
+			answered = true
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+)
+
+// Overflow is what happens to connections past the WithMaxConns limit.
+type Overflow int
+
+const (
+	// Backoff stops accepting until a connection closes; new clients wait
+	// in the kernel's listen backlog.
+	Backoff Overflow = iota
+	// Reject accepts and answers 503 with Retry-After straight away.
+	Reject
+)
+
+// retryAfter is the Retry-After sent with load shedding 503s, in seconds.
+const retryAfter = "1"
+
+const (
+	// maxRejects caps the connections being answered 503 at once, past it
+	// they are just closed.
+	maxRejects = 64
+	// rejectLinger is how long a rejected connection is drained after the
+	// 503, so closing it doesn't reset the response away.
+	rejectLinger = 250 * time.Millisecond
+	// rejectDrain caps what is read off a rejected connection.
+	rejectDrain = 64 << 10
+)
+
+// WithMaxConns caps the number of open connections.
+func WithMaxConns(n int, overflow Overflow) Option {
+	return func(s *Server) {
+		if n > 0 {
+			s.conns = make(chan struct{}, n)
+			s.overflow = overflow
+			if overflow == Reject {
+				s.rejects = make(chan struct{}, maxRejects)
+			}
+		}
+	}
+}
+
+// WithMaxBodySize caps request bodies, on both protocols. larger ones are
+// answered with 413 before they are read, or as soon as they pass n when
+// the size isn't known up front. the default is http2.DefaultMaxBodySize.
+func WithMaxBodySize(n int64) Option {
+	return func(s *Server) {
+		if n > 0 {
+			s.maxBodySize = n
+		}
+	}
+}
+
+// WithMaxHeaderBytes caps the request line and headers, on both protocols.
+// larger ones are answered with 431. the default is
+// request.DefaultMaxHeaderBytes.
+func WithMaxHeaderBytes(n int) Option {
+	return func(s *Server) {
+		if n > 0 {
+			s.maxHeaderBytes = n
+		}
+	}
+}
+
+// tooLarge reports whether the Content-Length of req is over the body cap.
+func (s *Server) tooLarge(req *request.Request) bool {
+	n, err := strconv.ParseInt(req.Headers["content-length"], 10, 64)
+	return err == nil && n > s.maxBodySize
+}
+
+// WithMaxHandlers caps the number of handlers running at once, over both
+// protocols. up to queue requests wait for a slot, for at most maxWait;
+// past either bound they get a 503 with Retry-After. maxWait 0 waits until
+// the client goes away.
+func WithMaxHandlers(n, queue int, maxWait time.Duration) Option {
+	return func(s *Server) {
+		if n > 0 {
+			s.handlerLimit = &handlerLimit{
+				slots:    make(chan struct{}, n),
+				maxQueue: int64(max(queue, 0)),
+				maxWait:  maxWait,
+			}
+		}
+	}
+}
+
+// WithAdaptiveShedding makes the handler queue shed harder under sustained
+// overload (CoDel style): once requests have waited longer than target for
+// a whole interval, queued requests only wait up to target until a request
+// gets through quickly again. needs WithMaxHandlers.
+func WithAdaptiveShedding(target, interval time.Duration) Option {
+	return func(s *Server) {
+		s.shedTarget = target
+		s.shedInterval = interval
+	}
+}
+
+// handlerLimit is a semaphore with a bounded wait queue.
+type handlerLimit struct {
+	slots    chan struct{}
+	waiting  atomic.Int64
+	maxQueue int64
+	maxWait  time.Duration
+
+	// adaptive shedding, off when target is 0
+	target   time.Duration
+	interval time.Duration
+
+	mu         sync.Mutex
+	firstAbove time.Time // when waits went over target, zero if they aren't
+	overloaded bool
+}
+
+// shed reasons, used as the metrics label
+const (
+	shedConns        = "conns"
+	shedQueueFull    = "queue_full"
+	shedQueueTimeout = "queue_timeout"
+)
+
+// acquire waits for a handler slot. it returns the shed reason if the
+// request should be turned away instead.
+func (l *handlerLimit) acquire(ctx context.Context) (string, bool) {
+	select {
+	case l.slots <- struct{}{}:
+		l.observe(0)
+		return "", true
+	default:
+	}
+
+	if l.waiting.Add(1) > l.maxQueue {
+		l.waiting.Add(-1)
+		return shedQueueFull, false
+	}
+	defer l.waiting.Add(-1)
+
+	wait := l.maxWait
+	if l.isOverloaded() {
+		wait = l.target
+	}
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		l.observe(time.Since(start))
+		return "", true
+	case <-timeout:
+		l.observe(wait)
+		return shedQueueTimeout, false
+	case <-ctx.Done():
+		return shedQueueTimeout, false
+	}
+}
+
+// observe feeds a queue wait into the overload detector.
+func (l *handlerLimit) observe(wait time.Duration) {
+	if l.target <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case wait < l.target:
+		l.firstAbove = time.Time{}
+		l.overloaded = false
+	case l.firstAbove.IsZero():
+		l.firstAbove = now
+	case now.Sub(l.firstAbove) >= l.interval:
+		l.overloaded = true
+	}
+}
+
+func (l *handlerLimit) isOverloaded() bool {
+	if l.target <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.overloaded
+}
+
+// admit takes a handler slot for req, or sends a 503 and returns false.
+func (s *Server) admit(w *response.Writer, req *request.Request) bool {
+	if s.handlerLimit == nil {
+		return true
+	}
+	reason, ok := s.handlerLimit.acquire(req.Context())
+	if ok {
+		return true
+	}
+	s.shed(reason)
+	w.Header().Set("Retry-After", retryAfter)
+	w.Header().Set("Content-Type", "text/plain")
+	_ = w.WriteStatusLine(response.StatusServiceUnavailable)
+	_, _ = w.Write([]byte(response.StatusText(response.StatusServiceUnavailable) + "\n"))
+	return false
+}
+
+func (s *Server) releaseHandler() {
+	if s.handlerLimit != nil {
+		<-s.handlerLimit.slots
+	}
+}
+
+// acceptSlot takes a connection slot. in Backoff mode it waits, and returns
+// false only when the server is closing.
+func (s *Server) acceptSlot() bool {
+	if s.conns == nil || s.overflow != Backoff {
+		return true
+	}
+	select {
+	case s.conns <- struct{}{}:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// tryConnSlot takes a connection slot in Reject mode without waiting.
+func (s *Server) tryConnSlot() bool {
+	if s.conns == nil || s.overflow != Reject {
+		return true
+	}
+	select {
+	case s.conns <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseConn() {
+	if s.conns != nil {
+		<-s.conns
+	}
+}
+
+// reject turns away a connection over the limit. up to maxRejects at a
+// time get a 503, the rest are closed straight away.
+func (s *Server) reject(conn net.Conn) {
+	s.shed(shedConns)
+	select {
+	case s.rejects <- struct{}{}:
+		go func() {
+			defer func() { <-s.rejects }()
+			s.rejectConn(conn)
+		}()
+	default:
+		conn.Close()
+	}
+}
+
+// rejectConn answers a connection over the limit with a canned 503 and
+// closes it. TLS connections are just closed, a handshake would cost more
+// than the connection is worth.
+func (s *Server) rejectConn(conn net.Conn) {
+	defer conn.Close()
+	if s.tlsConfig != nil {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := io.WriteString(conn, "HTTP/1.1 503 Service Unavailable\r\n"+
+		"Retry-After: "+retryAfter+"\r\n"+
+		"Connection: close\r\n"+
+		"Content-Length: 0\r\n\r\n")
+	if err != nil {
+		return
+	}
+
+	// closing with the request still unread makes the kernel send a reset,
+	// which can beat the 503 to the client. shut our side and read for a
+	// little while first.
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(rejectLinger))
+	_, _ = io.CopyN(io.Discard, conn, rejectDrain)
+}
+
+func (s *Server) shed(reason string) {
+	if s.metrics != nil {
+		s.metrics.shed.With(reason).Inc()
+	}
+}
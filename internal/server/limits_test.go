@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingHandler holds every request until release is closed.
+func blockingHandler(started chan<- string, release <-chan struct{}) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		started <- req.RequestLine.RequestTarget
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+func sendGet(t *testing.T, conn net.Conn, target string) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+}
+
+func readResp(t *testing.T, conn net.Conn) *http.Response {
+	t.Helper()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	return resp
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	dial := startServer(t, blockingHandler(started, release), WithMaxConns(1, Reject))
+
+	first := dial()
+	sendGet(t, first, "/a")
+	<-started
+
+	// Test: The connection over the limit gets a fast 503
+	over := dial()
+	_ = over.SetDeadline(time.Now().Add(5 * time.Second))
+	resp := readResp(t, over)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	close(release)
+	assert.Equal(t, 200, readResp(t, first).StatusCode)
+	_ = first.Close()
+
+	// Test: The slot is free again once the first connection is gone
+	require.Eventually(t, func() bool {
+		conn := dial()
+		sendGet(t, conn, "/b")
+		return readResp(t, conn).StatusCode == 200
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMaxConnsRejectDrains(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	dial := startServer(t, blockingHandler(started, release), WithMaxConns(1, Reject))
+	defer close(release)
+
+	first := dial()
+	sendGet(t, first, "/a")
+	<-started
+
+	// Test: A client that sent its request before reading gets the 503 and
+	// a clean close, not a reset
+	over := dial()
+	_ = over.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := over.Write([]byte("POST /b HTTP/1.1\r\nHost: localhost\r\n" +
+		"Content-Length: 32768\r\n\r\n" + strings.Repeat("x", 32768)))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	br := bufio.NewReader(over)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMaxConnsBackoff(t *testing.T) {
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}, WithMaxConns(1, Backoff))
+
+	first := dial()
+	sendGet(t, first, "/a")
+	assert.Equal(t, 200, readResp(t, first).StatusCode)
+
+	// the first connection is idle but open, the second waits in the backlog
+	second := dial()
+	sendGet(t, second, "/b")
+	_ = second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := second.Read(make([]byte, 1))
+	var nerr net.Error
+	require.ErrorAs(t, err, &nerr)
+	assert.True(t, nerr.Timeout())
+
+	_ = first.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.Equal(t, 200, readResp(t, second).StatusCode)
+}
+
+func TestMaxHandlers(t *testing.T) {
+	started, release := make(chan string, 2), make(chan struct{})
+	dial := startServer(t, blockingHandler(started, release), WithMaxHandlers(1, 1, 0))
+
+	running := dial()
+	sendGet(t, running, "/running")
+	assert.Equal(t, "/running", <-started)
+
+	queued := dial()
+	sendGet(t, queued, "/queued")
+	time.Sleep(50 * time.Millisecond)
+
+	// Test: Past the queue the request is shed straight away
+	full := dial()
+	sendGet(t, full, "/full")
+	resp := readResp(t, full)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Test: The queued request runs once a slot frees up
+	close(release)
+	assert.Equal(t, 200, readResp(t, running).StatusCode)
+	assert.Equal(t, "/queued", <-started)
+	assert.Equal(t, 200, readResp(t, queued).StatusCode)
+}
+
+func TestMaxHandlersQueueTimeout(t *testing.T) {
+	started, release := make(chan string, 1), make(chan struct{})
+	dial := startServer(t, blockingHandler(started, release), WithMaxHandlers(1, 5, 50*time.Millisecond))
+	t.Cleanup(func() { close(release) })
+
+	running := dial()
+	sendGet(t, running, "/running")
+	<-started
+
+	waiting := dial()
+	start := time.Now()
+	sendGet(t, waiting, "/waiting")
+	assert.Equal(t, 503, readResp(t, waiting).StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestAdaptiveShedding(t *testing.T) {
+	l := &handlerLimit{target: 10 * time.Millisecond, interval: 20 * time.Millisecond}
+
+	// Test: A single slow wait is not overload
+	l.observe(15 * time.Millisecond)
+	assert.False(t, l.isOverloaded())
+
+	// Test: Waits over target for a whole interval are
+	time.Sleep(25 * time.Millisecond)
+	l.observe(15 * time.Millisecond)
+	assert.True(t, l.isOverloaded())
+
+	// Test: One quick admission clears it
+	l.observe(time.Millisecond)
+	assert.False(t, l.isOverloaded())
+}
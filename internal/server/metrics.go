@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/metrics"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+)
+
+// RouteFunc names the route a request matched, for the route label of the
+// request metrics. it must return a small, fixed set of values; raw paths
+// would give every URL its own series.
+type RouteFunc func(req *request.Request) string
+
+// WithMetrics records server metrics into reg.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(s *Server) {
+		s.registry = reg
+	}
+}
+
+// WithAdminListener serves the metrics at /metrics on a separate port, so
+// they're never exposed on the public one. metrics are turned on with a
+// fresh registry if WithMetrics wasn't given.
+func WithAdminListener(port int) Option {
+	return func(s *Server) {
+		s.adminPort = &port
+	}
+}
+
+// WithRouteLabel sets how requests are grouped in the route label. without
+// it every request is counted under route "*".
+func WithRouteLabel(fn RouteFunc) Option {
+	return func(s *Server) {
+		s.route = fn
+	}
+}
+
+type serverMetrics struct {
+	connsActive   metrics.Gauge
+	connsAccepted metrics.Counter
+	connsClosed   metrics.Counter
+	connsBlocked  metrics.Counter
+	requests      metrics.CounterVec   // method, code, route
+	duration      metrics.HistogramVec // method, route
+	requestBytes  metrics.Counter
+	responseBytes metrics.Counter
+	parseErrors   metrics.CounterVec // type
+	inFlight      metrics.Gauge
+	shed          metrics.CounterVec // reason
+}
+
+func newServerMetrics(reg *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		connsActive:   reg.NewGauge("hermes_connections_active", "Connections currently open."),
+		connsAccepted: reg.NewCounter("hermes_connections_accepted_total", "Connections accepted."),
+		connsClosed:   reg.NewCounter("hermes_connections_closed_total", "Connections closed."),
+		connsBlocked:  reg.NewCounter("hermes_connections_blocked_total", "Connections dropped by the connection filter."),
+		requests: reg.NewCounterVec("hermes_requests_total",
+			"Requests handled, by method, status class and route.", "method", "code", "route"),
+		duration: reg.NewHistogramVec("hermes_request_duration_seconds",
+			"Time from the handler starting to the response being finished.", metrics.DefBuckets, "method", "route"),
+		requestBytes:  reg.NewCounter("hermes_request_bytes_total", "Request body bytes read."),
+		responseBytes: reg.NewCounter("hermes_response_bytes_total", "Response body bytes written."),
+		parseErrors: reg.NewCounterVec("hermes_parse_errors_total",
+			"Requests rejected because they didn't parse, by error type.", "type"),
+		inFlight: reg.NewGauge("hermes_handlers_in_flight", "Handlers currently running."),
+		shed: reg.NewCounterVec("hermes_shed_total",
+			"Connections and requests turned away by the server limits, by reason.", "reason"),
+	}
+}
+
+// knownMethods keeps the method label bounded, anything else is "other".
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+// observe records a finished request.
+func (m *serverMetrics) observe(route string, w *response.Writer, req *request.Request, took time.Duration) {
+	status := w.Status()
+	if status == 0 {
+		status = response.StatusOK
+	}
+	method := methodLabel(req.RequestLine.Method)
+	m.requests.With(method, fmt.Sprintf("%dxx", status/100), route).Inc()
+	m.duration.With(method, route).Observe(took.Seconds())
+	m.requestBytes.Add(int64(len(req.Body)))
+	m.responseBytes.Add(w.BytesWritten())
+}
+
+// parseErrorType names the reason a request was rejected before reaching
+// the handler.
+func parseErrorType(err error) string {
+	switch {
+	case errors.Is(err, request.ErrInvalidTarget):
+		return "target"
+	case errors.Is(err, request.ErrInvalidRequestFormat):
+		return "request_line"
+	case errors.Is(err, request.ErrUnsupportedHTTP):
+		return "version"
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return "header_too_large"
+	case errors.Is(err, headers.ErrInvalidHeader):
+		return "header"
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return "transfer_encoding"
+	case errors.Is(err, request.ErrInvalidContentLength):
+		return "content_length"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "unexpected_eof"
+	}
+	return "other"
+}
+
+func (s *Server) parseError(err error) {
+	if s.metrics != nil {
+		s.metrics.parseErrors.With(parseErrorType(err)).Inc()
+	}
+}
+
+// startAdmin runs the admin listener. it is a Server of its own, without
+// metrics, so scrapes don't show up in the numbers.
+func (s *Server) startAdmin(port int) error {
+	admin, err := Serve(port, s.adminHandler)
+	if err != nil {
+		return err
+	}
+	s.admin = admin
+	return nil
+}
+
+func (s *Server) adminHandler(w *response.Writer, req *request.Request) {
+	if req.RequestLine.URL.Path != "/metrics" {
+		w.Header().Set("Content-Type", "text/plain")
+		_ = w.WriteStatusLine(response.StatusNotFound)
+		_, _ = w.Write([]byte("Not Found\n"))
+		return
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	if _, err := s.registry.WriteTo(w); err != nil {
+		log.Printf("error writing metrics: %v", err)
+	}
+}
+
+// AdminAddr returns the address of the admin listener, nil without one.
+func (s *Server) AdminAddr() net.Addr {
+	if s.admin == nil {
+		return nil
+	}
+	return s.admin.Addr()
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/metrics"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/fail" {
+			_ = w.WriteStatusLine(response.StatusInternalServerError)
+		}
+		_, _ = w.Write([]byte("hello"))
+	}, WithAdminListener(0), WithRouteLabel(func(req *request.Request) string {
+		return strings.TrimPrefix(req.RequestLine.RequestTarget, "/")
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "GET /ok HTTP/1.1\r\n\r\n"+
+		"POST /fail HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc"+
+		"BREW /ok HTTP/1.1\r\n\r\n"+
+		"GET /ok HTTP/1.1\r\nbad header\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	for range 4 {
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		_, _ = io.ReadAll(resp.Body)
+	}
+	conn.Close()
+
+	want := []string{
+		"hermes_connections_accepted_total 1\n",
+		`hermes_requests_total{method="GET",code="2xx",route="ok"} 1` + "\n",
+		`hermes_requests_total{method="POST",code="5xx",route="fail"} 1` + "\n",
+		`hermes_requests_total{method="other",code="2xx",route="ok"} 1` + "\n",
+		`hermes_request_duration_seconds_count{method="GET",route="ok"} 1` + "\n",
+		"hermes_request_bytes_total 3\n",
+		"hermes_response_bytes_total 15\n",
+		`hermes_parse_errors_total{type="header"} 1` + "\n",
+		"hermes_handlers_in_flight 0\n",
+		"hermes_connections_active 0\n",
+	}
+	var body string
+	ok := assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + s.AdminAddr().String() + "/metrics")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body = string(b)
+		assert.Equal(t, metrics.ContentType, resp.Header.Get("Content-Type"))
+		for _, line := range want {
+			if !strings.Contains(body, line) {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+	if !ok {
+		t.Log(body)
+	}
+
+	resp, err := http.Get("http://" + s.AdminAddr().String() + "/other")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,13 @@
+package server
+
+// Middleware wraps a Handler with behaviour that runs around it.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with mws. the first middleware is the outermost one, so it
+// sees the request first and the finished response last.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
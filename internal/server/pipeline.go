@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxSlotBuffer is how much a response waiting for its turn may buffer.
+// past it the handler's writes block until the slot reaches the head.
+const maxSlotBuffer = 64 << 10
+
+// pipeline keeps pipelined responses in request order. every request gets a
+// slot; the oldest unfinished slot writes straight to the connection and the
+// ones behind it buffer until it's their turn.
+type pipeline struct {
+	mu    sync.Mutex
+	moved *sync.Cond // the head moved on, or the connection died
+	w     io.Writer
+	queue []*slot
+	err   error // first write error, the connection is dead after it
+}
+
+func newPipeline(w io.Writer) *pipeline {
+	p := &pipeline{w: w}
+	p.moved = sync.NewCond(&p.mu)
+	return p
+}
+
+// next reserves the slot for the next response on the connection.
+func (p *pipeline) next() *slot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sl := &slot{p: p}
+	p.queue = append(p.queue, sl)
+	return sl
+}
+
+type slot struct {
+	p    *pipeline
+	buf  bytes.Buffer
+	done bool
+	last bool // the connection closes once this response is out
+}
+
+func (sl *slot) Write(b []byte) (int, error) {
+	p := sl.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	written := 0
+	for {
+		if p.err != nil {
+			return written, p.err
+		}
+		if p.queue[0] == sl {
+			n, err := p.w.Write(b)
+			if err != nil {
+				p.err = err
+				p.moved.Broadcast()
+			}
+			return written + n, err
+		}
+		if len(b) == 0 {
+			return written, nil
+		}
+		room := maxSlotBuffer - sl.buf.Len()
+		if room <= 0 {
+			p.moved.Wait()
+			continue
+		}
+		n, _ := sl.buf.Write(b[:min(room, len(b))])
+		written += n
+		b = b[n:]
+	}
+}
+
+// closeAfter makes the response the last one on the connection: it is
+// closed as soon as the response is written, for bodies that end with it.
+func (sl *slot) closeAfter() {
+	sl.p.mu.Lock()
+	sl.last = true
+	sl.p.mu.Unlock()
+}
+
+// finish marks the response complete and hands the connection to the next
+// slot, flushing whatever it buffered in the meantime.
+func (sl *slot) finish() {
+	p := sl.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sl.done = true
+	for len(p.queue) > 0 && p.queue[0].done {
+		if p.queue[0].last && p.err == nil {
+			p.err = net.ErrClosed
+			if c, ok := p.w.(io.Closer); ok {
+				_ = c.Close()
+			}
+		}
+		p.queue = p.queue[1:]
+		if len(p.queue) == 0 || p.err != nil {
+			continue
+		}
+		next := p.queue[0]
+		if next.buf.Len() > 0 {
+			if _, err := p.w.Write(next.buf.Bytes()); err != nil {
+				p.err = err
+			}
+			next.buf.Reset()
+		}
+	}
+	p.moved.Broadcast()
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineOrder(t *testing.T) {
+	var out bytes.Buffer
+	p := newPipeline(&out)
+	first, second, third := p.next(), p.next(), p.next()
+
+	// Test: Later responses wait for earlier ones
+	_, _ = third.Write([]byte("3"))
+	third.finish()
+	_, _ = second.Write([]byte("2a"))
+	assert.Empty(t, out.String())
+
+	// Test: The head writes straight through
+	_, _ = first.Write([]byte("1"))
+	assert.Equal(t, "1", out.String())
+
+	// Test: Finishing the head flushes the next one, and everything done behind it
+	first.finish()
+	assert.Equal(t, "12a", out.String())
+	_, _ = second.Write([]byte("2b"))
+	assert.Equal(t, "12a2b", out.String())
+	second.finish()
+	assert.Equal(t, "12a2b3", out.String())
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	var out bytes.Buffer
+	p := newPipeline(&out)
+	first, second := p.next(), p.next()
+
+	// Test: A response behind the head buffers up to the cap, then waits
+	wrote := make(chan int)
+	go func() {
+		n, _ := second.Write(bytes.Repeat([]byte("x"), maxSlotBuffer+10))
+		wrote <- n
+	}()
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return second.buf.Len() == maxSlotBuffer
+	}, time.Second, time.Millisecond)
+	select {
+	case <-wrote:
+		t.Fatal("write past the cap didn't wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Test: It goes on once its slot reaches the head
+	first.finish()
+	assert.Equal(t, maxSlotBuffer+10, <-wrote)
+	assert.Equal(t, maxSlotBuffer+10, out.Len())
+}
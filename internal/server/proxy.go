@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/clientip"
+	"github.com/devwelkin/hermes-lite/internal/proxyproto"
+	"github.com/devwelkin/hermes-lite/internal/request"
+)
+
+// WithProxyProtocol expects a PROXY protocol header (v1 or v2) at the start
+// of every connection from the given load balancer addresses, any peer if
+// none are given. the addresses in the header replace the TCP ones. a
+// trusted peer that doesn't send a valid header is disconnected; other
+// peers are served as they are and can't spoof an address with one.
+func WithProxyProtocol(trusted ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.proxyProto = &clientip.Resolver{Trusted: trusted}
+	}
+}
+
+// WithTrustedProxies sets the reverse proxies whose X-Forwarded-For and
+// Forwarded headers are believed when working out Request.ClientIP.
+func WithTrustedProxies(trusted ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.proxies = &clientip.Resolver{Trusted: trusted}
+	}
+}
+
+// readProxyHeader reads the PROXY header if the peer is expected to send
+// one. it returns false if the connection should be dropped.
+func (s *Server) readProxyHeader(conn net.Conn) (net.Conn, bool) {
+	peer := addrOf(conn.RemoteAddr().String())
+	if !s.sendsProxyHeader(peer) {
+		return conn, true
+	}
+
+	if s.idleTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	}
+	pc, err := proxyproto.NewConn(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if errors.Is(err, proxyproto.ErrNoHeader) || errors.Is(err, proxyproto.ErrInvalidHeader) {
+			log.Printf("dropping connection from %s: %v", peer, err)
+		}
+		return conn, false
+	}
+	return pc, true
+}
+
+// sendsProxyHeader reports whether peer is expected to start with a PROXY
+// header.
+func (s *Server) sendsProxyHeader(peer netip.Addr) bool {
+	if s.proxyProto == nil {
+		return false
+	}
+	return len(s.proxyProto.Trusted) == 0 || s.proxyProto.IsTrusted(peer)
+}
+
+// resolveClientIP sets req.ClientIP from the peer address and, for trusted
+// proxies, the forwarding headers.
+func (s *Server) resolveClientIP(req *request.Request) {
+	peer := addrOf(req.RemoteAddr)
+	if s.proxies == nil {
+		req.ClientIP = peer
+		return
+	}
+	req.ClientIP = s.proxies.Resolve(peer, req.Headers)
+}
+
+// addrOf returns the IP of a host:port address, the zero Addr if it has
+// none (e.g. a pipe in tests).
+func addrOf(hostport string) netip.Addr {
+	ap, err := netip.ParseAddrPort(hostport)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
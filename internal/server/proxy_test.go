@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		_, _ = io.WriteString(w, req.RemoteAddr+" "+req.LocalAddr+" "+req.ClientIP.String())
+	}, WithProxyProtocol(), WithTrustedProxies(netip.MustParsePrefix("192.0.2.0/24")))
+
+	// Test: Header addresses replace the TCP ones, XFF from the proxy counts
+	conn := dial()
+	_, err := io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.2 5000 443\r\n"+
+		"GET / HTTP/1.1\r\nX-Forwarded-For: 203.0.113.5\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "192.0.2.1:5000 198.51.100.2:443 203.0.113.5", string(body))
+
+	// Test: No header from a peer that must send one
+	conn = dial()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestProxyProtocolUntrustedPeer(t *testing.T) {
+	// the test client isn't in the load balancer range, so its PROXY line
+	// is just a bad request
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {},
+		WithProxyProtocol(netip.MustParsePrefix("192.0.2.0/24")))
+
+	conn := dial()
+	_, err := io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.2 5000 443\r\nGET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -1,33 +1,192 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/devwelkin/hermes-lite/internal/clientip"
+	"github.com/devwelkin/hermes-lite/internal/form"
+	"github.com/devwelkin/hermes-lite/internal/http2"
+	"github.com/devwelkin/hermes-lite/internal/metrics"
 	"github.com/devwelkin/hermes-lite/internal/request"
 	"github.com/devwelkin/hermes-lite/internal/response"
 )
 
 type Handler func(w *response.Writer, req *request.Request)
 
+const (
+	// DefaultServerName is sent in the Server header unless overridden.
+	DefaultServerName = "hermes-lite"
+	// DefaultPipelineDepth is how many pipelined requests on one connection
+	// can be handled at the same time.
+	DefaultPipelineDepth = 8
+	// DefaultIdleTimeout is how long a kept-alive connection waits for the
+	// next request.
+	DefaultIdleTimeout = 60 * time.Second
+	// DefaultBodyTimeout is how long a client has to send a request body.
+	DefaultBodyTimeout = 30 * time.Second
+)
+
 type Server struct {
 	listener net.Listener
 	handler  Handler // güncellenmiş handler tipi
 	closed   atomic.Bool
+	ctx      context.Context // cancelled by Close
+	cancel   context.CancelFunc
+	connIDs  atomic.Uint64
+
+	serverName string
+	bufferSize int
+	dates      *dateCache
+	expect     ExpectFunc
+
+	pipelineDepth  int
+	idleTimeout    time.Duration
+	bodyTimeout    time.Duration
+	maxBodySize    int64
+	maxHeaderBytes int
+
+	tlsConfig *tls.Config
+	http2     bool // h2 over TLS
+	h2c       bool // cleartext h2
+	h2        *http2.Server
+
+	registry  *metrics.Registry
+	metrics   *serverMetrics // nil when metrics are off
+	route     RouteFunc
+	adminPort *int
+	admin     *Server
+
+	proxyProto *clientip.Resolver // peers that send a PROXY header
+	proxies    *clientip.Resolver // peers whose forwarding headers count
+	connFilter ConnFilter
+
+	conns        chan struct{} // connection slots, nil for no limit
+	overflow     Overflow
+	rejects      chan struct{} // connections being answered 503
+	handlerLimit *handlerLimit
+	shedTarget   time.Duration
+	shedInterval time.Duration
+}
+
+// ExpectFunc looks at the head of an Expect: 100-continue request before the
+// body is sent. returning response.StatusContinue lets the client go ahead,
+// any other status (417, 413, 401...) is sent as the final response and the
+// body is never read.
+type ExpectFunc func(req *request.Request) response.StatusCode
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithServerName sets the Server header value. an empty name leaves the
+// header out.
+func WithServerName(name string) Option {
+	return func(s *Server) {
+		s.serverName = name
+	}
+}
+
+// WithResponseBuffer sets how many body bytes a response buffers before it
+// falls back to chunked encoding. n <= 0 turns buffering off and handlers
+// have to frame the body themselves.
+func WithResponseBuffer(n int) Option {
+	return func(s *Server) {
+		s.bufferSize = n
+	}
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+// WithExpectContinue sets a hook that accepts or rejects Expect: 100-continue
+// requests before the body arrives. without one the decision is left to the
+// handler: 100 Continue goes out when it calls req.ReadBody, and the
+// connection is closed after the response.
+func WithExpectContinue(fn ExpectFunc) Option {
+	return func(s *Server) {
+		s.expect = fn
+	}
+}
+
+// WithPipelineDepth sets how many pipelined requests on a connection are
+// handled concurrently. only GET, HEAD and OPTIONS run alongside each
+// other, any other method waits for the requests ahead of it and holds up
+// the ones behind. responses still go out in request order. n <= 1 handles
+// them one at a time.
+func WithPipelineDepth(n int) Option {
+	return func(s *Server) {
+		s.pipelineDepth = max(n, 1)
+	}
+}
+
+// WithIdleTimeout sets how long a connection may sit idle between requests.
+// zero waits forever.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithBodyTimeout sets how long a client has to send a request body once
+// the server starts reading it, so a slow sender can't hold on to a
+// connection and a handler forever. zero waits forever.
+func WithBodyTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.bodyTimeout = d
+	}
+}
+
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	s := &Server{
+		handler:    handler,
+		serverName: DefaultServerName,
+		bufferSize: response.DefaultBufferSize,
+		dates:      newDateCache(),
+
+		pipelineDepth: DefaultPipelineDepth,
+		idleTimeout:   DefaultIdleTimeout,
+		bodyTimeout:   DefaultBodyTimeout,
+		maxBodySize:   http2.DefaultMaxBodySize,
+		http2:         true,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.handlerLimit != nil {
+		s.handlerLimit.target = s.shedTarget
+		s.handlerLimit.interval = s.shedInterval
+	}
+	s.h2 = s.newHTTP2()
+	if s.registry == nil && s.adminPort != nil {
+		s.registry = metrics.NewRegistry()
+	}
+	if s.registry != nil {
+		s.metrics = newServerMetrics(s.registry)
+	}
+
 	addr := fmt.Sprintf(":%d", port)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
+		s.cancel()
 		return nil, err
 	}
+	s.listener = listener
+	s.setupTLS()
 
-	s := &Server{
-		listener: listener,
-		handler:  handler,
+	if s.adminPort != nil {
+		if err := s.startAdmin(*s.adminPort); err != nil {
+			s.cancel()
+			listener.Close()
+			return nil, err
+		}
 	}
 
 	go s.listen()
@@ -35,15 +194,32 @@ func Serve(port int, handler Handler) (*Server, error) {
 	return s, nil
 }
 
+// Addr returns the address the server is listening on, handy with port 0.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections and cancels the context of every request
+// still being handled.
 func (s *Server) Close() error {
 	s.closed.Store(true)
+	s.cancel()
+	if s.admin != nil {
+		_ = s.admin.Close()
+	}
 	return s.listener.Close()
 }
 
 func (s *Server) listen() {
 	for {
+		if !s.acceptSlot() {
+			return
+		}
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if s.overflow == Backoff {
+				s.releaseConn()
+			}
 			if s.closed.Load() {
 				log.Println("listener closed, server shutting down.")
 				return
@@ -51,27 +227,340 @@ func (s *Server) listen() {
 			log.Printf("error accepting connection: %v", err)
 			continue
 		}
-		go s.handle(conn, s.handler)
+		if !s.allowConn(addrOf(conn.RemoteAddr().String())) {
+			conn.Close()
+			if s.overflow == Backoff {
+				s.releaseConn()
+			}
+			continue
+		}
+		if !s.tryConnSlot() {
+			s.reject(conn)
+			continue
+		}
+		if s.metrics != nil {
+			s.metrics.connsAccepted.Inc()
+			s.metrics.connsActive.Inc()
+		}
+		go s.handle(conn)
 	}
 }
 
-func (s *Server) handle(conn net.Conn, handler Handler) {
-	defer conn.Close()
+func (s *Server) handle(conn net.Conn) {
+	defer s.releaseConn()
+	// conn gets wrapped below, close whatever it ends up as
+	defer func() { conn.Close() }()
+	if s.metrics != nil {
+		defer func() {
+			s.metrics.connsActive.Dec()
+			s.metrics.connsClosed.Inc()
+		}()
+	}
 
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Printf("error parsing request: %v", err)
+	conn, ok := s.readProxyHeader(conn)
+	if !ok || !s.allowProxied(conn) {
+		return
+	}
+	if s.tlsConfig != nil {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+
+	ci := &connInfo{id: s.connIDs.Add(1), conn: conn}
+	ctx, cancel := context.WithCancel(context.WithValue(s.ctx, connInfoKey{}, ci))
+	defer cancel()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if s.idleTimeout > 0 {
+			_ = conn.SetDeadline(time.Now().Add(s.idleTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("tls handshake failed: %v", err)
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		ci.tls = &state
+		if state.NegotiatedProtocol == http2.NextProto {
+			s.serveHTTP2(ctx, conn, nil)
+			return
+		}
+	}
 
-		w := response.NewWriter(conn) // yeni writer'ı oluştur
+	rd := request.NewReader(conn)
+	rd.MaxHeaderBytes = s.maxHeaderBytes
+	out := newPipeline(conn)
+	inFlight := make(chan struct{}, s.pipelineDepth)
+	var wg sync.WaitGroup
+	defer wg.Wait()
 
-		_ = w.WriteStatusLine(response.StatusBadRequest)
-		h := response.GetDefaultHeaders(len("Bad Request\n")) // varsayılan header'lar
-		_ = w.WriteHeaders(h)
-		_, _ = w.WriteBody([]byte("Bad Request\n")) // body
+	for served := 0; ; served++ {
+		if s.idleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+		req, err := rd.ReadHeader()
+		if err != nil {
+			if clientGone(err) {
+				// the handlers still running have no one to answer
+				cancel()
+			}
+			if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("error parsing request: %v", err)
+			s.parseError(err)
+			code := response.StatusBadRequest
+			if errors.Is(err, request.ErrHeaderTooLarge) {
+				code = response.StatusRequestHeaderFieldsTooLarge
+			}
+			s.writeError(out.next(), code)
+			return
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+
+		if req.IsHTTP2Preface() {
+			if !s.h2c || served > 0 {
+				s.writeError(out.next(), response.StatusHTTPVersionNotSupported)
+				return
+			}
+			// give the engine the whole preface back, the reader ate the
+			// part that looks like a request line
+			preface := append([]byte("PRI * HTTP/2.0\r\n\r\n"), rd.Buffered()...)
+			s.serveHTTP2(ctx, conn, preface)
+			return
+		}
+
+		ci.fill(req, uint64(served+1))
+		s.resolveClientIP(req)
+		req.SetContext(ctx)
+		keepAlive := req.KeepAlive()
+		slot := out.next()
+
+		if _, ok := req.Headers["expect"]; ok && !req.ExpectsContinue() {
+			// the only expectation we know is 100-continue
+			s.writeError(slot, response.StatusExpectationFailed)
+			return
+		}
+		if s.tooLarge(req) {
+			s.writeError(slot, response.StatusContentTooLarge)
+			return
+		}
+
+		resWriter := s.newWriter(slot, keepAlive)
+		resWriter.SetRequestVersion(req.RequestLine.HTTPVersion)
+		if keepAlive && req.RequestLine.HTTPVersion == "1.0" {
+			resWriter.Header().Set("Connection", "keep-alive")
+		}
+		deferred := false
+
+		if req.ExpectsContinue() && s.expect == nil {
+			// the handler decides, 100 Continue goes out when it reads the
+			// body. we can't find the next request if it doesn't, so this
+			// is the last one on the connection.
+			deferred = true
+			keepAlive = false
+			resWriter.Header().Set("Connection", "close")
+			rd.DeferBody(req, func() error {
+				if err := resWriter.WriteInterimResponse(response.StatusContinue, nil); err != nil {
+					return err
+				}
+				// nothing is read after this body, the deadline can stay
+				s.setBodyDeadline(conn)
+				return nil
+			})
+		} else {
+			if req.ExpectsContinue() {
+				if code := s.expect(req); code != response.StatusContinue {
+					s.writeError(slot, code)
+					return
+				}
+				if err := resWriter.WriteInterimResponse(response.StatusContinue, nil); err != nil {
+					slot.finish()
+					return
+				}
+			}
+			if s.streamsBody(req) {
+				// forms are parsed off the connection, the handler
+				// streams the body and we skip what it leaves
+				deferred = true
+				rd.DeferBody(req, func() error {
+					s.setBodyDeadline(conn)
+					return nil
+				})
+			} else if err := s.readBody(conn, rd, req); err != nil {
+				code := response.StatusBadRequest
+				switch {
+				case errors.Is(err, os.ErrDeadlineExceeded):
+					code = response.StatusRequestTimeout
+				case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+					code = response.StatusNotImplemented
+				}
+				if code != response.StatusRequestTimeout {
+					log.Printf("error reading request body: %v", err)
+					s.parseError(err)
+				}
+				s.writeError(slot, code)
+				return
+			}
+		}
+
+		if s.h2c && isH2CUpgrade(req) {
+			// everything before the upgrade is answered over HTTP/1 first
+			wg.Wait()
+			if s.upgradeH2C(conn, slot, rd, req) {
+				return
+			}
+		}
+
+		serial := !safeMethod(req.RequestLine.Method)
+		if serial {
+			// side effects happen in request order, after everything
+			// ahead of this one and before anything behind it
+			wg.Wait()
+		}
+
+		reqCtx, cancelReq := context.WithCancel(ctx)
+		req.SetContext(reqCtx)
+		inFlight <- struct{}{}
+		wg.Add(1)
+		done := make(chan struct{})
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			defer func() { <-inFlight }()
+			defer cancelReq()
+
+			s.serve(resWriter, req)
+			if resWriter.CloseDelimited() {
+				slot.closeAfter()
+			}
+			slot.finish()
+		}()
+
+		if serial && keepAlive && !deferred {
+			<-done
+		}
+		if deferred {
+			// the body sits between us and the next request
+			<-done
+			if keepAlive {
+				s.setBodyDeadline(conn)
+				err := rd.DiscardBody(req)
+				_ = conn.SetReadDeadline(time.Time{})
+				if err != nil {
+					return
+				}
+			}
+		}
+		if !keepAlive {
+			if !deferred {
+				// nothing else is read off the connection, but a read
+				// still tells us if the client hangs up on the handler
+				go watchClose(conn, cancel)
+			}
+			return
+		}
+	}
+}
+
+// streamsBody reports whether the body of req is left on the connection
+// for the handler instead of being read up front. multipart uploads can be
+// large, ParseForm and MultipartReader read them as they arrive.
+func (s *Server) streamsBody(req *request.Request) bool {
+	if _, ok := req.Headers["transfer-encoding"]; ok || s.h2c && isH2CUpgrade(req) {
+		return false
+	}
+	_, err := form.MultipartBoundary(req.Headers["content-type"])
+	return err == nil
+}
+
+// readBody reads the body of req within the body timeout.
+func (s *Server) readBody(conn net.Conn, rd *request.Reader, req *request.Request) error {
+	s.setBodyDeadline(conn)
+	err := rd.ReadBody(req)
+	_ = conn.SetReadDeadline(time.Time{})
+	return err
+}
+
+// safeMethod reports whether requests with method may be handled alongside
+// the ones around them (RFC 9112 9.3.2).
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// setBodyDeadline starts the clock on the request body.
+func (s *Server) setBodyDeadline(conn net.Conn) {
+	if s.bodyTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.bodyTimeout))
+	}
+}
+
+// writeError sends a plain text response for a request that never reaches
+// the handler. the connection is closed after it.
+func (s *Server) writeError(slot *slot, code response.StatusCode) {
+	defer slot.finish()
+
+	w := s.newWriter(slot, false)
+	if err := w.WriteStatusLine(code); err != nil {
+		log.Printf("error writing %d response: %v", code, err)
 		return
 	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(response.StatusText(code) + "\n"))
+	_ = w.Close()
+}
 
-	resWriter := response.NewWriter(conn)
+// serve runs the handler for one request, on either protocol, and finishes
+// the response.
+func (s *Server) serve(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method == "HEAD" {
+		// HEAD runs the same handler as GET, the writer drops the body
+		// but keeps its length
+		w.DiscardBody()
+	}
+
+	start := time.Now()
+	if s.admit(w, req) {
+		if s.metrics != nil {
+			s.metrics.inFlight.Inc()
+		}
+		s.handler(w, req)
+		s.releaseHandler()
+		if err := req.Cleanup(); err != nil {
+			log.Printf("error removing upload files: %v", err)
+		}
+		if s.metrics != nil {
+			s.metrics.inFlight.Dec()
+		}
+	}
 
-	handler(resWriter, req)
+	if err := w.Close(); err != nil && req.Context().Err() == nil {
+		// a cancelled request has no one left to answer
+		log.Printf("error finishing response: %v", err)
+	}
+	if s.metrics != nil {
+		route := "*"
+		if s.route != nil {
+			route = s.route(req)
+		}
+		s.metrics.observe(route, w, req, time.Since(start))
+	}
+}
+
+// newWriter returns an HTTP/1 response writer preloaded with the headers the
+// server adds to every response.
+func (s *Server) newWriter(out io.Writer, keepAlive bool) *response.Writer {
+	w := response.NewBufferedWriter(out, s.bufferSize)
+	s.setDefaultHeaders(w)
+	if !keepAlive {
+		w.Header().Set("Connection", "close")
+	}
+	return w
+}
+
+func (s *Server) setDefaultHeaders(w *response.Writer) {
+	h := w.Header()
+	h.Set("Date", s.dates.Get())
+	if s.serverName != "" {
+		h.Set("Server", s.serverName)
+	}
 }
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs handler on a random port and returns a dialer for it.
+func startServer(t *testing.T, handler Handler, opts ...Option) func() net.Conn {
+	t.Helper()
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return func() net.Conn {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		// the first request is the slowest, its response must still go first
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(req.RequestLine.RequestTarget + ":" + string(req.Body)))
+	})
+
+	conn := dial()
+	_, err := io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"POST /post HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\n\r\nbody"+
+		"GET /last HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	for _, want := range []string{"/slow:", "/post:body", "/last:"} {
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(body))
+	}
+	// the server closes after Connection: close
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestPipelinedSideEffects(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		name := req.RequestLine.Method + " " + req.RequestLine.RequestTarget
+		record("start " + name)
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		record("end " + name)
+	})
+
+	// Test: Unsafe methods run one at a time, in order, and safe ones
+	// after them wait too
+	conn := dial()
+	_, err := io.WriteString(conn, "POST /slow HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n"+
+		"DELETE /slow HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /slow HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"GET /fast HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	for range 4 {
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		_, _ = io.ReadAll(resp.Body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"start POST /slow", "end POST /slow", "start DELETE /slow", "end DELETE /slow"}, events[:4])
+
+	// Test: Safe methods still overlap
+	assert.ElementsMatch(t, []string{"start GET /slow", "start GET /fast", "end GET /fast", "end GET /slow"}, events[4:])
+	assert.Equal(t, "end GET /slow", events[7])
+}
+
+func TestExpectContinue(t *testing.T) {
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		body, _ := req.ReadBody()
+		_, _ = w.Write(body)
+	}, WithExpectContinue(func(req *request.Request) response.StatusCode {
+		if req.Headers["content-length"] != "5" {
+			return response.StatusContentTooLarge
+		}
+		return response.StatusContinue
+	}))
+
+	// Test: Accepted by the hook, 100 goes out before the body is sent
+	conn := dial()
+	_, err := io.WriteString(conn, "PUT / HTTP/1.1\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	_, _ = br.ReadString('\n')
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Rejected by the hook, no 100 and the final status right away
+	conn = dial()
+	_, err = io.WriteString(conn, "PUT / HTTP/1.1\r\nContent-Length: 999999\r\nExpect: 100-continue\r\n\r\n")
+	require.NoError(t, err)
+	line, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "HTTP/1.1 413 "), line)
+}
+
+func TestRequestContext(t *testing.T) {
+	reqs := make(chan *request.Request, 4)
+	cancelled := make(chan uint64, 4)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		reqs <- req
+		if req.RequestLine.RequestTarget == "/wait" {
+			<-req.Context().Done()
+			cancelled <- req.Seq
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		return conn
+	}
+
+	// Test: Connection details, the sequence counts up on one connection
+	conn := dial()
+	_, err = io.WriteString(conn, "GET /a HTTP/1.1\r\n\r\nGET /wait HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	first, second := <-reqs, <-reqs
+	if first.Seq != 1 {
+		first, second = second, first
+	}
+	assert.Equal(t, uint64(1), first.Seq)
+	assert.Equal(t, uint64(2), second.Seq)
+	assert.Equal(t, first.ConnID, second.ConnID)
+	assert.NotZero(t, first.ConnID)
+	assert.Equal(t, conn.LocalAddr().String(), first.RemoteAddr)
+	assert.Equal(t, conn.RemoteAddr().String(), first.LocalAddr)
+	assert.Nil(t, first.TLS)
+	assert.WithinDuration(t, time.Now(), first.ReceivedAt, time.Second)
+	assert.ErrorIs(t, first.Context().Err(), context.Canceled, "done once the handler returned")
+
+	// Test: Client hangs up while the handler runs
+	conn.Close()
+	select {
+	case seq := <-cancelled:
+		assert.Equal(t, uint64(2), seq)
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled on disconnect")
+	}
+
+	// Test: Same for the last request on a connection
+	conn = dial()
+	_, err = io.WriteString(conn, "GET /wait HTTP/1.1\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	req := <-reqs
+	assert.NotEqual(t, first.ConnID, req.ConnID)
+	assert.NoError(t, req.Context().Err())
+	conn.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled on disconnect")
+	}
+
+	// Test: Closing the server cancels what's still running
+	conn = dial()
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /wait HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	<-reqs
+	require.NoError(t, s.Close())
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled on shutdown")
+	}
+}
+
+func TestInvalidTarget(t *testing.T) {
+	paths := make(chan string, 1)
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		paths <- req.RequestLine.URL.Path
+	})
+
+	// Test: The handler sees the normalized path
+	conn := dial()
+	_, err := io.WriteString(conn, "GET /a//b/../c?x=1 HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/a/c", <-paths)
+
+	// Test: Traversal never reaches the handler
+	conn = dial()
+	_, err = io.WriteString(conn, "GET /static/%2e%2e/%2e%2e/etc/passwd HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+	conn = dial()
+	_, err = io.WriteString(conn, "GET /static/..\\..\\secret HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Empty(t, paths)
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}, WithMaxHeaderBytes(512))
+
+	// Test: A head over the limit is answered 431
+	conn := dial()
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nX-Pad: "+strings.Repeat("a", 600)+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 431, resp.StatusCode)
+
+	// Test: Smaller ones go through
+	conn = dial()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nX-Pad: "+strings.Repeat("a", 100)+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestHTTP10LargeBody(t *testing.T) {
+	big := strings.Repeat("x", response.DefaultBufferSize+1)
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		_, _ = io.WriteString(w, big)
+	})
+
+	// Test: Past the buffer an HTTP/1.0 client gets the body up to the close,
+	// keep-alive or not
+	conn := dial()
+	_, err := io.WriteString(conn, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Empty(t, resp.TransferEncoding)
+	assert.True(t, resp.Close)
+	assert.EqualValues(t, -1, resp.ContentLength)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, big, string(body))
+}
+
+func TestBodyTimeout(t *testing.T) {
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		t.Error("handler ran without the body")
+	}, WithBodyTimeout(50*time.Millisecond))
+
+	// Test: A client that stalls in the middle of the body gets 408 and
+	// the connection closed
+	conn := dial()
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	_, _ = io.ReadAll(resp.Body)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestMultipartStreaming(t *testing.T) {
+	dial := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget != "/upload" {
+			_, _ = io.WriteString(w, "next")
+			return
+		}
+		mr, err := req.MultipartReader()
+		require.NoError(t, err)
+		part, err := mr.NextPart()
+		require.NoError(t, err)
+		data, _ := io.ReadAll(part)
+		_, _ = w.Write(data)
+	})
+
+	// Test: The handler reads the upload off the connection, whatever it
+	// leaves is skipped and the next request still gets through
+	body := "--b\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nfirst\r\n" +
+		"--b\r\nContent-Disposition: form-data; name=\"c\"\r\n\r\n" + strings.Repeat("x", 100000) + "\r\n--b--\r\n"
+	conn := dial()
+	_, err := io.WriteString(conn, "POST /upload HTTP/1.1\r\nContent-Type: multipart/form-data; boundary=b\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body+
+		"GET /next HTTP/1.1\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	for _, want := range []string{"first", "next"} {
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+}
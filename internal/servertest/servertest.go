@@ -0,0 +1,35 @@
+// Package servertest runs handlers and middleware in memory for tests,
+// without a listener.
+package servertest
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// Do runs req through h, finishes the response as the server would once h
+// returns, and parses what was written. nil Headers are filled in.
+func Do(t testing.TB, h server.Handler, req *request.Request) *http.Response {
+	t.Helper()
+	if req.Headers == nil {
+		req.Headers = headers.NewHeaders()
+	}
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	h(w, req)
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing the response: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatalf("parsing the response: %v", err)
+	}
+	return resp
+}
@@ -0,0 +1,147 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Custom errors
+var (
+	// ErrNotFound means the cookie doesn't name a live session, or doesn't
+	// verify.
+	ErrNotFound = errors.New("session not found")
+	ErrNoKeys   = errors.New("no session keys")
+	ErrShortKey = errors.New("session key too short")
+)
+
+// MinKeyLen is the shortest signing key SignedCookieStore accepts.
+const MinKeyLen = 32
+
+var b64 = base64.RawURLEncoding
+
+// SignedCookieStore keeps the whole session in the cookie, signed with
+// HMAC-SHA256. the client can read it but not change it.
+//
+// the first key signs, all of them verify, so keys can be rotated by adding
+// the new one in front and dropping the old one once its cookies expired.
+type SignedCookieStore struct {
+	keys [][]byte
+}
+
+// NewSignedCookieStore creates a SignedCookieStore. keys must be at least
+// MinKeyLen bytes.
+func NewSignedCookieStore(keys ...[]byte) (*SignedCookieStore, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	for i, k := range keys {
+		if len(k) < MinKeyLen {
+			return nil, fmt.Errorf("%w: key %d is %d bytes, want %d", ErrShortKey, i, len(k), MinKeyLen)
+		}
+	}
+	return &SignedCookieStore{keys: keys}, nil
+}
+
+func (s *SignedCookieStore) Load(value string) ([]byte, error) {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrNotFound
+	}
+	mac, err := b64.DecodeString(sig)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	for _, k := range s.keys {
+		if hmac.Equal(mac, sign(k, payload)) {
+			data, err := b64.DecodeString(payload)
+			if err != nil {
+				return nil, ErrNotFound
+			}
+			return data, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *SignedCookieStore) Save(_ string, data []byte, _ time.Duration) (string, error) {
+	payload := b64.EncodeToString(data)
+	return payload + "." + b64.EncodeToString(sign(s.keys[0], payload)), nil
+}
+
+// Delete is a no-op, the session goes away with the cookie.
+func (s *SignedCookieStore) Delete(string) error {
+	return nil
+}
+
+func sign(key []byte, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// EncryptedCookieStore keeps the whole session in the cookie, sealed with
+// AES-GCM so the client can neither read nor change it. keys rotate the
+// same way as in SignedCookieStore.
+type EncryptedCookieStore struct {
+	aeads []cipher.AEAD
+}
+
+// NewEncryptedCookieStore creates an EncryptedCookieStore. keys are AES
+// keys, 16, 24 or 32 bytes.
+func NewEncryptedCookieStore(keys ...[]byte) (*EncryptedCookieStore, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	s := &EncryptedCookieStore{}
+	for i, k := range keys {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		s.aeads = append(s.aeads, aead)
+	}
+	return s, nil
+}
+
+func (s *EncryptedCookieStore) Load(value string) ([]byte, error) {
+	sealed, err := b64.DecodeString(value)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	for _, aead := range s.aeads {
+		if len(sealed) < aead.NonceSize() {
+			return nil, ErrNotFound
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if data, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+			return data, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *EncryptedCookieStore) Save(_ string, data []byte, _ time.Duration) (string, error) {
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return b64.EncodeToString(aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+// Delete is a no-op, the session goes away with the cookie.
+func (s *EncryptedCookieStore) Delete(string) error {
+	return nil
+}
@@ -0,0 +1,301 @@
+// Package session keeps per-client state between requests: in a signed or
+// encrypted cookie, or server-side with the cookie holding only an ID.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/cookie"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// Defaults for the zero Config fields.
+const (
+	DefaultCookieName  = "session"
+	DefaultIdleTimeout = 30 * time.Minute
+	DefaultMaxLifetime = 24 * time.Hour
+)
+
+// touchInterval is how stale the last-seen time may get before an
+// unmodified session is saved again to push its idle expiry back.
+const touchInterval = time.Minute
+
+// maxCookieSize is the cookie size browsers are guaranteed to keep.
+const maxCookieSize = 4096
+
+// Config configures the session middleware.
+type Config struct {
+	Store Store
+
+	// CookieName defaults to DefaultCookieName.
+	CookieName string
+	// Path defaults to "/".
+	Path     string
+	Domain   string
+	Secure   bool
+	SameSite cookie.SameSite // SameSiteDefault means Lax
+
+	// IdleTimeout ends sessions not used for this long, defaults to
+	// DefaultIdleTimeout. negative turns idle expiry off.
+	IdleTimeout time.Duration
+	// MaxLifetime ends sessions this long after they were created however
+	// active they are, defaults to DefaultMaxLifetime.
+	MaxLifetime time.Duration
+}
+
+// Manager loads and saves sessions around requests.
+type Manager struct {
+	cfg Config
+	now func() time.Time
+}
+
+// New creates a Manager.
+func New(cfg Config) *Manager {
+	if cfg.CookieName == "" {
+		cfg.CookieName = DefaultCookieName
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.SameSite == cookie.SameSiteDefault {
+		cfg.SameSite = cookie.SameSiteLax
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.MaxLifetime <= 0 {
+		cfg.MaxLifetime = DefaultMaxLifetime
+	}
+	return &Manager{cfg: cfg, now: time.Now}
+}
+
+// Session is one client's session. values are strings; encode anything
+// richer before storing it.
+type Session struct {
+	id      string
+	rec     record
+	isNew   bool
+	dirty   bool
+	oldID   string // set by Regenerate, deleted from the store on save
+	destroy bool
+}
+
+// record is what gets stored.
+type record struct {
+	ID       string            `json:"i"`
+	Values   map[string]string `json:"v,omitempty"`
+	Flashes  []string          `json:"f,omitempty"`
+	Created  int64             `json:"c"`
+	LastSeen int64             `json:"s"`
+}
+
+type ctxKey struct{}
+
+// Get returns the request's session, nil outside the session middleware.
+func Get(req *request.Request) *Session {
+	s, _ := req.Context().Value(ctxKey{}).(*Session)
+	return s
+}
+
+// ID returns the session ID. it changes on Regenerate.
+func (s *Session) ID() string { return s.id }
+
+// IsNew reports whether the session was started by this request.
+func (s *Session) IsNew() bool { return s.isNew }
+
+// Value returns the value stored under key.
+func (s *Session) Value(key string) (string, bool) {
+	v, ok := s.rec.Values[key]
+	return v, ok
+}
+
+// Set stores value under key.
+func (s *Session) Set(key, value string) {
+	if s.rec.Values == nil {
+		s.rec.Values = make(map[string]string)
+	}
+	s.rec.Values[key] = value
+	s.dirty = true
+}
+
+// Delete removes key.
+func (s *Session) Delete(key string) {
+	if _, ok := s.rec.Values[key]; ok {
+		delete(s.rec.Values, key)
+		s.dirty = true
+	}
+}
+
+// AddFlash queues a message for the next request that reads the flashes,
+// typically the page a redirect lands on.
+func (s *Session) AddFlash(msg string) {
+	s.rec.Flashes = append(s.rec.Flashes, msg)
+	s.dirty = true
+}
+
+// Flashes returns the queued messages and clears them.
+func (s *Session) Flashes() []string {
+	f := s.rec.Flashes
+	if len(f) > 0 {
+		s.rec.Flashes = nil
+		s.dirty = true
+	}
+	return f
+}
+
+// Regenerate gives the session a new ID, keeping its values. call it when
+// the privilege level changes, on login in particular, so an ID planted
+// before (session fixation) is worth nothing after.
+func (s *Session) Regenerate() {
+	if s.oldID == "" && !s.isNew {
+		s.oldID = s.id
+	}
+	s.id = newID()
+	s.rec.ID = s.id
+	s.dirty = true
+}
+
+// Destroy ends the session, on logout for example. the cookie is cleared
+// and a server-side store drops the data.
+func (s *Session) Destroy() {
+	s.destroy = true
+}
+
+// Middleware loads the session before the handler runs and saves it just
+// before the response headers go out. changes made after the handler
+// started writing the body are lost.
+func (m *Manager) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			s := m.load(req)
+			req.SetContext(context.WithValue(req.Context(), ctxKey{}, s))
+			w.OnHeaders(func() { m.save(w, s) })
+			next(w, req)
+		}
+	}
+}
+
+// load returns the session named by the request's cookie, or a new one if
+// there is none or it expired.
+func (m *Manager) load(req *request.Request) *Session {
+	now := m.now()
+	if c, ok := req.Cookie(m.cfg.CookieName); ok {
+		if data, err := m.cfg.Store.Load(c.Value); err == nil {
+			var rec record
+			if json.Unmarshal(data, &rec) == nil && validID(rec.ID) {
+				if !m.expired(rec, now) {
+					return &Session{id: rec.ID, rec: rec}
+				}
+				_ = m.cfg.Store.Delete(rec.ID)
+			}
+		}
+	}
+	id := newID()
+	return &Session{
+		id:    id,
+		isNew: true,
+		rec:   record{ID: id, Created: now.Unix(), LastSeen: now.Unix()},
+	}
+}
+
+func (m *Manager) expired(rec record, now time.Time) bool {
+	if now.Sub(time.Unix(rec.Created, 0)) >= m.cfg.MaxLifetime {
+		return true
+	}
+	return m.cfg.IdleTimeout > 0 && now.Sub(time.Unix(rec.LastSeen, 0)) >= m.cfg.IdleTimeout
+}
+
+// save writes the session back and sets the cookie, if anything changed.
+func (m *Manager) save(w *response.Writer, s *Session) {
+	if s.destroy {
+		if s.oldID != "" {
+			m.delete(s.oldID)
+		}
+		m.delete(s.id)
+		if !s.isNew {
+			m.setCookie(w, "", -1)
+		}
+		return
+	}
+
+	now := m.now()
+	touch := !s.isNew && m.cfg.IdleTimeout > 0 && now.Sub(time.Unix(s.rec.LastSeen, 0)) >= touchInterval
+	if !s.dirty && !touch {
+		return
+	}
+
+	if s.oldID != "" {
+		m.delete(s.oldID)
+	}
+	s.rec.LastSeen = now.Unix()
+
+	// the session lives until the earlier of its idle and absolute expiry
+	ttl := time.Unix(s.rec.Created, 0).Add(m.cfg.MaxLifetime).Sub(now)
+	if m.cfg.IdleTimeout > 0 {
+		ttl = min(ttl, m.cfg.IdleTimeout)
+	}
+	data, err := json.Marshal(s.rec)
+	if err != nil {
+		log.Printf("session: encoding: %v", err)
+		return
+	}
+	value, err := m.cfg.Store.Save(s.id, data, ttl)
+	if err != nil {
+		log.Printf("session: saving: %v", err)
+		return
+	}
+	if len(value) > maxCookieSize {
+		log.Printf("session: cookie is %d bytes, browsers may drop it", len(value))
+	}
+	m.setCookie(w, value, max(int(ttl/time.Second), 1))
+}
+
+func (m *Manager) delete(id string) {
+	if err := m.cfg.Store.Delete(id); err != nil {
+		log.Printf("session: deleting: %v", err)
+	}
+}
+
+func (m *Manager) setCookie(w *response.Writer, value string, maxAge int) {
+	err := w.SetCookie(&cookie.Cookie{
+		Name:     m.cfg.CookieName,
+		Value:    value,
+		Path:     m.cfg.Path,
+		Domain:   m.cfg.Domain,
+		MaxAge:   maxAge,
+		Secure:   m.cfg.Secure,
+		HttpOnly: true,
+		SameSite: m.cfg.SameSite,
+	})
+	if err != nil {
+		log.Printf("session: setting cookie: %v", err)
+	}
+}
+
+// newID returns a random session ID, 256 bits in base64url.
+func newID() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return b64.EncodeToString(b)
+}
+
+// validID checks id has the shape newID gives it.
+func validID(id string) bool {
+	if len(id) != 43 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		b := id[i]
+		isAlnum := (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+		if !isAlnum && b != '-' && b != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+package session
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clock is a fake time source tests move by hand.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newManager(cfg Config) (*Manager, *clock) {
+	c := &clock{t: time.Now()}
+	m := New(cfg)
+	m.now = c.now
+	return m, c
+}
+
+// do runs handler behind the middleware with the cookie jar, and updates the
+// jar from the response.
+func do(t *testing.T, m *Manager, jar map[string]string, handler func(s *Session)) *http.Response {
+	t.Helper()
+	req := &request.Request{Headers: headers.NewHeaders()}
+	var pairs []string
+	for k, v := range jar {
+		pairs = append(pairs, k+"="+v)
+	}
+	if len(pairs) > 0 {
+		req.Headers["cookie"] = strings.Join(pairs, "; ")
+	}
+
+	resp := servertest.Do(t, m.Middleware()(func(w *response.Writer, req *request.Request) {
+		handler(Get(req))
+		_, _ = w.Write([]byte("ok"))
+	}), req)
+	for _, c := range resp.Cookies() {
+		if c.MaxAge < 0 {
+			delete(jar, c.Name)
+		} else {
+			jar[c.Name] = c.Value
+		}
+	}
+	return resp
+}
+
+func testStores(t *testing.T) map[string]Store {
+	key := bytes.Repeat([]byte("k"), 32)
+	signed, err := NewSignedCookieStore(key)
+	require.NoError(t, err)
+	encrypted, err := NewEncryptedCookieStore(key)
+	require.NoError(t, err)
+	file, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	return map[string]Store{
+		"signed":    signed,
+		"encrypted": encrypted,
+		"memory":    NewMemoryStore(),
+		"file":      file,
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			m, _ := newManager(Config{Store: store})
+			jar := map[string]string{}
+
+			// Test: An untouched session sets no cookie
+			resp := do(t, m, jar, func(s *Session) { assert.True(t, s.IsNew()) })
+			assert.Empty(t, resp.Cookies())
+
+			// Test: Values and flashes survive to the next request
+			var id string
+			resp = do(t, m, jar, func(s *Session) {
+				s.Set("user", "ada")
+				s.AddFlash("welcome")
+				id = s.ID()
+			})
+			require.Len(t, resp.Cookies(), 1)
+			c := resp.Cookies()[0]
+			assert.True(t, c.HttpOnly)
+			assert.Equal(t, http.SameSiteLaxMode, c.SameSite)
+			assert.Equal(t, "/", c.Path)
+
+			do(t, m, jar, func(s *Session) {
+				assert.False(t, s.IsNew())
+				assert.Equal(t, id, s.ID())
+				v, _ := s.Value("user")
+				assert.Equal(t, "ada", v)
+				assert.Equal(t, []string{"welcome"}, s.Flashes())
+			})
+			do(t, m, jar, func(s *Session) { assert.Empty(t, s.Flashes()) })
+
+			// Test: Regenerate changes the ID and drops the old one
+			oldCookie := jar[DefaultCookieName]
+			do(t, m, jar, func(s *Session) { s.Regenerate() })
+			do(t, m, jar, func(s *Session) {
+				assert.NotEqual(t, id, s.ID())
+				v, _ := s.Value("user")
+				assert.Equal(t, "ada", v)
+			})
+			if name == "memory" || name == "file" {
+				do(t, m, map[string]string{DefaultCookieName: oldCookie}, func(s *Session) {
+					assert.True(t, s.IsNew(), "old ID still valid")
+				})
+			}
+
+			// Test: Destroy clears the cookie
+			do(t, m, jar, func(s *Session) { s.Destroy() })
+			assert.Empty(t, jar)
+		})
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	m, c := newManager(Config{Store: NewMemoryStore(), IdleTimeout: 10 * time.Minute, MaxLifetime: time.Hour})
+	jar := map[string]string{}
+	do(t, m, jar, func(s *Session) { s.Set("a", "1") })
+
+	// Test: Activity keeps the session alive past the idle timeout
+	for range 5 {
+		c.advance(8 * time.Minute)
+		do(t, m, jar, func(s *Session) { assert.False(t, s.IsNew()) })
+	}
+
+	// Test: Idle too long
+	c.advance(11 * time.Minute)
+	do(t, m, jar, func(s *Session) { assert.True(t, s.IsNew()) })
+
+	// Test: The absolute lifetime ends an active session
+	jar = map[string]string{}
+	do(t, m, jar, func(s *Session) { s.Set("a", "1") })
+	for range 6 {
+		c.advance(9 * time.Minute)
+		do(t, m, jar, func(s *Session) { assert.False(t, s.IsNew()) })
+	}
+	c.advance(9 * time.Minute)
+	do(t, m, jar, func(s *Session) { assert.True(t, s.IsNew()) })
+}
+
+func TestCookieStores(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte("o"), 32), bytes.Repeat([]byte("n"), 32)
+
+	for name, mk := range map[string]func(keys ...[]byte) (Store, error){
+		"signed":    func(keys ...[]byte) (Store, error) { return NewSignedCookieStore(keys...) },
+		"encrypted": func(keys ...[]byte) (Store, error) { return NewEncryptedCookieStore(keys...) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			old, err := mk(oldKey)
+			require.NoError(t, err)
+			value, err := old.Save("", []byte("data"), time.Hour)
+			require.NoError(t, err)
+			if name == "encrypted" {
+				assert.NotContains(t, value, b64.EncodeToString([]byte("data")))
+			}
+
+			// Test: Rotation keeps old cookies valid
+			rotated, err := mk(newKey, oldKey)
+			require.NoError(t, err)
+			data, err := rotated.Load(value)
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+
+			// Test: Dropped key, tampering and garbage don't load
+			dropped, err := mk(newKey)
+			require.NoError(t, err)
+			_, err = dropped.Load(value)
+			assert.ErrorIs(t, err, ErrNotFound)
+			tampered := []byte(value)
+			tampered[2] ^= 1
+			_, err = rotated.Load(string(tampered))
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = rotated.Load("nonsense")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			_, err = mk()
+			assert.ErrorIs(t, err, ErrNoKeys)
+		})
+	}
+
+	_, err := NewSignedCookieStore([]byte("short"))
+	assert.ErrorIs(t, err, ErrShortKey)
+	_, err = NewEncryptedCookieStore([]byte("short"))
+	assert.Error(t, err)
+}
+
+func TestFileStore(t *testing.T) {
+	f, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	id := newID()
+
+	_, err = f.Save(id, []byte("data"), time.Hour)
+	require.NoError(t, err)
+	data, err := f.Load(id)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// Test: IDs that could escape the directory are refused
+	_, err = f.Load("../../etc/passwd")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Test: Sweep removes expired sessions
+	expired := newID()
+	_, err = f.Save(expired, []byte("old"), -time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, f.Sweep())
+	_, err = f.Load(expired)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = f.Load(id)
+	assert.NoError(t, err)
+
+	require.NoError(t, f.Delete(id))
+	_, err = f.Load(id)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
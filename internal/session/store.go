@@ -0,0 +1,198 @@
+package session
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store keeps session data. cookie stores put the data itself in the cookie
+// and ignore the ID; server-side stores keep it under the ID and the cookie
+// only carries the ID.
+type Store interface {
+	// Load returns the data for a cookie value, ErrNotFound if there is
+	// none or it doesn't verify.
+	Load(value string) ([]byte, error)
+	// Save stores data for at least ttl and returns the cookie value.
+	Save(id string, data []byte, ttl time.Duration) (string, error)
+	// Delete removes the session with this ID.
+	Delete(id string) error
+}
+
+// MemoryStore keeps sessions in memory, they are lost on restart and not
+// shared between processes.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memEntry
+	saves    int
+}
+
+type memEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// sweepEvery is how many saves go by between sweeps for expired sessions.
+const sweepEvery = 256
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]memEntry)}
+}
+
+func (m *MemoryStore) Load(id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if time.Now().After(e.expires) {
+		delete(m.sessions, id)
+		return nil, ErrNotFound
+	}
+	return e.data, nil
+}
+
+func (m *MemoryStore) Save(id string, data []byte, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sessions[id] = memEntry{data: data, expires: now.Add(ttl)}
+	if m.saves++; m.saves%sweepEvery == 0 {
+		for k, e := range m.sessions {
+			if now.After(e.expires) {
+				delete(m.sessions, k)
+			}
+		}
+	}
+	return id, nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// Len returns the number of sessions held, expired ones not yet swept
+// included.
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// FileStore keeps each session in a file of its own under Dir, so sessions
+// survive restarts. the file holds the expiry time followed by the data.
+type FileStore struct {
+	Dir string
+}
+
+// NewFileStore creates a FileStore, making dir if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (f *FileStore) Load(id string) ([]byte, error) {
+	path, ok := f.path(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 8 {
+		return nil, ErrNotFound
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(b)) {
+		_ = os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return b[8:], nil
+}
+
+func (f *FileStore) Save(id string, data []byte, ttl time.Duration) (string, error) {
+	path, ok := f.path(id)
+	if !ok {
+		return "", ErrNotFound
+	}
+	b := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(ttl).Unix()))
+	b = append(b, data...)
+
+	// write and rename, so a concurrent Load never sees half a file
+	tmp, err := os.CreateTemp(f.Dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return id, nil
+}
+
+func (f *FileStore) Delete(id string) error {
+	path, ok := f.path(id)
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Sweep removes the files of expired sessions. run it now and then, Load
+// only removes the ones it runs into.
+func (f *FileStore) Sweep() error {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, e := range entries {
+		if !validID(e.Name()) {
+			continue
+		}
+		path := filepath.Join(f.Dir, e.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if len(b) < 8 || now > int64(binary.BigEndian.Uint64(b)) {
+			_ = os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// path maps an ID to its file. IDs come from cookies, anything that isn't
+// shaped like one we made is refused before it gets near the file system.
+func (f *FileStore) path(id string) (string, bool) {
+	if !validID(id) {
+		return "", false
+	}
+	return filepath.Join(f.Dir, id), true
+}
@@ -0,0 +1,233 @@
+// Package shacrypt implements the SHA-crypt password hashes, $5$ (SHA-256)
+// and $6$ (SHA-512), as specified by Ulrich Drepper and used by glibc's
+// crypt(3): https://www.akkadia.org/drepper/SHA-crypt.txt.
+//
+// unlike the spec, settings asking for more than MaxRounds are refused
+// rather than run, a stored hash must not be able to stall the server.
+package shacrypt
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidHash is returned for a setting or hash that isn't SHA-crypt or
+// asks for more than MaxRounds.
+var ErrInvalidHash = errors.New("shacrypt: invalid hash")
+
+const (
+	// DefaultRounds is used when a setting doesn't say.
+	DefaultRounds = 5000
+	// MinRounds is the fewest rounds run, settings below it are raised.
+	MinRounds = 1000
+	// MaxRounds is the most rounds accepted, around a second of work.
+	MaxRounds = 1000000
+
+	maxSalt = 16
+)
+
+// alphabet is the crypt(3) alphabet. hashes are written in little-endian
+// 6 bit groups, which base64.Encoding can't do.
+const alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// order256 and order512 are the byte triples the final digest is encoded
+// in, the leftover bytes last, highest first.
+var (
+	order256 = digestOrder(32)
+	order512 = digestOrder(64)
+)
+
+// digestOrder spreads the digest over groups of three bytes i, i+n, i+2n
+// rotated per group, as the spec's tables do.
+func digestOrder(size int) []int {
+	n := size / 3 // 10 for SHA-256, 21 for SHA-512
+	var order []int
+	for i := 0; i < n; i++ {
+		a, b, c := i, i+n, i+2*n
+		switch {
+		case i%3 == 1 && size == 32:
+			a, b, c = c, a, b
+		case i%3 == 2 && size == 32:
+			a, b, c = b, c, a
+		case i%3 == 1:
+			a, b, c = b, c, a
+		case i%3 == 2:
+			a, b, c = c, a, b
+		}
+		order = append(order, a, b, c)
+	}
+	for i := size - 1; i >= 3*n; i-- {
+		order = append(order, i)
+	}
+	return order
+}
+
+// setting is a parsed $5$ or $6$ prefix.
+type setting struct {
+	id     string // "$5$" or "$6$"
+	rounds int
+	custom bool // rounds= was given, and is written back
+	salt   string
+	sum    string // what follows the salt in a whole hash
+}
+
+func parse(s string) (setting, error) {
+	var st setting
+	if len(s) < 3 || (s[:3] != "$5$" && s[:3] != "$6$") {
+		return st, ErrInvalidHash
+	}
+	st.id, s = s[:3], s[3:]
+	st.rounds = DefaultRounds
+	if rest, ok := strings.CutPrefix(s, "rounds="); ok {
+		n, after, found := strings.Cut(rest, "$")
+		r, err := strconv.Atoi(n)
+		if !found || err != nil || r < 0 || r > MaxRounds {
+			return st, ErrInvalidHash
+		}
+		st.rounds, st.custom, s = max(r, MinRounds), true, after
+	}
+	// the salt ends at the next $ or after 16 characters
+	st.salt, st.sum, _ = strings.Cut(s, "$")
+	if len(st.salt) > maxSalt {
+		st.salt = st.salt[:maxSalt]
+	}
+	return st, nil
+}
+
+// Rounds returns the rounds a hash or setting runs.
+func Rounds(hash string) (int, error) {
+	st, err := parse(hash)
+	return st.rounds, err
+}
+
+// Crypt hashes password with a setting like "$6$rounds=10000$salt", or a
+// whole hash whose setting is reused, and returns the hash.
+func Crypt(password, settingOrHash string) (string, error) {
+	st, err := parse(settingOrHash)
+	if err != nil {
+		return "", err
+	}
+	newHash, order := sha256.New, order256
+	if st.id == "$6$" {
+		newHash, order = sha512.New, order512
+	}
+
+	prefix := st.id
+	if st.custom {
+		prefix += "rounds=" + strconv.Itoa(st.rounds) + "$"
+	}
+	sum := crypt(newHash, []byte(password), []byte(st.salt), st.rounds, order)
+	return prefix + st.salt + "$" + sum, nil
+}
+
+// Compare reports whether password matches hash, in constant time for a
+// given hash.
+func Compare(hash, password string) (bool, error) {
+	st, err := parse(hash)
+	if err != nil {
+		return false, err
+	}
+	if want := map[string]int{"$5$": 43, "$6$": 86}[st.id]; len(st.sum) != want {
+		// a setting, or a hash cut short
+		return false, ErrInvalidHash
+	}
+	got, err := Crypt(password, hash)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(hash)) == 1, nil
+}
+
+func crypt(newHash func() hash.Hash, pw, salt []byte, rounds int, order []int) string {
+	h := newHash()
+	size := h.Size()
+
+	// B = H(pw salt pw)
+	h.Write(pw)
+	h.Write(salt)
+	h.Write(pw)
+	b := h.Sum(nil)
+
+	// A = H(pw salt B-for-len(pw) bits-of-len(pw))
+	h.Reset()
+	h.Write(pw)
+	h.Write(salt)
+	h.Write(repeat(b, len(pw)))
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 == 1 {
+			h.Write(b)
+		} else {
+			h.Write(pw)
+		}
+	}
+	a := h.Sum(nil)
+
+	// P = H(pw repeated len(pw) times) stretched to len(pw)
+	h.Reset()
+	for range len(pw) {
+		h.Write(pw)
+	}
+	p := repeat(h.Sum(nil), len(pw))
+
+	// S = H(salt repeated 16+A[0] times) stretched to len(salt)
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(salt)
+	}
+	s := repeat(h.Sum(nil), len(salt))
+
+	for i := range rounds {
+		h.Reset()
+		if i%2 == 1 {
+			h.Write(p)
+		} else {
+			h.Write(a)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 == 1 {
+			h.Write(a)
+		} else {
+			h.Write(p)
+		}
+		a = h.Sum(a[:0])
+	}
+
+	// three bytes make four characters, low bits first
+	var out strings.Builder
+	for i := 0; i < size; i += 3 {
+		var w uint32
+		chars := 4
+		switch size - i {
+		case 1:
+			w, chars = uint32(a[order[i]]), 2
+		case 2:
+			w, chars = uint32(a[order[i]])<<8|uint32(a[order[i+1]]), 3
+		default:
+			w = uint32(a[order[i]])<<16 | uint32(a[order[i+1]])<<8 | uint32(a[order[i+2]])
+		}
+		for range chars {
+			out.WriteByte(alphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return out.String()
+}
+
+// repeat returns b repeated to exactly n bytes.
+func repeat(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
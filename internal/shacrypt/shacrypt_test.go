@@ -0,0 +1,73 @@
+package shacrypt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the test vectors from the specification
+var vectors = []struct{ setting, password, hash string }{
+	{"$5$saltstring", "Hello world!",
+		"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+	{"$5$rounds=10000$saltstringsaltstring", "Hello world!",
+		"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+	{"$5$rounds=5000$toolongsaltstring", "This is just a test",
+		"$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5"},
+	{"$5$rounds=1400$anotherlongsaltstring", "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+		"$5$rounds=1400$anotherlongsalts$Rx.j8H.h8HjEDGomFU8bDkXm3XIUnzyxf12oP84Bnq1"},
+	{"$5$rounds=77777$short", "we have a short salt string but not a short password",
+		"$5$rounds=77777$short$JiO1O3ZpDAxGJeaDIuqCoEFysAe1mZNJRs3pw0KQRd/"},
+	{"$5$rounds=123456$asaltof16chars..", "a short string",
+		"$5$rounds=123456$asaltof16chars..$gP3VQ/6X7UUEW3HkBn2w1/Ptq2jxPyzV/cZKmF/wJvD"},
+	{"$5$rounds=10$roundstoolow", "the minimum number is still observed",
+		"$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC"},
+	{"$6$saltstring", "Hello world!",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+	{"$6$rounds=10000$saltstringsaltstring", "Hello world!",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+	{"$6$rounds=5000$toolongsaltstring", "This is just a test",
+		"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	{"$6$rounds=1400$anotherlongsaltstring", "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+		"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+	{"$6$rounds=77777$short", "we have a short salt string but not a short password",
+		"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	{"$6$rounds=123456$asaltof16chars..", "a short string",
+		"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+	{"$6$rounds=10$roundstoolow", "the minimum number is still observed",
+		"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+}
+
+func TestCrypt(t *testing.T) {
+	for _, v := range vectors {
+		got, err := Crypt(v.password, v.setting)
+		require.NoError(t, err, v.setting)
+		assert.Equal(t, v.hash, got, v.setting)
+
+		// Test: The hash carries its own setting
+		ok, err := Compare(v.hash, v.password)
+		require.NoError(t, err, v.hash)
+		assert.True(t, ok, v.hash)
+		ok, err = Compare(v.hash, v.password+"x")
+		require.NoError(t, err, v.hash)
+		assert.False(t, ok, v.hash)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	// Test: Other schemes, broken rounds and too much work are refused
+	for _, s := range []string{"", "$5", "$1$md5$xyz", "$2b$10$x", "$5$rounds=$salt$x", "$5$rounds=-1$salt$x", "$6$rounds=1000001$salt$x", "$6$rounds=999999999$salt$x"} {
+		_, err := Crypt("x", s)
+		assert.ErrorIs(t, err, ErrInvalidHash, s)
+		_, err = Rounds(s)
+		assert.ErrorIs(t, err, ErrInvalidHash, s)
+	}
+
+	rounds, err := Rounds("$6$rounds=10$roundstoolow")
+	require.NoError(t, err)
+	assert.Equal(t, MinRounds, rounds)
+	rounds, err = Rounds("$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultRounds, rounds)
+}
@@ -0,0 +1,220 @@
+// Package tracing propagates W3C Trace Context (traceparent and tracestate),
+// records a server span per request and hands finished spans to an Exporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Header names from the W3C Trace Context spec.
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// ErrInvalidTraceparent is returned for a traceparent that doesn't parse.
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+// TraceID identifies a trace, all zeroes is invalid.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace, all zeroes is invalid.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether t is not all zeroes.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether s is not all zeroes.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+func newTraceID() TraceID {
+	var t TraceID
+	_, _ = rand.Read(t[:])
+	return t
+}
+
+func newSpanID() SpanID {
+	var s SpanID
+	_, _ = rand.Read(s[:])
+	return s
+}
+
+// FlagSampled is the sampled bit of trace-flags.
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+	Remote     bool // parsed from an incoming request
+}
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Sampled reports whether the sampled flag is set.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// Traceparent formats sc as a version 00 traceparent value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent value. versions above 00 are read as
+// 00 with anything after the flags ignored, as the spec asks.
+func ParseTraceparent(v string) (SpanContext, error) {
+	var sc SpanContext
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	version, ok := lowerHex(v[:2])
+	if !ok || version[0] == 0xff {
+		return sc, ErrInvalidTraceparent
+	}
+	if version[0] == 0 && len(v) != 55 {
+		return sc, ErrInvalidTraceparent
+	}
+	if len(v) > 55 && v[55] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+
+	traceID, ok1 := lowerHex(v[3:35])
+	spanID, ok2 := lowerHex(v[36:52])
+	flags, ok3 := lowerHex(v[53:55])
+	if !ok1 || !ok2 || !ok3 {
+		return sc, ErrInvalidTraceparent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	sc.Remote = true
+	return sc, nil
+}
+
+// lowerHex decodes s, which may only hold lowercase hex digits.
+func lowerHex(s string) ([]byte, bool) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return nil, false
+		}
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// maxTracestateMembers is the list limit from the spec.
+const maxTracestateMembers = 32
+
+// ParseTracestate validates a tracestate value and returns it normalized
+// (no empty members, no whitespace around them). an invalid list is dropped
+// as a whole, which is what the spec asks vendors to do.
+func ParseTracestate(v string) (string, bool) {
+	var members []string
+	seen := map[string]bool{}
+	for _, m := range strings.Split(v, ",") {
+		m = strings.Trim(m, " \t")
+		if m == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(m, "=")
+		if !ok || !validTracestateKey(key) || !validTracestateValue(val) || seen[key] {
+			return "", false
+		}
+		seen[key] = true
+		members = append(members, m)
+	}
+	if len(members) > maxTracestateMembers {
+		return "", false
+	}
+	return strings.Join(members, ","), true
+}
+
+// validTracestateKey checks simple-key or tenant-id@system-id.
+func validTracestateKey(key string) bool {
+	tenant, system, multi := strings.Cut(key, "@")
+	if !multi {
+		return validKeyPart(key, 256, true)
+	}
+	return validKeyPart(tenant, 241, false) && validKeyPart(system, 14, true)
+}
+
+// validKeyPart checks lcalpha / digit followed by lcalpha / digit / _-*/ .
+// simple keys and system ids must start with a letter.
+func validKeyPart(s string, maxLen int, letterFirst bool) bool {
+	if s == "" || len(s) > maxLen {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		lower := c >= 'a' && c <= 'z'
+		digit := c >= '0' && c <= '9'
+		switch {
+		case i == 0 && letterFirst && !lower:
+			return false
+		case i == 0 && !lower && !digit:
+			return false
+		case !lower && !digit && c != '_' && c != '-' && c != '*' && c != '/':
+			return false
+		}
+	}
+	return true
+}
+
+// validTracestateValue checks 0-255 printable ASCII without ',' and '=',
+// not ending in a space.
+func validTracestateValue(v string) bool {
+	if v == "" || len(v) > 256 || v[len(v)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns ctx carrying span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span in ctx, nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Inject writes traceparent and tracestate for the span in ctx through set,
+// e.g. an outgoing http.Header's Set. it does nothing without a span.
+func Inject(ctx context.Context, set func(key, value string)) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	sc := span.SpanContext()
+	set(TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		set(TracestateHeader, sc.TraceState)
+	}
+}
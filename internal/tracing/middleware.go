@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/devwelkin/hermes-lite/internal/server"
+)
+
+// Extract reads the caller's span context from request headers. it returns
+// an invalid SpanContext if traceparent is missing or malformed; tracestate
+// is only kept alongside a valid traceparent.
+func Extract(h headers.Headers) SpanContext {
+	sc, err := ParseTraceparent(h[TraceparentHeader])
+	if err != nil {
+		return SpanContext{}
+	}
+	if ts, ok := ParseTracestate(h[TracestateHeader]); ok {
+		sc.TraceState = ts
+	}
+	return sc
+}
+
+// Middleware starts a server span for every request, continuing the
+// caller's trace when it sent a valid traceparent. the span is in the
+// request context for the handler, e.g. to Inject into upstream calls.
+func (t *Tracer) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			method := req.RequestLine.Method
+			ctx, span := t.Start(req.Context(), method, KindServer, Extract(req.Headers))
+
+			u := req.RequestLine.URL
+			span.SetAttributes(
+				String("http.request.method", method),
+				String("url.path", u.Path),
+				String("network.protocol.version", req.RequestLine.HTTPVersion),
+			)
+			if u.RawQuery != "" {
+				span.SetAttributes(String("url.query", u.RawQuery))
+			}
+			if host := req.Headers["host"]; host != "" {
+				span.SetAttributes(String("server.address", host))
+			}
+			if req.ClientIP.IsValid() {
+				span.SetAttributes(String("client.address", req.ClientIP.String()))
+			}
+			if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+				span.SetAttributes(String("network.peer.address", host))
+				if p, err := strconv.Atoi(port); err == nil {
+					span.SetAttributes(Int("network.peer.port", int64(p)))
+				}
+			}
+			if ua := req.Headers["user-agent"]; ua != "" {
+				span.SetAttributes(String("user_agent.original", ua))
+			}
+
+			req.SetContext(ctx)
+			next(w, req)
+
+			status := w.Status()
+			if status == 0 {
+				status = response.StatusOK
+			}
+			span.SetAttributes(Int("http.response.status_code", int64(status)))
+			if status.IsServerError() {
+				// 4xx are the client's fault, not an error of this span
+				span.SetStatus(StatusError, response.StatusText(status))
+			}
+			span.End()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"sync"
+	"time"
+)
+
+// SpanKind says which side of a call a span is.
+type SpanKind int
+
+// Values match the OTLP enum.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// StatusCode is the outcome of a span.
+type StatusCode int
+
+// Values match the OTLP enum.
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a key and a string, int64, float64 or bool value.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute { return Attribute{key, value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int64) Attribute { return Attribute{key, value} }
+
+// Float returns a floating point attribute.
+func Float(key string, value float64) Attribute { return Attribute{key, value} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute { return Attribute{key, value} }
+
+// SpanData is a finished span as exporters see it.
+type SpanData struct {
+	Name          string
+	Kind          SpanKind
+	SpanContext   SpanContext
+	Parent        SpanID // zero for a root span
+	Start, End    time.Time
+	Attributes    []Attribute
+	Status        StatusCode
+	StatusMessage string
+}
+
+// Span is an operation being timed. its methods are safe to call from
+// several goroutines and do nothing once the span has ended.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanContext returns the span's propagation context.
+func (s *Span) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+// SetAttributes adds attributes, a repeated key replaces the earlier value.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+outer:
+	for _, a := range attrs {
+		for i := range s.data.Attributes {
+			if s.data.Attributes[i].Key == a.Key {
+				s.data.Attributes[i] = a
+				continue outer
+			}
+		}
+		s.data.Attributes = append(s.data.Attributes, a)
+	}
+}
+
+// SetStatus sets the outcome. the message is only kept for StatusError.
+func (s *Span) SetStatus(code StatusCode, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Status = code
+	if code == StatusError {
+		s.data.StatusMessage = msg
+	} else {
+		s.data.StatusMessage = ""
+	}
+}
+
+// End finishes the span and queues it for export if it was sampled.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = s.tracer.now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.SpanContext.Sampled() {
+		s.tracer.enqueue(data)
+	}
+}
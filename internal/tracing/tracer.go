@@ -0,0 +1,214 @@
+package tracing
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Exporter sends finished spans somewhere. ExportSpans is called from a
+// single goroutine, one batch at a time.
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+}
+
+// Batching defaults.
+const (
+	DefaultBatchSize     = 512
+	DefaultMaxQueue      = 2048
+	DefaultFlushInterval = 5 * time.Second
+)
+
+// Config configures a Tracer.
+type Config struct {
+	Exporter Exporter
+	// SampleRatio is the fraction of new traces that are sampled, in
+	// (0, 1]. 0 samples all of them. requests that arrive with a
+	// traceparent follow the caller's decision.
+	SampleRatio   float64
+	BatchSize     int
+	MaxQueue      int // spans past this are dropped until the next export
+	FlushInterval time.Duration
+}
+
+// Tracer starts spans and exports the finished ones in batches from a
+// background goroutine.
+type Tracer struct {
+	cfg Config
+	now func() time.Time
+
+	mu      sync.Mutex
+	queue   []SpanData
+	dropped int
+	closed  bool
+
+	kick  chan struct{}
+	flush chan chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewTracer creates a Tracer and starts its export loop. call Shutdown to
+// export what's left and stop it.
+func NewTracer(cfg Config) *Tracer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = DefaultMaxQueue
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	t := &Tracer{
+		cfg:   cfg,
+		now:   time.Now,
+		kick:  make(chan struct{}, 1),
+		flush: make(chan chan struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// Start begins a span. its parent is the span in ctx, or remote when ctx has
+// none and remote is valid; otherwise it starts a new trace. the returned
+// context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, remote SpanContext) (context.Context, *Span) {
+	parent := remote
+	if local := SpanFromContext(ctx); local != nil {
+		parent = local.SpanContext()
+	}
+
+	sc := SpanContext{SpanID: newSpanID()}
+	var parentID SpanID
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+		sc.TraceState = parent.TraceState
+		parentID = parent.SpanID
+	} else {
+		sc.TraceID = newTraceID()
+		if t.cfg.SampleRatio <= 0 || t.cfg.SampleRatio >= 1 || rand.Float64() < t.cfg.SampleRatio {
+			sc.Flags = FlagSampled
+		}
+	}
+
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:        name,
+			Kind:        kind,
+			SpanContext: sc,
+			Parent:      parentID,
+			Start:       t.now(),
+		},
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) enqueue(data SpanData) {
+	t.mu.Lock()
+	if t.closed || len(t.queue) >= t.cfg.MaxQueue {
+		t.dropped++
+		t.mu.Unlock()
+		return
+	}
+	t.queue = append(t.queue, data)
+	full := len(t.queue) >= t.cfg.BatchSize
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.export()
+		case <-t.kick:
+			t.export()
+		case ack := <-t.flush:
+			t.export()
+			close(ack)
+		case <-t.stop:
+			t.export()
+			return
+		}
+	}
+}
+
+// export sends everything queued, a batch at a time.
+func (t *Tracer) export() {
+	for {
+		t.mu.Lock()
+		n := min(len(t.queue), t.cfg.BatchSize)
+		batch := t.queue[:n:n]
+		t.queue = t.queue[n:]
+		dropped := t.dropped
+		t.dropped = 0
+		t.mu.Unlock()
+
+		if dropped > 0 {
+			log.Printf("tracing: dropped %d spans, export queue full", dropped)
+		}
+		if n == 0 || t.cfg.Exporter == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.cfg.Exporter.ExportSpans(ctx, batch); err != nil {
+			log.Printf("tracing: exporting %d spans: %v", n, err)
+		}
+		cancel()
+	}
+}
+
+// ForceFlush exports everything queued so far and waits for it.
+func (t *Tracer) ForceFlush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports the remaining spans and stops the Tracer. spans ended
+// afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	close(t.stop)
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
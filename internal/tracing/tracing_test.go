@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/devwelkin/hermes-lite/internal/headers"
+	"github.com/devwelkin/hermes-lite/internal/request"
+	"github.com/devwelkin/hermes-lite/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+	assert.True(t, sc.Remote)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	// a future version may append fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-what-the-future-holds")
+	assert.NoError(t, err)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",   // 00 is exactly 55 long
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",         // forbidden version
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",         // uppercase
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",         // zero trace id
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",         // zero span id
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g",         // bad flags
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x",        // no dash after flags
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",         // wrong separator
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, 00-4bf", // sent twice
+	} {
+		_, err := ParseTraceparent(bad)
+		assert.ErrorIs(t, err, ErrInvalidTraceparent, bad)
+	}
+}
+
+func TestParseTracestate(t *testing.T) {
+	ts, ok := ParseTracestate(" congo=t61rcWkgMzE ,, rojo=00f067aa0ba902b7,tenant@sys=x y")
+	assert.True(t, ok)
+	assert.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7,tenant@sys=x y", ts)
+
+	for _, bad := range []string{
+		"Congo=x",    // uppercase key
+		"congo",      // no value
+		"congo=a=b",  // = in value
+		"a=1,a=2",    // duplicate key
+		"t@1sys=x",   // system id must start with a letter
+		"congo=\x01", // control character
+	} {
+		_, ok := ParseTracestate(bad)
+		assert.False(t, ok, bad)
+	}
+}
+
+// collector stands in for an OTLP/HTTP receiver.
+type collector struct {
+	mu    sync.Mutex
+	spans []map[string]any
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []map[string]any
+			}
+			ScopeSpans []struct {
+				Spans []map[string]any
+			}
+		}
+	}
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestMiddlewareExport(t *testing.T) {
+	col := &collector{}
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	tracer := NewTracer(Config{Exporter: &OTLPExporter{Endpoint: srv.URL + "/v1/traces", ServiceName: "test"}})
+	var upstream http.Header
+	handler := tracer.Middleware()(func(w *response.Writer, req *request.Request) {
+		// what a proxy does with its upstream request
+		_, client := tracer.Start(req.Context(), "GET upstream", KindClient, SpanContext{})
+		upstream = http.Header{}
+		Inject(ContextWithSpan(req.Context(), client), upstream.Set)
+		client.End()
+		_ = w.WriteStatusLine(response.StatusBadGateway)
+	})
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			Method: "GET", RequestTarget: "/p?q=1", HTTPVersion: "1.1",
+			URL: request.URL{Path: "/p", RawPath: "/p", RawQuery: "q=1"},
+		},
+		Headers:    headers.NewHeaders(),
+		RemoteAddr: "10.0.0.1:5555",
+	}
+	req.Headers.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Headers.Set("tracestate", "congo=t61rcWkgMzE")
+	handler(response.NewWriter(io.Discard), req)
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	sc, err := ParseTraceparent(upstream.Get("traceparent"))
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "congo=t61rcWkgMzE", upstream.Get("tracestate"))
+
+	require.Len(t, col.spans, 2)
+	clientSpan, serverSpan := col.spans[0], col.spans[1]
+	assert.Equal(t, "GET", serverSpan["name"])
+	assert.Equal(t, float64(KindServer), serverSpan["kind"])
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", serverSpan["traceId"])
+	assert.Equal(t, "00f067aa0ba902b7", serverSpan["parentSpanId"])
+	assert.Equal(t, map[string]any{"code": float64(StatusError), "message": "Bad Gateway"}, serverSpan["status"])
+	assert.Contains(t, serverSpan["attributes"], map[string]any{"key": "url.query", "value": map[string]any{"stringValue": "q=1"}})
+	assert.Contains(t, serverSpan["attributes"], map[string]any{"key": "http.response.status_code", "value": map[string]any{"intValue": "502"}})
+
+	assert.Equal(t, serverSpan["spanId"], clientSpan["parentSpanId"])
+	assert.Equal(t, sc.SpanID.String(), clientSpan["spanId"])
+}
+
+func TestUnsampledNotExported(t *testing.T) {
+	var got []SpanData
+	tracer := NewTracer(Config{Exporter: exporterFunc(func(_ context.Context, spans []SpanData) error {
+		got = append(got, spans...)
+		return nil
+	})})
+
+	remote, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	require.NoError(t, err)
+	_, span := tracer.Start(context.Background(), "x", KindServer, remote)
+	span.End()
+	_, root := tracer.Start(context.Background(), "y", KindInternal, SpanContext{})
+	root.End()
+	root.End()
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	require.Len(t, got, 1)
+	assert.Equal(t, "y", got[0].Name)
+	assert.False(t, got[0].Parent.IsValid())
+}
+
+type exporterFunc func(context.Context, []SpanData) error
+
+func (f exporterFunc) ExportSpans(ctx context.Context, spans []SpanData) error { return f(ctx, spans) }